@@ -0,0 +1,108 @@
+package fastar
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const numaNodesDir = "/sys/devices/system/node"
+
+type cpuSet = unix.CPUSet
+
+// CPU sets to pin download workers to with --pin-workers, assigned round
+// robin by worker number. "numa" uses the CPUs of each NUMA node, so on a
+// dual socket host even workers stay on one socket and odd ones on the
+// other. Otherwise it's a list of sets separated by colons, each in the
+// kernel's cpulist format, e.g. "0-15,32-47:16-31,48-63".
+//
+// A pinned worker's chunk buffer is allocated on its pinned thread, so the
+// kernel places it on that node's memory, and the goroutine reading each
+// chunk off the network is pinned to the same set.
+func workerCpuSets(spec string) ([]cpuSet, error) {
+	var lists []string
+	if spec == "numa" {
+		var err error
+		if lists, err = numaCpuLists(); err != nil {
+			return nil, err
+		}
+	} else {
+		lists = strings.Split(spec, ":")
+	}
+	var sets []cpuSet
+	for _, list := range lists {
+		set, err := parseCpuList(list)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("no CPUs in --pin-workers %q", spec)
+	}
+	return sets, nil
+}
+
+// CPU lists of the NUMA nodes that have any, in node order.
+func numaCpuLists() ([]string, error) {
+	nodes, err := filepath.Glob(filepath.Join(numaNodesDir, "node[0-9]*"))
+	if err != nil || len(nodes) == 0 {
+		return nil, fmt.Errorf("no NUMA nodes found in %s", numaNodesDir)
+	}
+	nodeNumber := func(path string) int {
+		n, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "node"))
+		return n
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodeNumber(nodes[i]) < nodeNumber(nodes[j]) })
+	var lists []string
+	for _, node := range nodes {
+		list, err := os.ReadFile(filepath.Join(node, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		if trimmed := strings.TrimSpace(string(list)); trimmed != "" {
+			lists = append(lists, trimmed)
+		}
+	}
+	return lists, nil
+}
+
+// Parses the kernel's cpulist format, e.g. "0-3,8,10-11".
+func parseCpuList(list string) (cpuSet, error) {
+	var set cpuSet
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || start < 0 || end < start || end >= len(set)*64 {
+			return set, fmt.Errorf("invalid CPU list %q", list)
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			set.Set(cpu)
+		}
+	}
+	return set, nil
+}
+
+// Locks the calling goroutine to its OS thread and pins that thread to
+// cpus. The goroutine never unlocks, so the pinned thread exits with it
+// instead of going back to the runtime's pool.
+func pinThread(cpus *cpuSet) {
+	if cpus == nil {
+		return
+	}
+	runtime.LockOSThread()
+	if err := unix.SchedSetaffinity(0, cpus); err != nil {
+		log.Println("Failed to pin download worker:", err.Error())
+	}
+}
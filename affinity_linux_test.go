@@ -0,0 +1,52 @@
+package fastar
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseCpuList(t *testing.T) {
+	set, err := parseCpuList("0-3,8,10-11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cpu := 0; cpu < 16; cpu++ {
+		expected := cpu <= 3 || cpu == 8 || cpu == 10 || cpu == 11
+		if set.IsSet(cpu) != expected {
+			t.Fatalf("CPU %d set is %v, wanted %v", cpu, set.IsSet(cpu), expected)
+		}
+	}
+	for _, invalid := range []string{"", "a", "3-1", "-1", "1-"} {
+		if _, err := parseCpuList(invalid); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+	if sets, err := workerCpuSets("0-1:2-3"); err != nil || len(sets) != 2 || !sets[1].IsSet(3) || sets[1].IsSet(1) {
+		t.Fatalf("Got %v, %v", sets, err)
+	}
+}
+
+func TestPinnedDownloadStream(t *testing.T) {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		t.Skip("Can't read CPU affinity: ", err)
+	}
+	cpu := 0
+	for !allowed.IsSet(cpu) {
+		cpu++
+	}
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 1000000
+	opts.PinWorkers = fmt.Sprint(cpu)
+
+	data := RandomString(1000)
+	downloader := TestDownloader{data, true, false}
+	if actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4)); err != nil || string(actual) != data {
+		t.Fatalf("Pinned download returned wrong data, err %v", err)
+	}
+}
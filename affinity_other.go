@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package fastar
+
+import "errors"
+
+// Other systems have no equivalent of the kernel's cpulist sets, pinning
+// is Linux only.
+type cpuSet struct{}
+
+func workerCpuSets(spec string) ([]cpuSet, error) {
+	return nil, errors.New("--pin-workers is only supported on Linux")
+}
+
+func pinThread(cpus *cpuSet) {}
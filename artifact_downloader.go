@@ -0,0 +1,128 @@
+package fastar
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Artifact repository flavors with special handling on top of plain HTTP.
+const (
+	artifactory = "artifactory"
+	nexus       = "nexus"
+)
+
+// Picks the flavor of URLs on a host listed in --artifactory-host or
+// --nexus-host. Only those hosts get the repository's credentials, and
+// Artifactory (https://host/artifactory/<repo>/<path>) and Nexus 3
+// (https://host/repository/<repo>/<path>) paths on any other host are
+// downloaded like any other HTTP(S) URL.
+func getArtifactRepoFlavor(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return ""
+	}
+	if matchesHost(parsed, opts.ArtifactoryHost) {
+		return artifactory
+	} else if matchesHost(parsed, opts.NexusHost) {
+		return nexus
+	}
+	return ""
+}
+
+// Hosts match with or without their port.
+func matchesHost(parsed *url.URL, hosts []string) bool {
+	for _, host := range hosts {
+		if strings.EqualFold(host, parsed.Host) || strings.EqualFold(host, parsed.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP downloader for Artifactory and Nexus repositories.
+//
+// Adds auth headers from $ARTIFACTORY_API_KEY/$ARTIFACTORY_ACCESS_TOKEN or
+// $NEXUS_USER/$NEXUS_PASSWORD and looks up the artifact's checksum from the
+// repository so downloads are verified automatically. Artifactory commonly
+// redirects downloads to CDN URLs that are only signed for GET, so it always
+// uses GET to get the file size. Every chunk request goes through the
+// repository again, so short-lived CDN redirects never expire mid-download.
+type ArtifactRepoDownloader struct {
+	HttpDownloader
+	flavor string
+}
+
+func NewArtifactRepoDownloader(rawUrl string, client *http.Client) ArtifactRepoDownloader {
+	flavor := getArtifactRepoFlavor(rawUrl)
+	headers := http.Header{}
+	if flavor == artifactory {
+		if apiKey := os.Getenv("ARTIFACTORY_API_KEY"); apiKey != "" {
+			headers.Set("X-JFrog-Art-Api", apiKey)
+		} else if token := os.Getenv("ARTIFACTORY_ACCESS_TOKEN"); token != "" {
+			headers.Set("Authorization", "Bearer "+token)
+		}
+	} else if user := os.Getenv("NEXUS_USER"); user != "" {
+		req, _ := http.NewRequest("GET", rawUrl, nil)
+		req.SetBasicAuth(user, os.Getenv("NEXUS_PASSWORD"))
+		headers.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	log.Printf("Detected %s repository URL\n", flavor)
+	// Downloads redirect to CDNs, which must not see the repository's
+	// credentials. Go only drops Authorization on its own.
+	redirecting := *client
+	redirecting.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			req.Header.Del("X-JFrog-Art-Api")
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
+	client = &redirecting
+	return ArtifactRepoDownloader{
+		HttpDownloader{Url: rawUrl, client: client, useGetForSize: flavor == artifactory || opts.UseGetForSize, headers: headers},
+		flavor,
+	}
+}
+
+// Artifactory returns checksums as response headers, Nexus serves them as
+// separate .sha256/.sha1 files next to the artifact.
+func (artifactRepoDownloader ArtifactRepoDownloader) ExpectedChecksum() (string, string) {
+	if artifactRepoDownloader.flavor == artifactory {
+		req := artifactRepoDownloader.generateRequest("GET")
+		req.Header.Set("Range", "bytes=0-0")
+		resp := artifactRepoDownloader.retryHttpRequest(req)
+		resp.Body.Close()
+		if sum := resp.Header.Get("X-Checksum-Sha256"); sum != "" {
+			return "sha256", sum
+		} else if sum := resp.Header.Get("X-Checksum-Sha1"); sum != "" {
+			return "sha1", sum
+		}
+	} else {
+		for _, algorithm := range []string{"sha256", "sha1"} {
+			sidecar := artifactRepoDownloader.HttpDownloader
+			sidecar.Url += "." + algorithm
+			req := sidecar.generateRequest("GET")
+			resp, err := sidecar.client.Do(req)
+			if err != nil {
+				continue
+			}
+			body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			if err == nil && resp.StatusCode == http.StatusOK {
+				if fields := strings.Fields(string(body)); len(fields) > 0 {
+					return algorithm, fields[0]
+				}
+			}
+		}
+	}
+	log.Println("No checksum available from repository, skipping verification")
+	return "", ""
+}
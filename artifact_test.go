@@ -0,0 +1,186 @@
+package fastar
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestArtifactRepoFlavor(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.ArtifactoryHost = []string{"artifacts.example.com"}
+	opts.NexusHost = []string{"nexus.example.com:8081"}
+
+	for rawUrl, expected := range map[string]string{
+		"https://artifacts.example.com/artifactory/libs/app.tar.gz":      artifactory,
+		"https://ARTIFACTS.example.com:8443/any/path/app.tar.gz":         artifactory,
+		"http://nexus.example.com:8081/repository/raw/app.tar.gz":        nexus,
+		"http://nexus.example.com/repository/raw/app.tar.gz":             "",
+		"https://downloads.example.org/artifactory/libs/app.tar.gz":      "",
+		"https://downloads.example.org/repository/raw/app.tar.gz":        "",
+		"https://downloads.example.org/?next=artifacts.example.com/x.gz": "",
+		"s3://artifacts.example.com/artifactory/app.tar.gz":              "",
+	} {
+		if flavor := getArtifactRepoFlavor(rawUrl); flavor != expected {
+			t.Fatalf("Expected %s to be %q, got %q", rawUrl, expected, flavor)
+		}
+	}
+}
+
+func TestArtifactRepoCredentials(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	options.RetryCount = 1
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	defer endCall()
+	t.Setenv("ARTIFACTORY_API_KEY", "artifactory-key")
+	t.Setenv("NEXUS_USER", "nexus-user")
+	t.Setenv("NEXUS_PASSWORD", "nexus-password")
+
+	data := RandomString(1000)
+	var mutex sync.Mutex
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r)
+		mutex.Unlock()
+		if strings.HasSuffix(r.URL.Path, ".sha256") || strings.HasSuffix(r.URL.Path, ".sha1") {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer server.Close()
+	host, _ := url.Parse(server.URL)
+
+	download := func(path string) []*http.Request {
+		mutex.Lock()
+		requests = nil
+		mutex.Unlock()
+		downloader := getDownloader(server.URL+path, false, false)
+		if provider, ok := downloader.(ChecksumProvider); ok {
+			provider.ExpectedChecksum()
+		}
+		body := downloader.Get()
+		defer body.Close()
+		if downloaded, _ := io.ReadAll(body); string(downloaded) != data {
+			t.Fatalf("Downloaded %d bytes instead of %d", len(downloaded), len(data))
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+
+	// Without an allowlisted host, repository looking paths are plain HTTP.
+	for _, path := range []string{"/artifactory/libs/app.tar", "/repository/raw/app.tar"} {
+		if downloader := getDownloader(server.URL+path, false, false); !isPlainHttp(downloader) {
+			t.Fatalf("Expected %s to use the HTTP downloader, got %T", path, downloader)
+		}
+		received := download(path)
+		if len(received) != 1 {
+			t.Fatalf("Expected a single request for %s, got %d", path, len(received))
+		}
+		for _, r := range received {
+			if r.Header.Get("X-JFrog-Art-Api") != "" || r.Header.Get("Authorization") != "" {
+				t.Fatalf("Credentials were sent to %s, which isn't a repository host", path)
+			}
+		}
+	}
+
+	opts.ArtifactoryHost = []string{host.Host}
+	for _, r := range download("/artifactory/libs/app.tar") {
+		if r.Header.Get("X-JFrog-Art-Api") != "artifactory-key" {
+			t.Fatalf("Expected the Artifactory API key on %s %s", r.Method, r.URL)
+		}
+	}
+
+	opts.ArtifactoryHost = nil
+	opts.NexusHost = []string{host.Hostname()}
+	for _, r := range download("/repository/raw/app.tar") {
+		if user, password, _ := r.BasicAuth(); user != "nexus-user" || password != "nexus-password" {
+			t.Fatalf("Expected Nexus credentials on %s %s", r.Method, r.URL)
+		}
+	}
+}
+
+func isPlainHttp(downloader Downloader) bool {
+	_, ok := downloader.(HttpDownloader)
+	return ok
+}
+
+func TestArtifactRepoRedirect(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	options.RetryCount = 1
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	defer endCall()
+	t.Setenv("ARTIFACTORY_API_KEY", "SECRET-KEY")
+	t.Setenv("NEXUS_USER", "nexus-user")
+	t.Setenv("NEXUS_PASSWORD", "nexus-password")
+
+	data := RandomString(1000)
+	var leaked atomic.Value
+	var cdnRequests atomic.Int64
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnRequests.Add(1)
+		for _, header := range []string{"X-JFrog-Art-Api", "Authorization"} {
+			if value := r.Header.Get(header); value != "" {
+				leaked.Store(header + ": " + value)
+			}
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer cdn.Close()
+	repository := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer repository.Close()
+	// The same server under another name, so the redirect changes host.
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(repository.URL, "http://"))
+	repositoryUrl := "http://localhost:" + port
+
+	opts.ArtifactoryHost = []string{"localhost"}
+	opts.NexusHost = nil
+	for _, flavor := range []string{artifactory, nexus} {
+		if flavor == nexus {
+			opts.ArtifactoryHost, opts.NexusHost = nil, []string{"localhost"}
+		}
+		downloader := getDownloader(repositoryUrl+"/"+flavor+"/app.tar", false, false)
+		if _, ok := downloader.(ArtifactRepoDownloader); !ok {
+			t.Fatalf("Expected the %s downloader, got %T", flavor, downloader)
+		}
+		downloader.(ArtifactRepoDownloader).ExpectedChecksum()
+		downloader.GetFileInfo()
+		body := downloader.Get()
+		downloaded, _ := io.ReadAll(body)
+		body.Close()
+		body = downloader.GetRange(10, 20)
+		part, _ := io.ReadAll(body)
+		body.Close()
+		if string(downloaded) != data || string(part) != data[10:20] {
+			t.Fatalf("Downloaded %d bytes and a %d byte range through the %s redirect", len(downloaded), len(part), flavor)
+		}
+	}
+	if cdnRequests.Load() == 0 {
+		t.Fatal("Nothing was redirected to the CDN")
+	}
+	if header := leaked.Load(); header != nil {
+		t.Fatalf("The redirect target got the repository credentials, %s", header)
+	}
+}
@@ -0,0 +1,230 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Xattrs are carried in pax records with this prefix.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Set by the kernel or LSMs rather than the archive, so never drift.
+var ignoredXattrs = map[string]bool{
+	"security.selinux": true,
+}
+
+// Compares every entry of the tarball against the tree already in the
+// output directory (--audit) instead of extracting it, and prints a line
+// to stdout for each file whose type, content, mode, owner or xattrs
+// differ. Owners are compared after --uid-map/--gid-map. Files on disk
+// that aren't in the archive aren't reported.
+//
+// Returns the number of differences.
+func AuditTar(stream io.Reader) int {
+	setupIdMappings()
+	setupEntryFilters()
+	tarReader := tar.NewReader(stream)
+	differences := 0
+	entries := 0
+	archivedBuf := make([]byte, 1<<20)
+	diskBuf := make([]byte, 1<<20)
+	report := func(path, field, archived, onDisk string) {
+		differences++
+		fmt.Printf("%s: %s differs, archive has %s, disk has %s\n", path, field, archived, onDisk)
+		emitEvent("audit_difference", map[string]interface{}{"path": path, "field": field, "archive": archived, "disk": onDisk})
+	}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatalStream("AuditTar: Next() failed: ", err)
+		}
+		dumpHeader(header)
+		header.Uid = mapId(header.Uid, uidMappings)
+		header.Gid = mapId(header.Gid, gidMappings)
+
+		name := header.Name
+		linkName := header.Linkname
+		if opts.StripComponents != 0 {
+			name = filepath.Join(strings.Split(name, "/")[opts.StripComponents:]...)
+			if linkName != "" {
+				linkName = filepath.Join(strings.Split(linkName, "/")[opts.StripComponents:]...)
+			}
+		}
+		if name == "" || filteredOut(name) {
+			continue
+		}
+		path := filepath.Join(opts.OutputDir, name)
+		kind, ok := auditedTypes[header.Typeflag]
+		if !ok {
+			continue
+		}
+		entries++
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			report(path, "existence", kind, "nothing")
+			continue
+		}
+		if diskKind := fileKind(info); diskKind != kind && header.Typeflag != tar.TypeLink {
+			report(path, "type", kind, diskKind)
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if info.Size() != header.Size {
+				report(path, "size", fmt.Sprint(header.Size), fmt.Sprint(info.Size()))
+			} else if same, err := sameContents(tarReader, path, archivedBuf, diskBuf); err != nil {
+				fatalf("AuditTar: failed to read %s: %s", path, err.Error())
+			} else if !same {
+				report(path, "content", "archived bytes", "different bytes")
+			}
+		case tar.TypeSymlink:
+			if target, _ := os.Readlink(path); target != linkName {
+				report(path, "symlink target", linkName, target)
+			}
+		case tar.TypeLink:
+			target, err := os.Lstat(filepath.Join(opts.OutputDir, linkName))
+			if err != nil || !os.SameFile(info, target) {
+				report(path, "hard link", linkName, "separate file")
+			}
+			continue
+		}
+
+		// Symlink modes are meaningless on Linux.
+		if header.Typeflag != tar.TypeSymlink && header.Mode&07777 != unixMode(info)&07777 {
+			report(path, "mode", fmt.Sprintf("%04o", header.Mode&07777), fmt.Sprintf("%04o", unixMode(info)&07777))
+		}
+		if uid, gid, ok := fileOwner(info); ok {
+			if uid != header.Uid {
+				report(path, "owner", fmt.Sprint(header.Uid), fmt.Sprint(uid))
+			}
+			if gid != header.Gid {
+				report(path, "group", fmt.Sprint(header.Gid), fmt.Sprint(gid))
+			}
+		}
+		archived, onDisk := archivedXattrs(header), diskXattrs(path)
+		for _, name := range sortedUnion(archived, onDisk) {
+			archivedValue, inArchive := archived[name]
+			diskValue, present := onDisk[name]
+			if !inArchive {
+				report(path, "xattr "+name, "none", fmt.Sprintf("%q", diskValue))
+			} else if !present {
+				report(path, "xattr "+name, fmt.Sprintf("%q", archivedValue), "none")
+			} else if archivedValue != diskValue {
+				report(path, "xattr "+name, fmt.Sprintf("%q", archivedValue), fmt.Sprintf("%q", diskValue))
+			}
+		}
+	}
+	log.Printf("Audited %d entries against %s, %d differences\n", entries, opts.OutputDir, differences)
+	emitEvent("audit_finished", map[string]interface{}{"entries": entries, "differences": differences})
+	return differences
+}
+
+var auditedTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeDir:     "directory",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "file",
+}
+
+func fileKind(info os.FileInfo) string {
+	switch {
+	case info.Mode().IsRegular():
+		return "file"
+	case info.IsDir():
+		return "directory"
+	case info.Mode()&os.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "special file"
+}
+
+// Compares the rest of reader to the file at path without holding either
+// in memory, a buffer of each at a time. The caller has already checked
+// the sizes match.
+func sameContents(reader io.Reader, path string, archived, onDisk []byte) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	for {
+		n, err := io.ReadFull(reader, archived)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return false, err
+		}
+		if _, diskErr := io.ReadFull(file, onDisk[:n]); diskErr != nil {
+			return false, diskErr
+		}
+		if !bytes.Equal(archived[:n], onDisk[:n]) {
+			return false, nil
+		}
+		if err != nil {
+			return true, nil
+		}
+	}
+}
+
+func archivedXattrs(header *tar.Header) map[string]string {
+	xattrs := map[string]string{}
+	for key, value := range header.PAXRecords {
+		if name := strings.TrimPrefix(key, paxXattrPrefix); name != key && !ignoredXattrs[name] {
+			xattrs[name] = value
+		}
+	}
+	return xattrs
+}
+
+func diskXattrs(path string) map[string]string {
+	xattrs := map[string]string{}
+	size, err := llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if err != nil && !errors.Is(err, syscall.ENOTSUP) {
+			log.Printf("AuditTar: failed to list xattrs of %s: %s\n", path, err.Error())
+		}
+		return xattrs
+	}
+	names := make([]byte, size)
+	size, err = llistxattr(path, names)
+	if err != nil {
+		return xattrs
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		if ignoredXattrs[name] {
+			continue
+		}
+		value := make([]byte, 64*1024)
+		if n, err := lgetxattr(path, name, value); err == nil {
+			xattrs[name] = string(value[:n])
+		}
+	}
+	return xattrs
+}
+
+func sortedUnion(a, b map[string]string) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,51 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditTar(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	uid, gid := os.Getuid(), os.Getgid()
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, Uid: uid, Gid: gid})
+	contents := map[string]string{"dir/a": RandomString(1000), "dir/b": RandomString(3000), "dir/c": ""}
+	for _, name := range []string{"dir/a", "dir/b", "dir/c"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Uid: uid, Gid: gid, Size: int64(len(contents[name]))})
+		tw.Write([]byte(contents[name]))
+	}
+	tw.WriteHeader(&tar.Header{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "dir/a", Uid: uid, Gid: gid})
+	tw.WriteHeader(&tar.Header{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "a", Uid: uid, Gid: gid})
+	tw.Close()
+
+	oldOpts := opts
+	oldStdout := os.Stdout
+	defer func() { opts = oldOpts; os.Stdout = oldStdout }()
+	os.Stdout, _ = os.Open(os.DevNull)
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	ExtractTar(context.Background(), bytes.NewReader(archive.Bytes()))
+
+	if differences := AuditTar(bytes.NewReader(archive.Bytes())); differences != 0 {
+		t.Fatalf("Got %d differences right after extraction", differences)
+	}
+
+	dir := filepath.Join(opts.OutputDir, "dir")
+	os.Chmod(filepath.Join(dir, "a"), 0600)
+	modified := []byte(contents["dir/b"])
+	modified[100]++
+	os.WriteFile(filepath.Join(dir, "b"), modified, 0644)
+	os.Remove(filepath.Join(dir, "c"))
+	os.Remove(filepath.Join(dir, "symlink"))
+	os.Symlink("b", filepath.Join(dir, "symlink"))
+	// a's mode, b's content, c's existence and the symlink's target. The
+	// hard link is still the same file as a.
+	if differences := AuditTar(bytes.NewReader(archive.Bytes())); differences != 4 {
+		t.Fatalf("Got %d differences, wanted 4", differences)
+	}
+}
@@ -0,0 +1,113 @@
+package fastar
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// With --auto-tune, each run against an origin tries the untried neighbor
+// of the fastest chunk size and worker count the capability cache has for
+// it, halving or doubling one of them, and records how fast it went. Once
+// every neighbor of the fastest is tried, runs stick to it, so the sweep
+// converges on a local optimum without benchmarking by hand. Throughput
+// drifts, so trials older than tuningTrialTtl are tried again.
+const tuningTrialTtl = 30 * 24 * time.Hour
+
+const (
+	minTunedChunkSize  = 1 << 20
+	maxTunedChunkSize  = 1 << 30
+	maxTunedNumWorkers = 128
+)
+
+// Throughput achieved with a chunk size and worker count, averaged over
+// runs with more weight on the recent ones.
+type tuningTrial struct {
+	ChunkSize      int64     `json:"chunk_size"`
+	NumWorkers     int       `json:"num_workers"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+	Runs           int       `json:"runs"`
+	Updated        time.Time `json:"updated"`
+}
+
+// Adds a run to trials, returning the updated list.
+func recordTrial(trials []tuningTrial, chunkSize int64, numWorkers int, bytesPerSecond float64) []tuningTrial {
+	for i := range trials {
+		if trials[i].ChunkSize == chunkSize && trials[i].NumWorkers == numWorkers {
+			trials[i].BytesPerSecond = (trials[i].BytesPerSecond + bytesPerSecond) / 2
+			trials[i].Runs++
+			trials[i].Updated = time.Now().UTC()
+			return trials
+		}
+	}
+	return append(trials, tuningTrial{chunkSize, numWorkers, bytesPerSecond, 1, time.Now().UTC()})
+}
+
+// Picks the chunk size and worker count for the next run from trials,
+// starting from chunkSize and numWorkers without any.
+func nextTrial(trials []tuningTrial, chunkSize int64, numWorkers int, now time.Time) (int64, int) {
+	var best *tuningTrial
+	tried := map[[2]int64]bool{}
+	for i := range trials {
+		if now.Sub(trials[i].Updated) > tuningTrialTtl {
+			continue
+		}
+		tried[[2]int64{trials[i].ChunkSize, int64(trials[i].NumWorkers)}] = true
+		if best == nil || trials[i].BytesPerSecond > best.BytesPerSecond {
+			best = &trials[i]
+		}
+	}
+	if best == nil {
+		return chunkSize, numWorkers
+	}
+	for _, neighbor := range [][2]int64{
+		{best.ChunkSize * 2, int64(best.NumWorkers)},
+		{best.ChunkSize / 2, int64(best.NumWorkers)},
+		{best.ChunkSize, int64(best.NumWorkers) * 2},
+		{best.ChunkSize, int64(best.NumWorkers) / 2},
+	} {
+		if neighbor[0] < minTunedChunkSize || neighbor[0] > maxTunedChunkSize || neighbor[1] < 1 || neighbor[1] > maxTunedNumWorkers {
+			continue
+		}
+		if !tried[neighbor] {
+			return neighbor[0], int(neighbor[1])
+		}
+	}
+	return best.ChunkSize, best.NumWorkers
+}
+
+// Whether any of the long flags was given on the command line or by a
+// config profile, which auto-tuning leaves alone.
+func flagGiven(args []string, names ...string) bool {
+	for _, arg := range args {
+		for _, name := range names {
+			if arg == "--"+name || strings.HasPrefix(arg, "--"+name+"=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sets the chunk size and worker count for a download from rawUrl with
+// --auto-tune, unless either was set explicitly.
+func applyAutoTune(rawUrl string, commandLine []string) {
+	if !opts.AutoTune || capabilityCachePath() == "" {
+		return
+	}
+	if flagGiven(append(commandLine, appliedProfileArgs...), "chunk-size", "download-workers") {
+		log.Println("Not auto-tuning, --chunk-size or --download-workers was given")
+		return
+	}
+	origin := originKey(rawUrl)
+	stats := loadCapabilityCache().Origins[origin]
+	chunkSize, numWorkers := nextTrial(stats.Trials, opts.ChunkSize, opts.NumWorkers, time.Now())
+	log.Printf("Auto-tuned %s to %dMB chunks with %d workers after %d trials\n", origin, chunkSize/1e6, numWorkers, len(stats.Trials))
+	emitEvent("auto_tune", map[string]interface{}{
+		"origin":      origin,
+		"chunk_size":  chunkSize,
+		"num_workers": numWorkers,
+		"trials":      len(stats.Trials),
+	})
+	opts.ChunkSize, opts.NumWorkers = chunkSize, numWorkers
+}
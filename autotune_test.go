@@ -0,0 +1,47 @@
+package fastar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextTrial(t *testing.T) {
+	now := time.Now()
+	if chunkSize, numWorkers := nextTrial(nil, 200e6, 4, now); chunkSize != 200e6 || numWorkers != 4 {
+		t.Fatalf("Expected the defaults without trials, got %d, %d", chunkSize, numWorkers)
+	}
+
+	// Sweeps the neighbors of the fastest trial, then settles on it.
+	var trials []tuningTrial
+	chunkSize, numWorkers := int64(200e6), 4
+	speeds := map[[2]int64]float64{{200e6, 4}: 100, {400e6, 4}: 120}
+	for run := 0; run < 20; run++ {
+		speed, ok := speeds[[2]int64{chunkSize, int64(numWorkers)}]
+		if !ok {
+			speed = 10
+		}
+		trials = recordTrial(trials, chunkSize, numWorkers, speed)
+		chunkSize, numWorkers = nextTrial(trials, 200e6, 4, now)
+	}
+	if chunkSize != 400e6 || numWorkers != 4 {
+		t.Fatalf("Expected to converge on 400MB chunks with 4 workers, got %d, %d", chunkSize, numWorkers)
+	}
+	// 400MB chunks beat 200MB right away, so only its neighbors are tried.
+	if len(trials) != 5 {
+		t.Fatalf("Expected 400MB chunks with 4 workers and its neighbors to be tried, got %v", trials)
+	}
+
+	// Stale trials are tried again.
+	if chunkSize, numWorkers := nextTrial(trials, 200e6, 4, now.Add(2*tuningTrialTtl)); chunkSize != 200e6 || numWorkers != 4 {
+		t.Fatalf("Expected stale trials to be ignored, got %d, %d", chunkSize, numWorkers)
+	}
+}
+
+func TestFlagGiven(t *testing.T) {
+	if !flagGiven([]string{"-C", "out", "--chunk-size=50"}, "chunk-size") || !flagGiven([]string{"--download-workers", "8"}, "chunk-size", "download-workers") {
+		t.Fatal("Expected given flags to be found")
+	}
+	if flagGiven([]string{"--chunk-sizes", "s3://bucket/--chunk-size"}, "chunk-size") {
+		t.Fatal("Expected only whole flags to match")
+	}
+}
@@ -0,0 +1,133 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+const azureBlobHostSuffix = ".blob.core.windows.net"
+
+// Downloader for Azure Blob Storage, handles az://account/container/path and
+// https://account.blob.core.windows.net/container/path URLs.
+//
+// A SAS token in the URL or $AZURE_STORAGE_SAS_TOKEN is used as is.
+// Otherwise requests are authenticated with DefaultAzureCredential, which
+// covers managed identities (set $AZURE_CLIENT_ID for a user assigned one),
+// service principals from the environment and the az CLI. Tokens are
+// refreshed as they expire, so retries late into a long download still
+// succeed.
+type AzureDownloader struct {
+	Url    string
+	client *blob.Client
+}
+
+func isAzureBlobUrl(url string) bool {
+	if strings.HasPrefix(url, "az://") {
+		return true
+	}
+	parts, err := blob.ParseURL(url)
+	return err == nil && parts.Scheme == "https" && strings.HasSuffix(parts.Host, azureBlobHostSuffix)
+}
+
+func NewAzureDownloader(rawUrl string, httpClient *http.Client) AzureDownloader {
+	if strings.HasPrefix(rawUrl, "az://") {
+		// az://account/container/path
+		account, path, _ := strings.Cut(strings.TrimPrefix(rawUrl, "az://"), "/")
+		rawUrl = "https://" + account + azureBlobHostSuffix + "/" + path
+	}
+	parts, err := blob.ParseURL(rawUrl)
+	if err != nil {
+		fatal("Failed to parse Azure url: ", err.Error())
+	}
+	if parts.ContainerName == "" || parts.BlobName == "" {
+		fatal("Azure url must be of the form az://account/container/path or https://account" + azureBlobHostSuffix + "/container/path")
+	}
+
+	options := &blob.ClientOptions{ClientOptions: azcore.ClientOptions{
+		Transport: httpClient,
+		Retry:     policy.RetryOptions{MaxRetries: int32(opts.RetryCount)},
+	}}
+	// Escaped a segment at a time, the service doesn't treat %2F as a
+	// directory separator.
+	segments := strings.Split(parts.BlobName, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	blobUrl := "https://" + parts.Host + "/" + parts.ContainerName + "/" + strings.Join(segments, "/")
+	sasToken := parts.SAS.Encode()
+	if sasToken == "" {
+		sasToken = strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	}
+	var client *blob.Client
+	if sasToken != "" {
+		client, err = blob.NewClientWithNoCredential(blobUrl+"?"+sasToken, options)
+	} else {
+		var credential *azidentity.DefaultAzureCredential
+		credential, err = azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			fatal("Failed to load Azure credentials: ", err.Error())
+		}
+		client, err = blob.NewClient(blobUrl, credential, options)
+	}
+	if err != nil {
+		fatal("Failed to create Azure client: ", err.Error())
+	}
+	return AzureDownloader{rawUrl, client}
+}
+
+func (azureDownloader AzureDownloader) GetFileInfo() (int64, bool, bool) {
+	resp, err := azureDownloader.client.GetProperties(context.Background(), nil)
+	handleAzureError(err)
+	return *resp.ContentLength, true, false
+}
+
+func (azureDownloader AzureDownloader) Get() io.ReadCloser {
+	return azureDownloader.download(blob.HTTPRange{})
+}
+
+func (azureDownloader AzureDownloader) GetRange(start, end int64) io.ReadCloser {
+	return azureDownloader.download(blob.HTTPRange{Offset: start, Count: end - start})
+}
+
+// Blob storage only serves a single range per request.
+func (azureDownloader AzureDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported by Azure Blob Storage")
+}
+
+func (azureDownloader AzureDownloader) download(httpRange blob.HTTPRange) io.ReadCloser {
+	resp, err := azureDownloader.client.DownloadStream(context.Background(), &blob.DownloadStreamOptions{Range: httpRange})
+	handleAzureError(err)
+	return resp.Body
+}
+
+func handleAzureError(err error) {
+	if err == nil {
+		return
+	}
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound, bloberror.ResourceNotFound) {
+		log.Println("404, fast failing:", err.Error())
+		exit(ErrNotFound)
+	} else if bloberror.HasCode(err, bloberror.AuthenticationFailed, bloberror.AuthorizationFailure, bloberror.AuthorizationPermissionMismatch) {
+		log.Println("Failed to authenticate:", err.Error())
+		exit(ErrPermission)
+	}
+	var authErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &authErr) {
+		log.Println("Failed to get Azure credentials:", err.Error())
+		exit(ErrPermission)
+	}
+	fatal("Unexpected error getting Azure blob: ", err.Error())
+}
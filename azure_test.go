@@ -0,0 +1,33 @@
+package fastar
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestAzureBlobUrl(t *testing.T) {
+	for url, expected := range map[string]bool{
+		"az://account/container/file.tar":                                 true,
+		"https://account.blob.core.windows.net/container/dir/file.tar":    true,
+		"https://account.blob.core.windows.net/container/file.tar?sv=1":   true,
+		"https://example.com/account.blob.core.windows.net/file.tar":      false,
+		"http://account.blob.core.windows.net.example.com/container/file": false,
+		"s3://bucket/file.tar": false,
+	} {
+		if actual := isAzureBlobUrl(url); actual != expected {
+			t.Fatalf("isAzureBlobUrl(%s) = %t, wanted %t", url, actual, expected)
+		}
+	}
+
+	downloader := NewAzureDownloader("https://account.blob.core.windows.net/container/dir/a%20b.tar?sv=2022-11-02&sig=abc", http.DefaultClient)
+	if url := downloader.client.URL(); url != "https://account.blob.core.windows.net/container/dir/a%20b.tar?sig=abc&sv=2022-11-02" {
+		t.Fatalf("Got blob url %s", url)
+	}
+	os.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2022-11-02&sig=def")
+	defer os.Unsetenv("AZURE_STORAGE_SAS_TOKEN")
+	downloader = NewAzureDownloader("az://account/container/dir/a b.tar", http.DefaultClient)
+	if url := downloader.client.URL(); url != "https://account.blob.core.windows.net/container/dir/a%20b.tar?sv=2022-11-02&sig=def" {
+		t.Fatalf("Got blob url %s", url)
+	}
+}
@@ -0,0 +1,139 @@
+package fastar
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// What `fastar capabilities` reports, so orchestration can pick command
+// lines the fastar installed on a node understands instead of parsing
+// --help or keeping a table of versions. Like the event stream, fields are
+// only ever added.
+type capabilities struct {
+	Version     string   `json:"version"`
+	Platform    string   `json:"platform"`
+	Subcommands []string `json:"subcommands"`
+	Schemes     []string `json:"schemes"`
+	Codecs      []string `json:"codecs"`
+	// Codecs fastar create can write.
+	CreateCodecs []string `json:"create_codecs"`
+	// Where the archive can go, named after the flag selecting it.
+	OutputModes  []string `json:"output_modes"`
+	ImageFormats []string `json:"image_formats"`
+	Digests      []string `json:"digests"`
+	Features     []string `json:"features"`
+	// Every long flag, without the leading dashes.
+	Flags []string `json:"flags"`
+}
+
+var subcommands = []string{"extract", "create", "proxy", "self-update", "capabilities"}
+
+func getCapabilities() capabilities {
+	outputModes := []string{"directory", "to-stdout", "extract-file", "tee-stdout", "to-squashfs", "to-image", "extract-to", "cas-dir", "audit", "estimate", "row-groups"}
+	if hasFeature("output_device") {
+		outputModes = append(outputModes, "output-device")
+	}
+	imageFormats := []string{"erofs", "squashfs"}
+	if hasFeature("ext4_image") {
+		imageFormats = append([]string{"ext4"}, imageFormats...)
+	}
+	digests := make([]string, 0, len(hashManifestNames))
+	for algorithm := range hashManifestNames {
+		digests = append(digests, algorithm)
+	}
+	sort.Strings(digests)
+	features := append([]string(nil), platformFeatures...)
+	if getVersionInfo().FipsCrypto {
+		features = append(features, "fips_crypto")
+	}
+	return capabilities{
+		Version:      version,
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Subcommands:  subcommands,
+		Schemes:      supportedBackends,
+		Codecs:       supportedCodecs,
+		CreateCodecs: []string{Tar.String(), Gzip.String(), Lz4.String(), Zstd.String()},
+		OutputModes:  outputModes,
+		ImageFormats: imageFormats,
+		Digests:      digests,
+		Features:     features,
+		Flags:        optionFlags(),
+	}
+}
+
+func hasFeature(name string) bool {
+	for _, feature := range platformFeatures {
+		if feature == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails for flags that need a feature this platform doesn't have, rather
+// than quietly ignoring them.
+func checkPlatformFlags() {
+	if opts.Preallocate > 0 && !hasFeature("fallocate") {
+		fatal("--preallocate is not supported on this platform")
+	}
+	if opts.DirectIo && !hasFeature("direct_io") {
+		fatal("--direct-io is not supported on this platform")
+	}
+	if opts.PostFsync == "syncfs" && !hasFeature("syncfs") {
+		fatal("--post-extract-fsync=syncfs is not supported on this platform")
+	}
+}
+
+// The long names of the Options flags.
+func optionFlags() []string {
+	var names []string
+	optionsType := reflect.TypeOf(Options{})
+	for i := 0; i < optionsType.NumField(); i++ {
+		if name := optionsType.Field(i).Tag.Get("long"); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// `fastar capabilities [--json]`, a line per kind of capability unless
+// --json is passed.
+func printCapabilities(args []string) {
+	asJson := false
+	for _, arg := range args {
+		if arg != "--json" {
+			fatal("Usage: fastar capabilities [--json]")
+		}
+		asJson = true
+	}
+	caps := getCapabilities()
+	if asJson {
+		out, err := json.MarshalIndent(caps, "", "  ")
+		if err != nil {
+			fatal("Failed to encode capabilities: ", err.Error())
+		}
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Printf("version: %s\nplatform: %s\n", caps.Version, caps.Platform)
+	for _, line := range []struct {
+		name   string
+		values []string
+	}{
+		{"subcommands", caps.Subcommands},
+		{"schemes", caps.Schemes},
+		{"codecs", caps.Codecs},
+		{"create codecs", caps.CreateCodecs},
+		{"output modes", caps.OutputModes},
+		{"image formats", caps.ImageFormats},
+		{"digests", caps.Digests},
+		{"features", caps.Features},
+	} {
+		fmt.Printf("%s: %s\n", line.name, strings.Join(line.values, " "))
+	}
+}
@@ -0,0 +1,35 @@
+package fastar
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	caps := getCapabilities()
+	flags := map[string]bool{}
+	for _, flag := range caps.Flags {
+		flags[flag] = true
+	}
+	for _, flag := range []string{"directory", "download-workers", "manifest", "fakeroot-db"} {
+		if !flags[flag] {
+			t.Errorf("Expected --%s in the flags, got %v", flag, caps.Flags)
+		}
+	}
+	if !reflect.DeepEqual(caps.Codecs, getVersionInfo().Codecs) || caps.CreateCodecs[3] != "zstd" {
+		t.Fatalf("Unexpected codecs %v, %v", caps.Codecs, caps.CreateCodecs)
+	}
+	for _, codec := range caps.Codecs {
+		if codec == Zip.String() {
+			t.Fatalf("Expected zip, which can't be extracted, not to be in %v", caps.Codecs)
+		}
+	}
+	if len(caps.Digests) != 3 || caps.Digests[2] != "sha256" {
+		t.Fatalf("Unexpected digests %v", caps.Digests)
+	}
+	for _, feature := range caps.Features {
+		if feature != "fips_crypto" && !hasFeature(feature) {
+			t.Fatalf("Unknown feature %s", feature)
+		}
+	}
+}
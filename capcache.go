@@ -0,0 +1,131 @@
+package fastar
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Small on-disk cache of what we've learned about each origin on previous
+// runs. Used to give estimates without having to download anything, and
+// to pick the chunk size and worker count with --auto-tune. Failures to
+// read or write the cache are never fatal.
+type originStats struct {
+	BytesPerSecond float64       `json:"bytes_per_second"`
+	ChunkSize      int64         `json:"chunk_size"`
+	NumWorkers     int           `json:"num_workers"`
+	Updated        time.Time     `json:"updated"`
+	Trials         []tuningTrial `json:"trials,omitempty"`
+}
+
+type capabilityCache struct {
+	Origins map[string]originStats `json:"origins"`
+}
+
+func capabilityCachePath() string {
+	if opts.CacheFile == "none" {
+		return ""
+	} else if opts.CacheFile != "" {
+		return opts.CacheFile
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fastar", "capabilities.json")
+}
+
+func loadCapabilityCache() capabilityCache {
+	cache := capabilityCache{Origins: map[string]originStats{}}
+	path := capabilityCachePath()
+	if path == "" {
+		return cache
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Println("Ignoring unreadable capability cache:", err.Error())
+		return capabilityCache{Origins: map[string]originStats{}}
+	}
+	if cache.Origins == nil {
+		cache.Origins = map[string]originStats{}
+	}
+	return cache
+}
+
+func (cache capabilityCache) save() {
+	path := capabilityCachePath()
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		log.Println("Failed to encode capability cache:", err.Error())
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Println("Failed to create capability cache dir:", err.Error())
+		return
+	}
+	// Write to a temp file and rename so concurrent fastar processes never
+	// see a partially written cache.
+	tmp := path + ".tmp." + time.Now().Format("150405.000000000")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("Failed to write capability cache:", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Println("Failed to write capability cache:", err.Error())
+	}
+}
+
+// Cache key for a source URL, e.g. "https://foo.net" or "s3://bucket".
+func originKey(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func recordOriginStats(rawUrl string, totalBytes int64, elapsed time.Duration) {
+	if capabilityCachePath() == "" || totalBytes == 0 || elapsed <= 0 {
+		return
+	}
+	cache := loadCapabilityCache()
+	bytesPerSecond := float64(totalBytes) / elapsed.Seconds()
+	trials := cache.Origins[originKey(rawUrl)].Trials
+	// Downloads that don't give every worker a chunk say little about the
+	// chunk size and worker count.
+	if totalBytes >= opts.ChunkSize*int64(opts.NumWorkers) {
+		trials = recordTrial(trials, opts.ChunkSize, opts.NumWorkers, bytesPerSecond)
+	}
+	cache.Origins[originKey(rawUrl)] = originStats{
+		BytesPerSecond: bytesPerSecond,
+		ChunkSize:      opts.ChunkSize,
+		NumWorkers:     opts.NumWorkers,
+		Updated:        time.Now().UTC(),
+		Trials:         trials,
+	}
+	cache.save()
+}
+
+// Counts bytes flowing through the download stream.
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,146 @@
+package fastar
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Content-addressable store output (--cas-dir). Every regular file is stored
+// once under CASDIR/objects and the output directory only gets hard links to
+// the objects, so extracting many versions of an artifact on the same node
+// only takes space for the files that actually changed between them.
+//
+// Objects are named by the SHA256 of their contents plus mode and owner,
+// since all hard links to an object share them:
+//
+//	CASDIR/objects/ab/abcdef...-0755-1000-1000
+//
+// The manifest is in sha256sum format with paths relative to the output
+// directory, so `sha256sum -c` from there verifies the materialized view.
+var (
+	casMutex    sync.Mutex
+	casManifest = map[string]string{}
+	casNewBytes atomic.Uint64
+	casDupBytes atomic.Uint64
+)
+
+// Stores buf in the object store if it isn't already there and hard links
+// it to filename.
+// Returns false if ctx was canceled before the object was stored.
+func writeFileToCas(ctx context.Context, filename string, buf []byte, header *tar.Header) bool {
+	sum := sha256.Sum256(buf)
+	hash := hex.EncodeToString(sum[:])
+	mode := header.FileInfo().Mode().Perm()
+	object := casObjectPath(hash, mode, header.Uid, header.Gid)
+
+	if _, err := os.Stat(object); err == nil {
+		casDupBytes.Add(uint64(len(buf)))
+	} else {
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			fatal("Failed to create CAS object directory: ", err.Error())
+		}
+		// Written to a temporary name first so concurrent extractions
+		// sharing the store never link a partially written object.
+		tmp, err := openTrackedFile(func() (*os.File, error) {
+			return os.CreateTemp(filepath.Dir(object), ".tmp-")
+		})
+		if err != nil {
+			fatal("Failed to create CAS object: ", err.Error())
+		}
+		err = writeBuffer(ctx, tmp, buf)
+		if err == nil && syncFiles() {
+			err = tmp.Sync()
+		}
+		closeTrackedFile(tmp)
+		if err != nil {
+			os.Remove(tmp.Name())
+			if ctx.Err() != nil {
+				return false
+			}
+			fatal("Failed to write CAS object: ", err.Error())
+		}
+		os.Chmod(tmp.Name(), mode)
+		os.Chown(tmp.Name(), header.Uid, header.Gid)
+		if err := os.Rename(tmp.Name(), object); err != nil {
+			fatal("Failed to store CAS object: ", err.Error())
+		}
+		casNewBytes.Add(uint64(len(buf)))
+	}
+
+	if opts.Overwrite {
+		if _, err := os.Lstat(filename); err == nil {
+			os.Remove(filename)
+		}
+	}
+	if err := os.Link(object, filename); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			fatalf("--cas-dir %s must be on the same filesystem as the output directory %s", opts.CasDir, opts.OutputDir)
+		}
+		fatal("Failed to link CAS object: ", err.Error())
+	}
+	recordCasEntry(filename, hash)
+	return true
+}
+
+func casObjectPath(hash string, mode os.FileMode, uid, gid int) string {
+	return filepath.Join(opts.CasDir, "objects", hash[:2], fmt.Sprintf("%s-%04o-%d-%d", hash, mode, uid, gid))
+}
+
+func recordCasEntry(filename, hash string) {
+	casMutex.Lock()
+	defer casMutex.Unlock()
+	casManifest[filename] = hash
+}
+
+// Hard links within the tarball point at the same object as their target.
+func recordCasLink(target, filename string) {
+	casMutex.Lock()
+	defer casMutex.Unlock()
+	if hash, ok := casManifest[target]; ok {
+		casManifest[filename] = hash
+	}
+}
+
+// Manifests default to CASDIR/manifests/<output dir name>.sha256 so
+// versions extracted side by side each keep theirs.
+func writeCasManifest() {
+	manifestPath := opts.CasManifest
+	if manifestPath == "" {
+		manifestPath = filepath.Join(opts.CasDir, "manifests", filepath.Base(filepath.Clean(opts.OutputDir))+".sha256")
+	}
+	lines := make([]string, 0, len(casManifest))
+	for filename, hash := range casManifest {
+		relative, err := filepath.Rel(opts.OutputDir, filename)
+		if err != nil {
+			relative = filename
+		}
+		lines = append(lines, hash+"  "+relative+"\n")
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][66:] < lines[j][66:] })
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		fatal("Failed to create CAS manifest directory: ", err.Error())
+	}
+	if err := os.WriteFile(manifestPath, []byte(strings.Join(lines, "")), 0644); err != nil {
+		fatal("Failed to write CAS manifest: ", err.Error())
+	}
+	log.Printf("Stored %d new bytes in %s, %d bytes were already present. Manifest written to %s\n",
+		casNewBytes.Load(), opts.CasDir, casDupBytes.Load(), manifestPath)
+	emitEvent("cas_manifest_written", map[string]interface{}{
+		"path": manifestPath, "files": len(lines), "new_bytes": casNewBytes.Load(), "deduplicated_bytes": casDupBytes.Load(),
+	})
+	casManifest = map[string]string{}
+	casNewBytes.Store(0)
+	casDupBytes.Store(0)
+}
@@ -0,0 +1,61 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCasDir(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.WriteWorkers = 4
+	opts.CasDir = t.TempDir()
+	root := t.TempDir()
+
+	extract := func(version string, files map[string]string) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, contents := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents)), Uid: os.Getuid(), Gid: os.Getgid()})
+			tw.Write([]byte(contents))
+		}
+		tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "shared"})
+		tw.Close()
+		opts.OutputDir = filepath.Join(root, version)
+		ExtractTar(context.Background(), &buf)
+	}
+	extract("v1", map[string]string{"shared": "same in both", "dir/changed": "old"})
+	extract("v2", map[string]string{"shared": "same in both", "dir/changed": "new"})
+
+	sameFile := func(a, b string) bool {
+		infoA, err := os.Stat(filepath.Join(root, a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infoB, err := os.Stat(filepath.Join(root, b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return os.SameFile(infoA, infoB)
+	}
+	if !sameFile("v1/shared", "v2/shared") || !sameFile("v1/shared", "v2/link") {
+		t.Fatal("Identical files weren't deduplicated")
+	}
+	if sameFile("v1/dir/changed", "v2/dir/changed") {
+		t.Fatal("Different files share an object")
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(opts.CasDir, "manifests", "v2.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(manifest)), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "  dir/changed") || lines[1][:64] != lines[2][:64] {
+		t.Fatalf("Unexpected manifest:\n%s", manifest)
+	}
+}
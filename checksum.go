@@ -0,0 +1,102 @@
+package fastar
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"strings"
+)
+
+// Implemented by downloaders that can look up the expected digest of the
+// object they serve (e.g. from repository metadata), so the download can
+// be verified without the user having to pass a checksum.
+type ChecksumProvider interface {
+	// Returns the hash algorithm ("sha256", "sha1", "md5" or "crc32c") and
+	// expected hex digest, or empty strings if unknown.
+	ExpectedChecksum() (string, string)
+}
+
+// Implemented by downloaders that verify the in order download stream
+// themselves, e.g. against per piece hashes.
+type StreamVerifier interface {
+	VerifyStream(io.Reader) io.Reader
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha256":
+		return sha256.New()
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	fatal("Unsupported checksum algorithm: ", algorithm)
+	return nil
+}
+
+// The digest to verify the download against: one passed with --sha256,
+// --sha1 or --md5, otherwise whatever the source knows about.
+func expectedChecksum(downloader Downloader) (string, string) {
+	var algorithm, expected string
+	for _, flag := range []struct{ algorithm, digest string }{{"sha256", opts.Sha256}, {"sha1", opts.Sha1}, {"md5", opts.Md5}} {
+		if flag.digest == "" {
+			continue
+		}
+		if expected != "" {
+			fatal("Only one of --sha256, --sha1 and --md5 can be passed")
+		}
+		if _, err := hex.DecodeString(flag.digest); err != nil || len(flag.digest) != newHash(flag.algorithm).Size()*2 {
+			fatalf("--%s must be a %d character hex digest", flag.algorithm, newHash(flag.algorithm).Size()*2)
+		}
+		algorithm, expected = flag.algorithm, flag.digest
+	}
+	if expected != "" {
+		return algorithm, expected
+	}
+	if provider, ok := downloader.(ChecksumProvider); ok {
+		return provider.ExpectedChecksum()
+	}
+	return "", ""
+}
+
+// Hashes the raw download stream as it's consumed.
+type verifyingReader struct {
+	reader    io.Reader
+	hash      hash.Hash
+	algorithm string
+	expected  string
+}
+
+func newVerifyingReader(reader io.Reader, algorithm, expected string) *verifyingReader {
+	log.Printf("Verifying download against expected %s %s\n", algorithm, expected)
+	return &verifyingReader{reader, newHash(algorithm), algorithm, strings.ToLower(expected)}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// Consumes whatever is left of the stream (decompressors and the tar reader
+// can stop before the end, e.g. on trailing padding) and exits with EBADMSG
+// if the digest doesn't match.
+func (r *verifyingReader) Verify() {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		fatal("Failed to read remainder of download for checksum: ", err.Error())
+	}
+	actual := hex.EncodeToString(r.hash.Sum(nil))
+	if actual != r.expected {
+		log.Printf("Checksum mismatch, expected %s %s but got %s\n", r.algorithm, r.expected, actual)
+		exit(ErrCorrupt)
+	}
+	log.Printf("Verified %s checksum %s\n", r.algorithm, actual)
+}
@@ -0,0 +1,50 @@
+package fastar
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+type checksumDownloader struct {
+	TestDownloader
+}
+
+func (checksumDownloader) ExpectedChecksum() (string, string) {
+	return "md5", "d41d8cd98f00b204e9800998ecf8427e"
+}
+
+func TestExpectedChecksum(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.Sha256 = ""
+	opts.Sha1 = ""
+	opts.Md5 = ""
+
+	if algorithm, expected := expectedChecksum(TestDownloader{}); algorithm != "" || expected != "" {
+		t.Fatalf("Got %s %s without any checksum", algorithm, expected)
+	}
+	if algorithm, expected := expectedChecksum(checksumDownloader{}); algorithm != "md5" || expected != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Fatalf("Got %s %s, wanted the source's checksum", algorithm, expected)
+	}
+	// Checksums passed on the command line take precedence.
+	opts.Sha1 = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	if algorithm, expected := expectedChecksum(checksumDownloader{}); algorithm != "sha1" || expected != opts.Sha1 {
+		t.Fatalf("Got %s %s, wanted --sha1", algorithm, expected)
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	for algorithm, expected := range map[string]string{
+		"sha256": "15e2b0d3c33891ebb0f1ef609ec419420c20e320ce94c65fbc8c3312448eb225",
+		"sha1":   "f7c3bc1d808e04732adf679965ccc34ca7ae3441",
+		"md5":    "25f9e794323b453885f5181f1b624d0b",
+		"crc32c": "e3069283",
+	} {
+		verifier := newVerifyingReader(strings.NewReader("123456789"), algorithm, strings.ToUpper(expected))
+		verifier.Verify()
+		if actual := hex.EncodeToString(verifier.hash.Sum(nil)); actual != expected {
+			t.Fatalf("Got %s %s, wanted %s", algorithm, actual, expected)
+		}
+	}
+}
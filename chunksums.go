@@ -0,0 +1,105 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SHA256 digests of the download's chunks from --chunk-checksums, by chunk
+// start offset. A worker checks each chunk once it has all of it and only
+// passes verified chunks on, downloading one that doesn't match again like
+// any other failed attempt. Some CDNs occasionally corrupt a single range,
+// which would otherwise surface as a corrupt tar header or a failed
+// --sha256 at the end, with no way to recover but starting over.
+var chunkChecksums map[int64][]byte
+
+// Loads --chunk-checksums, lines of "OFFSET LENGTH SHA256" with every chunk
+// but the last LENGTH bytes long, from a local file or any URL fastar can
+// download. The chunk size is switched to the manifest's.
+func setupChunkChecksums() {
+	chunkChecksums = nil
+	if opts.ChunkChecksums == "" {
+		return
+	}
+	var manifest io.ReadCloser
+	if strings.Contains(opts.ChunkChecksums, "://") {
+		manifest = getDownloader(opts.ChunkChecksums, opts.UseFips, opts.UseGetForSize).Get()
+	} else {
+		file, err := os.Open(opts.ChunkChecksums)
+		if err != nil {
+			fatal("Failed to open --chunk-checksums: ", err.Error())
+		}
+		manifest = file
+	}
+	defer manifest.Close()
+	sums, chunkSize, err := parseChunkChecksums(manifest)
+	if err != nil {
+		fatal("Failed to parse --chunk-checksums: ", err.Error())
+	}
+	if chunkSize != opts.ChunkSize {
+		log.Printf("Using the %d byte chunks of --chunk-checksums\n", chunkSize)
+		opts.ChunkSize = chunkSize
+	}
+	chunkChecksums = sums
+}
+
+func parseChunkChecksums(manifest io.Reader) (map[int64][]byte, int64, error) {
+	sums := map[int64][]byte{}
+	var chunkSize, next int64
+	var last bool
+	scanner := bufio.NewScanner(manifest)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 || last {
+			return nil, 0, fmt.Errorf("line %d: expected OFFSET LENGTH SHA256 after the previous chunk", line)
+		}
+		offset, offsetErr := strconv.ParseInt(fields[0], 10, 64)
+		length, lengthErr := strconv.ParseInt(fields[1], 10, 64)
+		digest, digestErr := hex.DecodeString(fields[2])
+		if offsetErr != nil || lengthErr != nil || digestErr != nil || len(digest) != sha256.Size || length <= 0 {
+			return nil, 0, fmt.Errorf("line %d: invalid chunk %q", line, scanner.Text())
+		}
+		if chunkSize == 0 {
+			chunkSize = length
+		}
+		if offset != next || length > chunkSize {
+			return nil, 0, fmt.Errorf("line %d: chunks must be contiguous and %d bytes long", line, chunkSize)
+		}
+		last = length < chunkSize
+		sums[offset] = digest
+		next += length
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(sums) == 0 {
+		return nil, 0, fmt.Errorf("no chunks")
+	}
+	return sums, chunkSize, nil
+}
+
+// Checks a complete chunk against --chunk-checksums, if it was passed.
+func verifyChunk(start int64, data []byte) error {
+	if chunkChecksums == nil {
+		return nil
+	}
+	expected, ok := chunkChecksums[start]
+	if !ok {
+		fatalf("--chunk-checksums has no chunk starting at byte %d", start)
+	}
+	if actual := sha256.Sum256(data); !bytes.Equal(actual[:], expected) {
+		return fmt.Errorf("chunk checksum mismatch, got %x", actual)
+	}
+	return nil
+}
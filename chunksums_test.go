@@ -0,0 +1,74 @@
+package fastar
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Corrupts responses for the chunk at corruptAt until one of them has been
+// read in full, the test build of Reader fails most reads on purpose.
+type corruptingDownloader struct {
+	TestDownloader
+	corruptAt int64
+	delivered *atomic.Bool
+}
+
+type deliveryReader struct {
+	*strings.Reader
+	delivered *atomic.Bool
+}
+
+func (r deliveryReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.Reader.Len() == 0 {
+		r.delivered.Store(true)
+	}
+	return n, err
+}
+
+func (d corruptingDownloader) GetRange(start, end int64) io.ReadCloser {
+	if start == d.corruptAt && !d.delivered.Load() {
+		data := []byte(d.Data[start:end])
+		data[len(data)/2] ^= 0xff
+		return io.NopCloser(deliveryReader{strings.NewReader(string(data)), d.delivered})
+	}
+	return d.TestDownloader.GetRange(start, end)
+}
+
+func TestChunkChecksums(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; chunkChecksums = nil }()
+	opts.RetryCount = 1000000
+
+	data := RandomString(1000)
+	var manifest strings.Builder
+	for start := 0; start < len(data); start += 300 {
+		end := min(int64(start+300), int64(len(data)))
+		fmt.Fprintf(&manifest, "%d %d %x\n", start, end-int64(start), sha256.Sum256([]byte(data[start:end])))
+	}
+	sums, chunkSize, err := parseChunkChecksums(strings.NewReader(manifest.String()))
+	if err != nil || chunkSize != 300 || len(sums) != 4 {
+		t.Fatalf("Got %d chunks of %d bytes, %v", len(sums), chunkSize, err)
+	}
+	chunkChecksums = sums
+
+	downloader := corruptingDownloader{TestDownloader{data, true, false}, 600, &atomic.Bool{}}
+	actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, chunkSize, 2))
+	if err != nil || string(actual) != data {
+		t.Fatalf("Expected the corrupt chunk to be downloaded again, err %v", err)
+	}
+	if !downloader.delivered.Load() {
+		t.Fatal("Expected a corrupt chunk to have been delivered")
+	}
+
+	for _, invalid := range []string{"", "0 300 abc", "0 300 " + strings.Repeat("0", 64) + "\n400 300 " + strings.Repeat("0", 64), "0 100 " + strings.Repeat("0", 64) + "\n100 300 " + strings.Repeat("0", 64)} {
+		if _, _, err := parseChunkChecksums(strings.NewReader(invalid)); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// The fastar command line tool, see fastar.Main.
+package main
+
+import "github.com/databricks/fastar"
+
+func main() {
+	fastar.Main()
+}
@@ -0,0 +1,621 @@
+package fastar
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Most Parquet/ORC footers fit in the first request for the tail.
+const columnarTailGuess = 64 << 10
+
+// A row group (stripe for ORC) of a columnar file.
+type rowGroup struct {
+	Index  int   `json:"index"`
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	Rows   int64 `json:"rows"`
+}
+
+type partialFetchSummary struct {
+	Format       string     `json:"format"`
+	Output       string     `json:"output"`
+	Size         int64      `json:"size"`
+	TailBytes    int64      `json:"tail_bytes"`
+	TotalGroups  int        `json:"total_row_groups"`
+	RowGroups    []rowGroup `json:"row_groups"`
+	BytesFetched int64      `json:"bytes_fetched"`
+}
+
+// Only downloads the footer and the selected row groups of a Parquet or
+// ORC file, for jobs that only need a slice of a huge table. The result is
+// a sparse file of the same size as the original, with everything that
+// wasn't requested left as a hole, so readers that only touch the footer
+// and those row groups can use it like the real thing. A JSON summary of
+// what was fetched is printed to stdout.
+//
+// Sources without RANGE support (which includes HTTP files smaller than
+// --chunk-size) are downloaded whole, the summary is still printed.
+func FetchRowGroups(downloader Downloader, filename string) {
+	size, supportsRange, _ := downloader.GetFileInfo()
+	selected, err := selectedRowGroups()
+	if err != nil {
+		fatal("Failed to parse row group selection: ", err.Error())
+	}
+	outputDir := opts.OutputDir
+	if outputDir == "" {
+		outputDir = "."
+	}
+	summary := partialFetchSummary{Output: filepath.Join(outputDir, filename), Size: size}
+
+	var output *os.File
+	readTail := func(length int64) []byte {
+		length = min(length, size)
+		tail := make([]byte, length)
+		var err error
+		if output != nil {
+			_, err = output.ReadAt(tail, size-length)
+		} else {
+			body := downloader.GetRange(size-length, size)
+			_, err = io.ReadFull(body, tail)
+			body.Close()
+		}
+		if err != nil {
+			fatal("Failed to read file footer: ", err.Error())
+		}
+		return tail
+	}
+	if !supportsRange {
+		log.Println("Source doesn't support RANGE requests, downloading the whole file")
+		output = createRowGroupOutput(summary.Output, size)
+		defer output.Close()
+		body := downloader.Get()
+		written, err := io.Copy(output, body)
+		body.Close()
+		if err != nil {
+			fatal("Failed to download file: ", err.Error())
+		} else if written != size {
+			fatalf("Downloaded %d bytes, expected %d", written, size)
+		}
+		summary.BytesFetched = size
+	}
+
+	tail := readTail(columnarTailGuess)
+	format, needed, err := columnarTailLength(tail)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if needed > size {
+		fatalf("Footer of %d bytes doesn't fit in a %d byte file", needed, size)
+	}
+	if needed > int64(len(tail)) {
+		tail = readTail(needed)
+	}
+	tailFetched := int64(len(tail))
+	tail = tail[int64(len(tail))-needed:]
+	var groups []rowGroup
+	if format == "parquet" {
+		groups, err = parseParquetRowGroups(tail)
+	} else {
+		groups, err = parseOrcStripes(tail)
+	}
+	if err != nil {
+		fatalf("Failed to parse %s footer: %s", format, err.Error())
+	}
+
+	summary.Format, summary.TailBytes, summary.TotalGroups = format, needed, len(groups)
+	for _, index := range selected {
+		if index < 0 || index >= len(groups) {
+			fatalf("Row group %d doesn't exist, file has %d", index, len(groups))
+		}
+		group := groups[index]
+		if group.Offset < 0 || group.Offset+group.Length > size-needed {
+			fatalf("Row group %d has invalid byte range %d+%d", index, group.Offset, group.Length)
+		}
+		summary.RowGroups = append(summary.RowGroups, group)
+	}
+
+	if output == nil {
+		output = createRowGroupOutput(summary.Output, size)
+		defer output.Close()
+		if _, err := output.WriteAt(tail, size-needed); err != nil {
+			fatal("Failed to write footer: ", err.Error())
+		}
+		summary.BytesFetched = fetchRanges(downloader, output, summary.RowGroups) + tailFetched
+	}
+
+	emitEvent("row_groups_fetched", map[string]interface{}{
+		"format": format, "row_groups": len(summary.RowGroups), "bytes": summary.BytesFetched,
+	})
+	out, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		fatal("Failed to encode summary: ", err.Error())
+	}
+	fmt.Println(string(out))
+}
+
+func createRowGroupOutput(path string, size int64) *os.File {
+	if _, err := os.Stat(path); err == nil && !opts.Overwrite {
+		log.Printf("%s already exists, pass --overwrite to replace it\n", path)
+		exit(syscall.EEXIST)
+	}
+	output, err := os.Create(path)
+	if err != nil {
+		fatal("Failed to create output file: ", err.Error())
+	}
+	if err := output.Truncate(size); err != nil {
+		fatal("Failed to size output file: ", err.Error())
+	}
+	return output
+}
+
+// Downloads the row groups in --chunk-size pieces with --download-workers
+// in parallel, writing each piece at its original offset.
+func fetchRanges(downloader Downloader, output *os.File, groups []rowGroup) int64 {
+	type piece struct{ start, end int64 }
+	pieces := make(chan piece)
+	go func() {
+		for _, group := range groups {
+			for start := group.Offset; start < group.Offset+group.Length; start += opts.ChunkSize {
+				pieces <- piece{start, min(start+opts.ChunkSize, group.Offset+group.Length)}
+			}
+		}
+		close(pieces)
+	}()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var fetched int64
+	for i := 0; i < opts.NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pieces {
+				body := downloader.GetRange(p.start, p.end)
+				n, err := io.Copy(io.NewOffsetWriter(output, p.start), io.LimitReader(body, p.end-p.start))
+				body.Close()
+				if err != nil {
+					fatal("Failed to download row group: ", err.Error())
+				} else if n != p.end-p.start {
+					fatalf("Got %d bytes for range %d-%d", n, p.start, p.end)
+				}
+				mutex.Lock()
+				fetched += n
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return fetched
+}
+
+// Row groups from --row-groups (e.g. "0,3-5") or the "row_groups" list of
+// the JSON --row-group-spec file.
+func selectedRowGroups() ([]int, error) {
+	if opts.RowGroupSpec != "" {
+		data, err := os.ReadFile(opts.RowGroupSpec)
+		if err != nil {
+			return nil, err
+		}
+		var spec struct {
+			RowGroups []int `json:"row_groups"`
+		}
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, err
+		}
+		return uniqueSorted(spec.RowGroups), nil
+	}
+	var selected []int
+	for _, part := range strings.Split(opts.RowGroups, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, err
+			}
+		}
+		if end < start {
+			return nil, errors.New("invalid range " + part)
+		}
+		for i := start; i <= end; i++ {
+			selected = append(selected, i)
+		}
+	}
+	return uniqueSorted(selected), nil
+}
+
+func uniqueSorted(values []int) []int {
+	sort.Ints(values)
+	unique := values[:0]
+	for _, value := range values {
+		if len(unique) == 0 || value != unique[len(unique)-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// Identifies the format from the end of the file and returns how many bytes
+// from the end the footer needs.
+func columnarTailLength(tail []byte) (string, int64, error) {
+	if len(tail) >= 12 && bytes.HasSuffix(tail, []byte("PAR1")) {
+		footerLength := binary.LittleEndian.Uint32(tail[len(tail)-8:])
+		return "parquet", int64(footerLength) + 8, nil
+	}
+	if postscript, err := orcPostscript(tail); err == nil {
+		return "orc", 1 + int64(len(postscript.raw)) + int64(postscript.footerLength) + int64(postscript.metadataLength), nil
+	}
+	return "", 0, errors.New("not a Parquet or ORC file")
+}
+
+// Parquet ends with a Thrift encoded FileMetaData, its length and "PAR1".
+func parseParquetRowGroups(tail []byte) ([]rowGroup, error) {
+	footerLength := int(binary.LittleEndian.Uint32(tail[len(tail)-8:]))
+	reader := &thriftReader{data: tail[len(tail)-8-footerLength : len(tail)-8]}
+	metadata := reader.readStruct(0)
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	var groups []rowGroup
+	for i, value := range thriftList(metadata[4]) {
+		group, _ := value.(map[int16]interface{})
+		start, end := int64(math.MaxInt64), int64(0)
+		for _, columnValue := range thriftList(group[1]) {
+			column, _ := columnValue.(map[int16]interface{})
+			if path, _ := column[1].([]byte); len(path) != 0 {
+				return nil, errors.New("column chunks in external files aren't supported")
+			}
+			columnMeta, _ := column[3].(map[int16]interface{})
+			compressedSize, _ := columnMeta[7].(int64)
+			columnStart, _ := columnMeta[9].(int64)
+			if dictionaryStart, ok := columnMeta[11].(int64); ok && dictionaryStart > 0 && dictionaryStart < columnStart {
+				columnStart = dictionaryStart
+			}
+			start = min(start, columnStart)
+			end = max64(end, columnStart+compressedSize)
+		}
+		if end <= start {
+			return nil, fmt.Errorf("row group %d has no column data", i)
+		}
+		rows, _ := group[3].(int64)
+		groups = append(groups, rowGroup{Index: i, Offset: start, Length: end - start, Rows: rows})
+	}
+	return groups, nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func thriftList(value interface{}) []interface{} {
+	list, _ := value.([]interface{})
+	return list
+}
+
+// Just enough of the Thrift compact protocol to walk Parquet metadata.
+// Structs are decoded into maps keyed by field id.
+type thriftReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+const (
+	thriftTypeStop = iota
+	thriftTypeTrue
+	thriftTypeFalse
+	thriftTypeByte
+	thriftTypeI16
+	thriftTypeI32
+	thriftTypeI64
+	thriftTypeDouble
+	thriftTypeBinary
+	thriftTypeList
+	thriftTypeSet
+	thriftTypeMap
+	thriftTypeStruct
+)
+
+func (r *thriftReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.pos = len(r.data)
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.data) {
+		r.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	r.pos++
+	return r.data[r.pos-1]
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail(errors.New("invalid varint"))
+		return 0
+	}
+	r.pos += n
+	return value
+}
+
+func (r *thriftReader) zigzag() int64 {
+	value := r.uvarint()
+	return int64(value>>1) ^ -int64(value&1)
+}
+
+func (r *thriftReader) readStruct(depth int) map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var id int16
+	for r.err == nil {
+		header := r.byte()
+		fieldType := header & 0x0f
+		if fieldType == thriftTypeStop {
+			break
+		}
+		if delta := header >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			id = int16(r.zigzag())
+		}
+		switch fieldType {
+		case thriftTypeTrue:
+			fields[id] = true
+		case thriftTypeFalse:
+			fields[id] = false
+		default:
+			fields[id] = r.readValue(fieldType, depth+1)
+		}
+	}
+	return fields
+}
+
+func (r *thriftReader) readValue(valueType byte, depth int) interface{} {
+	if depth > 64 {
+		r.fail(errors.New("metadata nested too deeply"))
+		return nil
+	}
+	switch valueType {
+	case thriftTypeTrue, thriftTypeFalse:
+		return r.byte() == thriftTypeTrue
+	case thriftTypeByte:
+		return int64(int8(r.byte()))
+	case thriftTypeI16, thriftTypeI32, thriftTypeI64:
+		return r.zigzag()
+	case thriftTypeDouble:
+		if r.pos+8 > len(r.data) {
+			r.fail(io.ErrUnexpectedEOF)
+			return nil
+		}
+		r.pos += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(r.data[r.pos-8:]))
+	case thriftTypeBinary:
+		length := r.uvarint()
+		if length > uint64(len(r.data)-r.pos) {
+			r.fail(io.ErrUnexpectedEOF)
+			return nil
+		}
+		r.pos += int(length)
+		return r.data[r.pos-int(length) : r.pos]
+	case thriftTypeList, thriftTypeSet:
+		header := r.byte()
+		size := uint64(header >> 4)
+		if size == 15 {
+			size = r.uvarint()
+		}
+		var list []interface{}
+		for i := uint64(0); i < size && r.err == nil; i++ {
+			list = append(list, r.readValue(header&0x0f, depth+1))
+		}
+		return list
+	case thriftTypeMap:
+		size := r.uvarint()
+		if size == 0 {
+			return nil
+		}
+		types := r.byte()
+		for i := uint64(0); i < size && r.err == nil; i++ {
+			r.readValue(types>>4, depth+1)
+			r.readValue(types&0x0f, depth+1)
+		}
+		return nil
+	case thriftTypeStruct:
+		return r.readStruct(depth)
+	default:
+		r.fail(fmt.Errorf("unknown thrift type %d", valueType))
+		return nil
+	}
+}
+
+type orcPostscriptInfo struct {
+	raw            []byte
+	footerLength   uint64
+	metadataLength uint64
+	compression    uint64
+}
+
+// ORC ends with a protobuf PostScript, preceded by the footer and stripe
+// metadata, and the PostScript's length as the very last byte.
+func orcPostscript(tail []byte) (orcPostscriptInfo, error) {
+	var info orcPostscriptInfo
+	if len(tail) < 2 {
+		return info, io.ErrUnexpectedEOF
+	}
+	length := int(tail[len(tail)-1])
+	if length+1 > len(tail) {
+		return info, io.ErrUnexpectedEOF
+	}
+	info.raw = tail[len(tail)-1-length : len(tail)-1]
+	magic := false
+	err := consumeProtoFields(info.raw, func(num protowire.Number, value uint64, data []byte) {
+		switch num {
+		case 1:
+			info.footerLength = value
+		case 2:
+			info.compression = value
+		case 5:
+			info.metadataLength = value
+		case 8000:
+			magic = string(data) == "ORC"
+		}
+	})
+	if err != nil {
+		return info, err
+	} else if !magic {
+		return info, errors.New("missing ORC magic")
+	}
+	return info, nil
+}
+
+func parseOrcStripes(tail []byte) ([]rowGroup, error) {
+	postscript, err := orcPostscript(tail)
+	if err != nil {
+		return nil, err
+	}
+	footerEnd := len(tail) - 1 - len(postscript.raw)
+	footer, err := orcDecompress(tail[footerEnd-int(postscript.footerLength):footerEnd], postscript.compression)
+	if err != nil {
+		return nil, err
+	}
+	var groups []rowGroup
+	err = consumeProtoFields(footer, func(num protowire.Number, _ uint64, data []byte) {
+		if num != 3 {
+			return
+		}
+		var offset, indexLength, dataLength, footerLength, rows uint64
+		consumeProtoFields(data, func(num protowire.Number, value uint64, _ []byte) {
+			switch num {
+			case 1:
+				offset = value
+			case 2:
+				indexLength = value
+			case 3:
+				dataLength = value
+			case 4:
+				footerLength = value
+			case 5:
+				rows = value
+			}
+		})
+		groups = append(groups, rowGroup{
+			Index:  len(groups),
+			Offset: int64(offset),
+			Length: int64(indexLength + dataLength + footerLength),
+			Rows:   int64(rows),
+		})
+	})
+	return groups, err
+}
+
+// ORC's CompressionKind values that can be decompressed.
+const (
+	orcNone   = 0
+	orcZlib   = 1
+	orcSnappy = 2
+	orcZstd   = 5
+)
+
+// ORC compresses metadata in chunks with a 3 byte header holding the chunk
+// length and whether it was stored uncompressed.
+func orcDecompress(data []byte, compression uint64) ([]byte, error) {
+	switch compression {
+	case orcNone:
+		return data, nil
+	case orcZlib, orcSnappy, orcZstd:
+	default:
+		return nil, fmt.Errorf("unsupported ORC compression kind %d, only NONE, ZLIB, SNAPPY and ZSTD are supported", compression)
+	}
+	var out bytes.Buffer
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		header := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		length := header >> 1
+		if 3+length > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		chunk := data[3 : 3+length]
+		if header&1 == 0 {
+			var err error
+			if chunk, err = orcDecompressChunk(chunk, compression); err != nil {
+				return nil, err
+			}
+		}
+		out.Write(chunk)
+		data = data[3+length:]
+	}
+	return out.Bytes(), nil
+}
+
+func orcDecompressChunk(chunk []byte, compression uint64) ([]byte, error) {
+	switch compression {
+	case orcZlib:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(chunk)))
+	case orcSnappy:
+		// Raw blocks, not the framing format.
+		return snappy.Decode(nil, chunk)
+	default:
+		return decodeZstdFrame(chunk)
+	}
+}
+
+// Calls field for each varint or length delimited field of a protobuf
+// message, skipping everything else.
+func consumeProtoFields(b []byte, field func(num protowire.Number, value uint64, data []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, value, nil)
+			b = b[n:]
+		case protowire.BytesType:
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, 0, data)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
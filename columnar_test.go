@@ -0,0 +1,230 @@
+package fastar
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Minimal Thrift compact protocol writer for building Parquet footers.
+type thriftWriter struct {
+	bytes.Buffer
+	lastId []int16
+}
+
+func (w *thriftWriter) field(id int16, fieldType byte) {
+	last := &w.lastId[len(w.lastId)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		w.WriteByte(fieldType)
+		w.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) zigzag(value int64) {
+	w.Write(binary.AppendUvarint(nil, uint64(value<<1^value>>63)))
+}
+
+func (w *thriftWriter) i64(id int16, value int64) {
+	w.field(id, thriftTypeI64)
+	w.zigzag(value)
+}
+
+func (w *thriftWriter) binary(id int16, value string) {
+	w.field(id, thriftTypeBinary)
+	w.Write(binary.AppendUvarint(nil, uint64(len(value))))
+	w.WriteString(value)
+}
+
+func (w *thriftWriter) beginStruct() { w.lastId = append(w.lastId, 0) }
+
+func (w *thriftWriter) endStruct() {
+	w.WriteByte(thriftTypeStop)
+	w.lastId = w.lastId[:len(w.lastId)-1]
+}
+
+func (w *thriftWriter) list(id int16, elemType byte, size int) {
+	w.field(id, thriftTypeList)
+	w.WriteByte(byte(size)<<4 | elemType)
+}
+
+type testColumn struct{ dictionary, data, length int64 }
+
+func buildParquetFooter(rowGroups [][]testColumn) []byte {
+	w := &thriftWriter{}
+	w.beginStruct()
+	w.field(1, thriftTypeI32)
+	w.zigzag(1)
+	w.list(2, thriftTypeStruct, 1)
+	w.beginStruct()
+	w.binary(4, "schema")
+	w.endStruct()
+	w.i64(3, 300)
+	w.list(4, thriftTypeStruct, len(rowGroups))
+	for _, columns := range rowGroups {
+		w.beginStruct()
+		w.list(1, thriftTypeStruct, len(columns))
+		for _, column := range columns {
+			w.beginStruct()
+			w.i64(2, column.data)
+			w.field(3, thriftTypeStruct)
+			w.beginStruct()
+			w.field(1, thriftTypeI32)
+			w.zigzag(6)
+			w.list(2, thriftTypeI32, 2)
+			w.zigzag(0)
+			w.zigzag(3)
+			w.list(3, thriftTypeBinary, 1)
+			w.Write([]byte{1, 'c'})
+			w.i64(7, column.length)
+			w.i64(9, column.data)
+			if column.dictionary != 0 {
+				w.i64(11, column.dictionary)
+			}
+			// Field id deltas over 15 need the long form.
+			w.field(30, thriftTypeTrue)
+			w.endStruct()
+			w.endStruct()
+		}
+		w.i64(2, 1000)
+		w.i64(3, 100)
+		w.endStruct()
+	}
+	w.binary(6, "test writer")
+	w.field(7, thriftTypeDouble)
+	w.Write(make([]byte, 8))
+	w.endStruct()
+	return w.Bytes()
+}
+
+func TestFetchParquetRowGroups(t *testing.T) {
+	data := []byte("PAR1" + RandomString(3000))
+	footer := buildParquetFooter([][]testColumn{
+		{{0, 4, 500}, {0, 504, 500}},
+		{{1004, 1100, 500}, {0, 1600, 404}},
+		{{0, 2004, 1000}},
+	})
+	data = append(data, footer...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(footer)))
+	data = append(data, "PAR1"...)
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.RowGroups = "2,0"
+	opts.ChunkSize = 300
+	opts.NumWorkers = 3
+	FetchRowGroups(TestDownloader{string(data), true, false}, "table.parquet")
+
+	output, err := os.ReadFile(filepath.Join(opts.OutputDir, "table.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output) != len(data) {
+		t.Fatalf("Got %d bytes, wanted %d", len(output), len(data))
+	}
+	for _, r := range [][2]int{{4, 1004}, {2004, 3004}, {3004, len(data)}} {
+		if !bytes.Equal(output[r[0]:r[1]], data[r[0]:r[1]]) {
+			t.Fatalf("Bytes %d-%d weren't fetched", r[0], r[1])
+		}
+	}
+	if !bytes.Equal(output[1004:2004], make([]byte, 1000)) {
+		t.Fatal("Unselected row group was fetched")
+	}
+
+	// Without RANGE support everything gets downloaded.
+	opts.Overwrite = true
+	FetchRowGroups(TestDownloader{string(data), false, false}, "table.parquet")
+	if output, _ := os.ReadFile(filepath.Join(opts.OutputDir, "table.parquet")); !bytes.Equal(output, data) {
+		t.Fatal("Whole file wasn't downloaded")
+	}
+}
+
+func TestParseOrcStripes(t *testing.T) {
+	stripe := func(offset, index, data, footer, rows uint64) []byte {
+		var b []byte
+		for i, value := range []uint64{offset, index, data, footer, rows} {
+			b = protowire.AppendTag(b, protowire.Number(i+1), protowire.VarintType)
+			b = protowire.AppendVarint(b, value)
+		}
+		return b
+	}
+	var footer []byte
+	footer = protowire.AppendTag(footer, 1, protowire.VarintType)
+	footer = protowire.AppendVarint(footer, 3)
+	for _, s := range [][]byte{stripe(3, 10, 100, 20, 50), stripe(133, 5, 200, 10, 70)} {
+		footer = protowire.AppendTag(footer, 3, protowire.BytesType)
+		footer = protowire.AppendBytes(footer, s)
+	}
+	zstdEncoder, _ := zstd.NewWriter(nil)
+	defer zstdEncoder.Close()
+	for kind, compress := range map[uint64]func([]byte) []byte{
+		orcZlib: func(b []byte) []byte {
+			var compressed bytes.Buffer
+			writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+			writer.Write(b)
+			writer.Close()
+			return compressed.Bytes()
+		},
+		orcSnappy: func(b []byte) []byte { return snappy.Encode(nil, b) },
+		orcZstd:   func(b []byte) []byte { return zstdEncoder.EncodeAll(b, nil) },
+	} {
+		compressed := compress(footer)
+		chunk := []byte{byte(len(compressed) << 1), byte(len(compressed) >> 7), byte(len(compressed) >> 15)}
+		chunk = append(chunk, compressed...)
+
+		var postscript []byte
+		for _, field := range [][2]uint64{{1, uint64(len(chunk))}, {2, kind}, {3, 262144}, {5, 0}} {
+			postscript = protowire.AppendTag(postscript, protowire.Number(field[0]), protowire.VarintType)
+			postscript = protowire.AppendVarint(postscript, field[1])
+		}
+		postscript = protowire.AppendTag(postscript, 8000, protowire.BytesType)
+		postscript = protowire.AppendString(postscript, "ORC")
+		tail := append(append([]byte("ORC"), make([]byte, 345)...), chunk...)
+		tail = append(append(tail, postscript...), byte(len(postscript)))
+
+		format, needed, err := columnarTailLength(tail)
+		if err != nil || format != "orc" || needed != int64(1+len(postscript)+len(chunk)) {
+			t.Fatalf("Compression kind %d: got %s, %d, %v", kind, format, needed, err)
+		}
+		stripes, err := parseOrcStripes(tail)
+		if err != nil {
+			t.Fatalf("Compression kind %d: %v", kind, err)
+		}
+		expected := []rowGroup{{0, 3, 130, 50}, {1, 133, 215, 70}}
+		if !reflect.DeepEqual(stripes, expected) {
+			t.Fatalf("Compression kind %d: got %v, wanted %v", kind, stripes, expected)
+		}
+	}
+}
+
+func TestSelectedRowGroups(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RowGroups = "5, 0-2,1"
+	if selected, err := selectedRowGroups(); err != nil || !reflect.DeepEqual(selected, []int{0, 1, 2, 5}) {
+		t.Fatalf("Got %v, %v", selected, err)
+	}
+	for _, invalid := range []string{"", "a", "3-1", "1-"} {
+		opts.RowGroups = invalid
+		if _, err := selectedRowGroups(); err == nil {
+			t.Fatalf("Expected error for %q", invalid)
+		}
+	}
+	spec := filepath.Join(t.TempDir(), "spec.json")
+	os.WriteFile(spec, []byte(`{"row_groups": [4, 1]}`), 0644)
+	opts.RowGroupSpec = spec
+	if selected, err := selectedRowGroups(); err != nil || !reflect.DeepEqual(selected, []int{1, 4}) {
+		t.Fatalf("Got %v, %v", selected, err)
+	}
+}
@@ -0,0 +1,192 @@
+package fastar
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TLS sessions shared by every transport, so that after the first
+// handshake with a host the workers' connections resume its session
+// instead of going through a full handshake each.
+var tlsSessions = tls.NewLRUClientSessionCache(0)
+
+// How long an idle connection is kept for the next chunk, the same as
+// http.DefaultTransport.
+const idleConnTimeout = 90 * time.Second
+
+// Keeps a connection per download worker open between chunks, unless
+// --max-idle-conns-per-host says otherwise. The default of 2 closes most
+// of them after each chunk, so the next one needs a new handshake.
+func idleConnsPerHost() int {
+	if opts.MaxIdlePerHost > 0 {
+		return opts.MaxIdlePerHost
+	}
+	if opts.NumWorkers > http.DefaultMaxIdleConnsPerHost {
+		return opts.NumWorkers
+	}
+	return http.DefaultMaxIdleConnsPerHost
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// --tls-min-version, 0 for crypto/tls's default.
+func tlsMinVersion() uint16 {
+	return tlsVersions[opts.TlsMinVersion]
+}
+
+// The options newNetTransport builds a transport from.
+type transportKey struct {
+	unixSocket  string
+	resolve     string
+	connTimeout int
+	idlePerHost int
+	keepalive   bool
+	http2       bool
+	tlsMin      uint16
+}
+
+var (
+	transportsMutex sync.Mutex
+	transports      = map[transportKey]*http.Transport{}
+)
+
+// Returns the transport every downloader and uploader with the same
+// transport options shares, so that the connections one leaves idle are
+// reused by the next instead of each dialing and handshaking its own.
+func sharedNetTransport() *http.Transport {
+	key := transportKey{
+		unixSocket:  opts.UnixSocket,
+		resolve:     strings.Join(opts.Resolve, "\n"),
+		connTimeout: opts.ConnTimeout,
+		idlePerHost: idleConnsPerHost(),
+		keepalive:   !opts.NoKeepalive,
+		http2:       opts.Http2 && !opts.DisableHttp2,
+		tlsMin:      tlsMinVersion(),
+	}
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	transport, ok := transports[key]
+	if !ok {
+		transport = newNetTransport()
+		transports[key] = transport
+	}
+	return transport
+}
+
+// Implemented by downloaders that can open their connections before the
+// transfer starts, so the first chunks don't all pay for a handshake with
+// a far away origin at once. Returns false if the downloader it wraps
+// can't.
+type connectionWarmer interface {
+	warmConnections(ctx context.Context, n int) bool
+}
+
+// Opens n connections for downloader by sending that many metadata
+// requests at once. The transport keeps them idle for the workers.
+func prewarmConnections(ctx context.Context, downloader Downloader, n int) {
+	warmer, ok := downloader.(connectionWarmer)
+	if opts.NoPrewarm || !ok || n <= 1 {
+		return
+	}
+	start := time.Now()
+	if !warmer.warmConnections(ctx, n) {
+		return
+	}
+	log.Printf("Opened %d connections in %s\n", n, time.Since(start).Round(time.Millisecond))
+	emitEvent("connections_warmed", map[string]interface{}{
+		"connections": n,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+// Runs request n times concurrently. Concurrent HTTP/1.1 requests each
+// get a connection of their own.
+func warmConcurrently(n int, request func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request()
+		}()
+	}
+	wg.Wait()
+}
+
+// Failures are left for the actual chunk requests to report and retry.
+func (httpDownloader HttpDownloader) warmConnections(ctx context.Context, n int) bool {
+	_, rejected := headRejected.Load(httpDownloader.Url)
+	warmConcurrently(n, func() {
+		var req *http.Request
+		if httpDownloader.useGetForSize || rejected {
+			req = httpDownloader.generateRequest("GET")
+			req.Header.Set("Range", "bytes=0-0")
+		} else {
+			req = httpDownloader.generateRequest("HEAD")
+		}
+		resp, err := httpDownloader.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return
+		}
+		// The connection only goes back to the pool once the body is read.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	})
+	return true
+}
+
+func (s3Downloader S3Downloader) warmConnections(ctx context.Context, n int) bool {
+	bucket, key := getBucketAndKey(s3Downloader.Url)
+	warmConcurrently(n, func() {
+		s3Downloader.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			RequestPayer: requestPayer(),
+		})
+	})
+	return true
+}
+
+// Spreads the connections over the mirrors the way chunks are.
+func (mirrorDownloader *MirrorDownloader) warmConnections(ctx context.Context, n int) bool {
+	var wg sync.WaitGroup
+	warmed := false
+	for i, mirror := range mirrorDownloader.mirrors {
+		warmer, ok := mirror.(connectionWarmer)
+		share := (n + len(mirrorDownloader.mirrors) - 1 - i) / len(mirrorDownloader.mirrors)
+		if !ok || share == 0 {
+			continue
+		}
+		warmed = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			warmer.warmConnections(ctx, share)
+		}()
+	}
+	wg.Wait()
+	return warmed
+}
+
+func (d requestCountingDownloader) warmConnections(ctx context.Context, n int) bool {
+	warmer, ok := d.downloader.(connectionWarmer)
+	if !ok {
+		return false
+	}
+	d.counts.Head.Add(int64(n))
+	return warmer.warmConnections(ctx, n)
+}
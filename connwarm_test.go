@@ -0,0 +1,97 @@
+package fastar
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrewarmConnections(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.NumWorkers = 4
+	opts.RetryCount = 1000
+
+	data := RandomString(1000)
+	var opened atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	transport := newNetTransport()
+	transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+	transport.TLSClientConfig.RootCAs.AddCert(server.Certificate())
+	downloader := HttpDownloader{Url: server.URL, client: &http.Client{Transport: transport}}
+
+	prewarmConnections(context.Background(), downloader, opts.NumWorkers)
+	if opened.Load() != 4 {
+		t.Fatalf("Expected 4 connections to be opened, got %d", opened.Load())
+	}
+	// Chunks are downloaded over the warm connections, twice in a row.
+	for round := 0; round < 2; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < opts.NumWorkers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := downloader.GetRange(int64(i)*100, int64(i+1)*100)
+				defer body.Close()
+				if chunk, err := io.ReadAll(body); err != nil || string(chunk) != data[i*100:(i+1)*100] {
+					t.Errorf("Wrong chunk %d, err %v", i, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+	if opened.Load() != 4 {
+		t.Fatalf("Expected the chunks to reuse the 4 connections, %d were opened", opened.Load())
+	}
+}
+
+func TestSharedNetTransport(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.NumWorkers = 16
+	opts.MaxIdlePerHost = 0
+
+	transport := sharedNetTransport()
+	if sharedNetTransport() != transport {
+		t.Fatal("Expected downloaders with the same options to share a transport")
+	}
+	if transport.MaxIdleConnsPerHost != 16 || transport.DisableKeepAlives || transport.ForceAttemptHTTP2 {
+		t.Fatalf("Unexpected defaults: %d idle per host", transport.MaxIdleConnsPerHost)
+	}
+
+	opts.Http2 = true
+	opts.NoKeepalive = true
+	opts.MaxIdlePerHost = 4
+	opts.TlsMinVersion = "1.3"
+	tuned := sharedNetTransport()
+	if tuned == transport {
+		t.Fatal("Expected different options to get their own transport")
+	}
+	if tuned.MaxIdleConnsPerHost != 4 || !tuned.DisableKeepAlives || !tuned.ForceAttemptHTTP2 || tuned.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("Options weren't applied: %d idle per host, TLS %x", tuned.MaxIdleConnsPerHost, tuned.TLSClientConfig.MinVersion)
+	}
+
+	opts.DisableHttp2 = true
+	if sharedNetTransport().ForceAttemptHTTP2 {
+		t.Fatal("Expected --disable-http2 to win over --http2")
+	}
+}
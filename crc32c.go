@@ -0,0 +1,156 @@
+package fastar
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Implemented by downloaders whose source stores a CRC32C of the object,
+// like GCS does for every object including composite ones, which have no
+// MD5. Returns false if it's unknown or doesn't cover the bytes served.
+//
+// GCS only reports the CRC32C of the whole object, never of a range, so
+// each worker checksums the chunks it downloads and they're combined in
+// stream order. The download fails with EBADMSG in place of its end if
+// they don't add up, before the consumer sees a clean EOF.
+type crc32cSource interface {
+	objectCrc32c() (uint32, bool)
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CRC32C of the chunks handed to the consumer so far. Only touched by the
+// worker whose turn it is to write, except for chunks.
+type streamCrc32c struct {
+	expected uint32
+	crc      uint32
+	length   int64
+	// Chunks written out of order by DownloadToFile, by offset.
+	mutex  sync.Mutex
+	chunks map[int64]chunkCrc32c
+}
+
+type chunkCrc32c struct {
+	crc    uint32
+	length int64
+}
+
+// Returns the checker for downloader's stream, or nil if its source has
+// no CRC32C.
+func newStreamCrc32c(downloader Downloader) *streamCrc32c {
+	source, ok := downloader.(crc32cSource)
+	if !ok || opts.NoCrc32c {
+		return nil
+	}
+	expected, ok := source.objectCrc32c()
+	if !ok {
+		return nil
+	}
+	log.Printf("Verifying chunks against the object's CRC32C %08x\n", expected)
+	return &streamCrc32c{expected: expected}
+}
+
+// Adds the next chunk in stream order.
+func (s *streamCrc32c) add(crc uint32, length int64) {
+	s.crc = crc32cCombine(s.crc, crc, length)
+	s.length += length
+}
+
+// Adds a chunk finished out of stream order, see addChunks.
+func (s *streamCrc32c) addAt(start int64, crc uint32, length int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.chunks == nil {
+		s.chunks = map[int64]chunkCrc32c{}
+	}
+	s.chunks[start] = chunkCrc32c{crc, length}
+}
+
+// Adds the chunks passed to addAt in stream order, once all of them were.
+func (s *streamCrc32c) addChunks() {
+	starts := make([]int64, 0, len(s.chunks))
+	for start := range s.chunks {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		s.add(s.chunks[start].crc, s.chunks[start].length)
+	}
+}
+
+// Checks the CRC32C of the whole stream once its last chunk was added.
+func (s *streamCrc32c) verify() error {
+	if s.crc != s.expected {
+		log.Printf("CRC32C mismatch, the object's is %08x but the %d bytes downloaded have %08x\n", s.expected, s.length, s.crc)
+		return &Error{int(ErrCorrupt), fmt.Sprintf("download doesn't match the object's CRC32C %08x", s.expected)}
+	}
+	log.Printf("Verified CRC32C %08x\n", s.crc)
+	return nil
+}
+
+// The CRC32C of a followed by b from the CRC32C of each and b's length,
+// the way zlib's crc32_combine does it: appending lengthB zero bytes to a
+// is a linear map over GF(2), applied by repeated squaring.
+func crc32cCombine(crcA, crcB uint32, lengthB int64) uint32 {
+	if lengthB <= 0 {
+		return crcA
+	}
+	var even, odd [32]uint32
+	// The operator for a single zero bit.
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	// Two zero bits, then four.
+	gf2MatrixSquare(even[:], odd[:])
+	gf2MatrixSquare(odd[:], even[:])
+	// Each pass squares into the next power of two zero bytes, applied
+	// for the bits set in lengthB.
+	for {
+		gf2MatrixSquare(even[:], odd[:])
+		if lengthB&1 != 0 {
+			crcA = gf2MatrixTimes(even[:], crcA)
+		}
+		if lengthB >>= 1; lengthB == 0 {
+			break
+		}
+		gf2MatrixSquare(odd[:], even[:])
+		if lengthB&1 != 0 {
+			crcA = gf2MatrixTimes(odd[:], crcA)
+		}
+		if lengthB >>= 1; lengthB == 0 {
+			break
+		}
+	}
+	return crcA ^ crcB
+}
+
+func gf2MatrixTimes(matrix []uint32, vector uint32) uint32 {
+	var sum uint32
+	for i := 0; vector != 0; i, vector = i+1, vector>>1 {
+		if vector&1 != 0 {
+			sum ^= matrix[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, matrix []uint32) {
+	for n := range matrix {
+		square[n] = gf2MatrixTimes(matrix, matrix[n])
+	}
+}
+
+func (d requestCountingDownloader) objectCrc32c() (uint32, bool) {
+	source, ok := d.downloader.(crc32cSource)
+	if !ok {
+		return 0, false
+	}
+	d.counts.Head.Add(1)
+	return source.objectCrc32c()
+}
@@ -0,0 +1,53 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"syscall"
+	"testing"
+)
+
+type crc32cDownloader struct {
+	TestDownloader
+	crc uint32
+}
+
+func (d crc32cDownloader) objectCrc32c() (uint32, bool) {
+	return d.crc, true
+}
+
+func TestCrc32cCombine(t *testing.T) {
+	data := []byte(RandomString(1000))
+	for _, split := range []int{0, 1, 7, 500, 999, 1000} {
+		a := crc32.Checksum(data[:split], castagnoliTable)
+		b := crc32.Checksum(data[split:], castagnoliTable)
+		if combined := crc32cCombine(a, b, int64(len(data)-split)); combined != crc32.Checksum(data, castagnoliTable) {
+			t.Fatalf("Combining at %d got %08x", split, combined)
+		}
+	}
+}
+
+func TestStreamCrc32c(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 1000000
+
+	data := RandomString(1000)
+	crc := crc32.Checksum([]byte(data), castagnoliTable)
+	actual, err := io.ReadAll(GetDownloadStream(context.Background(), crc32cDownloader{TestDownloader{data, true, false}, crc}, 300, 2))
+	if err != nil || string(actual) != data {
+		t.Fatalf("Expected a matching download to succeed, got %v", err)
+	}
+
+	_, err = io.ReadAll(GetDownloadStream(context.Background(), crc32cDownloader{TestDownloader{data, true, false}, crc ^ 1}, 300, 2))
+	if !errors.Is(err, syscall.EBADMSG) {
+		t.Fatalf("Expected EBADMSG for a CRC32C mismatch, got %v", err)
+	}
+
+	opts.NoCrc32c = true
+	if _, err := io.ReadAll(GetDownloadStream(context.Background(), crc32cDownloader{TestDownloader{data, true, false}, crc ^ 1}, 300, 2)); err != nil {
+		t.Fatalf("Expected --no-crc32c to skip verification, got %v", err)
+	}
+}
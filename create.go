@@ -0,0 +1,588 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4"
+)
+
+// `fastar create DIRECTORY URL` is the reverse of a download: it tars
+// DIRECTORY, compresses it by the extension of URL (or --compression) and
+// uploads it while it's being written, so nothing is staged on local disk.
+//
+// s3:// and gs:// URLs are uploaded in parts of --chunk-size by up to
+// --download-workers goroutines in parallel, as S3 multipart uploads and
+// as GCS temporary objects composed into the archive at the end. Other
+// http(s) URLs get a single streaming PUT, which can't be retried since
+// the archive isn't kept around. Anything else is a local path, or - for
+// stdout.
+//
+// Hard links are stored as separate copies, and sockets are skipped.
+
+// GCS composes at most 32 objects at a time, into objects of at most 1024
+// components.
+const (
+	gcsMaxComposeSources = 32
+	gcsMaxComponentCount = 1024
+)
+
+// Destination of a multipart upload. Parts are numbered from 1 and uploaded
+// concurrently, in any order. Failures are fatal, after cleaning up what
+// was uploaded so far.
+type partUploader interface {
+	// Most parts the destination can take.
+	maxParts() int
+
+	uploadPart(number int, buf []byte)
+
+	// Assembles the parts into the archive once all are uploaded.
+	complete()
+
+	// Drops the parts uploaded so far when creating the archive fails
+	// before complete(), best effort.
+	abort()
+}
+
+func CreateArchive(dir, rawUrl string) {
+	if info, err := os.Stat(dir); err != nil {
+		fatal("Failed to read directory to archive: ", err.Error())
+	} else if !info.IsDir() {
+		fatal(dir, " is not a directory")
+	}
+	start := time.Now()
+	compressionType := createCompressionType(rawUrl)
+	log.Printf("Creating %s archive of %s at %s\n", compressionType, dir, rawUrl)
+	emitEvent("start", map[string]interface{}{"url": rawUrl, "directory": dir, "compression": compressionType.String()})
+
+	sink := openArchiveSink(rawUrl)
+	files, bytesRead, written := writeArchive(dir, sink, compressionType, start)
+	elapsed := time.Since(start)
+	log.Printf("Created %s with %d entries, %.3fMB read and %.3fMB written in %s\n", rawUrl, files, float64(bytesRead)/1e6, float64(written)/1e6, elapsed.Round(time.Millisecond))
+	emitEvent("created", map[string]interface{}{
+		"url":           rawUrl,
+		"entries":       files,
+		"bytes_read":    bytesRead,
+		"bytes_written": written,
+		"millis":        elapsed.Milliseconds(),
+	})
+}
+
+// Writes the compressed tarball of dir to sink and closes it. Returns the
+// number of entries, bytes of files read and bytes written. Any failure
+// aborts a multipart upload first, S3 keeps billing for the parts and GCS
+// keeps the temporary objects otherwise.
+func writeArchive(dir string, sink io.WriteCloser, compressionType CompressionType, start time.Time) (int, int64, int64) {
+	abort := func(args ...interface{}) {
+		if parts, ok := sink.(*partWriter); ok {
+			parts.abort()
+		}
+		fatal(args...)
+	}
+	counter := &countingWriter{writer: sink}
+	compressor, err := compressArchive(counter, compressionType)
+	if err != nil {
+		abort("Failed to start compression: ", err.Error())
+	}
+	files, bytesRead, err := writeTar(compressor, dir, func() {
+		log.Printf("Archived %.3fMB, average output speed %.3fMBps\n", float64(atomic.LoadInt64(&counter.count))/1e6, float64(atomic.LoadInt64(&counter.count))/1e6/time.Since(start).Seconds())
+	})
+	if err != nil {
+		abort("Failed to archive directory: ", err.Error())
+	}
+	if err := compressor.Close(); err != nil {
+		abort("Failed to compress archive: ", err.Error())
+	}
+	if err := sink.Close(); err != nil {
+		abort("Failed to upload archive: ", err.Error())
+	}
+	return files, bytesRead, atomic.LoadInt64(&counter.count)
+}
+
+// Picks the compression of the archive at rawUrl from --compression or its
+// file extension, raw tar without a known one.
+func createCompressionType(rawUrl string) CompressionType {
+	compressionType := Tar
+	if opts.Compression != "" {
+		compressionType = parseCompressionType(opts.Compression)
+	} else {
+		filename := rawUrl
+		if parsed, err := url.Parse(rawUrl); err == nil && parsed.Scheme != "" {
+			filename = parsed.Path
+		}
+		for _, extension := range formatExtensions {
+			if strings.HasSuffix(path.Base(filename), extension.suffix) {
+				compressionType = extension.format
+				break
+			}
+		}
+	}
+	switch compressionType {
+	case Tar, Gzip, Lz4, Zstd:
+		return compressionType
+	}
+	fatalf("fastar create can't write %s, only tar, gzip, lz4 and zstd", compressionType)
+	return Tar
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func compressArchive(writer io.Writer, compressionType CompressionType) (io.WriteCloser, error) {
+	switch compressionType {
+	case Gzip:
+		return pgzip.NewWriter(writer), nil
+	case Lz4:
+		return lz4.NewWriter(writer), nil
+	case Zstd:
+		return newZstdWriter(writer)
+	}
+	return nopWriteCloser{writer}, nil
+}
+
+// There's no zstd encoder in the standard library either, so the archive is
+// piped through the zstd binary.
+type zstdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newZstdWriter(writer io.Writer) (io.WriteCloser, error) {
+	cmd := exec.Command("zstd", "-c", "-q", "-T0")
+	cmd.Stdout = writer
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("creating zstd archives needs zstd in PATH")
+	} else if err != nil {
+		return nil, err
+	}
+	return zstdWriter{stdin, cmd}, nil
+}
+
+func (z zstdWriter) Close() error {
+	if err := z.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return z.cmd.Wait()
+}
+
+// Writes the contents of dir to writer as a tar stream, calling logProgress
+// every 30 seconds. Returns the number of entries and bytes of files read.
+func writeTar(writer io.Writer, dir string, logProgress func()) (int, int64, error) {
+	tarWriter := tar.NewWriter(writer)
+	var entries int
+	var bytesRead int64
+	lastLog := time.Now()
+	err := filepath.WalkDir(dir, func(localPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, localPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var linkName string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkName, err = os.Readlink(localPath); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, linkName)
+		if err != nil {
+			log.Printf("Skipping %s: %s\n", localPath, err.Error())
+			emitEvent("entry_skipped", map[string]interface{}{"path": localPath, "reason": err.Error()})
+			return nil
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			file, err := os.Open(localPath)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(tarWriter, file, header.Size)
+			file.Close()
+			if err == io.EOF {
+				return fmt.Errorf("%s shrank while it was archived", localPath)
+			} else if err != nil {
+				return err
+			}
+			bytesRead += header.Size
+		}
+		entries++
+		if time.Since(lastLog) >= 30*time.Second {
+			logProgress()
+			lastLog = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return 0, 0, err
+	}
+	return entries, bytesRead, nil
+}
+
+// Returns where the archive for rawUrl is written to.
+func openArchiveSink(rawUrl string) io.WriteCloser {
+	if rawUrl == "-" {
+		return nopWriteCloser{os.Stdout}
+	}
+	netTransport := sharedNetTransport()
+	httpClient := http.Client{Transport: netTransport}
+	switch {
+	case strings.HasPrefix(rawUrl, "s3://"):
+		bucket, key := getBucketAndKey(rawUrl)
+		return newPartWriter(newS3PartUploader(S3Uploader{bucket, newS3Client(&httpClient, opts.UseFips)}, key))
+	case strings.HasPrefix(rawUrl, "gs://"):
+		bucket, object := getBucketAndObject(rawUrl)
+		return newPartWriter(newGCSPartUploader(GCSUploader{bucket, newGCSClient(netTransport)}, object))
+	case strings.HasPrefix(rawUrl, "http://") || strings.HasPrefix(rawUrl, "https://"):
+		return newHttpPutWriter(&httpClient, rawUrl)
+	}
+	file, err := os.Create(strings.TrimPrefix(rawUrl, "file://"))
+	if err != nil {
+		fatal("Failed to create archive: ", err.Error())
+	}
+	return file
+}
+
+// Cuts the archive into parts of --chunk-size and hands them to a
+// partUploader, with up to --download-workers uploads in flight. Memory
+// use is bounded by one part per worker plus the one being filled.
+type partWriter struct {
+	uploader partUploader
+	partSize int64
+	buf      []byte
+	parts    int
+	tokens   chan bool
+	free     chan []byte
+	wg       sync.WaitGroup
+}
+
+func newPartWriter(uploader partUploader) *partWriter {
+	partSize := opts.ChunkSize
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	numWorkers := opts.NumWorkers
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	writer := &partWriter{
+		uploader: uploader,
+		partSize: partSize,
+		tokens:   make(chan bool, numWorkers),
+		free:     make(chan []byte, numWorkers),
+	}
+	for i := 0; i < numWorkers; i++ {
+		writer.tokens <- true
+	}
+	return writer
+}
+
+func (w *partWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if w.buf == nil {
+			select {
+			case w.buf = <-w.free:
+				w.buf = w.buf[:0]
+			default:
+				w.buf = make([]byte, 0, w.partSize)
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		if int64(len(w.buf)) == w.partSize {
+			w.flush()
+		}
+	}
+	return written, nil
+}
+
+func (w *partWriter) flush() {
+	w.parts++
+	if w.parts > w.uploader.maxParts() {
+		w.abort()
+		fatalf("Archive needs more than %d parts, raise --chunk-size", w.uploader.maxParts())
+	}
+	<-w.tokens
+	w.wg.Add(1)
+	go func(number int, buf []byte) {
+		defer w.wg.Done()
+		w.uploader.uploadPart(number, buf)
+		emitEvent("part_uploaded", map[string]interface{}{"part": number, "size": len(buf)})
+		select {
+		case w.free <- buf:
+		default:
+		}
+		w.tokens <- true
+	}(w.parts, w.buf)
+	w.buf = nil
+}
+
+// Uploads the last part and waits for the upload to be assembled. An empty
+// archive is still uploaded as one empty part.
+func (w *partWriter) Close() error {
+	if len(w.buf) > 0 || w.parts == 0 {
+		w.flush()
+	}
+	w.wg.Wait()
+	w.uploader.complete()
+	return nil
+}
+
+// Waits for the uploads in flight, then drops every part uploaded.
+func (w *partWriter) abort() {
+	w.wg.Wait()
+	w.uploader.abort()
+}
+
+type s3PartUploader struct {
+	S3Uploader
+	key      string
+	uploadId *string
+	mutex    sync.Mutex
+	parts    []types.CompletedPart
+}
+
+func newS3PartUploader(uploader S3Uploader, key string) *s3PartUploader {
+	upload, err := uploader.client.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(uploader.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		fatalf("Failed to start multipart upload of s3://%s/%s: %s", uploader.bucket, key, err.Error())
+	}
+	return &s3PartUploader{S3Uploader: uploader, key: key, uploadId: upload.UploadId}
+}
+
+func (u *s3PartUploader) maxParts() int {
+	return s3MaxPartCount
+}
+
+func (u *s3PartUploader) uploadPart(number int, buf []byte) {
+	resp, err := u.client.UploadPart(context.Background(), &s3.UploadPartInput{
+		Bucket:        aws.String(u.bucket),
+		Key:           aws.String(u.key),
+		UploadId:      u.uploadId,
+		PartNumber:    aws.Int32(int32(number)),
+		Body:          bytes.NewReader(buf),
+		ContentLength: aws.Int64(int64(len(buf))),
+	})
+	if err != nil {
+		u.abort()
+		fatalf("Failed to upload part %d of s3://%s/%s: %s", number, u.bucket, u.key, err.Error())
+	}
+	u.mutex.Lock()
+	u.parts = append(u.parts, types.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int32(int32(number))})
+	u.mutex.Unlock()
+}
+
+func (u *s3PartUploader) complete() {
+	sort.Slice(u.parts, func(i, j int) bool { return *u.parts[i].PartNumber < *u.parts[j].PartNumber })
+	_, err := u.client.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.bucket),
+		Key:             aws.String(u.key),
+		UploadId:        u.uploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: u.parts},
+	})
+	if err != nil {
+		u.abort()
+		fatalf("Failed to complete multipart upload of s3://%s/%s: %s", u.bucket, u.key, err.Error())
+	}
+}
+
+// Drops the parts uploaded so far, S3 keeps billing for them otherwise.
+func (u *s3PartUploader) abort() {
+	u.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(u.key),
+		UploadId: u.uploadId,
+	})
+}
+
+// Parts are uploaded as temporary objects next to the archive, composed in
+// rounds of up to 32 and deleted once the archive is complete.
+type gcsPartUploader struct {
+	GCSUploader
+	object     string
+	tempPrefix string
+	mutex      sync.Mutex
+	parts      map[int]string
+	temps      []string
+}
+
+func newGCSPartUploader(uploader GCSUploader, object string) *gcsPartUploader {
+	return &gcsPartUploader{
+		GCSUploader: uploader,
+		object:      object,
+		tempPrefix:  fmt.Sprintf("%s.fastar-parts-%d/", object, time.Now().UnixNano()),
+		parts:       map[int]string{},
+	}
+}
+
+func (u *gcsPartUploader) maxParts() int {
+	return gcsMaxComponentCount
+}
+
+func (u *gcsPartUploader) uploadPart(number int, buf []byte) {
+	name := fmt.Sprintf("%spart-%05d", u.tempPrefix, number)
+	writer := u.client.Bucket(u.bucket).Object(name).NewWriter(context.Background())
+	_, err := writer.Write(buf)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		u.cleanup()
+		fatalf("Failed to upload part %d of gs://%s/%s: %s", number, u.bucket, u.object, err.Error())
+	}
+	u.mutex.Lock()
+	u.parts[number] = name
+	u.temps = append(u.temps, name)
+	u.mutex.Unlock()
+}
+
+func (u *gcsPartUploader) complete() {
+	names := make([]string, 0, len(u.parts))
+	for number := 1; number <= len(u.parts); number++ {
+		names = append(names, u.parts[number])
+	}
+	for round := 0; len(names) > gcsMaxComposeSources; round++ {
+		var composed []string
+		for i := 0; i < len(names); i += gcsMaxComposeSources {
+			end := i + gcsMaxComposeSources
+			if end > len(names) {
+				end = len(names)
+			}
+			name := fmt.Sprintf("%scompose-%d-%05d", u.tempPrefix, round, i/gcsMaxComposeSources)
+			u.temps = append(u.temps, name)
+			u.compose(name, names[i:end])
+			composed = append(composed, name)
+		}
+		names = composed
+	}
+	u.compose(u.object, names)
+	u.cleanup()
+}
+
+func (u *gcsPartUploader) abort() {
+	u.cleanup()
+}
+
+func (u *gcsPartUploader) compose(name string, sources []string) {
+	bucket := u.client.Bucket(u.bucket)
+	var objects []*storage.ObjectHandle
+	for _, source := range sources {
+		objects = append(objects, bucket.Object(source))
+	}
+	if _, err := bucket.Object(name).ComposerFrom(objects...).Run(context.Background()); err != nil {
+		u.cleanup()
+		fatalf("Failed to compose gs://%s/%s: %s", u.bucket, u.object, err.Error())
+	}
+}
+
+// Deletes the temporary objects, best effort.
+func (u *gcsPartUploader) cleanup() {
+	u.mutex.Lock()
+	temps := append([]string(nil), u.temps...)
+	u.mutex.Unlock()
+	for _, name := range temps {
+		if err := u.client.Bucket(u.bucket).Object(name).Delete(context.Background()); err != nil {
+			log.Printf("Failed to delete temporary object gs://%s/%s: %s\n", u.bucket, name, err.Error())
+		}
+	}
+}
+
+// Streams the archive as the body of a single PUT.
+type httpPutWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func newHttpPutWriter(client *http.Client, rawUrl string) httpPutWriter {
+	reader, writer := io.Pipe()
+	req, err := http.NewRequest(http.MethodPut, rawUrl, reader)
+	if err != nil {
+		fatal("Failed creating PUT request: ", err.Error())
+	}
+	for key, value := range opts.Headers {
+		req.Header.Add(key, value)
+	}
+	applyCommandHeaders(req)
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("server answered %s", resp.Status)
+			}
+		}
+		// Fails writes still in flight instead of blocking them forever.
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	return httpPutWriter{writer, done}
+}
+
+func (h httpPutWriter) Close() error {
+	h.PipeWriter.Close()
+	return <-h.done
+}
@@ -0,0 +1,193 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryPartUploader struct {
+	mutex     sync.Mutex
+	parts     map[int][]byte
+	completed bool
+	aborted   bool
+	// Most parts, 100 if 0.
+	limit int
+}
+
+func (u *memoryPartUploader) maxParts() int {
+	if u.limit > 0 {
+		return u.limit
+	}
+	return 100
+}
+
+func (u *memoryPartUploader) uploadPart(number int, buf []byte) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.parts[number] = append([]byte(nil), buf...)
+}
+
+func (u *memoryPartUploader) complete() {
+	u.completed = true
+}
+
+func (u *memoryPartUploader) abort() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.parts = map[int][]byte{}
+	u.aborted = true
+}
+
+// Archives dir into uploader through a library call, returning how it
+// failed.
+func writeArchiveParts(t *testing.T, dir string, uploader *memoryPartUploader) error {
+	options := DefaultOptions()
+	options.ChunkSize = 0
+	options.NumWorkers = 3
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	defer endCall()
+	runOwned(func() { writeArchive(dir, newPartWriter(uploader), Tar, time.Now()) })
+	return callError()
+}
+
+// Fills dir with enough data for a couple of parts.
+func writePartsWorth(t *testing.T, dir string) {
+	if err := os.WriteFile(filepath.Join(dir, "a-big"), []byte(RandomString(2*s3MinPartSize+1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeArchiveSource(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "file"), []byte(strings.Repeat(RandomString(1000), 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/file", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Lists the entries of the tar stream with the contents of regular files.
+func readTarEntries(t *testing.T, stream io.Reader) map[string]string {
+	entries := map[string]string{}
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tarReader)
+		entries[header.Name] = string(header.Typeflag) + header.Linkname + string(data)
+	}
+}
+
+func TestCreateArchiveRoundTrip(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	dir := makeArchiveSource(t)
+	data, _ := os.ReadFile(filepath.Join(dir, "sub", "file"))
+
+	for _, name := range []string{"out.tar", "out.tar.gz", "out.tar.lz4"} {
+		archive := filepath.Join(t.TempDir(), name)
+		CreateArchive(dir, archive)
+		file, err := os.Open(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, layers := unwrapStream(file, name)
+		entries := readTarEntries(t, stream)
+		file.Close()
+		if len(entries) != 4 || entries["sub/file"] != "0"+string(data) || entries["link"] != "2sub/file" || entries["sub/empty/"] != "5" {
+			t.Fatalf("Unexpected entries in %s (%v): %q", name, layers, entries)
+		}
+	}
+}
+
+func TestPartWriter(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.ChunkSize = 0
+	opts.NumWorkers = 3
+
+	uploader := &memoryPartUploader{parts: map[int][]byte{}}
+	writer := newPartWriter(uploader)
+	data := []byte(RandomString(3*s3MinPartSize + 1000))
+	for start := 0; start < len(data); start += 777777 {
+		end := start + 777777
+		if end > len(data) {
+			end = len(data)
+		}
+		writer.Write(data[start:end])
+	}
+	writer.Close()
+	if !uploader.completed || len(uploader.parts) != 4 {
+		t.Fatalf("Expected 4 parts to be completed, got %d", len(uploader.parts))
+	}
+	var joined []byte
+	for number := 1; number <= 4; number++ {
+		joined = append(joined, uploader.parts[number]...)
+	}
+	if !bytes.Equal(joined, data) || len(uploader.parts[4]) != 1000 {
+		t.Fatal("Parts don't add up to the archive")
+	}
+
+	uploader = &memoryPartUploader{parts: map[int][]byte{}}
+	newPartWriter(uploader).Close()
+	if len(uploader.parts) != 1 || len(uploader.parts[1]) != 0 {
+		t.Fatalf("Expected an empty archive to be a single empty part, got %d parts", len(uploader.parts))
+	}
+}
+
+func TestPartWriterTooManyParts(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	dir := t.TempDir()
+	writePartsWorth(t, dir)
+
+	uploader := &memoryPartUploader{parts: map[int][]byte{}, limit: 1}
+	if err := writeArchiveParts(t, dir, uploader); err == nil || !strings.Contains(err.Error(), "more than 1 parts") {
+		t.Fatalf("Expected the archive to need too many parts, got %v", err)
+	}
+	if !uploader.aborted || uploader.completed || len(uploader.parts) != 0 {
+		t.Fatalf("Expected the upload to be aborted, %d parts are left", len(uploader.parts))
+	}
+}
+
+func TestCreateArchiveHttpPut(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	dir := makeArchiveSource(t)
+
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		received, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	CreateArchive(dir, server.URL+"/out.tar")
+	if entries := readTarEntries(t, bytes.NewReader(received)); len(entries) != 4 {
+		t.Fatalf("Expected 4 entries to be uploaded, got %q", entries)
+	}
+}
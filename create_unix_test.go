@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCreateArchiveAbortsParts(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	dir := t.TempDir()
+	writePartsWorth(t, dir)
+	// Nested deeper than PATH_MAX, so walking into it fails even as root.
+	// Created relative to each parent since the full path can't be used.
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "b-" + strings.Repeat("d", 200)
+	for depth := 0; depth < 25; depth++ {
+		if err := unix.Mkdirat(fd, name, 0755); err != nil {
+			t.Fatal(err)
+		}
+		child, err := unix.Openat(fd, name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		unix.Close(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd = child
+	}
+	unix.Close(fd)
+
+	uploader := &memoryPartUploader{parts: map[int][]byte{}}
+	err = writeArchiveParts(t, dir, uploader)
+	if err == nil || !strings.Contains(err.Error(), syscall.ENAMETOOLONG.Error()) {
+		t.Fatalf("Expected walking %s to fail, got %v", filepath.Join(dir, name, "..."), err)
+	}
+	if !uploader.aborted || uploader.completed || len(uploader.parts) != 0 {
+		t.Fatalf("Expected the upload to be aborted, %d parts are left", len(uploader.parts))
+	}
+}
@@ -0,0 +1,146 @@
+package fastar
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// --credential-helper runs a command for the credentials of each origin,
+// like kubectl's exec plugins, so fastar doesn't need to know every auth
+// scheme. The command gets FASTAR_URL, FASTAR_ORIGIN and FASTAR_EXEC_INFO,
+// a JSON ExecCredential with the same in its spec, and prints an
+// ExecCredential whose status has a bearer token, headers, or both:
+//
+//	{"apiVersion": "client.authentication.k8s.io/v1", "kind": "ExecCredential",
+//	 "status": {"token": "abc", "headers": {"X-Tenant": "ml"},
+//	            "expirationTimestamp": "2024-05-01T12:00:00Z"}}
+//
+// Credentials are cached per origin until shortly before they expire, or
+// until the origin answers 401 or 403.
+type execCredential struct {
+	ApiVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Spec       *execCredentialSpec   `json:"spec,omitempty"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialSpec struct {
+	Url    string `json:"url"`
+	Origin string `json:"origin"`
+}
+
+type execCredentialStatus struct {
+	Token               string            `json:"token"`
+	Headers             map[string]string `json:"headers"`
+	ExpirationTimestamp *time.Time        `json:"expirationTimestamp"`
+}
+
+// Credentials expiring within this are fetched again before a request
+// rather than sent and refused.
+const credentialExpirySkew = 30 * time.Second
+
+type originCredential struct {
+	header  http.Header
+	expires time.Time
+	// Counts runs for the origin, like commandHeaders.generation.
+	generation int64
+}
+
+var helperCredentials struct {
+	mutex   sync.Mutex
+	origins map[string]*originCredential
+}
+
+// Parses what --credential-helper printed.
+func parseExecCredential(output []byte) (http.Header, time.Time, error) {
+	var credential execCredential
+	if err := json.Unmarshal(output, &credential); err != nil {
+		return nil, time.Time{}, err
+	}
+	if credential.Kind != "ExecCredential" || credential.Status == nil {
+		return nil, time.Time{}, fmt.Errorf("expected an ExecCredential with a status")
+	}
+	status := credential.Status
+	if status.Token == "" && len(status.Headers) == 0 {
+		return nil, time.Time{}, fmt.Errorf("the status has neither a token nor headers")
+	}
+	header := http.Header{}
+	if status.Token != "" {
+		header.Set("Authorization", "Bearer "+status.Token)
+	}
+	for name, value := range status.Headers {
+		header.Set(name, value)
+	}
+	var expires time.Time
+	if status.ExpirationTimestamp != nil {
+		expires = *status.ExpirationTimestamp
+	}
+	return header, expires, nil
+}
+
+// Runs --credential-helper for url. Must be called with the mutex held.
+func runCredentialHelper(url string) *originCredential {
+	origin := originKey(url)
+	info, _ := json.Marshal(execCredential{
+		ApiVersion: "client.authentication.k8s.io/v1",
+		Kind:       "ExecCredential",
+		Spec:       &execCredentialSpec{url, origin},
+	})
+	cmd := shellCommand(opts.CredHelper)
+	cmd.Env = append(os.Environ(), "FASTAR_URL="+url, "FASTAR_ORIGIN="+origin, "FASTAR_EXEC_INFO="+string(info))
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		fatal("--credential-helper failed: ", err.Error())
+	}
+	header, expires, err := parseExecCredential(output)
+	if err != nil {
+		fatal("Failed to parse --credential-helper output: ", err.Error())
+	}
+	if helperCredentials.origins == nil {
+		helperCredentials.origins = map[string]*originCredential{}
+	}
+	credential := helperCredentials.origins[origin]
+	if credential == nil {
+		credential = &originCredential{}
+		helperCredentials.origins[origin] = credential
+	} else {
+		log.Println("Refreshed credentials for", origin, "with --credential-helper")
+		emitEvent("credentials_refreshed", map[string]interface{}{"origin": origin, "generation": credential.generation + 1})
+	}
+	credential.header = header
+	credential.expires = expires
+	credential.generation++
+	return credential
+}
+
+// Sets the credentials of req's origin, running --credential-helper first
+// if there are none yet or they're about to expire. Returns their
+// generation to pass to refreshCredentials.
+func applyCredentials(req *http.Request) int64 {
+	helperCredentials.mutex.Lock()
+	defer helperCredentials.mutex.Unlock()
+	credential := helperCredentials.origins[originKey(req.URL.String())]
+	if credential == nil || (!credential.expires.IsZero() && time.Until(credential.expires) < credentialExpirySkew) {
+		credential = runCredentialHelper(req.URL.String())
+	}
+	for name, values := range credential.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	return credential.generation
+}
+
+// Runs --credential-helper again after a request sent with the credentials
+// of generation was refused, unless another request already did.
+func refreshCredentials(req *http.Request, generation int64) {
+	helperCredentials.mutex.Lock()
+	defer helperCredentials.mutex.Unlock()
+	if credential := helperCredentials.origins[originKey(req.URL.String())]; credential == nil || credential.generation == generation {
+		runCredentialHelper(req.URL.String())
+	}
+}
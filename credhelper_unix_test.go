@@ -0,0 +1,79 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseExecCredential(t *testing.T) {
+	header, expires, err := parseExecCredential([]byte(`{"apiVersion": "client.authentication.k8s.io/v1", "kind": "ExecCredential",
+		"status": {"token": "abc", "headers": {"x-tenant": "ml"}, "expirationTimestamp": "2024-05-01T12:00:00Z"}}`))
+	if err != nil || header.Get("Authorization") != "Bearer abc" || header.Get("X-Tenant") != "ml" || !expires.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Got %v, %v, %v", header, expires, err)
+	}
+	for _, output := range []string{`{"kind": "ExecCredential"}`, `{"kind": "ExecCredential", "status": {}}`, `token`} {
+		if _, _, err := parseExecCredential([]byte(output)); err == nil {
+			t.Fatalf("Expected %s to be rejected", output)
+		}
+	}
+}
+
+func TestCredentialHelperPerOrigin(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; helperCredentials.origins = nil }()
+	opts.RetryCount = 3
+	opts.RetryWait = 0
+
+	// Each run hands out the next token for the origin it's asked about,
+	// the first origin only takes its second token and later. The second
+	// origin's token is later made to expire.
+	dir := t.TempDir()
+	opts.CredHelper = `f=` + dir + `/$(echo $FASTAR_ORIGIN | tr -c 'a-z0-9\n' _); n=$(( $(cat $f 2>/dev/null || echo 0) + 1 )); echo $n > $f
+		echo '{"kind": "ExecCredential", "status": {"token": "'$n'", "headers": {"X-Url": "'$FASTAR_URL'"}, "expirationTimestamp": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}}'`
+	handler := func(refuseFirst bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if refuseFirst && r.Header.Get("Authorization") == "Bearer 1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			io.WriteString(w, r.Header.Get("Authorization")+" "+r.Header.Get("X-Url"))
+		}
+	}
+	first := httptest.NewServer(handler(true))
+	defer first.Close()
+	second := httptest.NewServer(handler(false))
+	defer second.Close()
+
+	get := func(server *httptest.Server, path string) string {
+		downloader := HttpDownloader{Url: server.URL + path, client: server.Client()}
+		body, err := io.ReadAll(downloader.Get())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if body := get(first, "/a"); body != "Bearer 2 "+first.URL+"/a" {
+		t.Fatalf("Expected the refused request to be retried with fresh credentials, got %q", body)
+	}
+	// Credentials are cached per origin, not per URL.
+	if body := get(first, "/b"); body != "Bearer 2 "+first.URL+"/a" {
+		t.Fatalf("Expected the cached credentials, got %q", body)
+	}
+	if body := get(second, "/c"); body != "Bearer 1 "+second.URL+"/c" {
+		t.Fatalf("Expected the second origin to get its own credentials, got %q", body)
+	}
+	helperCredentials.origins[originKey(second.URL)].expires = time.Now()
+	if body := get(second, "/d"); body != "Bearer 2 "+second.URL+"/d" {
+		t.Fatalf("Expected expired credentials to be fetched again, got %q", body)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 2 {
+		t.Fatalf("Expected the helper to run for 2 origins, got %v", matches)
+	}
+}
@@ -0,0 +1,89 @@
+package fastar
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Streams the decompressed image onto a raw block device, replacing
+// `fastar -O ... | dd of=/dev/... oflag=direct bs=...`.
+//
+// Writes bypass the page cache with O_DIRECT so provisioning a large image
+// doesn't evict everything else from memory. Direct I/O has to be a multiple
+// of the device's logical block size, so if the image doesn't end on a block
+// boundary the tail is written after switching back to buffered I/O. The
+// device is fsynced before returning.
+func WriteToDevice(stream io.Reader, path string, writeSize int) {
+	info, err := os.Stat(path)
+	if err != nil {
+		fatal("Failed to stat output device: ", err.Error())
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		log.Printf("Warning: %s is not a block device\n", path)
+	}
+
+	direct := true
+	device, err := openDirect(path, os.O_WRONLY, 0)
+	if errors.Is(err, syscall.EINVAL) {
+		// Some filesystems (e.g. tmpfs) don't support O_DIRECT.
+		log.Printf("%s doesn't support O_DIRECT, falling back to buffered writes\n", path)
+		direct = false
+		device, err = os.OpenFile(path, os.O_WRONLY, 0)
+	}
+	if err != nil {
+		fatal("Failed to open output device: ", err.Error())
+	}
+	defer device.Close()
+
+	blockSize := 512
+	if info.Mode()&os.ModeDevice != 0 {
+		if blockSize, err = unix.IoctlGetInt(int(device.Fd()), unix.BLKSSZGET); err != nil {
+			fatal("Failed to get logical block size of output device: ", err.Error())
+		}
+	}
+	if writeSize <= 0 || writeSize%blockSize != 0 {
+		fatalf("Device write size %d must be a multiple of the logical block size %d", writeSize, blockSize)
+	}
+	log.Printf("Writing to %s in %d byte writes (block size %d, O_DIRECT %t)\n", path, writeSize, blockSize, direct)
+
+	start := time.Now()
+	buf := alignedBuffer(writeSize, directIoAlignment)
+	var written int64
+	for {
+		n, err := io.ReadFull(stream, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			fatal("Failed to read download stream: ", err.Error())
+		}
+		if n == 0 {
+			break
+		}
+		if direct && n%blockSize != 0 {
+			if err := disableDirect(device); err != nil {
+				fatal("Failed to disable O_DIRECT for the final write: ", err.Error())
+			}
+			direct = false
+		}
+		if _, err := device.Write(buf[:n]); err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				log.Printf("Image doesn't fit on %s, ran out of space after %d bytes\n", path, written)
+				exit(ErrDiskFull)
+			}
+			fatal("Failed to write to output device: ", err.Error())
+		}
+		written += int64(n)
+		if n < len(buf) {
+			break
+		}
+	}
+	if err := device.Sync(); err != nil {
+		fatal("Failed to sync output device: ", err.Error())
+	}
+	log.Printf("Wrote %d bytes to %s in %s\n", written, path, time.Since(start))
+	emitEvent("device_written", map[string]interface{}{"device": path, "bytes": written})
+}
@@ -0,0 +1,27 @@
+package fastar
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteToDevice(t *testing.T) {
+	for _, size := range []int{0, 4096, 10000, 3*8192 + 1} {
+		data := []byte(RandomString(int64(size)))
+		target := filepath.Join(t.TempDir(), "device")
+		// Devices have a fixed size, older contents past the image stay.
+		if err := os.WriteFile(target, bytes.Repeat([]byte{'x'}, size+100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		WriteToDevice(bytes.NewReader(data), target, 8192)
+		written, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written[:size], data) || len(written) != size+100 {
+			t.Fatalf("Device contents don't match for size %d", size)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package fastar
+
+import "io"
+
+// Raw block device writes rely on O_DIRECT and Linux ioctls.
+func WriteToDevice(stream io.Reader, path string, writeSize int) {
+	fatal("--output-device is only supported on Linux")
+}
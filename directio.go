@@ -0,0 +1,112 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// O_DIRECT needs buffers aligned to the logical block size, page alignment
+// covers every block size in practice.
+const directIoAlignment = 4096
+
+// Smaller files are always written through the page cache with
+// --direct-io, bypassing it costs more than it saves for them.
+const directIoMinSize = 1 << 20
+
+// Set once the target filesystem turned out not to support O_DIRECT or
+// fallocate, after which extraction stops trying.
+var directIoUnsupported, preallocateUnsupported atomic.Bool
+
+func alignedBuffer(size, alignment int) []byte {
+	buf := make([]byte, size+alignment)
+	offset := 0
+	if remainder := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(alignment)); remainder != 0 {
+		offset = alignment - remainder
+	}
+	return buf[offset : offset+size]
+}
+
+func isAligned(buf []byte) bool {
+	return uintptr(unsafe.Pointer(&buf[0]))%directIoAlignment == 0
+}
+
+// Opens filename for writing, with O_DIRECT if direct is set and the
+// filesystem supports it. Returns whether the file bypasses the page cache.
+func openFileForWrite(filename string, direct bool, mode os.FileMode) (*os.File, bool, error) {
+	flag := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	if !opts.UnsafePaths {
+		flag |= openNoFollow
+	}
+	if direct && !directIoUnsupported.Load() {
+		file, err := openTrackedFile(func() (*os.File, error) {
+			return openDirect(filename, flag, mode)
+		})
+		if err == nil {
+			return file, true, nil
+		}
+		if !errors.Is(err, syscall.EINVAL) {
+			return nil, false, err
+		}
+		if !directIoUnsupported.Swap(true) {
+			log.Printf("%s doesn't support O_DIRECT, writing through the page cache\n", opts.OutputDir)
+		}
+	}
+	file, err := openTrackedFile(func() (*os.File, error) {
+		return os.OpenFile(filename, flag, mode)
+	})
+	return file, false, err
+}
+
+// Allocates the whole file before writing it with --preallocate, so the
+// filesystem can lay it out contiguously and writes don't have to allocate
+// blocks as they go.
+func preallocate(file *os.File, size int64) {
+	if preallocateUnsupported.Load() {
+		return
+	}
+	if err := preallocateFile(file, size); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+			if !preallocateUnsupported.Swap(true) {
+				log.Printf("%s doesn't support fallocate, not preallocating files\n", opts.OutputDir)
+			}
+			return
+		}
+		log.Printf("Failed to preallocate %s: %s\n", file.Name(), err.Error())
+	}
+}
+
+// Writes buf to a file opened with O_DIRECT a slice at a time, through an
+// aligned buffer if buf itself isn't aligned. The tail that doesn't fill a
+// whole block is written after switching back to buffered I/O.
+func writeDirect(ctx context.Context, file *os.File, buf []byte) error {
+	var bounce []byte
+	for len(buf) >= directIoAlignment {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := buf[:min(int64(len(buf)), writeSlice)/directIoAlignment*directIoAlignment]
+		if !isAligned(chunk) {
+			if bounce == nil {
+				bounce = alignedBuffer(int(writeSlice)/directIoAlignment*directIoAlignment, directIoAlignment)
+			}
+			chunk = bounce[:copy(bounce, chunk)]
+		}
+		n, err := file.Write(chunk)
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if err := disableDirect(file); err != nil {
+		return err
+	}
+	return writeBuffer(ctx, file, buf)
+}
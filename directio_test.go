@@ -0,0 +1,31 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileDirect(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.DirectIo = true
+	opts.Preallocate = 1
+	opts.OutputDir = t.TempDir()
+
+	// Not a multiple of the block size, and not aligned either.
+	data := []byte(RandomString(3<<20 + 123))
+	for _, buf := range [][]byte{data, data[1:]} {
+		path := filepath.Join(opts.OutputDir, "file")
+		if !writeFile(context.Background(), path, buf, &tar.Header{Mode: 0644}) {
+			t.Fatal("Expected write to succeed")
+		}
+		if contents, err := os.ReadFile(path); err != nil || !bytes.Equal(contents, buf) {
+			t.Fatalf("File reads back differently, err %v", err)
+		}
+		os.Remove(path)
+	}
+}
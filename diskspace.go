@@ -0,0 +1,66 @@
+package fastar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// How much of a compressed archive is decompressed up front to estimate
+// its compression ratio for the disk space check.
+const spaceSampleSize = 16 << 20
+
+// Fails before extracting anything if --directory clearly can't hold the
+// archive, rather than after filling the disk. Compressed archives are
+// estimated from the ratio of the first spaceSampleSize bytes of the tar
+// stream to the download bytes it took, consumed counts the latter.
+// Returns the stream to extract from in place of stream.
+func checkDiskSpace(stream io.Reader, layers []string, consumed *atomic.Int64) io.Reader {
+	size := progressSize.Load()
+	if opts.NoSpaceCheck || size <= 0 {
+		return stream
+	}
+	free, err := freeDiskSpace(opts.OutputDir)
+	if err != nil {
+		log.Println("Not checking for free disk space: ", err.Error())
+		return stream
+	}
+	needed := size
+	if len(layers) != 1 || layers[0] != "tar" {
+		buffered := bufio.NewReaderSize(stream, spaceSampleSize)
+		sample, err := buffered.Peek(spaceSampleSize)
+		stream = buffered
+		if err == io.EOF {
+			needed = int64(len(sample))
+		} else if err != nil {
+			// Extraction runs into the same error.
+			return stream
+		} else if read := consumed.Load(); read > 0 {
+			needed = int64(float64(size) * float64(len(sample)) / float64(read))
+		}
+	}
+	log.Printf("Archive needs about %s, %s free on %s\n", formatProgressBytes(needed), formatProgressBytes(free), opts.OutputDir)
+	emitEvent("disk_space", map[string]interface{}{"needed": needed, "free": free})
+	if needed > free {
+		message := fmt.Sprintf("Not enough space on %s: the archive needs about %s but only %s is free, pass --no-space-check to extract anyway", opts.OutputDir, formatProgressBytes(needed), formatProgressBytes(free))
+		log.Println(message)
+		fail(&Error{int(ErrDiskFull), message})
+	}
+	return stream
+}
+
+// Running out of space mid-extraction removes the half written file, so
+// nothing truncated is left looking extracted, and fails saying how to go
+// on.
+func failDiskFull(filename string, err error) {
+	os.Remove(filename)
+	message := fmt.Sprintf("Ran out of space on %s writing %s: %s", opts.OutputDir, filename, err.Error())
+	if journal != nil {
+		message += ", free up space and run again with --resume to carry on"
+	}
+	log.Println(message)
+	fail(&Error{int(ErrDiskFull), message})
+}
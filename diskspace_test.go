@@ -0,0 +1,56 @@
+package fastar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	defer progressSize.Store(0)
+	options := DefaultOptions()
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	defer endCall()
+	opts.OutputDir = t.TempDir()
+	free, err := freeDiskSpace(opts.OutputDir)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	// A gzipped archive of zeros, small to download but expanding past the
+	// free space once decompressed.
+	data := strings.Repeat("\x00", 1<<20)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(data))
+	writer.Close()
+	var consumed atomic.Int64
+	consumed.Store(int64(compressed.Len()))
+	progressSize.Store(int64(compressed.Len()))
+	stream := checkDiskSpace(strings.NewReader(data), []string{"gzip"}, &consumed)
+	if extracted, _ := io.ReadAll(stream); string(extracted) != data {
+		t.Fatal("Expected the sampled stream to still return everything")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		progressSize.Store(free + 1<<30)
+		checkDiskSpace(strings.NewReader(data), []string{"tar"}, &consumed)
+	}()
+	<-done
+	if err := callError(); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("Expected an archive larger than the free space to fail, got %v", err)
+	}
+}
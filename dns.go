@@ -0,0 +1,133 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name resolution for every connection fastar dials itself. --resolve pins
+// HOST:PORT to fixed addresses like curl's option of the same name, e.g. to
+// keep talking to known object store VIPs through a DNS incident. Other
+// lookups are cached for --dns-cache-ttl seconds, so the many connections
+// chunk requests open don't each hit the resolver.
+type resolveOverride struct {
+	host  string
+	port  string // "*" matches any port
+	addrs []string
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+var dnsCacheMutex sync.Mutex
+var dnsCache = map[string]dnsCacheEntry{}
+
+// Swapped out by tests.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// Parses --resolve values of the form HOST:PORT:ADDR[,ADDR]..., where IPv6
+// addresses may be bracketed and PORT may be * for any port.
+func parseResolveOverrides(values []string) ([]resolveOverride, error) {
+	var overrides []resolveOverride
+	for _, value := range values {
+		host, rest, ok := strings.Cut(value, ":")
+		port, addrList, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 || host == "" || port == "" || addrList == "" {
+			return nil, fmt.Errorf("invalid --resolve %q, expected HOST:PORT:ADDR[,ADDR]", value)
+		}
+		override := resolveOverride{host: strings.ToLower(host), port: port}
+		for _, addr := range strings.Split(addrList, ",") {
+			addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+			if net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("invalid address %q in --resolve %q", addr, value)
+			}
+			override.addrs = append(override.addrs, addr)
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, nil
+}
+
+// Returns a DialContext that applies overrides and the DNS cache, trying
+// each address of a host in turn until one connects.
+func newDialContext(dialer *net.Dialer, overrides []resolveOverride) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := resolve(ctx, host, port, overrides)
+		if err != nil {
+			return nil, err
+		}
+		var dialErr error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, dialErr
+	}
+}
+
+func resolve(ctx context.Context, host, port string, overrides []resolveOverride) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	name := strings.ToLower(host)
+	for _, override := range overrides {
+		if override.host == name && (override.port == port || override.port == "*") {
+			return override.addrs, nil
+		}
+	}
+	ttl := time.Duration(opts.DnsCacheTtl) * time.Second
+	if ttl > 0 {
+		dnsCacheMutex.Lock()
+		entry, ok := dnsCache[name]
+		dnsCacheMutex.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			return entry.addrs, nil
+		}
+	}
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+	if ttl > 0 {
+		dnsCacheMutex.Lock()
+		dnsCache[name] = dnsCacheEntry{addrs, time.Now().Add(ttl)}
+		dnsCacheMutex.Unlock()
+	}
+	return addrs, nil
+}
+
+// Dials address with --connection-timeout, --resolve and the DNS cache,
+// for backends that open their own connections.
+func dial(network, address string) (net.Conn, error) {
+	return newDialer()(context.Background(), network, address)
+}
+
+func newDialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	overrides, err := parseResolveOverrides(opts.Resolve)
+	if err != nil {
+		fatal(err.Error())
+	}
+	return newDialContext(&net.Dialer{
+		Timeout: time.Duration(opts.ConnTimeout) * time.Second,
+	}, overrides)
+}
@@ -0,0 +1,81 @@
+package fastar
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseResolveOverrides(t *testing.T) {
+	overrides, err := parseResolveOverrides([]string{"Bucket.s3.amazonaws.com:443:10.0.0.5,[::1]", "example.com:*:127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []resolveOverride{
+		{"bucket.s3.amazonaws.com", "443", []string{"10.0.0.5", "::1"}},
+		{"example.com", "*", []string{"127.0.0.1"}},
+	}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Fatalf("Got %v, wanted %v", overrides, expected)
+	}
+	for _, invalid := range []string{"example.com", "example.com:443", "example.com:443:not-an-ip", ":443:10.0.0.5"} {
+		if _, err := parseResolveOverrides([]string{invalid}); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestDialWithOverridesAndCache(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	oldOpts, oldLookupHost := opts, lookupHost
+	defer func() { opts, lookupHost = oldOpts, oldLookupHost }()
+	lookups := 0
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, nil
+	}
+	opts.ConnTimeout = 1
+	opts.DnsCacheTtl = 60
+	opts.Resolve = []string{"pinned.invalid:" + port + ":192.0.2.1,127.0.0.1"}
+	dialContext := newDialer()
+
+	// The first pinned address is unreachable, the second one connects.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dialContext(ctx, "tcp", net.JoinHostPort("pinned.invalid", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if lookups != 0 {
+		t.Fatalf("Expected pinned host not to be resolved, got %d lookups", lookups)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := dialContext(ctx, "tcp", net.JoinHostPort("cached.invalid", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if lookups != 1 {
+		t.Fatalf("Expected 1 lookup with the cache, got %d", lookups)
+	}
+}
@@ -1,9 +1,11 @@
-package main
+package fastar
 
 import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"mime/multipart"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -19,7 +22,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"golang.org/x/oauth2"
-	"golang.org/x/sys/unix"
 	"google.golang.org/api/option"
 	raw "google.golang.org/api/storage/v1"
 	htransport "google.golang.org/api/transport/http"
@@ -63,73 +65,139 @@ type Downloader interface {
 	GetRanges(ranges [][]int64) (*multipart.Reader, error)
 }
 
-func GetDownloader(url string, useFips bool, useGetForSize bool) Downloader {
-	// NOTE: Only S3 + HTTP downloaders use this transport. GCS uses the default transport configured by the SDK.
-	var netTransport = &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: time.Duration(opts.ConnTimeout) * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: time.Duration(opts.ConnTimeout) * time.Second,
-	}
+func getDownloader(url string, useFips bool, useGetForSize bool) Downloader {
+	var netTransport = sharedNetTransport()
 	var httpClient = http.Client{
 		Transport: netTransport,
 	}
 
-	if strings.HasPrefix(url, "s3") {
-		cfg, err := config.LoadDefaultConfig(context.Background())
-		if err != nil {
-			log.Fatal("Failed to load s3 config: ", err)
-		}
-		client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.HTTPClient = &httpClient
-			o.RetryMaxAttempts = opts.RetryCount
-			if useFips {
-				o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
-			}
-		})
-		return S3Downloader{url, client}
+	if url == "-" {
+		return StdinDownloader{}
+	} else if strings.HasPrefix(url, "s3") {
+		return S3Downloader{url, newS3Client(&httpClient, useFips)}
 	} else if strings.HasPrefix(url, "gs") {
-		ctx := context.Background()
-		options := []option.ClientOption{}
-
-		// Add custom credentials option if defined
-		credsJSON := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")
-		gcsAccessToken := os.Getenv("GCS_ACCESS_TOKEN")
-		if credsJSON != "" {
-			options = append(options, option.WithCredentialsJSON([]byte(credsJSON)))
-		} else if gcsAccessToken != "" {
-			// Create a token source that always returns the static access token
-			tokenSource := oauth2.StaticTokenSource(
-				&oauth2.Token{AccessToken: gcsAccessToken},
-			)
-			options = append(options, option.WithTokenSource(tokenSource))
-		}
-
-		if opts.DisableHttp2 {
-			// This disables HTTP/2 in transport.
-			netTransport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		return GCSDownloader{url, newGCSClient(netTransport)}
+	} else if isAzureBlobUrl(url) {
+		return NewAzureDownloader(url, &httpClient)
+	} else if strings.HasPrefix(url, "hdfs://") || strings.HasPrefix(url, "webhdfs://") || strings.HasPrefix(url, "swebhdfs://") {
+		return NewWebHdfsDownloader(url, &httpClient)
+	} else if strings.HasPrefix(url, "smb://") {
+		return NewSmbDownloader(url)
+	} else if strings.HasPrefix(url, "sftp://") || strings.HasPrefix(url, "scp://") {
+		return NewSftpDownloader(url)
+	} else if strings.HasPrefix(url, "rsync://") {
+		return NewRsyncDownloader(url)
+	} else if strings.HasPrefix(url, "grpc://") || strings.HasPrefix(url, "grpcs://") {
+		return NewGrpcDownloader(url)
+	} else if strings.HasPrefix(url, "magnet:") || strings.HasSuffix(url, ".torrent") {
+		return NewTorrentDownloader(url, &httpClient)
+	} else if strings.HasPrefix(url, "ipfs://") {
+		return NewIpfsDownloader(url, &httpClient)
+	} else if strings.HasPrefix(url, "github://") {
+		return NewGithubReleaseDownloader(url, &httpClient)
+	} else if strings.HasPrefix(url, "github-lfs://") {
+		return NewGitLfsDownloader(url, &httpClient)
+	} else if getArtifactRepoFlavor(url) != "" {
+		return NewArtifactRepoDownloader(url, &httpClient)
+	} else {
+		return HttpDownloader{Url: url, client: &httpClient, useGetForSize: useGetForSize}
+	}
+}
 
-			options = append(options, option.WithScopes(raw.DevstorageFullControlScope))
-			trans, err := htransport.NewTransport(ctx, netTransport, options...)
-			if err != nil {
-				log.Fatalf("Failed to create GCS transport: %s", err)
-			}
-			c := http.Client{Transport: trans}
+// NOTE: Only S3 + HTTP clients use this transport. GCS uses the default transport configured by the SDK.
+func newNetTransport() *http.Transport {
+	dialContext := newDialer()
+	if socket := opts.UnixSocket; socket != "" {
+		// Every connection goes to the socket, the URL only decides the
+		// Host header and path.
+		dialer := &net.Dialer{Timeout: time.Duration(opts.ConnTimeout) * time.Second}
+		dialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	return &http.Transport{
+		DialContext:         dialContext,
+		TLSHandshakeTimeout: time.Duration(opts.ConnTimeout) * time.Second,
+		TLSClientConfig:     &tls.Config{ClientSessionCache: tlsSessions, MinVersion: tlsMinVersion()},
+		MaxIdleConnsPerHost: idleConnsPerHost(),
+		IdleConnTimeout:     idleConnTimeout,
+		DisableKeepAlives:   opts.NoKeepalive,
+		// A custom dialer and TLS config turn HTTP/2 off unless forced.
+		ForceAttemptHTTP2: opts.Http2 && !opts.DisableHttp2,
+	}
+}
 
-			options = append(options, option.WithHTTPClient(&c))
+func newS3Client(httpClient *http.Client, useFips bool) *s3.Client {
+	var loadOptions []func(*config.LoadOptions) error
+	if opts.S3Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(opts.S3Region))
+	}
+	if credentials := staticS3Credentials(); credentials != nil {
+		loadOptions = append(loadOptions, config.WithCredentialsProvider(credentials))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), loadOptions...)
+	if err != nil {
+		fatal("Failed to load s3 config: ", err)
+	}
+	if cfg.Region == "" && opts.S3Endpoint != "" {
+		// MinIO and Ceph accept any region, but requests have to be
+		// signed for one.
+		cfg.Region = "us-east-1"
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.HTTPClient = httpClient
+		o.RetryMaxAttempts = opts.RetryCount
+		if useFips {
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+		}
+		if opts.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.S3Endpoint)
 		}
+		o.UsePathStyle = opts.S3PathStyle
+	})
+}
 
-		client, err := storage.NewClient(
-			ctx,
-			options...,
+func newGCSClient(netTransport *http.Transport) *storage.Client {
+	ctx := context.Background()
+	options := []option.ClientOption{}
+
+	// Add custom credentials option if defined
+	credsJSON := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")
+	gcsAccessToken := os.Getenv("GCS_ACCESS_TOKEN")
+	if credsJSON != "" {
+		options = append(options, option.WithCredentialsJSON([]byte(credsJSON)))
+	} else if gcsAccessToken != "" {
+		// Create a token source that always returns the static access token
+		tokenSource := oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: gcsAccessToken},
 		)
+		options = append(options, option.WithTokenSource(tokenSource))
+	}
+
+	if opts.DisableHttp2 {
+		// This disables HTTP/2 in transport, without touching the one
+		// shared with the other clients.
+		netTransport = netTransport.Clone()
+		netTransport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+
+		options = append(options, option.WithScopes(raw.DevstorageFullControlScope))
+		trans, err := htransport.NewTransport(ctx, netTransport, options...)
 		if err != nil {
-			log.Fatal("Failed to create GCS client: ", err)
+			fatalf("Failed to create GCS transport: %s", err)
 		}
-		return GCSDownloader{url, client}
-	} else {
-		return HttpDownloader{url, &httpClient, useGetForSize}
+		c := http.Client{Transport: trans}
+
+		options = append(options, option.WithHTTPClient(&c))
+	}
+
+	client, err := storage.NewClient(
+		ctx,
+		options...,
+	)
+	if err != nil {
+		fatal("Failed to create GCS client: ", err)
 	}
+	return client
 }
 
 // Returns a single io.Reader byte stream that transparently makes use of parallel
@@ -137,15 +205,20 @@ func GetDownloader(url string, useFips bool, useGetForSize bool) Downloader {
 //
 // Will fall back to a single download stream if the download source doesn't support
 // RANGE requests or if the total file is smaller than a single download chunk.
-func GetDownloadStream(downloader Downloader, chunkSize int64, numWorkers int) io.Reader {
-	var size, supportsRange, supportsMultipart = downloader.GetFileInfo()
-	log.Printf("File Size (B): %d", size)
-	log.Printf("File Size (MiB): %d", size/1e6)
-	log.Println("Supports RANGE:", supportsRange)
-	log.Println("Supports multipart RANGE:", supportsMultipart)
+//
+// Canceling ctx aborts the requests in flight, stops the workers and fails
+// the next Read with ctx.Err(). A worker giving up on its chunk does the
+// same with an *Error, as does any failure of the library call in flight.
+func GetDownloadStream(ctx context.Context, downloader Downloader, chunkSize int64, numWorkers int) io.Reader {
+	var size, supportsRange, supportsMultipart = getFileInfo(downloader)
 	if !supportsRange || size < chunkSize {
-		return downloader.Get()
+		if chunkChecksums != nil {
+			log.Println("Downloading on a single stream, --chunk-checksums can't be verified")
+		}
+		return rateLimitedReader{closeOnCancel(ctx, downloader.Get())}
 	}
+	prewarmConnections(ctx, downloader, int(min(int64(numWorkers), (size+chunkSize-1)/chunkSize)))
+	crc := newStreamCrc32c(downloader)
 
 	// Bool channels used to synchronize when workers write to the output stream.
 	// Each worker sleeps until a token is pushed to their channel by the previous
@@ -157,18 +230,44 @@ func GetDownloadStream(downloader Downloader, chunkSize int64, numWorkers int) i
 		chans = append(chans, make(chan bool, 1))
 	}
 
+	var cpuSets = pinnedCpuSets()
+
 	// All workers share a single writer pipe, the reader side is used by the
 	// eventual consumer.
 	var reader, writer = io.Pipe()
 
+	// Canceled with the cause of the first failure, which stops every
+	// worker and fails the consumer's next Read with it.
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-failed():
+			cancel(callError())
+		case <-ctx.Done():
+		}
+		// Workers that already returned no longer watch ctx, so don't
+		// count on one of them to close the pipe.
+		writer.CloseWithError(context.Cause(ctx))
+	}()
+
 	for i := 0; i < numWorkers; i++ {
+		var cpus *cpuSet
+		if len(cpuSets) > 0 {
+			cpus = &cpuSets[i%len(cpuSets)]
+		}
 		go writePartial(
+			ctx,
+			cancel,
+			cpus,
 			downloader,
+			crc,
 			supportsMultipart,
 			size,
 			int64(i)*chunkSize,
 			chunkSize,
 			numWorkers,
+			nil,
 			writer,
 			chans[i],
 			chans[(i+1)%numWorkers])
@@ -176,25 +275,113 @@ func GetDownloadStream(downloader Downloader, chunkSize int64, numWorkers int) i
 	// Send initial token to worker 0 signifying they can start writing data to
 	// the pipe.
 	chans[0] <- true
+	return newFallbackReader(parent, reader, downloader)
+}
+
+// Queries and logs downloader's file info, which the progress bar needs.
+func getFileInfo(downloader Downloader) (int64, bool, bool) {
+	var size, supportsRange, supportsMultipart = downloader.GetFileInfo()
+	log.Printf("File Size (B): %d", size)
+	log.Printf("File Size (MiB): %d", size/1e6)
+	log.Println("Supports RANGE:", supportsRange)
+	log.Println("Supports multipart RANGE:", supportsMultipart)
+	emitEvent("file_info", map[string]interface{}{
+		"size":               size,
+		"supports_range":     supportsRange,
+		"supports_multipart": supportsMultipart,
+	})
+	progressSize.Store(size)
+	return size, supportsRange, supportsMultipart
+}
+
+// The CPU sets of --pin-workers, nil without it.
+func pinnedCpuSets() []cpuSet {
+	if opts.PinWorkers == "" {
+		return nil
+	}
+	cpuSets, err := workerCpuSets(opts.PinWorkers)
+	if err != nil {
+		fatal("Failed to parse --pin-workers: ", err.Error())
+	}
+	log.Printf("Pinning download workers round robin to %d CPU sets\n", len(cpuSets))
+	return cpuSets
+}
+
+// Closes body once ctx is canceled, so a Read blocked on the network
+// returns instead of waiting for the server.
+func closeOnCancel(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	reader := &cancelableReader{ctx: ctx, body: body, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			body.Close()
+		case <-reader.done:
+		}
+	}()
 	return reader
 }
 
+type cancelableReader struct {
+	ctx  context.Context
+	body io.ReadCloser
+	done chan struct{}
+	once sync.Once
+}
+
+func (r *cancelableReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err != nil {
+		r.once.Do(func() { close(r.done) })
+		if r.ctx.Err() != nil {
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+func (r *cancelableReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return r.body.Close()
+}
+
 // Individual worker thread entry function
 func writePartial(
+	ctx context.Context,
+	cancel context.CancelCauseFunc, // fails the whole download
+	cpus *cpuSet, // nil unless --pin-workers
 	downloader Downloader,
+	crc *streamCrc32c, // nil unless the source has a CRC32C
 	supportsMultipart bool,
 	size int64, // total file size
 	start int64, // the starting offset for the first chunk for this worker
 	chunkSize int64,
 	numWorkers int,
+	sink io.WriterAt, // nil to write to the pipe in stream order, see DownloadToFile
 	writer *io.PipeWriter,
 	curChan chan bool,
 	nextChan chan bool) {
 
+	pinThread(cpus)
 	var err error
 	var workerNum = start / chunkSize
 
 	var reader = NewReader(size, start, chunkSize, numWorkers, supportsMultipart, downloader)
+	var progress = workerProgressCounter(workerNum)
+
+	// On cancellation, abort whatever request is in flight and fail the
+	// consumer's next Read. Every worker does this, the first one wins.
+	var workerDone = make(chan struct{})
+	defer close(workerDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			reader.Abort()
+			if writer != nil {
+				writer.CloseWithError(context.Cause(ctx))
+			}
+		case <-workerDone:
+		}
+	}()
 
 	// Keep track of how many times we've tried to connect to download server for current chunk.
 	// Used for limiting retries on slow/stalled network connections.
@@ -212,7 +399,27 @@ func writePartial(
 
 	for reader.CurChunkStart < size {
 
+		waitWhilePaused()
+		if ctx.Err() != nil {
+			return
+		}
+		if softDeadlinePassed() && writer != nil {
+			// Everything before this chunk has been passed on once it's
+			// our turn.
+			select {
+			case <-curChan:
+				stopAtSoftDeadline(reader.CurChunkStart, size)
+			case <-ctx.Done():
+			}
+			return
+		}
 		reader.RequestChunk()
+		var chunkEnd = min(reader.CurChunkStart+chunkSize, size)
+		emitEvent("chunk_started", map[string]interface{}{
+			"worker": workerNum,
+			"start":  reader.CurChunkStart,
+			"end":    chunkEnd,
+		})
 		if !reader.UseMultipart() {
 			// When not using multipart, every new chunk is a new network request so reset attemptNumber
 			attemptNumber = 1
@@ -223,14 +430,20 @@ func writePartial(
 
 		// Used by reader thread to tell writer there's more data it can pipe out
 		var moreToWrite = make(chan bool, 1)
+		// Closed by the reader thread once the whole chunk has been read
+		var chunkRead = make(chan struct{})
+		// Set by the reader thread before closing chunkRead, with a crc.
+		var chunkCrc uint32
 
 		// Async thread to read off the network into in memory buffer
 		go func() {
+			pinThread(cpus)
 			// Time spent downloading chunk not including current attempt
 			var chunkElapsedMilli = float64(0)
 			// Time spent on this attempt downloading chunk
 			var attemptStartTime = time.Now()
 			var totalReadForAttempt = float64(0)
+			var chunkAttempts = 1
 			var timeSpentOnChunk = func() float64 {
 				return chunkElapsedMilli + float64(time.Since(attemptStartTime).Milliseconds())
 			}
@@ -245,13 +458,39 @@ func writePartial(
 				// We also wouldn't be able to enforce min speeds as there's no way to
 				// MITM ReadAll().
 				read, err = reader.Read(buf[totalReadForChunk:])
+				if ctx.Err() != nil {
+					// Aborted, the writer side gives up on this chunk.
+					break
+				}
+				waitForBandwidth(read)
+				progress.Add(int64(read))
 				totalReadForAttempt += float64(read)
 				totalReadForChunk += int64(read)
 				totalReadForWorker += float64(read)
 
 				// Make sure to handle bytes read before error handling, Read() can return successful bytes and error in the same call.
+				var corrupt error
 				if ChunkFinished(reader.CurChunkStart, totalReadForChunk, size, chunkSize) {
+					corrupt = verifyChunk(reader.CurChunkStart, buf[:totalReadForChunk])
+				}
+				if corrupt != nil {
+					// Download the whole chunk again, the corrupt bytes could be anywhere.
+					log.Printf("Worker %d's chunk at byte %d is corrupt: %s\n", workerNum, reader.CurChunkStart, corrupt.Error())
+					err = corrupt
+					totalReadForChunk = 0
+				} else if ChunkFinished(reader.CurChunkStart, totalReadForChunk, size, chunkSize) {
 					reader.Close()
+					attemptSucceeded()
+					if crc != nil {
+						chunkCrc = crc32.Checksum(buf[:totalReadForChunk], castagnoliTable)
+					}
+					emitEvent("chunk_finished", map[string]interface{}{
+						"worker": workerNum,
+						"start":  reader.CurChunkStart,
+						"end":    chunkEnd,
+						"millis": timeSpentOnChunk(),
+					})
+					recordChunkLatency(chunkLatency{workerNum, reader.CurChunkStart, chunkEnd, timeSpentOnChunk(), chunkAttempts})
 					break
 				}
 
@@ -267,38 +506,102 @@ func writePartial(
 				var attemptReadSpeed = totalReadForAttempt / attemptTimeMilli
 				var chunkTooSlowSoFar = attemptTimeMilli/1e3 > float64(opts.MinSpeedWait) && attemptReadSpeed < minSpeedBytesPerMillisecond
 				if chunkTooSlowSoFar || err != nil {
+					var reason = "too slow"
+					if err != nil {
+						reason = err.Error()
+					}
+					if tripped := attemptFailed(reason); tripped != nil {
+						cancel(tripped)
+						break
+					}
 					if attemptNumber > opts.RetryCount {
 						log.Printf("Too many slow/stalled/failed connections for worker %d's chunk, giving up.", workerNum)
 						log.Printf("Worker %d final download speed %.3fMBps\n", workerNum, totalReadForWorker/1e3/(timeDownloadingMilli+timeSpentOnChunk()))
-						os.Exit(int(unix.EIO))
+						cancel(&Error{int(ErrNetwork), fmt.Sprintf("worker %d gave up on the chunk at byte %d after %d attempts", workerNum, reader.CurChunkStart, attemptNumber)})
+						break
 					}
 					if err != nil {
 						log.Printf("Worker %d failed to read current chunk, resetting connection: %s\n", workerNum, err.Error())
 					} else {
 						log.Printf("Worker %d too slow so far for current chunk (download attempt averaged %.3fMBps), resetting connection\n", workerNum, attemptReadSpeed/1e3)
 					}
+					emitEvent("retry", map[string]interface{}{
+						"worker": workerNum,
+						"offset": reader.CurChunkStart + totalReadForChunk,
+						"reason": reason,
+					})
+					// Let go of the failed request's connection before asking again.
+					reader.Close()
 					// Reset info relative to what we have left to download for this chunk
 					reader.Reset(reader.CurChunkStart + totalReadForChunk)
 					reader.RequestChunk()
 					attemptNumber++
+					chunkAttempts++
 					chunkElapsedMilli += attemptTimeMilli
 					attemptStartTime = time.Now()
 					totalReadForAttempt = 0
 				}
 			}
 			timeDownloadingMilli += timeSpentOnChunk()
-			moreToWrite <- true
+			close(chunkRead)
+			select {
+			case moreToWrite <- true:
+			case <-ctx.Done():
+			}
 		}()
 
+		if sink != nil {
+			// Chunks land at their offset whenever they're done, no
+			// waiting for the workers before.
+			select {
+			case <-chunkRead:
+			case <-ctx.Done():
+				return
+			}
+			// Makes room for the reader thread's last wakeup, which
+			// nobody waits for here.
+			select {
+			case <-moreToWrite:
+			default:
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if _, err := sink.WriteAt(buf[:totalReadForChunk], reader.CurChunkStart); err != nil {
+				cancel(err)
+				return
+			}
+			if crc != nil {
+				crc.addAt(reader.CurChunkStart, chunkCrc, totalReadForChunk)
+			}
+			reader.AdvanceNextChunk()
+			continue
+		}
+
 		// wait for our turn to write to shared pipe
-		<-curChan
+		select {
+		case <-curChan:
+		case <-ctx.Done():
+			return
+		}
+		if chunkChecksums != nil {
+			// Only verified chunks are passed on, so wait for all of it.
+			select {
+			case <-chunkRead:
+			case <-ctx.Done():
+				return
+			}
+		}
 
 		// Logic to write our current chunk
 		for !ChunkFinished(reader.CurChunkStart, totalWrittenForChunk, size, chunkSize) {
 			if ChunkFinished(reader.CurChunkStart, totalReadForChunk, size, chunkSize) {
 				// This worker has read its entire chunk off the wire, pipe the rest to writer in a single call
 				if written, err := io.Copy(writer, bytes.NewReader(buf[totalWrittenForChunk:totalReadForChunk])); err != nil {
-					log.Fatal("io copy failed:", err.Error())
+					// The consumer closed the stream, or another
+					// worker failed it.
+					cancel(err)
+					return
 				} else {
 					totalWrittenForChunk += int64(written)
 				}
@@ -307,15 +610,29 @@ func writePartial(
 				// write what we have so far.
 				// Avoid spinning until there's something to write, wait for reader thread to
 				// tell us it has something.
-				<-moreToWrite
+				select {
+				case <-moreToWrite:
+				case <-ctx.Done():
+					return
+				}
 				if written, err := writer.Write(buf[totalWrittenForChunk:totalReadForChunk]); err != nil {
-					log.Fatal("partial write failed:", err.Error())
+					cancel(err)
+					return
 				} else {
 					totalWrittenForChunk += int64(written)
 				}
 			}
 		}
 
+		if crc != nil {
+			select {
+			case <-chunkRead:
+			case <-ctx.Done():
+				return
+			}
+			crc.add(chunkCrc, totalReadForChunk)
+		}
+
 		// Trigger next worker to start writing to stdout.
 		// Only send token if next worker has more work to do,
 		// otherwise they already exited and won't be waiting
@@ -323,9 +640,25 @@ func writePartial(
 		if reader.CurChunkStart+chunkSize < size {
 			nextChan <- true
 		} else {
+			if crc != nil {
+				if err := crc.verify(); err != nil {
+					cancel(err)
+					return
+				}
+			}
 			writer.Close()
+			// Done, which also stops watching for failures.
+			cancel(nil)
 		}
 		reader.AdvanceNextChunk()
 	}
 	log.Printf("Worker %d final download speed %.3fMBps\n", workerNum, totalReadForWorker/1e3/timeDownloadingMilli)
+	var mbps = 0.0
+	if timeDownloadingMilli > 0 {
+		mbps = totalReadForWorker / 1e3 / timeDownloadingMilli
+	}
+	emitEvent("worker_finished", map[string]interface{}{
+		"worker": workerNum,
+		"mbps":   mbps,
+	})
 }
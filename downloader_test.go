@@ -1,18 +1,25 @@
-package main
+package fastar
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"math/rand"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -86,7 +93,7 @@ func TestSingleReader(t *testing.T) {
 		downloader := TestDownloader{data, false, false}
 		for chunkSize := int64(0); chunkSize < 32; chunkSize++ {
 			for numWorkers := 1; numWorkers < 32; numWorkers++ {
-				if bytes, err := io.ReadAll(GetDownloadStream(downloader, chunkSize, numWorkers)); err == nil {
+				if bytes, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, chunkSize, numWorkers)); err == nil {
 					actual := string(bytes)
 					if actual != data {
 						t.Fatalf("Failed with fileSize: %d, chunkSize: %d, numWorkers: %d", fileSize, chunkSize, numWorkers)
@@ -106,7 +113,7 @@ func TestRangeReader(t *testing.T) {
 		downloader := TestDownloader{data, true, false}
 		for chunkSize := int64(1); chunkSize < 32; chunkSize++ {
 			for numWorkers := 1; numWorkers < 32; numWorkers++ {
-				if bytes, err := io.ReadAll(GetDownloadStream(downloader, chunkSize, numWorkers)); err == nil {
+				if bytes, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, chunkSize, numWorkers)); err == nil {
 					actual := string(bytes)
 					if actual != data {
 						t.Fatalf("Failed with fileSize: %d, chunkSize: %d, numWorkers: %d", fileSize, chunkSize, numWorkers)
@@ -126,7 +133,7 @@ func TestMultipartRangeReader(t *testing.T) {
 		downloader := TestDownloader{data, true, true}
 		for chunkSize := int64(1); chunkSize < 32; chunkSize++ {
 			for numWorkers := 1; numWorkers < 32; numWorkers++ {
-				if bytes, err := io.ReadAll(GetDownloadStream(downloader, chunkSize, numWorkers)); err == nil {
+				if bytes, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, chunkSize, numWorkers)); err == nil {
 					actual := string(bytes)
 					if actual != data {
 						t.Fatalf("Failed with fileSize: %d, chunkSize: %d, numWorkers: %d", fileSize, chunkSize, numWorkers)
@@ -139,6 +146,118 @@ func TestMultipartRangeReader(t *testing.T) {
 	}
 }
 
+// Labels multipart parts with their Content-Range but sends them in
+// reverse order.
+type misorderingDownloader struct {
+	TestDownloader
+}
+
+func (downloader misorderingDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i := len(ranges) - 1; i >= 0; i-- {
+		r := ranges[i]
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", r[0], r[1]-1, len(downloader.Data))},
+		})
+		part.Write([]byte(downloader.Data[r[0]:r[1]]))
+	}
+	writer.Close()
+	return multipart.NewReader(body, writer.Boundary()), nil
+}
+
+func TestMultipartMisordered(t *testing.T) {
+	oldRetryCount := opts.RetryCount
+	opts.RetryCount = math.MaxInt64
+	defer func() { opts.RetryCount = oldRetryCount }()
+	data := RandomString(1000)
+	downloader := misorderingDownloader{TestDownloader{data, true, true}}
+	if actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 50, 2)); err != nil || string(actual) != data {
+		t.Fatalf("Misordered multipart download returned wrong data, err %v", err)
+	}
+}
+
+func TestAlignPart(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Range": {"bytes 0-199/1000"}})
+	part.Write([]byte(strings.Repeat("a", 100) + strings.Repeat("b", 100)))
+	writer.Close()
+	merged, _ := multipart.NewReader(body, writer.Boundary()).NextPart()
+
+	// A part merging two ranges is trimmed to the one that was expected.
+	aligned, err := alignPart(merged, 100, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := io.ReadAll(aligned); string(contents) != strings.Repeat("b", 50) {
+		t.Fatalf("Got %q", contents)
+	}
+	if _, err := alignPart(merged, 150, 250); err == nil {
+		t.Fatal("Expected a part missing the end of the range to be rejected")
+	}
+}
+
+// Serves the first chunk, then every request stalls until it's closed.
+type stallingDownloader struct {
+	TestDownloader
+}
+
+func (downloader stallingDownloader) GetRange(start, end int64) io.ReadCloser {
+	if start == 0 {
+		return downloader.TestDownloader.GetRange(start, end)
+	}
+	reader, _ := io.Pipe()
+	return reader
+}
+
+func TestDownloadStreamCanceled(t *testing.T) {
+	oldRetryCount := opts.RetryCount
+	opts.RetryCount = math.MaxInt32
+	defer func() { opts.RetryCount = oldRetryCount }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	downloader := stallingDownloader{TestDownloader{RandomString(1000), true, false}}
+	result := make(chan error)
+	go func() {
+		_, err := io.ReadAll(GetDownloadStream(ctx, downloader, 100, 4))
+		result <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download didn't stop after cancellation")
+	}
+}
+
+func TestDownloadStreamWorkerFailure(t *testing.T) {
+	oldRetryCount := opts.RetryCount
+	// Reads fail 95% of the time in tests, a worker soon runs out of attempts.
+	opts.RetryCount = 1
+	opts.NoFallback = true
+	defer func() { opts.RetryCount = oldRetryCount; opts.NoFallback = false }()
+
+	downloader := TestDownloader{RandomString(100000), true, false}
+	result := make(chan error)
+	go func() {
+		_, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, syscall.EIO) {
+			t.Fatalf("Expected the stream to fail with EIO, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download didn't stop after a worker failed")
+	}
+}
+
 func TestHttpGetForSize(t *testing.T) {
 	// Backup original options
 	oldRetryCount := opts.RetryCount
@@ -201,3 +320,113 @@ func TestHttpGetForSize(t *testing.T) {
 	fmt.Printf("HTTP GET with Range header test passed! Size: %d, Range: %v, Multipart: %v\n", 
 		size, supportsRange, supportsMultipart)
 }
+
+func TestHttpHeadRejected(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 3
+	opts.ChunkSize = 32
+
+	testData := RandomString(100)
+	heads, gets := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			heads++
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		gets++
+		if r.Header.Get("Range") != "bytes=0-0" {
+			t.Errorf("Unexpected Range %q", r.Header.Get("Range"))
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-0/%d", len(testData)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(testData[:1]))
+	}))
+	defer server.Close()
+
+	downloader := HttpDownloader{Url: server.URL, client: server.Client()}
+	for i := 0; i < 2; i++ {
+		if size, supportsRange, _ := downloader.GetFileInfo(); size != int64(len(testData)) || !supportsRange {
+			t.Fatalf("Got size %d, range support %v", size, supportsRange)
+		}
+	}
+	if heads != 1 || gets != 2 {
+		t.Fatalf("Expected HEAD to be tried once and GET after, got %d HEADs and %d GETs", heads, gets)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "origin.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hosts []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host+r.URL.Path)
+		w.Header().Set("Content-Length", "11")
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Method == "GET" {
+			w.Write([]byte("hello world"))
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.UnixSocket = socket
+	opts.RetryCount = 3
+	downloader := getDownloader("http://origin.invalid/image.tar", false, false)
+	if size, _, _ := downloader.GetFileInfo(); size != 11 {
+		t.Fatalf("Expected size 11, got %d", size)
+	}
+	if len(hosts) == 0 || hosts[0] != "origin.invalid/image.tar" {
+		t.Fatalf("Expected requests for origin.invalid/image.tar, got %v", hosts)
+	}
+}
+
+func TestWebHdfsDownloader(t *testing.T) {
+	// Needs to be high enough to survive forced read failures, but not so
+	// high that retry-go can't allocate its error list for http requests.
+	oldRetryCount := opts.RetryCount
+	opts.RetryCount = 1000
+	defer func() { opts.RetryCount = oldRetryCount }()
+
+	testData := RandomString(1000)
+	datanode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		end := len(testData)
+		if length := r.URL.Query().Get("length"); length != "" {
+			l, _ := strconv.Atoi(length)
+			end = offset + l
+		}
+		w.Write([]byte(testData[offset:end]))
+	}))
+	defer datanode.Close()
+	namenode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/webhdfs/v1/data/file.tar" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("op") {
+		case "GETFILESTATUS":
+			fmt.Fprintf(w, `{"FileStatus":{"length":%d,"type":"FILE"}}`, len(testData))
+		case "OPEN":
+			http.Redirect(w, r, datanode.URL+"/?"+r.URL.RawQuery, http.StatusTemporaryRedirect)
+		}
+	}))
+	defer namenode.Close()
+
+	downloader := NewWebHdfsDownloader(strings.Replace(namenode.URL, "http", "webhdfs", 1)+"/data/file.tar", namenode.Client())
+	if size, supportsRange, _ := downloader.GetFileInfo(); size != int64(len(testData)) || !supportsRange {
+		t.Fatalf("Got size %d and range support %v", size, supportsRange)
+	}
+	for _, chunkSize := range []int64{100, 333, 2000} {
+		if bytes, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, chunkSize, 4)); err != nil || string(bytes) != testData {
+			t.Fatalf("Failed with chunkSize: %d, err: %v", chunkSize, err)
+		}
+	}
+}
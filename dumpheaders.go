@@ -0,0 +1,78 @@
+package fastar
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --dump-headers writes every tar header to a file as a JSON line, as read
+// from the archive before --strip-components, --uid-map or filters touch
+// it, to debug archives a producer got wrong without fetching them again
+// with another tool. Entries whose name already showed up earlier in the
+// archive are marked duplicate.
+type dumpedHeader struct {
+	Index      int               `json:"index"`
+	Typeflag   string            `json:"typeflag"`
+	Name       string            `json:"name"`
+	Linkname   string            `json:"linkname,omitempty"`
+	Size       int64             `json:"size"`
+	Mode       string            `json:"mode"`
+	Uid        int               `json:"uid"`
+	Gid        int               `json:"gid"`
+	Uname      string            `json:"uname,omitempty"`
+	Gname      string            `json:"gname,omitempty"`
+	ModTime    string            `json:"mtime"`
+	Devmajor   int64             `json:"devmajor,omitempty"`
+	Devminor   int64             `json:"devminor,omitempty"`
+	Format     string            `json:"format"`
+	PAXRecords map[string]string `json:"pax,omitempty"`
+	Duplicate  bool              `json:"duplicate,omitempty"`
+}
+
+// Only touched by the goroutine reading the archive.
+var headerDump struct {
+	encoder *json.Encoder
+	entries int
+	names   map[string]bool
+}
+
+// Appends header to --dump-headers, if given. Call right after Next().
+func dumpHeader(header *tar.Header) {
+	if opts.DumpHeaders == "" {
+		return
+	}
+	if headerDump.encoder == nil {
+		file, err := os.Create(opts.DumpHeaders)
+		if err != nil {
+			fatal("Failed to create --dump-headers file: ", err.Error())
+		}
+		headerDump.encoder = json.NewEncoder(file)
+		headerDump.names = map[string]bool{}
+	}
+	err := headerDump.encoder.Encode(dumpedHeader{
+		Index:      headerDump.entries,
+		Typeflag:   string(header.Typeflag),
+		Name:       header.Name,
+		Linkname:   header.Linkname,
+		Size:       header.Size,
+		Mode:       strconv.FormatInt(header.Mode, 8),
+		Uid:        header.Uid,
+		Gid:        header.Gid,
+		Uname:      header.Uname,
+		Gname:      header.Gname,
+		ModTime:    header.ModTime.UTC().Format(time.RFC3339Nano),
+		Devmajor:   header.Devmajor,
+		Devminor:   header.Devminor,
+		Format:     header.Format.String(),
+		PAXRecords: header.PAXRecords,
+		Duplicate:  headerDump.names[header.Name],
+	})
+	if err != nil {
+		fatal("Failed to write --dump-headers file: ", err.Error())
+	}
+	headerDump.entries++
+	headerDump.names[header.Name] = true
+}
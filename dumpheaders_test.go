@@ -0,0 +1,63 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDumpHeaders(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.DumpHeaders = filepath.Join(t.TempDir(), "headers.jsonl")
+	headerDump.encoder = nil
+	headerDump.entries = 0
+
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value"}},
+		{Name: "dir/file", Typeflag: tar.TypeSymlink, Linkname: "other", Mode: 0777},
+	} {
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tarWriter.Write([]byte("abc"))
+		}
+	}
+	tarWriter.Close()
+
+	if ExtractFile(&buf, "missing", io.Discard) {
+		t.Fatal("Expected no entry named missing")
+	}
+	file, err := os.Open(opts.DumpHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var dumped []dumpedHeader
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var header dumpedHeader
+		if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+			t.Fatal(err)
+		}
+		dumped = append(dumped, header)
+	}
+	if len(dumped) != 3 {
+		t.Fatalf("Expected 3 headers, got %d", len(dumped))
+	}
+	if dumped[1].Typeflag != "0" || dumped[1].Size != 3 || dumped[1].Mode != "644" || dumped[1].PAXRecords["SCHILY.xattr.user.test"] != "value" || dumped[1].Duplicate {
+		t.Fatalf("Unexpected file header %+v", dumped[1])
+	}
+	if dumped[2].Index != 2 || dumped[2].Typeflag != "2" || dumped[2].Linkname != "other" || !dumped[2].Duplicate {
+		t.Fatalf("Expected the symlink to be marked duplicate, got %+v", dumped[2])
+	}
+}
@@ -0,0 +1,51 @@
+package fastar
+
+import (
+	"log"
+	"os"
+)
+
+// Archives can hold several entries at the same path, e.g. after tar -r
+// appended a newer version of a file. --duplicates decides which one ends
+// up extracted:
+//
+//	last   the later entry replaces the earlier one, like tar does
+//	first  the earlier entry is kept and later ones are skipped
+//	error  the extraction fails
+//
+// Directories can appear any number of times, their later entries only
+// update the metadata. A replacing entry waits for the write of the entry
+// it replaces first, in case that's still in flight.
+
+// Paths extracted to so far. Only touched by the goroutine reading the
+// archive.
+type seenPaths map[string]bool
+
+// Returns whether the entry named name should be extracted to path, and
+// whether it replaces an earlier entry there. wait blocks until the earlier
+// entry is written.
+func (seen seenPaths) admit(path, name string, wait func()) (bool, bool) {
+	if !seen[path] {
+		seen[path] = true
+		return true, false
+	}
+	switch opts.Duplicates {
+	case "first":
+		log.Printf("Skipping %s, the archive already had an entry at that path\n", name)
+		emitEvent("entry_skipped", map[string]interface{}{"path": path, "reason": "duplicate"})
+		return false, false
+	case "error":
+		fatalf("%s appears more than once in the archive, pass --duplicates=last or --duplicates=first to extract it anyway", name)
+	}
+	log.Printf("Replacing %s with a later entry at the same path\n", name)
+	wait()
+	return true, true
+}
+
+// Removes what an earlier entry extracted to path, so the replacing entry
+// doesn't write through a symlink or fail on an existing link.
+func removeReplaced(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fatal("Failed to remove duplicate entry: ", err.Error())
+	}
+}
@@ -0,0 +1,262 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	erofsMagic       = 0xe0f5e1e2
+	erofsBlockSize   = 4096
+	erofsBlockBits   = 12
+	erofsSuperOffset = 1024
+	// Inodes are addressed in 32 byte slots from the start of the metadata
+	// area, extended inodes take two.
+	erofsSlotSize   = 32
+	erofsInodeSize  = 64
+	erofsDirentSize = 12
+	// Extended inode with the flat plain data layout, i.e. data stored
+	// uncompressed in consecutive blocks.
+	erofsInodeFormat = 1
+)
+
+// Directory entry file types.
+const (
+	erofsFtRegFile = iota + 1
+	erofsFtDir
+	erofsFtChrdev
+	erofsFtBlkdev
+	erofsFtFifo
+	erofsFtSock
+	erofsFtSymlink
+)
+
+// POSIX file type bits of st_mode, as EROFS inodes and the rsync protocol
+// store them whatever the host.
+const (
+	modeTypeMask = 0170000
+	modeFifo     = 0010000
+	modeChrdev   = 0020000
+	modeDir      = 0040000
+	modeBlkdev   = 0060000
+	modeRegular  = 0100000
+	modeSymlink  = 0120000
+)
+
+type erofsInode struct {
+	nid     uint64
+	blkaddr uint32
+	size    int64
+}
+
+// Converts a tar stream into an uncompressed EROFS image without
+// extracting it to disk first.
+//
+// File contents are appended to the image block aligned as they're read.
+// Once the whole tree is known directories, symlink targets and finally all
+// inodes are written after the data. The root inode goes first so its nid
+// fits the superblock's 16 bit field.
+func WriteErofs(stream io.Reader, imagePath string) {
+	image, err := os.Create(imagePath)
+	if err != nil {
+		fatal("Failed to create EROFS image: ", err.Error())
+	}
+	defer image.Close()
+	// Block 0 holds the superblock.
+	block := uint32(1)
+	if _, err := image.Seek(erofsBlockSize, io.SeekStart); err != nil {
+		fatal("Failed to seek EROFS image: ", err.Error())
+	}
+	writeBlocks := func(data io.Reader) int64 {
+		written, err := io.Copy(image, data)
+		if err != nil {
+			fatal("Failed to write EROFS image: ", err.Error())
+		}
+		if padding := written % erofsBlockSize; padding != 0 {
+			if _, err := image.Write(make([]byte, erofsBlockSize-padding)); err != nil {
+				fatal("Failed to write EROFS image: ", err.Error())
+			}
+		}
+		block += uint32((written + erofsBlockSize - 1) / erofsBlockSize)
+		return written
+	}
+
+	root := readImageTree(stream, func(node *imageNode, data io.Reader) {
+		node.erofs.blkaddr = block
+		node.erofs.size = writeBlocks(data)
+	})
+
+	// Breadth first so the root is first, hard links only get one inode.
+	nodes := []*imageNode{root}
+	parents := map[*imageNode]*imageNode{root: root}
+	seen := map[*imageNode]bool{root: true}
+	for i := 0; i < len(nodes); i++ {
+		for _, name := range sortedChildren(nodes[i]) {
+			if child := nodes[i].children[name]; !seen[child] {
+				seen[child] = true
+				parents[child] = nodes[i]
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	for i, node := range nodes {
+		node.erofs.nid = uint64(i * erofsInodeSize / erofsSlotSize)
+	}
+
+	for _, node := range nodes {
+		switch node.header.Typeflag {
+		case tar.TypeDir:
+			node.erofs.blkaddr = block
+			node.erofs.size = writeBlocks(bytes.NewReader(erofsDirBlocks(node, parents[node])))
+		case tar.TypeSymlink:
+			node.erofs.blkaddr = block
+			node.erofs.size = writeBlocks(bytes.NewReader([]byte(node.header.Linkname)))
+		}
+	}
+
+	metaBlkaddr := block
+	var inodes bytes.Buffer
+	for i, node := range nodes {
+		header := node.header
+		nlink := node.nlink
+		var mode uint16
+		var data uint32
+		switch header.Typeflag {
+		case tar.TypeDir:
+			mode = modeDir
+			nlink = 2
+			for _, child := range node.children {
+				if child.isDir() {
+					nlink++
+				}
+			}
+		case tar.TypeReg:
+			mode = modeRegular
+		case tar.TypeSymlink:
+			mode = modeSymlink
+		case tar.TypeBlock, tar.TypeChar:
+			mode = modeBlkdev
+			if header.Typeflag == tar.TypeChar {
+				mode = modeChrdev
+			}
+			major, minor := uint32(header.Devmajor), uint32(header.Devminor)
+			data = minor&0xff | major<<8 | (minor&^0xff)<<12
+		default:
+			mode = modeFifo
+		}
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeSymlink {
+			data = node.erofs.blkaddr
+		}
+		for _, field := range []interface{}{
+			uint16(erofsInodeFormat),
+			uint16(0), // Xattr count
+			mode | uint16(header.Mode&07777),
+			uint16(0),
+			uint64(node.erofs.size),
+			data,
+			uint32(i + 1), // Inode number
+			uint32(header.Uid),
+			uint32(header.Gid),
+			uint64(header.ModTime.Unix()),
+			uint32(header.ModTime.Nanosecond()),
+			nlink,
+			[16]byte{},
+		} {
+			binary.Write(&inodes, binary.LittleEndian, field)
+		}
+	}
+	writeBlocks(&inodes)
+
+	now := time.Now()
+	var superblock bytes.Buffer
+	for _, field := range []interface{}{
+		uint32(erofsMagic),
+		uint32(0), // Checksum, not enabled
+		uint32(0), // Compatible features
+		uint8(erofsBlockBits),
+		uint8(0), // Superblock extension slots
+		uint16(root.erofs.nid),
+		uint64(len(nodes)),
+		uint64(now.Unix()),
+		uint32(now.Nanosecond()),
+		block, // Total blocks
+		metaBlkaddr,
+		uint32(0),  // Xattr block address
+		[16]byte{}, // UUID
+		[16]byte{}, // Volume name
+		uint32(0),  // Incompatible features
+		[44]byte{},
+	} {
+		binary.Write(&superblock, binary.LittleEndian, field)
+	}
+	if _, err := image.WriteAt(superblock.Bytes(), erofsSuperOffset); err != nil {
+		fatal("Failed to write EROFS superblock: ", err.Error())
+	}
+	if err := image.Sync(); err != nil {
+		fatal("Failed to sync EROFS image: ", err.Error())
+	}
+	log.Printf("Wrote EROFS image %s with %d inodes (%d bytes)\n", imagePath, len(nodes), int64(block)*erofsBlockSize)
+}
+
+// Directory data is a sequence of blocks, each starting with the dirents of
+// the names it holds followed by the names themselves. Entries, including
+// "." and "..", are sorted across all blocks so lookups can binary search.
+func erofsDirBlocks(node, parent *imageNode) []byte {
+	type dirent struct {
+		name     string
+		nid      uint64
+		fileType uint8
+	}
+	entries := []dirent{{".", node.erofs.nid, erofsFtDir}, {"..", parent.erofs.nid, erofsFtDir}}
+	for name, child := range node.children {
+		entries = append(entries, dirent{name, child.erofs.nid, erofsFileType(child)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var blocks bytes.Buffer
+	for i := 0; i < len(entries); {
+		count, used := 0, 0
+		for i+count < len(entries) && used+erofsDirentSize+len(entries[i+count].name) <= erofsBlockSize {
+			used += erofsDirentSize + len(entries[i+count].name)
+			count++
+		}
+		if blocks.Len()%erofsBlockSize != 0 {
+			blocks.Write(make([]byte, erofsBlockSize-blocks.Len()%erofsBlockSize))
+		}
+		nameOffset := count * erofsDirentSize
+		for _, entry := range entries[i : i+count] {
+			binary.Write(&blocks, binary.LittleEndian, entry.nid)
+			binary.Write(&blocks, binary.LittleEndian, uint16(nameOffset))
+			binary.Write(&blocks, binary.LittleEndian, []uint8{entry.fileType, 0})
+			nameOffset += len(entry.name)
+		}
+		for _, entry := range entries[i : i+count] {
+			blocks.WriteString(entry.name)
+		}
+		i += count
+	}
+	return blocks.Bytes()
+}
+
+func erofsFileType(node *imageNode) uint8 {
+	switch node.header.Typeflag {
+	case tar.TypeDir:
+		return erofsFtDir
+	case tar.TypeReg:
+		return erofsFtRegFile
+	case tar.TypeSymlink:
+		return erofsFtSymlink
+	case tar.TypeBlock:
+		return erofsFtBlkdev
+	case tar.TypeChar:
+		return erofsFtChrdev
+	default:
+		return erofsFtFifo
+	}
+}
@@ -0,0 +1,180 @@
+package fastar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestErofsRoundTrip(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts = DefaultOptions()
+
+	tarball, expected, inodeCount := imageTestTar(t)
+	imagePath := filepath.Join(t.TempDir(), "image.erofs")
+	WriteErofs(bytes.NewReader(tarball), imagePath)
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newErofsTestReader(t, image)
+	if reader.super.Inodes != uint64(inodeCount) {
+		t.Fatalf("Superblock has %d inodes, wanted %d", reader.super.Inodes, inodeCount)
+	}
+	entries := map[string]imageTestEntry{}
+	nids := map[uint64]bool{}
+	root := uint64(reader.super.RootNid)
+	reader.walk(".", root, root, entries, nids)
+	if len(nids) != inodeCount {
+		t.Fatalf("Found %d distinct inodes, wanted %d", len(nids), inodeCount)
+	}
+	checkImageEntries(t, entries, expected)
+
+	fsck, err := exec.LookPath("fsck.erofs")
+	if err != nil {
+		t.Log("fsck.erofs not found, skipping the check with erofs-utils")
+		return
+	}
+	if output, err := exec.Command(fsck, imagePath).CombinedOutput(); err != nil {
+		t.Fatalf("fsck.erofs failed: %v\n%s", err, output)
+	}
+}
+
+type erofsTestSuperblock struct {
+	Magic, Checksum, FeatureCompat uint32
+	BlockBits, ExtSlots            uint8
+	RootNid                        uint16
+	Inodes, BuildTime              uint64
+	BuildTimeNsec, Blocks          uint32
+	MetaBlkaddr, XattrBlkaddr      uint32
+}
+
+type erofsTestInode struct {
+	Format, XattrCount, Mode, Reserved uint16
+	Size                               uint64
+	Data, Ino, Uid, Gid                uint32
+	ModTime                            uint64
+	ModTimeNsec, Nlink                 uint32
+	Reserved2                          [16]byte
+}
+
+// Just enough of an EROFS reader to check what WriteErofs produces.
+type erofsTestReader struct {
+	t     *testing.T
+	image []byte
+	super erofsTestSuperblock
+}
+
+func newErofsTestReader(t *testing.T, image []byte) *erofsTestReader {
+	r := &erofsTestReader{t: t, image: image}
+	if err := binary.Read(bytes.NewReader(image[erofsSuperOffset:]), binary.LittleEndian, &r.super); err != nil {
+		t.Fatal(err)
+	}
+	super := r.super
+	if super.Magic != erofsMagic || super.BlockBits != erofsBlockBits {
+		t.Fatalf("Bad superblock magic %x or block size bits %d", super.Magic, super.BlockBits)
+	}
+	if len(image) != int(super.Blocks)*erofsBlockSize || super.MetaBlkaddr >= super.Blocks {
+		t.Fatalf("Image is %d bytes, superblock says %d blocks with metadata at %d", len(image), super.Blocks, super.MetaBlkaddr)
+	}
+	return r
+}
+
+func (r *erofsTestReader) inode(name string, nid uint64) erofsTestInode {
+	var inode erofsTestInode
+	offset := int(r.super.MetaBlkaddr)*erofsBlockSize + int(nid)*erofsSlotSize
+	if err := binary.Read(bytes.NewReader(r.image[offset:]), binary.LittleEndian, &inode); err != nil {
+		r.t.Fatalf("Failed to read the inode of %s: %v", name, err)
+	}
+	if inode.Format != erofsInodeFormat || inode.XattrCount != 0 {
+		r.t.Fatalf("%s has inode format %d with %d xattrs", name, inode.Format, inode.XattrCount)
+	}
+	return inode
+}
+
+func (r *erofsTestReader) data(name string, inode erofsTestInode) []byte {
+	start := int64(inode.Data) * erofsBlockSize
+	if start+int64(inode.Size) > int64(r.super.MetaBlkaddr)*erofsBlockSize {
+		r.t.Fatalf("Data of %s runs into the metadata", name)
+	}
+	return r.image[start : start+int64(inode.Size)]
+}
+
+// Reads the inode nid, and everything under it if it's a directory, into
+// entries.
+func (r *erofsTestReader) walk(name string, nid, parent uint64, entries map[string]imageTestEntry, nids map[uint64]bool) uint16 {
+	inode := r.inode(name, nid)
+	nids[nid] = true
+	entry := imageTestEntry{mode: uint32(inode.Mode), uid: inode.Uid, gid: inode.Gid, nlink: inode.Nlink}
+	switch inode.Mode & modeTypeMask {
+	case modeDir:
+		r.walkDir(name, r.data(name, inode), nid, parent, entries, nids)
+	case modeRegular, modeSymlink:
+		entry.data = string(r.data(name, inode))
+	case modeChrdev, modeBlkdev:
+		entry.rdev = inode.Data
+	}
+	entries[name] = entry
+	return inode.Mode & modeTypeMask
+}
+
+func (r *erofsTestReader) walkDir(dir string, data []byte, nid, parent uint64, entries map[string]imageTestEntry, nids map[uint64]bool) {
+	fileTypes := map[uint16]uint8{
+		modeRegular: erofsFtRegFile,
+		modeDir:     erofsFtDir,
+		modeChrdev:  erofsFtChrdev,
+		modeBlkdev:  erofsFtBlkdev,
+		modeFifo:    erofsFtFifo,
+		modeSymlink: erofsFtSymlink,
+	}
+	previous := ""
+	for blockStart := 0; blockStart < len(data); blockStart += erofsBlockSize {
+		block := data[blockStart:]
+		if len(block) > erofsBlockSize {
+			block = block[:erofsBlockSize]
+		}
+		count := int(binary.LittleEndian.Uint16(block[8:])) / erofsDirentSize
+		for i := 0; i < count; i++ {
+			dirent := block[i*erofsDirentSize:]
+			childNid := binary.LittleEndian.Uint64(dirent)
+			nameEnd := len(block)
+			if i+1 < count {
+				nameEnd = int(binary.LittleEndian.Uint16(block[(i+1)*erofsDirentSize+8:]))
+			} else if end := bytes.IndexByte(block[binary.LittleEndian.Uint16(dirent[8:]):], 0); end >= 0 {
+				nameEnd = int(binary.LittleEndian.Uint16(dirent[8:])) + end
+			}
+			name := string(block[binary.LittleEndian.Uint16(dirent[8:]):nameEnd])
+			if name <= previous {
+				r.t.Fatalf("Entries of %s aren't sorted: %q after %q", dir, name, previous)
+			}
+			previous = name
+			switch name {
+			case ".":
+				if childNid != nid {
+					r.t.Fatalf("%s/. points at nid %d instead of %d", dir, childNid, nid)
+				}
+				continue
+			case "..":
+				if childNid != parent {
+					r.t.Fatalf("%s/.. points at nid %d instead of %d", dir, childNid, parent)
+				}
+				continue
+			}
+			path := name
+			if dir != "." {
+				path = dir + "/" + name
+			}
+			if kind := r.walk(path, childNid, nid, entries, nids); fileTypes[kind] != dirent[10] {
+				r.t.Fatalf("%s has file type %d in its directory entry, but mode %o", path, dirent[10], kind)
+			}
+		}
+	}
+	if previous == "" {
+		r.t.Fatalf("%s has no entries", dir)
+	}
+}
@@ -0,0 +1,189 @@
+package fastar
+
+import (
+	"archive/tar"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/avast/retry-go"
+)
+
+// Classes of failure and the status the CLI exits with for each. Failures
+// outside of them exit with 1, or one of the few more specific errnos
+// listed in the README.
+const (
+	// The source couldn't be reached, or kept failing past --retry-count.
+	ErrNetwork = syscall.EIO
+	// The source kept throttling requests past --retry-count.
+	ErrThrottled = syscall.EBUSY
+	// The source, or a path the archive needs, doesn't exist.
+	ErrNotFound = syscall.ENOENT
+	// The download doesn't match its checksum, or the archive doesn't
+	// parse.
+	ErrCorrupt = syscall.EBADMSG
+	// No space left for the output.
+	ErrDiskFull = syscall.ENOSPC
+	// The source refused the credentials, or the output isn't writable.
+	ErrPermission = syscall.EACCES
+)
+
+var errorClasses = map[syscall.Errno]string{
+	ErrNetwork:    "network",
+	ErrThrottled:  "throttled",
+	ErrNotFound:   "not_found",
+	ErrCorrupt:    "corrupt",
+	ErrDiskFull:   "disk_full",
+	ErrPermission: "permission",
+}
+
+// Error a library call fails with. Code is the status the CLI exits with
+// for the same failure, mostly an errno, so errors.Is(err, ErrNotFound)
+// tells a missing source apart from other failures.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	errno, ok := target.(syscall.Errno)
+	return ok && int(errno) == e.Code
+}
+
+// The class of the failure, e.g. "not_found", or "other".
+func (e *Error) Class() string {
+	if class, ok := errorClasses[syscall.Errno(e.Code)]; ok {
+		return class
+	}
+	return "other"
+}
+
+// Picks the class of err by its cause, 0 if it has none of them.
+func classifyError(err error) syscall.Errno {
+	var retryErr retry.Error
+	if errors.As(err, &retryErr) && len(retryErr) > 0 {
+		return classifyError(retryErr[len(retryErr)-1])
+	}
+	var fastarErr *Error
+	var corruptInput flate.CorruptInputError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &fastarErr):
+		if _, ok := errorClasses[syscall.Errno(fastarErr.Code)]; ok {
+			return syscall.Errno(fastarErr.Code)
+		}
+	case errors.Is(err, syscall.ENOSPC):
+		return ErrDiskFull
+	case errors.Is(err, fs.ErrPermission):
+		return ErrPermission
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrNotFound
+	case errors.Is(err, tar.ErrHeader), errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &corruptInput):
+		return ErrCorrupt
+	case errors.As(err, &netErr):
+		return ErrNetwork
+	}
+	return 0
+}
+
+// Failures deep in the pipeline exit the CLI right away. Under the library
+// API the first failure is recorded instead, the goroutine that hit it
+// stops, and every call in flight returns it.
+var (
+	libraryMutex   sync.Mutex
+	libraryCalls   int
+	libraryOptions Options
+	libraryFailed  chan struct{}
+	libraryErr     *Error
+)
+
+// Like log.Fatal.
+func fatal(v ...interface{}) {
+	message := fmt.Sprint(v...)
+	log.Output(2, message)
+	fail(&Error{1, message})
+}
+
+// Like log.Fatalf.
+func fatalf(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	log.Output(2, message)
+	fail(&Error{1, message})
+}
+
+// Like fatal for err, exiting with the status of its class.
+func fatalErr(message string, err error) {
+	log.Output(2, message+err.Error())
+	fail(classifiedError(message, err))
+}
+
+// The *Error for err with the status of its class, 1 if it has none.
+func classifiedError(message string, err error) *Error {
+	code := 1
+	if errno := classifyError(err); errno != 0 {
+		code = int(errno)
+	}
+	return &Error{code, message + err.Error()}
+}
+
+// Exits with errno as the status, the reason has already been logged.
+func exit(errno syscall.Errno) {
+	fail(&Error{int(errno), errno.Error()})
+}
+
+// Like fatal for a failed Read of a download stream, keeping the status of
+// the *Error a download worker closed the stream with, if that's why.
+func fatalStream(message string, err error) {
+	var streamErr *Error
+	log.Output(2, message+err.Error())
+	if errors.As(err, &streamErr) {
+		fail(streamErr)
+	}
+	fail(classifiedError(message, err))
+}
+
+// Closed once a library call failed, nil and so never ready for the CLI,
+// which exits instead. Lets goroutines that aren't the one failing stop.
+func failed() <-chan struct{} {
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+	if libraryCalls == 0 {
+		return nil
+	}
+	return libraryFailed
+}
+
+func fail(err *Error) {
+	emitEvent("error", map[string]interface{}{"code": err.Code, "class": err.Class(), "message": err.Message})
+	libraryMutex.Lock()
+	inLibrary := libraryCalls > 0
+	if inLibrary && libraryErr == nil {
+		libraryErr = err
+		close(libraryFailed)
+	}
+	libraryMutex.Unlock()
+	if !inLibrary {
+		// Anything failing after SIGINT/SIGTERM is fallout of the
+		// cancellation.
+		status := interruptedStatus()
+		if status == 0 {
+			status = err.Code
+		}
+		flushMetrics(status)
+		os.Exit(status)
+	}
+	runtime.Goexit()
+}
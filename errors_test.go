@@ -0,0 +1,48 @@
+package fastar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/avast/retry-go"
+)
+
+func TestClassifyError(t *testing.T) {
+	_, missing := os.Open("/nonexistent/fastar")
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	for _, test := range []struct {
+		err      error
+		expected syscall.Errno
+	}{
+		{missing, ErrNotFound},
+		{fmt.Errorf("write: %w", syscall.ENOSPC), ErrDiskFull},
+		{os.ErrPermission, ErrPermission},
+		{tar.ErrHeader, ErrCorrupt},
+		{io.ErrUnexpectedEOF, ErrCorrupt},
+		{dialErr, ErrNetwork},
+		{retry.Error{missing, dialErr}, ErrNetwork},
+		{&Error{int(ErrThrottled), "throttled"}, ErrThrottled},
+		{&Error{1, "other"}, 0},
+		{errors.New("unknown"), 0},
+	} {
+		if actual := classifyError(test.err); actual != test.expected {
+			t.Errorf("Expected %v to be classified as %v, got %v", test.err, test.expected, actual)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	err := classifiedError("Failed: ", fmt.Errorf("open: %w", os.ErrNotExist))
+	if !errors.Is(err, ErrNotFound) || err.Class() != "not_found" || err.Message != "Failed: open: file does not exist" {
+		t.Fatalf("Unexpected error %+v with class %s", err, err.Class())
+	}
+	if class := (&Error{int(syscall.ESTALE), "changed"}).Class(); class != "other" {
+		t.Fatalf("Expected ESTALE to be classified as other, got %s", class)
+	}
+}
@@ -0,0 +1,378 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eStargz and zstd:chunked container layers are tarballs where every file
+// (and every chunk of a large file) is compressed as a separate gzip member
+// or zstd frame, with a JSON table of contents (TOC) at the end saying where
+// each one lives. A footer at the very end of the blob points at the TOC.
+// Streaming extraction handles eStargz like any other gzip file, but for
+// RemoteTarFS the TOC means single files can be read out of a compressed
+// layer with ranged requests, and their chunks checked against the digests
+// in the TOC.
+const (
+	// The footer is a gzip member with an empty body whose extra field
+	// holds the TOC offset as "%016xSTARGZ", in the "SG" subfield for
+	// eStargz. At least 47 bytes long.
+	legacyStargzFooterSize  = 47
+	estargzTocName          = "stargz.index.json"
+	zstdChunkedFooterSize   = 64
+	zstdChunkedFooterMagic  = "GNUlInUx"
+	zstdChunkedManifestType = 1
+)
+
+// Subset of the TOC entry fields shared by eStargz and zstd:chunked.
+type tocEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size"`
+	ModTime     string `json:"modtime"`
+	LinkName    string `json:"linkName"`
+	Mode        int64  `json:"mode"`
+	Uid         int    `json:"uid"`
+	Gid         int    `json:"gid"`
+	UserName    string `json:"userName"`
+	GroupName   string `json:"groupName"`
+	DevMajor    int64  `json:"devMajor"`
+	DevMinor    int64  `json:"devMinor"`
+	Offset      int64  `json:"offset"`
+	EndOffset   int64  `json:"endOffset"`
+	Digest      string `json:"digest"`
+	ChunkOffset int64  `json:"chunkOffset"`
+	ChunkSize   int64  `json:"chunkSize"`
+	ChunkDigest string `json:"chunkDigest"`
+	ChunkType   string `json:"chunkType"`
+}
+
+type toc struct {
+	Version int        `json:"version"`
+	Entries []tocEntry `json:"entries"`
+}
+
+// Part of a file stored as its own compressed member.
+type tocChunk struct {
+	// Compressed byte range within the blob.
+	offset, end int64
+	// Uncompressed range within the file.
+	fileOffset, size int64
+	digest           string
+	// zstd:chunked stores runs of zeros as holes without any data.
+	zeros bool
+}
+
+// Checks the footer of the blob for an eStargz or zstd:chunked TOC and if
+// there is one indexes the archive from it. Returns false for anything else.
+func (fsys *RemoteTarFS) indexFromToc() (bool, error) {
+	size := fsys.reader.size
+	// Enough for the zstd:chunked footer plus its skippable frame header.
+	tail := make([]byte, zstdChunkedFooterSize+8)
+	if size < int64(len(tail)) {
+		return false, nil
+	}
+	if _, err := fsys.reader.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return false, err
+	}
+
+	var tocStart, tocEnd int64
+	isZstd := bytes.HasSuffix(tail, []byte(zstdChunkedFooterMagic))
+	if isZstd {
+		footer := tail[8:]
+		if binary.LittleEndian.Uint32(tail[4:]) != zstdChunkedFooterSize {
+			// Older writers used a 40 byte footer without tar-split offsets.
+			footer = tail[len(tail)-40:]
+		}
+		manifestType := binary.LittleEndian.Uint64(footer[24:])
+		if manifestType != zstdChunkedManifestType {
+			return true, fmt.Errorf("unsupported zstd:chunked manifest type %d", manifestType)
+		}
+		tocStart = int64(binary.LittleEndian.Uint64(footer[0:]))
+		tocEnd = tocStart + int64(binary.LittleEndian.Uint64(footer[8:]))
+		fsys.decompress = zstdDecompress
+	} else if offset, footerSize := parseStargzFooter(tail); footerSize != 0 {
+		tocStart, tocEnd = offset, size-int64(footerSize)
+		fsys.decompress = func(compressed []byte) (io.Reader, error) {
+			return gzip.NewReader(bytes.NewReader(compressed))
+		}
+	} else {
+		return false, nil
+	}
+	if tocStart < 0 || tocEnd > size || tocStart >= tocEnd {
+		return true, errors.New("TOC footer points outside of the archive")
+	}
+
+	compressed := make([]byte, tocEnd-tocStart)
+	if _, err := fsys.reader.ReadAt(compressed, tocStart); err != nil {
+		return true, err
+	}
+	tocReader, err := fsys.decompress(compressed)
+	if err != nil {
+		return true, err
+	}
+	if !isZstd {
+		// The eStargz TOC is itself wrapped in a tarball.
+		tarReader := tar.NewReader(tocReader)
+		if header, err := tarReader.Next(); err != nil || header.Name != estargzTocName {
+			return true, errors.New("eStargz TOC member doesn't contain " + estargzTocName)
+		}
+		tocReader = tarReader
+	}
+	var index toc
+	if err := json.NewDecoder(tocReader).Decode(&index); err != nil {
+		return true, fmt.Errorf("failed to parse TOC: %w", err)
+	}
+	fsys.addTocEntries(index.Entries, tocStart)
+	return true, nil
+}
+
+// Returns the TOC offset and footer size if tail ends in a (legacy) stargz
+// footer, or a zero footer size otherwise. The footer is 51 bytes (47 for
+// legacy stargz) when written by most tools, but that depends on how the
+// gzip library encodes an empty body, so it's searched for instead.
+func parseStargzFooter(tail []byte) (int64, int) {
+	for start := len(tail) - legacyStargzFooterSize; start >= 0; start-- {
+		if !bytes.HasPrefix(tail[start:], []byte{0x1f, 0x8b, 8, 4}) {
+			continue
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(tail[start:]))
+		if err != nil {
+			continue
+		}
+		extra := reader.Header.Extra
+		if len(extra) == 26 && extra[0] == 'S' && extra[1] == 'G' {
+			extra = extra[4:]
+		}
+		if len(extra) != 22 || !bytes.HasSuffix(extra, []byte("STARGZ")) {
+			continue
+		}
+		offset, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+		if err != nil {
+			continue
+		}
+		return offset, len(tail) - start
+	}
+	return 0, 0
+}
+
+func (fsys *RemoteTarFS) addTocEntries(entries []tocEntry, tocStart int64) {
+	// eStargz only records where chunks start, each one ends where the
+	// next member begins.
+	var offsets []int64
+	for _, entry := range entries {
+		if entry.Offset > 0 {
+			offsets = append(offsets, entry.Offset)
+		}
+	}
+	offsets = append(offsets, tocStart)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	compressedEnd := func(entry tocEntry) int64 {
+		if entry.EndOffset > 0 {
+			return entry.EndOffset
+		}
+		return offsets[sort.Search(len(offsets), func(i int) bool { return offsets[i] > entry.Offset })]
+	}
+
+	// Chunk entries follow the regular file they belong to.
+	lastFile := ""
+	for _, entry := range entries {
+		name := path.Clean(strings.TrimPrefix(entry.Name, "/"))
+		if entry.Type == "chunk" {
+			if file, ok := fsys.entries[lastFile]; ok {
+				file.chunks = append(file.chunks, newTocChunk(entry, file.header.Size, compressedEnd(entry)))
+				fsys.entries[lastFile] = file
+			}
+			continue
+		}
+		lastFile = ""
+		if name == "." || !fs.ValidPath(name) || name == ".prefetch.landmark" || name == ".no.prefetch.landmark" {
+			continue
+		}
+		header := &tar.Header{
+			Name:     entry.Name,
+			Linkname: entry.LinkName,
+			Size:     entry.Size,
+			Mode:     entry.Mode,
+			Uid:      entry.Uid,
+			Gid:      entry.Gid,
+			Uname:    entry.UserName,
+			Gname:    entry.GroupName,
+			Devmajor: entry.DevMajor,
+			Devminor: entry.DevMinor,
+		}
+		header.ModTime, _ = time.Parse(time.RFC3339, entry.ModTime)
+		switch entry.Type {
+		case "dir":
+			header.Typeflag = tar.TypeDir
+		case "reg":
+			header.Typeflag = tar.TypeReg
+		case "symlink":
+			header.Typeflag = tar.TypeSymlink
+		case "char":
+			header.Typeflag = tar.TypeChar
+		case "block":
+			header.Typeflag = tar.TypeBlock
+		case "fifo":
+			header.Typeflag = tar.TypeFifo
+		case "hardlink":
+			target, ok := fsys.entries[path.Clean(strings.TrimPrefix(entry.LinkName, "/"))]
+			if !ok {
+				continue
+			}
+			linkHeader := *target.header
+			linkHeader.Name = entry.Name
+			fsys.addEntry(name, remoteTarEntry{header: &linkHeader, chunks: target.chunks})
+			continue
+		default:
+			continue
+		}
+		fileEntry := remoteTarEntry{header: header}
+		if header.Typeflag == tar.TypeReg {
+			// Empty files have no data, but still need a chunk list to
+			// be read through the TOC.
+			fileEntry.chunks = []tocChunk{}
+			if header.Size > 0 {
+				fileEntry.chunks = append(fileEntry.chunks, newTocChunk(entry, header.Size, compressedEnd(entry)))
+			}
+		}
+		fsys.addEntry(name, fileEntry)
+		if header.Typeflag == tar.TypeReg {
+			lastFile = name
+		}
+	}
+	fsys.sortDirs()
+}
+
+func newTocChunk(entry tocEntry, fileSize, end int64) tocChunk {
+	size := entry.ChunkSize
+	if size == 0 {
+		size = fileSize - entry.ChunkOffset
+	}
+	digest := entry.ChunkDigest
+	if digest == "" && entry.ChunkOffset == 0 && size == fileSize {
+		digest = entry.Digest
+	}
+	return tocChunk{
+		offset:     entry.Offset,
+		end:        end,
+		fileOffset: entry.ChunkOffset,
+		size:       size,
+		digest:     digest,
+		zeros:      entry.ChunkType == "zeros",
+	}
+}
+
+// io.ReaderAt over a file in a TOC indexed archive. The most recently used
+// chunk is kept decompressed so sequential reads only fetch each chunk once.
+type tocFile struct {
+	fsys   *RemoteTarFS
+	chunks []tocChunk
+	size   int64
+
+	mutex  sync.Mutex
+	cached int
+	data   []byte
+}
+
+func (f *tocFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off+int64(n) < f.size {
+		position := off + int64(n)
+		i := sort.Search(len(f.chunks), func(i int) bool {
+			return f.chunks[i].fileOffset+f.chunks[i].size > position
+		})
+		if i == len(f.chunks) || f.chunks[i].fileOffset > position {
+			return n, fmt.Errorf("no chunk covers offset %d", position)
+		}
+		data, err := f.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[position-f.chunks[i].fileOffset:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *tocFile) chunk(i int) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.data != nil && f.cached == i {
+		return f.data, nil
+	}
+	data, err := f.fsys.readChunk(f.chunks[i])
+	if err != nil {
+		return nil, err
+	}
+	f.cached, f.data = i, data
+	return data, nil
+}
+
+// Downloads and decompresses a single chunk, verifying it against its
+// digest from the TOC.
+func (fsys *RemoteTarFS) readChunk(chunk tocChunk) ([]byte, error) {
+	if chunk.zeros {
+		return make([]byte, chunk.size), nil
+	}
+	if chunk.end <= chunk.offset {
+		return nil, fmt.Errorf("invalid compressed range %d-%d in TOC", chunk.offset, chunk.end)
+	}
+	compressed := make([]byte, chunk.end-chunk.offset)
+	if _, err := fsys.reader.ReadAt(compressed, chunk.offset); err != nil {
+		return nil, err
+	}
+	reader, err := fsys.decompress(compressed)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, chunk.size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk at %d: %w", chunk.offset, err)
+	}
+	if chunk.digest != "" {
+		algorithm, expected, _ := strings.Cut(chunk.digest, ":")
+		if algorithm != "sha256" {
+			return nil, errors.New("unsupported chunk digest " + chunk.digest)
+		}
+		sum := sha256.Sum256(data)
+		if actual := hex.EncodeToString(sum[:]); actual != expected {
+			return nil, fmt.Errorf("chunk at %d has digest sha256:%s, TOC says %s", chunk.offset, actual, chunk.digest)
+		}
+	}
+	return data, nil
+}
+
+// There's no zstd decoder in the standard library, so frames are handed to
+// the zstd binary.
+func zstdDecompress(compressed []byte) (io.Reader, error) {
+	cmd := exec.Command("zstd", "-d", "-c", "-q")
+	cmd.Stdin = bytes.NewReader(compressed)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("reading zstd:chunked layers needs zstd in PATH")
+	} else if err != nil {
+		return nil, fmt.Errorf("zstd failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return bytes.NewReader(output), nil
+}
@@ -0,0 +1,195 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// Writes through to whichever gzip member is currently open, so a single
+// tar.Writer can be split across members like eStargz does.
+type gzipMembers struct {
+	blob bytes.Buffer
+	gz   *gzip.Writer
+}
+
+func (m *gzipMembers) Write(p []byte) (int, error) { return m.gz.Write(p) }
+
+func (m *gzipMembers) next() int64 {
+	if m.gz != nil {
+		m.gz.Close()
+	}
+	m.gz = gzip.NewWriter(&m.blob)
+	return int64(m.blob.Len())
+}
+
+func chunkDigest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func buildEstargz(files map[string]string, chunkSize int, corrupt bool) []byte {
+	members := &gzipMembers{}
+	members.next()
+	tw := tar.NewWriter(members)
+	entries := []tocEntry{{Name: "dir/", Type: "dir", Mode: 0755}}
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, data := range files {
+		members.next()
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+		entry := tocEntry{Name: name, Type: "reg", Mode: 0644, Size: int64(len(data)), Digest: chunkDigest(data)}
+		for written := 0; written < len(data); written += chunkSize {
+			chunk := data[written:minInt(written+chunkSize, len(data))]
+			entry.Offset = members.next()
+			entry.ChunkOffset = int64(written)
+			entry.ChunkSize = 0
+			if len(chunk) == chunkSize {
+				entry.ChunkSize = int64(chunkSize)
+			}
+			entry.ChunkDigest = chunkDigest(chunk)
+			if corrupt {
+				entry.ChunkDigest = chunkDigest("")
+			}
+			tw.Write([]byte(chunk))
+			entries = append(entries, entry)
+			entry = tocEntry{Name: name, Type: "chunk"}
+		}
+		if len(data) == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	entries = append(entries, tocEntry{Name: "hard", Type: "hardlink", LinkName: "dir/big"})
+	tw.Flush()
+	members.gz.Close()
+
+	tocOffset := int64(members.blob.Len())
+	index, _ := json.Marshal(toc{Version: 1, Entries: entries})
+	gz := gzip.NewWriter(&members.blob)
+	tocTar := tar.NewWriter(gz)
+	tocTar.WriteHeader(&tar.Header{Name: estargzTocName, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(index))})
+	tocTar.Write(index)
+	tocTar.Close()
+	gz.Close()
+
+	footer, _ := gzip.NewWriterLevel(&members.blob, gzip.NoCompression)
+	footer.Header.Extra = append([]byte{'S', 'G', 22, 0}, fmt.Sprintf("%016xSTARGZ", tocOffset)...)
+	footer.Close()
+	return members.blob.Bytes()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestEstargzFS(t *testing.T) {
+	files := map[string]string{
+		"dir/big":   RandomString(10000),
+		"dir/small": "hello",
+		"empty":     "",
+	}
+	blob := buildEstargz(files, 4096, false)
+	if offset, footerSize := parseStargzFooter(blob[len(blob)-72:]); footerSize < legacyStargzFooterSize || offset <= 0 {
+		t.Fatalf("Footer not recognized, got %d/%d", offset, footerSize)
+	}
+	fsys, err := openTestRemoteTarFS(TestDownloader{string(blob), true, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fsys.entries["dir/big"].chunks) != 3 {
+		t.Fatalf("Got %d chunks for dir/big, wanted 3", len(fsys.entries["dir/big"].chunks))
+	}
+	for name, expected := range files {
+		if actual, err := fs.ReadFile(fsys, name); err != nil || string(actual) != expected {
+			t.Fatalf("ReadFile(%s) got %d bytes, %v", name, len(actual), err)
+		}
+	}
+	if actual, err := fs.ReadFile(fsys, "hard"); err != nil || string(actual) != files["dir/big"] {
+		t.Fatalf("ReadFile(hard) got %d bytes, %v", len(actual), err)
+	}
+
+	blob = buildEstargz(files, 4096, true)
+	fsys, err = openTestRemoteTarFS(TestDownloader{string(blob), true, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(fsys, "dir/small"); err == nil || !strings.Contains(err.Error(), "TOC says") {
+		t.Fatalf("Expected a digest mismatch, got %v", err)
+	}
+}
+
+func zstdCompress(t *testing.T, data []byte) []byte {
+	cmd := exec.Command("zstd", "-c", "-q")
+	cmd.Stdin = bytes.NewReader(data)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+func skippableFrame(data []byte) []byte {
+	frame := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(frame, 0x184D2A50)
+	binary.LittleEndian.PutUint32(frame[4:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func TestZstdChunkedFS(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not installed")
+	}
+	files := map[string]string{"a/one": "first file", "two": RandomString(5000)}
+	var blob bytes.Buffer
+	var entries []tocEntry
+	for _, name := range []string{"a/one", "two"} {
+		var member bytes.Buffer
+		tw := tar.NewWriter(&member)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(files[name]))})
+		blob.Write(zstdCompress(t, member.Bytes()))
+		offset := int64(blob.Len())
+		blob.Write(zstdCompress(t, []byte(files[name])))
+		entries = append(entries, tocEntry{
+			Name: name, Type: "reg", Mode: 0600, Size: int64(len(files[name])),
+			Offset: offset, EndOffset: int64(blob.Len()), Digest: chunkDigest(files[name]),
+		})
+	}
+	entries = append(entries, tocEntry{Name: "sparse", Type: "reg", Mode: 0600, Size: 100, Offset: 1, EndOffset: 2, ChunkType: "zeros"})
+	index, _ := json.Marshal(toc{Version: 1, Entries: entries})
+	manifest := zstdCompress(t, index)
+	blob.Write(skippableFrame(manifest))
+	footer := make([]byte, zstdChunkedFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(blob.Len()-len(manifest)))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(manifest)))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(index)))
+	binary.LittleEndian.PutUint64(footer[24:], zstdChunkedManifestType)
+	copy(footer[56:], zstdChunkedFooterMagic)
+	blob.Write(skippableFrame(footer))
+
+	fsys, err := openTestRemoteTarFS(TestDownloader{blob.String(), true, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range files {
+		if actual, err := fs.ReadFile(fsys, name); err != nil || string(actual) != expected {
+			t.Fatalf("ReadFile(%s) got %q, %v", name, actual, err)
+		}
+	}
+	if actual, err := fs.ReadFile(fsys, "sparse"); err != nil || string(actual) != string(make([]byte, 100)) {
+		t.Fatalf("ReadFile(sparse) got %q, %v", actual, err)
+	}
+	if info, err := fs.Stat(fsys, "a/one"); err != nil || info.Mode() != 0600 {
+		t.Fatalf("Stat(a/one) got %v, %v", info, err)
+	}
+}
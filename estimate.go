@@ -0,0 +1,58 @@
+package fastar
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type downloadEstimate struct {
+	Url               string `json:"url"`
+	Size              int64  `json:"size"`
+	SupportsRange     bool   `json:"supports_range"`
+	SupportsMultipart bool   `json:"supports_multipart"`
+	NumWorkers        int    `json:"num_workers"`
+	ChunkSize         int64  `json:"chunk_size"`
+	// Memory pinned by the download workers' chunk buffers.
+	BufferBytes int64 `json:"buffer_bytes"`
+	// Null when we've never downloaded from this origin before.
+	HistoricalBytesPerSecond *float64 `json:"historical_bytes_per_second"`
+	EstimatedSeconds         *float64 `json:"estimated_seconds"`
+	// Requests the download takes without retries, by the classes the run
+	// summary counts.
+	EstimatedRequests map[string]int64 `json:"estimated_requests"`
+}
+
+// Only query file metadata and print how long we expect the download to
+// take and how much memory it will need, without downloading anything.
+func printEstimate(rawUrl string, downloader Downloader) {
+	size, supportsRange, supportsMultipart := downloader.GetFileInfo()
+	estimate := downloadEstimate{
+		Url:               rawUrl,
+		Size:              size,
+		SupportsRange:     supportsRange,
+		SupportsMultipart: supportsMultipart,
+		NumWorkers:        opts.NumWorkers,
+		ChunkSize:         opts.ChunkSize,
+		BufferBytes:       opts.ChunkSize * int64(opts.NumWorkers),
+	}
+	// Mirrors the single stream fallback in GetDownloadStream()
+	if !supportsRange || size < opts.ChunkSize {
+		estimate.NumWorkers = 1
+		estimate.BufferBytes = 0
+		estimate.EstimatedRequests = map[string]int64{"head": 1, "get": 1}
+	} else if supportsMultipart {
+		estimate.EstimatedRequests = map[string]int64{"head": 1, "multipart_get": int64(opts.NumWorkers)}
+	} else {
+		estimate.EstimatedRequests = map[string]int64{"head": 1, "ranged_get": (size + opts.ChunkSize - 1) / opts.ChunkSize}
+	}
+	if stats, ok := loadCapabilityCache().Origins[originKey(rawUrl)]; ok && stats.BytesPerSecond > 0 {
+		seconds := float64(size) / stats.BytesPerSecond
+		estimate.HistoricalBytesPerSecond = &stats.BytesPerSecond
+		estimate.EstimatedSeconds = &seconds
+	}
+	out, err := json.MarshalIndent(estimate, "", "  ")
+	if err != nil {
+		fatal("Failed to encode estimate: ", err.Error())
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,76 @@
+package fastar
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEstimate(t *testing.T) {
+	data := RandomString(2500000)
+	var gets atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer server.Close()
+	url := server.URL + "/data.bin"
+	cacheFile := filepath.Join(t.TempDir(), "capabilities.json")
+	// Reads fail 95% of the time in tests, so the real download retries a
+	// lot.
+	flags := []string{"--cache-file", cacheFile, "--download-workers", "2", "--min-speed", "0", "--retry-count", "20000", "--retry-wait", "0"}
+
+	estimate := func(chunkSize string) downloadEstimate {
+		before := gets.Load()
+		stdout, _ := runFastar(t, append([]string{url, "--estimate", "--chunk-size", chunkSize}, flags...)...)
+		if gets.Load() != before {
+			t.Fatalf("Estimating sent %d GET requests", gets.Load()-before)
+		}
+		var estimate downloadEstimate
+		if err := json.Unmarshal(stdout, &estimate); err != nil {
+			t.Fatalf("Estimate %q isn't JSON: %v", stdout, err)
+		}
+		if estimate.Url != url || estimate.Size != int64(len(data)) {
+			t.Fatalf("Unexpected estimate %+v", estimate)
+		}
+		return estimate
+	}
+
+	parallel := estimate("1")
+	if !parallel.SupportsRange || parallel.NumWorkers != 2 || parallel.ChunkSize != 1e6 || parallel.BufferBytes != 2e6 {
+		t.Fatalf("Unexpected parallel estimate %+v", parallel)
+	}
+	if !reflect.DeepEqual(parallel.EstimatedRequests, map[string]int64{"head": 1, "ranged_get": 3}) {
+		t.Fatalf("Unexpected requests %v", parallel.EstimatedRequests)
+	}
+	if parallel.HistoricalBytesPerSecond != nil || parallel.EstimatedSeconds != nil {
+		t.Fatalf("Estimated a duration without having downloaded from %s", server.URL)
+	}
+	// Smaller than a chunk, downloaded on a single stream.
+	single := estimate("3")
+	if single.NumWorkers != 1 || single.BufferBytes != 0 || !reflect.DeepEqual(single.EstimatedRequests, map[string]int64{"head": 1, "get": 1}) {
+		t.Fatalf("Unexpected single stream estimate %+v", single)
+	}
+
+	// Downloading records the origin's throughput for the next estimate.
+	stdout, _ := runFastar(t, append([]string{url, "--to-stdout", "--chunk-size", "1"}, flags...)...)
+	if string(stdout) != data {
+		t.Fatalf("Downloaded %d bytes instead of %d", len(stdout), len(data))
+	}
+	informed := estimate("1")
+	if informed.HistoricalBytesPerSecond == nil || *informed.HistoricalBytesPerSecond <= 0 || informed.EstimatedSeconds == nil {
+		t.Fatalf("Expected a duration estimate after downloading, got %+v", informed)
+	}
+	if expected := float64(len(data)) / *informed.HistoricalBytesPerSecond; math.Abs(*informed.EstimatedSeconds-expected) > 1e-9*expected {
+		t.Fatalf("Estimated %fs, wanted %fs", *informed.EstimatedSeconds, expected)
+	}
+}
@@ -0,0 +1,130 @@
+package fastar
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Machine-readable event stream used by --porcelain and --events-fd.
+//
+// Every event is a JSON object containing at least an "event" and "time"
+// key. With --porcelain they are written to stderr one per line, with
+// --events-fd each event is prefixed by its length as a 4 byte big endian
+// integer. The set of event names and their fields is part of fastar's
+// stable interface, new fields may be added but existing ones are never
+// renamed or removed:
+//
+//	start            url, filename (fastar create: url, directory, compression)
+//	file_info        size, supports_range, supports_multipart
+//	head_rejected    status (the server refused HEAD, the size is learned with a ranged GET)
+//	compression      type, layers (the layers of the archive, outermost first, each "tar", "gzip",
+//	                 "lz4", "zstd", "xz", "bzip2" or "gpg"; type is the last of them)
+//	chunk_started    worker, start, end
+//	chunk_finished   worker, start, end, millis
+//	retry            worker, offset, reason
+//	multipart_fallback offset, reason (a misordered multipart response, single ranges from then on)
+//	fallback         offset, reason (a parallel download restarting on a single stream)
+//	mirror_failed    url, reason
+//	deadline_reached downloaded, size, fraction (--deadline-soft stopped the download)
+//	circuit_open     failures, reasons (failed attempts by reason, right before the transfer fails)
+//	throttled        status
+//	object_changed   url, validator
+//	headers_refreshed generation (--header-command ran again)
+//	credentials_refreshed origin, generation (--credential-helper ran again)
+//	connections_warmed connections, duration_ms
+//	auto_tune        origin, chunk_size, num_workers, trials
+//	profiles_applied profiles
+//	resume           path, done, checkpoint (--resume picked up an earlier extraction)
+//	disk_space       needed, free
+//	file_extracted   path, type, size
+//	entry_skipped    path, reason, type (not for every reason)
+//	write_workers_changed device, workers, latency_ms
+//	manifest_verified files, mismatched, unlisted, missing
+//	hash_manifest_written path, algorithm, files
+//	cas_manifest_written path, files, new_bytes, deduplicated_bytes
+//	audit_difference path, field, archive, disk
+//	audit_finished   entries, differences
+//	synced           mode, millis (--post-fsync)
+//	device_written   device, bytes
+//	row_groups_fetched format, row_groups, bytes
+//	part_uploaded    part, size (fastar create uploading in parts)
+//	created          url, entries, bytes_read, bytes_written, millis
+//	worker_finished  worker, mbps
+//	slow_chunks      final, chunks (each worker, start, end, millis, attempts)
+//	file_size_histogram buckets (each bucket, files, bytes, mbps)
+//	request_counts   head, get, ranged_get and multipart_get by backend
+//	progress         downloaded, size, mbps, eta_seconds, workers (--progress-json only)
+//	proxy_listening  url, address, size
+//	paused           (no extra fields)
+//	resumed          (no extra fields)
+//	interrupted      signal (the first SIGINT or SIGTERM, fastar stops and exits with 128 plus it)
+//	finished         (no extra fields)
+//	error            code, class, message (right before fastar exits or a library call fails)
+//	log              message (any free-form log line fastar would otherwise print, --porcelain only)
+var eventLock sync.Mutex
+
+// Set by setupEventsFd() when --events-fd is passed.
+var eventsFile *os.File
+
+func emitEvent(event string, fields map[string]interface{}) {
+	if metrics != nil {
+		recordMetric(event, fields)
+	}
+	if !opts.Porcelain && eventsFile == nil {
+		return
+	}
+	record := map[string]interface{}{}
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["event"] = event
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		// Should be impossible since we only ever pass plain values
+		line, _ = json.Marshal(map[string]interface{}{"event": "log", "message": err.Error()})
+	}
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if opts.Porcelain {
+		os.Stderr.Write(append(line, '\n'))
+	}
+	if eventsFile != nil && event != "log" {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(line)))
+		if _, err := eventsFile.Write(append(length[:], line...)); err != nil {
+			// Supervisor went away, don't let that take down the download.
+			eventsFile = nil
+		}
+	}
+}
+
+// Wraps free-form log output (including fatal error messages) into "log"
+// events so stderr stays parseable as line-delimited JSON.
+type porcelainLogWriter struct{}
+
+func (porcelainLogWriter) Write(p []byte) (int, error) {
+	emitEvent("log", map[string]interface{}{"message": strings.TrimRight(string(p), "\n")})
+	return len(p), nil
+}
+
+func setupEventsFd() {
+	if opts.EventsFd > 0 {
+		eventsFile = os.NewFile(uintptr(opts.EventsFd), "events")
+		if eventsFile == nil {
+			fatalf("Invalid --events-fd %d", opts.EventsFd)
+		}
+	}
+}
+
+func setupPorcelain() {
+	if opts.Porcelain {
+		log.SetFlags(0)
+		log.SetOutput(porcelainLogWriter{})
+	}
+}
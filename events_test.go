@@ -0,0 +1,209 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs Main with the JSON encoded arguments in FASTAR_TEST_MAIN when the
+// test binary is started as fastar by a test, see runFastar.
+func TestMain(m *testing.M) {
+	if encoded := os.Getenv("FASTAR_TEST_MAIN"); encoded != "" {
+		var args []string
+		if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+			panic(err)
+		}
+		os.Args = append([]string{"fastar"}, args...)
+		Main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Runs fastar with args in a child process, returning what it wrote to
+// stdout and stderr.
+func runFastar(t *testing.T, args ...string) ([]byte, []byte) {
+	return runFastarWithFiles(t, nil, args...)
+}
+
+// Like runFastar, with files passed on as fd 3 and up.
+func runFastarWithFiles(t *testing.T, files []*os.File, args ...string) ([]byte, []byte) {
+	encoded, _ := json.Marshal(args)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FASTAR_TEST_MAIN="+string(encoded))
+	cmd.ExtraFiles = files
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("fastar %s failed: %v\n%s", strings.Join(args, " "), err, stderr.Bytes())
+	}
+	return stdout.Bytes(), stderr.Bytes()
+}
+
+func TestPorcelainEvents(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	gz.Close()
+	archivePath := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := os.WriteFile(archivePath, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	_, output := runFastar(t, "extract", archivePath, "--directory", dir, "--porcelain")
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		var event map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Line %q isn't a JSON event: %v", scanner.Text(), err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, event["time"].(string)); err != nil {
+			t.Fatalf("Event %v has an invalid time: %v", event, err)
+		}
+		events = append(events, event)
+	}
+
+	byName := map[string][]map[string]interface{}{}
+	for _, event := range events {
+		name := event["event"].(string)
+		byName[name] = append(byName[name], event)
+	}
+	for name, fields := range map[string][]string{
+		"start":          {"url", "filename"},
+		"file_info":      {"size", "supports_range", "supports_multipart"},
+		"compression":    {"type", "layers"},
+		"file_extracted": {"path", "type", "size"},
+		"finished":       {},
+		"log":            {"message"},
+	} {
+		if len(byName[name]) == 0 {
+			t.Fatalf("No %s event in %s", name, output)
+		}
+		for _, event := range byName[name] {
+			for _, field := range fields {
+				if _, ok := event[field]; !ok {
+					t.Fatalf("%s event %v is missing %s", name, event, field)
+				}
+			}
+		}
+	}
+	if start := byName["start"][0]; start["url"] != archivePath || start["filename"] != "archive.tar.gz" {
+		t.Fatalf("Unexpected start event %v", start)
+	}
+	if size := byName["file_info"][0]["size"]; size != float64(archive.Len()) {
+		t.Fatalf("file_info reported %v bytes instead of %d", size, archive.Len())
+	}
+	compression := byName["compression"][0]
+	if compression["type"] != "tar" || !reflect.DeepEqual(compression["layers"], []interface{}{"gzip", "tar"}) {
+		t.Fatalf("Unexpected compression event %v", compression)
+	}
+	extracted := map[string]interface{}{}
+	for _, event := range byName["file_extracted"] {
+		extracted[event["path"].(string)] = event["type"]
+	}
+	if extracted[filepath.Join(dir, "dir")] != "dir" || extracted[filepath.Join(dir, "dir", "file")] != "file" {
+		t.Fatalf("Unexpected file_extracted events %v", byName["file_extracted"])
+	}
+	if last := events[len(events)-1]["event"]; last != "finished" {
+		t.Fatalf("The last event is %v instead of finished", last)
+	}
+
+	// Everything emitted has to be part of the documented schema.
+	source, err := os.ReadFile("events.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range byName {
+		if !bytes.Contains(source, []byte("//\t"+name+" ")) {
+			t.Fatalf("The %s event isn't documented in events.go", name)
+		}
+	}
+}
+
+func TestEventsFd(t *testing.T) {
+	data := RandomString(2500000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer server.Close()
+	// Reads fail 95% of the time in tests, so there are retries to report.
+	args := []string{server.URL + "/data.bin", "--to-stdout", "--events-fd", "3", "--chunk-size", "1", "--download-workers", "2", "--min-speed", "0", "--retry-count", "20000", "--retry-wait", "0"}
+
+	events, err := os.Create(filepath.Join(t.TempDir(), "events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	if stdout, _ := runFastarWithFiles(t, []*os.File{events}, args...); string(stdout) != data {
+		t.Fatalf("Downloaded %d bytes instead of %d", len(stdout), len(data))
+	}
+	written, err := os.ReadFile(events.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	finished := map[float64]bool{}
+	for len(written) > 0 {
+		if len(written) < 4 || len(written) < 4+int(binary.BigEndian.Uint32(written)) {
+			t.Fatalf("Truncated event %q", written)
+		}
+		length := int(binary.BigEndian.Uint32(written))
+		var event map[string]interface{}
+		if err := json.Unmarshal(written[4:4+length], &event); err != nil {
+			t.Fatalf("Event %q isn't JSON: %v", written[4:4+length], err)
+		}
+		written = written[4+length:]
+		name := event["event"].(string)
+		names = append(names, name)
+		switch name {
+		case "log":
+			t.Fatalf("Log line %v was written to --events-fd", event)
+		case "fallback":
+			t.Fatalf("The parallel download fell back to a single stream, %v", event)
+		case "chunk_finished":
+			finished[event["start"].(float64)] = true
+		case "retry":
+			if _, ok := event["reason"]; !ok {
+				t.Fatalf("Retry event %v has no reason", event)
+			}
+		}
+	}
+	if len(names) == 0 || names[0] != "start" || names[len(names)-1] != "finished" {
+		t.Fatalf("Unexpected events %v", names)
+	}
+	if !reflect.DeepEqual(finished, map[float64]bool{0: true, 1e6: true, 2e6: true}) {
+		t.Fatalf("Chunks finished at %v", finished)
+	}
+
+	// A supervisor that went away doesn't stop the download, here a single
+	// stream one.
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	defer writer.Close()
+	if stdout, _ := runFastarWithFiles(t, []*os.File{writer}, append(args, "--chunk-size", "3")...); string(stdout) != data {
+		t.Fatalf("Downloaded %d bytes without a supervisor, instead of %d", len(stdout), len(data))
+	}
+}
@@ -0,0 +1,237 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// --expected-manifest is an allowlist of the paths an archive may contain,
+// optionally with the digest each regular file and hard link must have,
+// enforced before an entry is written so a compromised artifact can't add
+// files to a production node. It takes the formats of --manifest, plus
+// lines that are just a path and JSON paths mapped to "" for entries whose
+// content isn't pinned. Directories leading to a listed path are allowed
+// too. Anything else stops the extraction, or is left out with
+// --unexpected-entries=skip. --record-manifest writes such a manifest of
+// every entry of a trusted extraction.
+var expectedManifest struct {
+	entries map[string]*manifestEntry
+	dirs    map[string]bool
+	mutex   sync.Mutex
+	skipped int
+}
+
+var recordedManifest struct {
+	mutex   sync.Mutex
+	entries map[string]string
+}
+
+// Entries with an empty algorithm may have any content.
+func parseExpectedManifest(data []byte) (map[string]*manifestEntry, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var digests map[string]string
+		if err := json.Unmarshal(trimmed, &digests); err != nil {
+			return nil, err
+		}
+		entries := map[string]*manifestEntry{}
+		for name, digest := range digests {
+			entry := &manifestEntry{}
+			if digest != "" {
+				algorithm, hexDigest, err := parseManifestDigest(digest)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", name, err.Error())
+				}
+				entry.algorithm, entry.digest = algorithm, hexDigest
+			}
+			entries[manifestName(name)] = entry
+		}
+		return entries, nil
+	}
+	entries := map[string]*manifestEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Lines that aren't a digest and a name are a path on their own.
+		parsed, err := parseManifest([]byte(line))
+		if err != nil {
+			entries[manifestName(line)] = &manifestEntry{}
+			continue
+		}
+		for name, entry := range parsed {
+			entries[name] = entry
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func loadExpectedManifest() {
+	data, err := os.ReadFile(opts.ExpectManifest)
+	if err != nil {
+		fatalErr("Failed to read --expected-manifest: ", err)
+	}
+	entries, err := parseExpectedManifest(data)
+	if err != nil {
+		fatal("Failed to parse --expected-manifest: ", err.Error())
+	}
+	dirs := map[string]bool{".": true}
+	for name := range entries {
+		for dir := path.Dir(name); dir != "." && dir != "/" && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	expectedManifest.entries = entries
+	expectedManifest.dirs = dirs
+	expectedManifest.skipped = 0
+}
+
+// Fails the extraction for an entry --expected-manifest doesn't allow, or
+// returns false to skip it with --unexpected-entries=skip.
+func rejectUnexpected(name string, header *tar.Header, reason string) bool {
+	if opts.Unexpected != "skip" {
+		message := fmt.Sprintf("%s %s, refusing to extract it", name, reason)
+		log.Println(message)
+		fail(&Error{int(ErrCorrupt), message})
+	}
+	log.Printf("Skipping %s, it %s\n", name, reason)
+	emitEvent("entry_skipped", map[string]interface{}{"path": name, "type": string(header.Typeflag), "reason": reason})
+	expectedManifest.mutex.Lock()
+	defer expectedManifest.mutex.Unlock()
+	expectedManifest.skipped++
+	return false
+}
+
+// Whether the entry called name, relative to the root of the extraction,
+// may be extracted. Its content is checked separately once it's read.
+func expectedEntry(name string, header *tar.Header) bool {
+	if opts.ExpectManifest == "" {
+		return true
+	}
+	name = manifestName(name)
+	if _, listed := expectedManifest.entries[name]; listed {
+		return true
+	}
+	if header.Typeflag == tar.TypeDir && expectedManifest.dirs[name] {
+		return true
+	}
+	return rejectUnexpected(name, header, "isn't in --expected-manifest")
+}
+
+// Whether buf is the content --expected-manifest allows for name.
+func expectedContent(name string, buf []byte, header *tar.Header) bool {
+	if opts.ExpectManifest == "" {
+		return true
+	}
+	name = manifestName(name)
+	entry := expectedManifest.entries[name]
+	if entry == nil || entry.algorithm == "" {
+		return true
+	}
+	hash := newHash(entry.algorithm)
+	hash.Write(buf)
+	if hex.EncodeToString(hash.Sum(nil)) == entry.digest {
+		return true
+	}
+	return rejectUnexpected(name, header, "doesn't match its digest in --expected-manifest")
+}
+
+// Hard links are checked against the content of their target before
+// they're created.
+func expectedLinkContent(name, target string, header *tar.Header) bool {
+	if opts.ExpectManifest == "" {
+		return true
+	}
+	if entry := expectedManifest.entries[manifestName(name)]; entry == nil || entry.algorithm == "" {
+		return true
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		fatalErr("Failed to read hard link target to check against --expected-manifest: ", err)
+	}
+	return expectedContent(name, data, header)
+}
+
+func logSkippedUnexpected() {
+	if expectedManifest.skipped > 0 {
+		log.Printf("Skipped %d entries not allowed by --expected-manifest\n", expectedManifest.skipped)
+	}
+}
+
+// Records an extracted entry for --record-manifest. digest is empty for
+// entries other than regular files.
+func recordManifestEntry(name string, digest string) {
+	if opts.RecordManifest == "" {
+		return
+	}
+	recordedManifest.mutex.Lock()
+	defer recordedManifest.mutex.Unlock()
+	if recordedManifest.entries == nil {
+		recordedManifest.entries = map[string]string{}
+	}
+	recordedManifest.entries[manifestName(name)] = digest
+}
+
+func recordManifestFile(name string, buf []byte) {
+	if opts.RecordManifest == "" {
+		return
+	}
+	hash := newHash("sha256")
+	hash.Write(buf)
+	recordManifestEntry(name, "sha256:"+hex.EncodeToString(hash.Sum(nil)))
+}
+
+// Hard links have the digest of their target, which has been written (and
+// hashed) by the time the link is created.
+func recordManifestLink(target, name string) {
+	if opts.RecordManifest == "" {
+		return
+	}
+	recordedManifest.mutex.Lock()
+	digest := recordedManifest.entries[manifestName(target)]
+	recordedManifest.mutex.Unlock()
+	recordManifestEntry(name, digest)
+}
+
+// Writes --record-manifest as JSON, which --expected-manifest takes.
+func writeRecordedManifest() {
+	if opts.RecordManifest == "" {
+		return
+	}
+	entries := recordedManifest.entries
+	if entries == nil {
+		entries = map[string]string{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		fatal("Failed to encode --record-manifest: ", err.Error())
+	}
+	if err := os.WriteFile(opts.RecordManifest, append(data, '\n'), 0644); err != nil {
+		fatalErr("Failed to write --record-manifest: ", err)
+	}
+	log.Printf("Recorded %d entries in --record-manifest %s\n", len(entries), opts.RecordManifest)
+	recordedManifest.entries = nil
+}
+
+// Records an entry extracted by an earlier --resume run.
+func recordExtractedEntry(filename string, header *tar.Header) {
+	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeGNUSparse && header.Typeflag != tar.TypeLink {
+		recordManifestEntry(relativeToOutputDir(filename), "")
+		return
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fatalErr("Failed to read file to record in --record-manifest: ", err)
+	}
+	recordManifestFile(relativeToOutputDir(filename), data)
+}
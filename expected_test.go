@@ -0,0 +1,102 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseExpectedManifest(t *testing.T) {
+	sha := sha256.Sum256([]byte("a"))
+	shaHex := hex.EncodeToString(sha[:])
+	for _, manifest := range []string{
+		shaHex + "  ./a\ndir/my link\n# comment\n",
+		`{"a": "sha256:` + shaHex + `", "dir/my link": ""}`,
+	} {
+		entries, err := parseExpectedManifest([]byte(manifest))
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", manifest, err)
+		}
+		if len(entries) != 2 || entries["a"].digest != shaHex || entries["dir/my link"] == nil || entries["dir/my link"].algorithm != "" {
+			t.Fatalf("Unexpected entries for %q: %v", manifest, entries)
+		}
+	}
+	if _, err := parseExpectedManifest([]byte(`{"a": "sha512:` + shaHex + `"}`)); err == nil {
+		t.Fatal("Expected an unsupported digest to be rejected")
+	}
+}
+
+func TestExtractExpectedManifest(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	contents := map[string]string{"a": RandomString(1000), "dir/b": RandomString(5000)}
+	archive := func(extra string, tampered bool) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+		for _, name := range []string{"a", "dir/b"} {
+			data := contents[name]
+			if tampered && name == "dir/b" {
+				data = RandomString(int64(len(data)))
+			}
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+			tw.Write([]byte(data))
+		}
+		tw.WriteHeader(&tar.Header{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "a"})
+		tw.WriteHeader(&tar.Header{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "b"})
+		if extra != "" {
+			tw.WriteHeader(&tar.Header{Name: extra, Typeflag: tar.TypeReg, Mode: 0755, Size: 4})
+			tw.Write([]byte("evil"))
+		}
+		tw.Close()
+		return &buf
+	}
+	manifest := filepath.Join(t.TempDir(), "expected.json")
+	options := DefaultOptions()
+	options.RecordManifest = manifest
+	if err := Extract(context.Background(), archive("", false), t.TempDir(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	options = DefaultOptions()
+	options.ExpectManifest = manifest
+	if err := Extract(context.Background(), archive("", false), t.TempDir(), options); err != nil {
+		t.Fatalf("Expected the recorded manifest to allow the archive, got %v", err)
+	}
+
+	dir := t.TempDir()
+	err := Extract(context.Background(), archive("dir/sub/backdoor", false), dir, options)
+	var fastarErr *Error
+	if !errors.As(err, &fastarErr) || !errors.Is(err, ErrCorrupt) || fastarErr.Message != "dir/sub/backdoor isn't in --expected-manifest, refusing to extract it" {
+		t.Fatalf("Expected the unlisted entry to fail the extraction, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir/sub/backdoor")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the unlisted entry not to be written, got %v", err)
+	}
+
+	dir = t.TempDir()
+	err = Extract(context.Background(), archive("", true), dir, options)
+	if !errors.As(err, &fastarErr) || fastarErr.Message != "dir/b doesn't match its digest in --expected-manifest, refusing to extract it" {
+		t.Fatalf("Expected the tampered file to fail the extraction, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir/b")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the tampered file not to be written, got %v", err)
+	}
+
+	options.Unexpected = "skip"
+	dir = t.TempDir()
+	if err := Extract(context.Background(), archive("backdoor", true), dir, options); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{"a": true, "dir/link": true, "dir/symlink": true, "dir/b": false, "backdoor": false} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Fatalf("Expected %s to exist: %v, got %v", name, exists, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package fastar
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+// Normalizes an archive path for comparison, so "./etc/app.conf",
+// "/etc/app.conf" and "etc//app.conf" all name the same entry.
+func archivePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Streams the content of the entry named name to out and returns as soon as
+// it's written, without reading the rest of the archive. Returns false if
+// the archive has no such entry. Entries other than regular files fail,
+// hard links name the earlier entry holding their content.
+func ExtractFile(stream io.Reader, name string, out io.Writer) bool {
+	wanted := archivePath(name)
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			fatalStream("ExtractFile: Next() failed: ", err)
+		}
+		dumpHeader(header)
+		if archivePath(header.Name) != wanted {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+		case tar.TypeLink:
+			fatalf("%s is a hard link to %s, extract that instead", header.Name, header.Linkname)
+		case tar.TypeSymlink:
+			fatalf("%s is a symlink to %s, extract that instead", header.Name, header.Linkname)
+		default:
+			fatalf("%s isn't a regular file", header.Name)
+		}
+		n, err := io.Copy(out, tarReader)
+		if err != nil {
+			fatalStream("Failed to write file to stdout: ", err)
+		}
+		log.Printf("Extracted %s (%d bytes), skipping the rest of the archive\n", header.Name, n)
+		emitEvent("file_extracted", map[string]interface{}{"path": header.Name, "type": "file", "size": n})
+		return true
+	}
+}
@@ -0,0 +1,44 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read past the extracted file")
+}
+
+func TestExtractFile(t *testing.T) {
+	contents := RandomString(10000)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "etc/other.conf", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("other"))
+	tw.WriteHeader(&tar.Header{Name: "etc/app.conf", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+	tw.Write([]byte(contents))
+	tw.Flush()
+	found := archive.Len()
+	tw.WriteHeader(&tar.Header{Name: "etc/link.conf", Typeflag: tar.TypeSymlink, Linkname: "app.conf"})
+	tw.Close()
+
+	// Nothing after the entry is read.
+	var out bytes.Buffer
+	if !ExtractFile(io.MultiReader(bytes.NewReader(archive.Bytes()[:found]), failingReader{}), "./etc//app.conf", &out) {
+		t.Fatal("Expected etc/app.conf to be found")
+	}
+	if out.String() != contents {
+		t.Fatalf("Extracted %d bytes instead of the %d byte file", out.Len(), len(contents))
+	}
+
+	out.Reset()
+	if ExtractFile(bytes.NewReader(archive.Bytes()), "etc/missing.conf", &out) || out.Len() != 0 {
+		t.Fatal("Expected a missing entry not to be found")
+	}
+}
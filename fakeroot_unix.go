@@ -0,0 +1,143 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// An unprivileged extraction can't chown files to other users or create
+// device nodes. With --fakeroot-db whatever couldn't be applied is written
+// to a database in the format of fakeroot's -s, keyed by device and inode
+// like fakeroot does, so running the image build under fakeroot -i shows
+// the files with the owners, modes and devices of the archive. Device
+// nodes are extracted as empty regular files, as fakeroot's mknod does.
+type fakerootEntry struct {
+	dev, ino, mode, uid, gid, nlink, rdev uint64
+}
+
+type fakerootKey struct {
+	dev, ino uint64
+}
+
+var fakeroot struct {
+	mutex   sync.Mutex
+	entries map[fakerootKey]fakerootEntry
+}
+
+// Loads an existing --fakeroot-db, e.g. saved while extracting a previous
+// layer, so that its entries are kept.
+func loadFakerootDb() {
+	fakeroot.entries = map[fakerootKey]fakerootEntry{}
+	file, err := os.Open(opts.FakerootDb)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fatalErr("Failed to open --fakeroot-db: ", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e fakerootEntry
+		_, err := fmt.Sscanf(scanner.Text(), "dev=%x,ino=%d,mode=%o,uid=%d,gid=%d,nlink=%d,rdev=%d", &e.dev, &e.ino, &e.mode, &e.uid, &e.gid, &e.nlink, &e.rdev)
+		if err != nil {
+			fatalf("Failed to parse --fakeroot-db line %q: %s", scanner.Text(), err.Error())
+		}
+		fakeroot.entries[fakerootKey{e.dev, e.ino}] = e
+	}
+	if err := scanner.Err(); err != nil {
+		fatalErr("Failed to read --fakeroot-db: ", err)
+	}
+}
+
+// Records the owner and mode header asked for if path didn't end up with
+// them, and always for device nodes and fifos, whose type only the
+// database knows.
+func recordFakeroot(path string, header *tar.Header) {
+	if opts.FakerootDb == "" {
+		return
+	}
+	var stat unix.Stat_t
+	if err := unix.Lstat(path, &stat); err != nil {
+		fatalErr("Failed to stat for --fakeroot-db: ", err)
+	}
+	mode := uint64(stat.Mode)
+	perm := uint64(header.Mode) & 07777
+	var rdev uint64
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode, rdev = unix.S_IFCHR|perm, uint64(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+	case tar.TypeBlock:
+		mode, rdev = unix.S_IFBLK|perm, uint64(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+	case tar.TypeFifo:
+		mode = unix.S_IFIFO | perm
+	case tar.TypeSymlink:
+		// Symlinks have no mode of their own.
+	default:
+		mode = mode&unix.S_IFMT | perm
+	}
+	if mode == uint64(stat.Mode) && uint64(stat.Uid) == uint64(header.Uid) && uint64(stat.Gid) == uint64(header.Gid) {
+		return
+	}
+	key := fakerootKey{uint64(stat.Dev), uint64(stat.Ino)}
+	fakeroot.mutex.Lock()
+	defer fakeroot.mutex.Unlock()
+	fakeroot.entries[key] = fakerootEntry{key.dev, key.ino, mode, uint64(header.Uid), uint64(header.Gid), uint64(stat.Nlink), rdev}
+}
+
+// Stands in for a device node or fifo with an empty file the database
+// gives its type. Returns false for any other entry.
+func extractFakerootNode(path string, header *tar.Header) bool {
+	if opts.FakerootDb == "" || (header.Typeflag != tar.TypeChar && header.Typeflag != tar.TypeBlock && header.Typeflag != tar.TypeFifo) {
+		return false
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		fatalErr("Failed to create device node placeholder: ", err)
+	}
+	file.Close()
+	chownEntry(path, header.Uid, header.Gid, false)
+	recordFakeroot(path, header)
+	return true
+}
+
+// Writes --fakeroot-db, sorted like fakeroot saves it.
+func saveFakerootDb() {
+	if opts.FakerootDb == "" {
+		return
+	}
+	entries := make([]fakerootEntry, 0, len(fakeroot.entries))
+	for _, e := range fakeroot.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].dev != entries[j].dev {
+			return entries[i].dev < entries[j].dev
+		}
+		return entries[i].ino < entries[j].ino
+	})
+	file, err := os.Create(opts.FakerootDb)
+	if err != nil {
+		fatalErr("Failed to create --fakeroot-db: ", err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, e := range entries {
+		fmt.Fprintf(writer, "dev=%x,ino=%d,mode=%o,uid=%d,gid=%d,nlink=%d,rdev=%d\n", e.dev, e.ino, e.mode, e.uid, e.gid, e.nlink, e.rdev)
+	}
+	if err := writer.Flush(); err != nil {
+		fatalErr("Failed to write --fakeroot-db: ", err)
+	}
+	if err := file.Close(); err != nil {
+		fatalErr("Failed to write --fakeroot-db: ", err)
+	}
+	log.Printf("Recorded %d entries in --fakeroot-db %s\n", len(entries), opts.FakerootDb)
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractTarFakerootDb(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755, Uid: os.Getuid(), Gid: os.Getgid()})
+	tw.WriteHeader(&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3})
+	tw.WriteHeader(&tar.Header{Name: "app", Typeflag: tar.TypeReg, Mode: 0755, Size: 3, Uid: os.Getuid(), Gid: os.Getgid()})
+	tw.Write([]byte("elf"))
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	opts.FakerootDb = filepath.Join(t.TempDir(), "fakeroot.db")
+	earlier := "dev=ff,ino=1,mode=100600,uid=5,gid=5,nlink=1,rdev=0\n"
+	os.WriteFile(opts.FakerootDb, []byte(earlier), 0644)
+	ExtractTar(context.Background(), &buf)
+
+	var stat unix.Stat_t
+	if err := unix.Stat(filepath.Join(opts.OutputDir, "dev/null"), &stat); err != nil || stat.Mode&unix.S_IFMT != unix.S_IFREG || stat.Size != 0 {
+		t.Fatalf("Expected an empty placeholder file for the device, err %v", err)
+	}
+	node := fmt.Sprintf("dev=%x,ino=%d,mode=20666,uid=0,gid=0,nlink=1,rdev=%d\n", uint64(stat.Dev), uint64(stat.Ino), uint64(unix.Mkdev(1, 3)))
+	db, _ := os.ReadFile(opts.FakerootDb)
+	// The directory and file got their owners and modes, only the device
+	// needs recording.
+	if lines := strings.SplitAfter(strings.TrimSuffix(string(db), "\n"), "\n"); len(lines) != 2 || !strings.Contains(string(db), earlier) || !strings.Contains(string(db), node) {
+		t.Fatalf("Unexpected database:\n%s\nwanted %s", db, node)
+	}
+}
@@ -0,0 +1,18 @@
+package fastar
+
+import "archive/tar"
+
+// fakeroot databases are keyed by unix device and inode numbers.
+func loadFakerootDb() {
+	if opts.FakerootDb != "" {
+		fatal("--fakeroot-db is not supported on Windows")
+	}
+}
+
+func recordFakeroot(path string, header *tar.Header) {}
+
+func extractFakerootNode(path string, header *tar.Header) bool {
+	return false
+}
+
+func saveFakerootDb() {}
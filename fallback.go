@@ -0,0 +1,71 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// A parallel download that gives up, e.g. because a chunk keeps failing or
+// coming back corrupt, or the server stopped honoring ranges part way, is
+// restarted once on a single stream before failing, as a slower download
+// beats a failed job. The single stream starts over from the beginning of
+// the file and skips what was already passed on, since ranges may be what
+// broke. Checksum mismatches over the whole file aren't retried, as the
+// single stream can't check them, nor is a source the circuit breaker found
+// down. --no-fallback fails right away instead.
+type fallbackReader struct {
+	ctx        context.Context
+	reader     io.Reader
+	downloader Downloader
+	delivered  int64
+	fellBack   bool
+}
+
+func newFallbackReader(ctx context.Context, reader io.Reader, downloader Downloader) io.Reader {
+	if opts.NoFallback {
+		return reader
+	}
+	return &fallbackReader{ctx: ctx, reader: reader, downloader: downloader}
+}
+
+// Whether the parallel download failing with err can be retried on a
+// single stream, rather than being canceled or having failed for good.
+func canFallBack(ctx context.Context, err error) bool {
+	return !opts.NoFallback && ctx.Err() == nil && callError() == nil && retryBudgetTripped() == nil && errors.Is(err, ErrNetwork)
+}
+
+func (r *fallbackReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.delivered += int64(n)
+	if err == nil || err == io.EOF || r.fellBack || !canFallBack(r.ctx, err) {
+		return n, err
+	}
+	r.fellBack = true
+	logFallback(r.delivered, err)
+	stream := rateLimitedReader{closeOnCancel(r.ctx, r.downloader.Get())}
+	if _, err := io.CopyN(io.Discard, stream, r.delivered); err != nil {
+		r.reader = errorReader{fmt.Errorf("single stream fallback failed to skip to byte %d: %w", r.delivered, err)}
+	} else {
+		r.reader = stream
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return r.Read(p)
+}
+
+func logFallback(offset int64, err error) {
+	log.Printf("Parallel download failed at byte %d: %s. Restarting it once on a single stream\n", offset, err.Error())
+	emitEvent("fallback", map[string]interface{}{"offset": offset, "reason": err.Error()})
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,32 @@
+package fastar
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDownloadStreamFallback(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	// Reads fail 95% of the time in tests, so the parallel download gives
+	// up part way and the single stream, which doesn't fail, takes over.
+	opts.RetryCount = 1
+
+	data := RandomString(100000)
+	downloader := TestDownloader{data, true, false}
+	actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4))
+	if err != nil || string(actual) != data {
+		t.Fatalf("Expected the single stream fallback to finish the download, got %d bytes, %v", len(actual), err)
+	}
+
+	path := filepath.Join(t.TempDir(), "image")
+	var written atomic.Int64
+	DownloadToFile(context.Background(), downloader, path, 100, 4, &written)
+	if actual, err := os.ReadFile(path); err != nil || string(actual) != data || written.Load() != int64(len(data)) {
+		t.Fatalf("Expected --output-file to fall back too, got %d bytes (%d written), %v", len(actual), written.Load(), err)
+	}
+}
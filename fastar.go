@@ -1,53 +1,197 @@
-package main
+package fastar
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/hex"
+	"encoding/binary"
 	"io"
 	"log"
+	"math"
 	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jessevdk/go-flags"
-	"github.com/pierrec/lz4"
 )
 
-var opts struct {
+// Settings of a download/extraction, the same as the command line flags.
+// Start from DefaultOptions() to get the flag defaults.
+type Options struct {
 	NumWorkers      int               `long:"download-workers" default:"4" description:"How many parallel workers to download the file"`
 	ChunkSize       int64             `long:"chunk-size" default:"200" description:"Size of file chunks (in MB) to pull in parallel"`
+	DeadlineSoft    int               `long:"deadline-soft" description:"After this many seconds stop requesting new chunks, finish the ones in flight and stop like on SIGINT, reporting the fraction downloaded and exiting with 110. Keeps the --resume journal to carry on from"`
+	NoFallback      bool              `long:"no-fallback" description:"Fail when a parallel download gives up instead of restarting it once on a single stream"`
 	OutputDir       string            `long:"directory" short:"C" description:"Directory to extract tarball to. Defaults to current dir if not specified"`
 	ToStdout        bool              `long:"to-stdout" short:"O" description:"Dump downloaded file to stdout rather than extracting to disk"`
+	OutputFile      string            `long:"output-file" description:"Write the downloaded file as is to this path instead of extracting it, e.g. a disk image. Workers write their chunks at their offsets in parallel, which is faster than redirecting --to-stdout"`
+	ExtractFile     string            `long:"extract-file" description:"Write only the content of this entry of the archive to stdout and exit as soon as it's found, without downloading the rest"`
+	TeeStdout       bool              `long:"tee-stdout" description:"Also write the decompressed tar stream to stdout while extracting, e.g. to pipe it on to another host"`
+	PinWorkers      string            `long:"pin-workers" description:"Pin download workers' threads and buffers to CPU sets, round robin. \"numa\" for one set per NUMA node, or sets in cpulist format separated by colons, e.g. 0-15,32-47:16-31,48-63"`
 	WriteWorkers    int               `long:"write-workers" default:"8" description:"How many parallel workers to use to write file to disk"`
+	NoFsTuning      bool              `long:"no-fs-tuning" description:"Keep the usual write settings when --directory is on a network or FUSE filesystem instead of writing with fewer workers and giving up on chown/chmod once it rejects them"`
+	DecodeWorkers   int               `long:"decompress-workers" default:"0" description:"How many cores decode lz4 blocks, zstd frames and BGZF gzip members in parallel, separately from download and write workers. 0 for one per core, 1 to decode on a single thread. Other gzip streams are inflated ahead on one, xz and bzip2 always decode on one"`
+	AutoscaleWrites bool              `long:"autoscale-write-workers" description:"Start at --write-workers and adjust the number of writers per filesystem based on observed write latency"`
+	MaxWriteWorkers int               `long:"max-write-workers" default:"64" description:"Upper bound on write workers per filesystem with --autoscale-write-workers"`
 	StripComponents int               `long:"strip-components" description:"Strip STRIP-COMPONENTS leading components from file names on extraction"`
-	Compression     string            `long:"compression" choice:"tar" choice:"gzip" choice:"lz4" description:"Force specific compression schema instead of inferring from magic bytes or filename extension"`
+	Exclude         []string          `long:"exclude" description:"Skip entries matching this shell glob, e.g. '*/docs/*' or '*.debug'. * also matches /, and a pattern matching a directory skips everything in it. Prefix with re: for a regular expression. Can be passed multiple times"`
+	Include         []string          `long:"include" description:"Only extract entries matching this glob (or re: regular expression), like --exclude. Can be passed multiple times, --exclude wins over it"`
+	Compression     string            `long:"compression" choice:"tar" choice:"gzip" choice:"lz4" choice:"zstd" choice:"xz" choice:"bzip2" description:"Force specific compression schema instead of inferring from magic bytes or filename extension"`
 	RetryCount      int               `long:"retry-count" default:"4" description:"Max number of retries for a single chunk (exponential backoff starting at --retry-wait seconds)"`
 	RetryWait       int               `long:"retry-wait" default:"1" description:"Starting number of seconds to wait in between retries (2x every retry)"`
-	MaxWait         int               `long:"max-wait" default:"10" description:"Exponential retry wait is capped at this many seconds"`
+	MaxWait         int               `long:"max-wait" default:"10" description:"Exponential retry wait is capped at this many seconds. A Retry-After from a throttling server is waited out instead, up to 10 minutes"`
+	RetryOn         []string          `long:"retry-on" description:"HTTP(S) status codes to retry, e.g. 429,503 or 500-504 or 5xx. Any other non-2xx response fails right away. Can be passed multiple times. Defaults to retrying every status but 404"`
+	RetryBudget     int               `long:"retry-budget" description:"Failed attempts all workers may make together before the transfer fails, each finished chunk earning one back. 0 for no limit beyond --retry-count per chunk"`
+	CircuitBreaker  int               `long:"circuit-breaker" default:"50" description:"Fail the transfer once this many attempts in a row fail across all workers without one succeeding, as when the source is down, instead of each worker using up --retry-count. 0 disables it"`
 	MinSpeed        string            `long:"min-speed" default:"1K" description:"Minimum speed per each chunk download. Retries and then fails if any are slower than this. 0 for no min speed, append K or M for KBps or MBps"`
 	MinSpeedWait    int               `long:"min-speed-wait" default:"5" description:"How long to wait in seconds for download to stabilize before enforcing min speed"`
 	ConnTimeout     int               `long:"connection-timeout" default:"60" description:"Abort download if TCP dial takes longer than this many seconds. Only supported for S3 and HTTP schemes."`
+	Resolve         []string          `long:"resolve" description:"Connect to HOST:PORT at ADDR instead of resolving HOST, like curl's --resolve, e.g. bucket.s3.amazonaws.com:443:10.0.0.5. PORT may be * and ADDR a comma separated list. Can be passed multiple times"`
+	DnsCacheTtl     int               `long:"dns-cache-ttl" default:"60" description:"Seconds to reuse a DNS lookup for new download connections instead of resolving the host again. 0 to resolve every connection"`
+	NoPrewarm       bool              `long:"no-prewarm" description:"Don't open the download workers' connections before the transfer starts. They're still kept open between chunks and share TLS sessions"`
+	UnixSocket      string            `long:"unix-socket" description:"Send HTTP(S) requests over this unix domain socket, e.g. to a node local caching sidecar, instead of connecting to the host in the URL. The URL still sets the Host header and path"`
 	IgnoreNodeFiles bool              `long:"ignore-node-files" description:"Don't throw errors on character or block device nodes"`
+	Lenient         bool              `long:"lenient" description:"Skip tar entries of unsupported types, such as GNU volume headers or pax global headers, with a warning instead of failing"`
 	Overwrite       bool              `long:"overwrite" description:"Overwrite any existing files"`
+	Duplicates      string            `long:"duplicates" default:"last" choice:"last" choice:"first" choice:"error" description:"What to do with an entry at the same path as an earlier one: last replaces it like tar does, first keeps the earlier one, error fails the extraction"`
+	UnsafePaths     bool              `long:"unsafe-paths" description:"Extract entries with absolute names, or names, hard link targets or symlink targets climbing out of --directory with .., wherever they point instead of failing"`
+	NoSpaceCheck    bool              `long:"no-space-check" description:"Extract even if --directory doesn't have the free space the archive is estimated to need"`
+	Preallocate     int64             `long:"preallocate" description:"Preallocate regular files of at least this many MB with fallocate before writing them, so they're laid out contiguously. They're written without holes. 0 disables it"`
+	DirectIo        bool              `long:"direct-io" description:"Write regular files of 1MiB or more with O_DIRECT from aligned buffers, bypassing the page cache. They're written without holes. Falls back to buffered writes on filesystems without O_DIRECT"`
+	NoSparse        bool              `long:"no-sparse" description:"Write runs of zeros in regular files of 1MiB or more out in full instead of leaving holes. Sparse entries are always extracted sparse"`
+	PostFsync       string            `long:"post-extract-fsync" default:"none" choice:"none" choice:"files" choice:"dirs" choice:"syncfs" description:"Make extracted files durable before exiting: files fsyncs each file as it's written, dirs also fsyncs the directories they're in at the end, syncfs syncs the filesystem of --directory once at the end"`
 	Headers         map[string]string `long:"headers" short:"H" description:"Headers to use with http request"`
+	HeaderCommand   string            `long:"header-command" description:"Shell command printing \"Name: value\" headers to send with every HTTP(S) request, e.g. a short-lived bearer token. Run again on 401 or 403 and after --header-ttl. FASTAR_URL is set to the URL"`
+	HeaderTtl       int               `long:"header-ttl" description:"Seconds after which --header-command is run again for fresh headers. 0 to only run it again on 401 or 403"`
+	CredHelper      string            `long:"credential-helper" description:"Shell command printing a kubectl style ExecCredential JSON with a token or headers for the origin of each HTTP(S) request. Cached per origin until it expires or the origin answers 401 or 403. FASTAR_URL and FASTAR_ORIGIN are set"`
 	UseFips         bool              `long:"use-fips-endpoint" description:"Use FIPS endpoint when downloading from S3"`
+	S3Endpoint      string            `long:"s3-endpoint" description:"Send S3 requests to this endpoint instead of AWS, e.g. https://minio.internal:9000 for MinIO or Ceph"`
+	S3Region        string            `long:"s3-region" description:"Region to sign S3 requests for, overriding the AWS config and environment. Defaults to us-east-1 with --s3-endpoint if none is configured"`
+	S3AccessKey     string            `long:"s3-access-key" description:"Access key to sign S3 requests with instead of the AWS config and environment, e.g. for an S3 compatible gateway. Needs --s3-secret-key"`
+	S3SecretKey     string            `long:"s3-secret-key" description:"Secret key for --s3-access-key"`
+	S3SessionToken  string            `long:"s3-session-token" description:"Session token for temporary --s3-access-key credentials"`
+	Sign            string            `long:"sign" description:"Sign plain HTTP(S) requests with AWS Signature Version 4 for s3:REGION, e.g. s3:us-east-1, using --s3-access-key and --s3-secret-key"`
+	S3PathStyle     bool              `long:"s3-path-style" description:"Address S3 buckets as ENDPOINT/BUCKET/KEY instead of BUCKET.ENDPOINT/KEY, which MinIO and Ceph usually need"`
+	RequestPayer    string            `long:"request-payer" choice:"requester" description:"Pass requester to download from S3 requester pays buckets, charging the requests and transfer to your account"`
 	DisableHttp2    bool              `long:"disable-http2" description:"Disable http2 to avoid reusing connections for GCS downloads"`
+	Http2           bool              `long:"http2" description:"Negotiate HTTP/2 with S3 and HTTP(S) sources, multiplexing every worker over one connection per host instead of opening one each"`
+	MaxIdlePerHost  int               `long:"max-idle-conns-per-host" description:"Idle connections kept open per host between chunks. 0 for one per worker"`
+	NoKeepalive     bool              `long:"disable-keepalive" description:"Close every S3 and HTTP(S) connection after its request, e.g. to spread chunks across the hosts behind a load balancer"`
+	TlsMinVersion   string            `long:"tls-min-version" choice:"1.0" choice:"1.1" choice:"1.2" choice:"1.3" description:"Refuse TLS versions older than this for S3 and HTTP(S) sources. Defaults to 1.2"`
 	UseGetForSize   bool              `long:"use-get-for-size" description:"Use GET with Range header instead of HEAD to determine file size for HTTP(S) URLs. Assumes RANGE support on the server side."`
+	MaxPathDepth    int               `long:"max-path-depth" default:"1024" description:"Fail extraction if any entry has more than this many path components. 0 for no limit"`
+	Version         bool              `long:"version" description:"Print version, build info and supported backends/codecs as JSON and exit"`
+	Porcelain       bool              `long:"porcelain" description:"Machine-readable mode: stdout only carries the data stream and stderr carries line-delimited JSON events"`
+	MaxNameLength   int               `long:"max-name-length" default:"255" description:"Fail extraction if any path component of an entry is longer than this many bytes. 0 for no limit"`
+	Config          string            `long:"config" description:"Config file with per-host profiles of flag defaults, see the README. Defaults to fastar/config in the user config directory, e.g. ~/.config/fastar/config"`
+	Progress        bool              `long:"progress" description:"Draw a progress bar on stderr with bytes downloaded, ETA and each worker's speed"`
+	ProgressJson    bool              `long:"progress-json" description:"Emit a progress event every second with bytes downloaded, ETA and each worker's speed. Written to --events-fd if given, otherwise to stderr as line-delimited JSON like --porcelain"`
+	Listen          string            `long:"listen" default:"127.0.0.1:8080" description:"Address the proxy subcommand serves the object on"`
+	ProxyCache      int64             `long:"proxy-cache" default:"256" description:"MB of small range reads the proxy subcommand keeps cached in memory"`
+	ReleaseUrl      string            `long:"release-url" description:"Base URL to pull releases from for the self-update subcommand"`
+	ReleasePubKey   string            `long:"release-public-key" description:"Base64 ed25519 public key used by self-update to verify release checksums"`
+	Estimate        bool              `long:"estimate" description:"Only query file metadata and print the expected duration and memory footprint as JSON, without downloading"`
+	CacheFile       string            `long:"cache-file" description:"Path of the per-origin capability cache used for estimates. Defaults to fastar/capabilities.json in the user cache dir, \"none\" to disable"`
+	AutoTune        bool              `long:"auto-tune" description:"Pick the chunk size and worker count from the throughput of previous runs against the same origin in the capability cache, sweeping neighboring settings until the fastest is found. Ignored if --chunk-size or --download-workers is given"`
+	MaxRate         string            `long:"max-rate" description:"Cap the aggregate download rate of all workers, e.g. 500M or 200MB/s. K, M and G are decimal. Also caps --bandwidth-schedule windows"`
+	BandwidthSched  string            `long:"bandwidth-schedule" description:"Daily download rate windows in local time, e.g. \"09:00-18:00=200MB/s,18:00-09:00=unlimited\". Times outside every window are unlimited"`
+	OverlayWhiteout bool              `long:"overlay-whiteouts" description:"Translate OCI layer whiteout files (.wh.*) into overlayfs whiteout devices and opaque directory xattrs"`
+	EventsFd        int               `long:"events-fd" description:"Write length-prefixed JSON progress events to this inherited file descriptor"`
+	UidMap          []string          `long:"uid-map" description:"Shift file owners during extraction as CONTAINER:HOST:SIZE, e.g. 0:100000:65536. Can be passed multiple times, unmapped IDs become 65534"`
+	GidMap          []string          `long:"gid-map" description:"Shift file groups during extraction as CONTAINER:HOST:SIZE, e.g. 0:100000:65536. Can be passed multiple times, unmapped IDs become 65534"`
+	IpfsGateways    []string          `long:"ipfs-gateway" default:"https://ipfs.io" default:"https://dweb.link" description:"HTTP gateway to fetch ipfs:// URLs through. Can be passed multiple times, chunks are spread across all responsive gateways"`
+	SshKey          string            `long:"ssh-key" description:"Private key to authenticate sftp:// downloads with, instead of ~/.ssh/id_ed25519, id_ecdsa and id_rsa. Keys in ssh-agent are tried first"`
+	SshKnownHosts   string            `long:"ssh-known-hosts" description:"known_hosts file to verify sftp:// host keys against. Defaults to ~/.ssh/known_hosts, \"none\" to skip verification"`
+	RsyncBasis      string            `long:"rsync-basis" description:"Older local copy of an rsync:// source, only the blocks that differ from it are downloaded"`
+	OutputDevice    string            `long:"output-device" description:"Write the decompressed file straight onto this block device with O_DIRECT instead of extracting it"`
+	DeviceWriteSize int               `long:"device-write-size" default:"1024" description:"Size of each write (in KiB) to --output-device, must be a multiple of the device's logical block size"`
+	ToSquashfs      string            `long:"to-squashfs" description:"Convert the tarball into a SquashFS image at this path instead of extracting it"`
+	ToImage         string            `long:"to-image" description:"Build a filesystem image instead of extracting it, one of ext4:PATH:SIZE (needs root), erofs:PATH or squashfs:PATH"`
+	CasDir          string            `long:"cas-dir" description:"Store extracted files once by content hash in this directory and hard link them into the output directory, deduplicating across extractions. Must be on the same filesystem"`
+	CasManifest     string            `long:"cas-manifest" description:"Where to write the sha256sum style manifest of a --cas-dir extraction. Defaults to CASDIR/manifests/<output dir name>.sha256"`
+	RowGroups       string            `long:"row-groups" description:"Only fetch the footer and these row groups (stripes for ORC) of a Parquet or ORC file, e.g. 0,3-5, into a sparse copy in --directory"`
+	RowGroupSpec    string            `long:"row-group-spec" description:"JSON file like {\"row_groups\": [0, 3]} selecting row groups to fetch, instead of --row-groups"`
+	GpgPassFile     string            `long:"gpg-passphrase-file" description:"File with the passphrase for symmetrically GPG encrypted archives. Otherwise gpg uses its keyring and agent"`
+	SniffLength     int               `long:"sniff-length" default:"512" description:"How many leading bytes of each layer to inspect for magic numbers. Raise it if zstd or lz4 skippable frames hide the first real frame. At least 512"`
+	HashFiles       string            `long:"hash-files" choice:"sha256" choice:"sha1" choice:"md5" description:"Compute a digest of every extracted file as it's written and save them as a sha256sum style manifest"`
+	HashManifest    string            `long:"hash-manifest" description:"Where to write the --hash-files manifest. Defaults to SHA256SUMS (or SHA1SUMS, MD5SUMS) in the output directory"`
+	Manifest        string            `long:"manifest" description:"Verify every extracted file against the digest this manifest lists for it, a SHA256SUMS style file or a JSON object of path to digest, and fail with a report of the files that don't match, aren't listed or are missing"`
+	ExpectManifest  string            `long:"expected-manifest" description:"Only extract the paths this allowlist has, a --manifest style file whose lines can also be just a path or JSON mapping paths to \"\" where content isn't pinned, checking the digests it has before writing. Directories leading to listed paths are allowed"`
+	Unexpected      string            `long:"unexpected-entries" default:"fail" choice:"fail" choice:"skip" description:"What to do with archive entries --expected-manifest doesn't allow: fail the extraction, or skip them"`
+	RecordManifest  string            `long:"record-manifest" description:"Write a JSON --expected-manifest of every extracted entry, with the SHA256 of regular files"`
+	Resume          bool              `long:"resume" description:"Journal extracted entries in DIRECTORY/.fastar-state so an interrupted extraction can be rerun with --resume to continue where it left off. Raw tarballs restart the download at the last checkpoint"`
+	Audit           bool              `long:"audit" description:"Don't extract, compare the archive against the tree already in --directory and print every file whose content, mode, owner or xattrs differ. Exits with 1 if any do"`
+	DumpHeaders     string            `long:"dump-headers" description:"Write every tar header as read from the archive (typeflag, name, size, PAX records, ...) to this file as JSON lines, before any mapping or filtering, to debug archives a producer got wrong"`
+	FakerootDb      string            `long:"fakeroot-db" description:"Record owners, modes and device nodes an unprivileged extraction couldn't apply in this fakeroot database, loadable with fakeroot -i. Entries of an existing database are kept"`
+	Sha256          string            `long:"sha256" description:"Expected SHA256 hex digest of the downloaded file. The whole stream is hashed as it's consumed and fastar exits with EBADMSG (74) on a mismatch"`
+	Sha1            string            `long:"sha1" description:"Expected SHA1 hex digest of the downloaded file, like --sha256"`
+	Md5             string            `long:"md5" description:"Expected MD5 hex digest of the downloaded file, like --sha256"`
+	ChunkChecksums  string            `long:"chunk-checksums" description:"File or URL of SHA256 digests of the download's chunks as lines of OFFSET LENGTH SHA256. Each chunk is checked before it's passed on and downloaded again if it's corrupt. The chunk size becomes LENGTH"`
+	VerifyObject    bool              `long:"verify-object-checksum" description:"Verify S3 and GCS downloads against the checksum stored with the object (S3 SHA256/SHA1 checksums, GCS MD5 or CRC32C) when there is one. S3 single part ETags are verified without it"`
+	NoEtagCheck     bool              `long:"no-etag-check" description:"Don't verify S3 downloads against the object's ETag when it's the MD5 of a single part upload. MD5 hashes the stream on a single core"`
+	NoCrc32c        bool              `long:"no-crc32c" description:"Don't verify the chunks of parallel GCS downloads against the object's CRC32C"`
+	MetricsFile     string            `long:"metrics-file" description:"Keep a JSON snapshot of download and extraction metrics (throughput per worker, retries, chunk latencies, bytes, extracted files) in this file, rewritten every 10 seconds and when fastar exits"`
+	MetricsAddr     string            `long:"metrics-addr" description:"Serve the same metrics over HTTP on this address while fastar runs, e.g. 127.0.0.1:9100, in Prometheus text format on /metrics and as JSON on /metrics.json"`
+	SlowChunks      int               `long:"slow-chunks" default:"5" description:"Log the byte ranges and attempt counts of this many slowest download chunks every minute while they change and at the end. 0 to disable"`
+	ExtractTo       string            `long:"extract-to" description:"Upload extracted files under this object store prefix, e.g. s3://bucket/prefix/ or gs://bucket/prefix/, instead of writing them to local disk"`
+	FormatHint      string            `long:"format-hint" choice:"tar" choice:"gzip" choice:"lz4" choice:"zstd" choice:"xz" choice:"bzip2" choice:"gpg" description:"Format to assume when neither the magic bytes nor the file extension are conclusive, instead of raw tar"`
+	ArtifactoryHost []string          `long:"artifactory-host" description:"Treat HTTP(S) URLs on this host as Artifactory downloads, authenticated with $ARTIFACTORY_API_KEY or $ARTIFACTORY_ACCESS_TOKEN and verified against the checksum Artifactory reports. Can be passed multiple times"`
+	NexusHost       []string          `long:"nexus-host" description:"Treat HTTP(S) URLs on this host as Nexus downloads, authenticated with $NEXUS_USER and $NEXUS_PASSWORD and verified against the .sha256 or .sha1 file next to the artifact. Can be passed multiple times"`
 }
 
+var opts Options
+
 var minSpeedBytesPerMillisecond = 0.0
 
-// Magic byte sequences prepended to the start of every gzip or lz4
-// compressed bundle. When downloading a file we can check for either
-// of these sequences to automatically infer if we need to perform
-// decompression, as well as which compression schema was used.
-const (
-	gzipMagicNumber = "1f8b"
-	lz4MagicNumber  = "04224d18"
-)
+// Magic byte sequences identifying each format, at a fixed offset from the
+// start of the stream. When downloading a file we can check for these to
+// automatically infer if we need to perform decompression, as well as which
+// compression schema was used. Signatures with frame set can also show up
+// after zstd/lz4 skippable frames, which both formats allow in front of
+// their first real frame.
+var formatSignatures = []struct {
+	format CompressionType
+	offset int
+	magic  string
+	frame  bool
+}{
+	{Tar, 257, "ustar", false},
+	{Gzip, 0, "\x1f\x8b", false},
+	{Lz4, 0, "\x04\x22\x4d\x18", true},
+	{Lz4, 0, "\x02\x21\x4c\x18", true},
+	{Zstd, 0, "\x28\xb5\x2f\xfd", true},
+	{Xz, 0, "\xfd7zXZ\x00", false},
+	{Bzip2, 0, "BZh", false},
+	{Zip, 0, "PK\x03\x04", false},
+	{Zip, 0, "PK\x05\x06", false},
+}
+
+// File extensions to fall back to when the magic bytes are inconclusive,
+// checked in order against the end of the filename. Once a layer is
+// unwrapped its extension is swapped for the replacement.
+var formatExtensions = []struct {
+	suffix      string
+	replacement string
+	format      CompressionType
+}{
+	{".tar", ".tar", Tar},
+	{".tgz", ".tar", Gzip},
+	{".gz", "", Gzip},
+	{".tlz4", ".tar", Lz4},
+	{".lz4", "", Lz4},
+	{".tzst", ".tar", Zstd},
+	{".zst", "", Zstd},
+	{".txz", ".tar", Xz},
+	{".xz", "", Xz},
+	{".tbz2", ".tar", Bzip2},
+	{".tbz", ".tar", Bzip2},
+	{".bz2", "", Bzip2},
+	{".zip", "", Zip},
+	{".gpg", "", Gpg},
+	{".pgp", "", Gpg},
+	{".asc", "", Gpg},
+}
 
 type CompressionType int
 
@@ -55,127 +199,369 @@ const (
 	Tar CompressionType = iota
 	Gzip
 	Lz4
+	Zstd
+	Xz
+	Bzip2
+	Zip
+	Gpg
 )
 
-func main() {
+var compressionTypeNames = []string{"tar", "gzip", "lz4", "zstd", "xz", "bzip2", "zip", "gpg"}
+
+func (c CompressionType) String() string {
+	if int(c) < len(compressionTypeNames) {
+		return compressionTypeNames[c]
+	}
+	return "tar"
+}
+
+func parseCompressionType(name string) CompressionType {
+	for i, compressionName := range compressionTypeNames {
+		if compressionName == name {
+			return CompressionType(i)
+		}
+	}
+	fatal("Unknown compression type ", name)
+	return Tar
+}
+
+// Runs the fastar command line tool with os.Args.
+func Main() {
 	var parser = flags.NewParser(&opts, flags.HelpFlag|flags.IgnoreUnknown)
 	args, err := parser.Parse()
 	if err != nil {
-		log.Fatal("Failed to parse arguments: ", err)
+		fatal("Failed to parse arguments: ", err)
+	}
+	if opts.Version {
+		printVersion()
+		return
+	}
+	if len(args) > 0 && args[0] == "capabilities" {
+		printCapabilities(args[1:])
+		return
 	}
 	if len(args) == 0 {
-		log.Fatal("Please pass source URL to download file from")
+		fatal("Please pass source URL to download file from, or - to read from stdin")
 	}
+	args = applyProfiles(args, os.Args[1:])
+	setupProgress()
+	setupPorcelain()
+	setupEventsFd()
+	setupMetrics()
+	logAppliedProfiles()
 	var rawUrl = args[0]
 	processMinSpeedFlag()
+	setupRetryPolicy()
+	if opts.CredHelper != "" && opts.HeaderCommand != "" {
+		fatal("--credential-helper and --header-command can't be combined")
+	}
+	checkS3Keys()
+	checkPlatformFlags()
+	raiseFileLimit()
+	if rawUrl == "self-update" {
+		SelfUpdate()
+		return
+	}
 	opts.ChunkSize *= 1e6 // Convert chunk size from MB to B
-	fileStream := GetDownloadStream(GetDownloader(rawUrl, opts.UseFips, opts.UseGetForSize), opts.ChunkSize, opts.NumWorkers)
+	if rawUrl == "proxy" {
+		if len(args) != 2 {
+			fatal("Usage: fastar proxy URL [--listen ADDRESS]")
+		}
+		ServeProxy(args[1])
+		return
+	}
+	if rawUrl == "create" {
+		if len(args) != 3 {
+			fatal("Usage: fastar create DIRECTORY URL")
+		}
+		CreateArchive(args[1], args[2])
+		return
+	}
+	// `fastar extract ARCHIVE` extracts an archive already on disk, or
+	// stdin for -, like tar -x.
+	localArchive := rawUrl == "extract"
+	if localArchive {
+		if len(args) != 2 {
+			fatal("Usage: fastar extract ARCHIVE [-C DIRECTORY]")
+		}
+		args = args[1:]
+		rawUrl = args[0]
+	}
 
 	url, err := url.Parse(rawUrl)
 	if err != nil {
-		log.Fatal("Failed to parse url: ", err.Error())
+		fatal("Failed to parse url: ", err.Error())
 	}
 	filename := path.Base(url.Path)
+	emitEvent("start", map[string]interface{}{"url": rawUrl, "filename": filename})
+
+	// Further URLs are mirrors of the first.
+	var downloader Downloader
+	if localArchive && rawUrl != "-" {
+		downloader = NewLocalFileDownloader(rawUrl)
+	} else if len(args) > 1 {
+		for _, mirror := range args {
+			if mirror == "-" {
+				fatal("stdin can't be one of several mirrors")
+			}
+		}
+		log.Printf("Striping chunks across %d mirrors\n", len(args))
+		downloader = NewMirrorDownloader(args, opts.UseFips, opts.UseGetForSize)
+	} else {
+		downloader = getDownloader(rawUrl, opts.UseFips, opts.UseGetForSize)
+	}
+	if rawUrl != "-" && !localArchive {
+		applyAutoTune(rawUrl, os.Args[1:])
+	}
+	if opts.Estimate {
+		printEstimate(rawUrl, downloader)
+		return
+	}
+	if opts.RowGroups != "" || opts.RowGroupSpec != "" {
+		if rawUrl == "-" {
+			fatal("--row-groups needs to read the footer first, so it can't read from stdin")
+		}
+		FetchRowGroups(countRequests(downloader, backendName(rawUrl)), filename)
+		logRequestCounts()
+		return
+	}
+
+	setupChunkChecksums()
+	if opts.DeadlineSoft > 0 && opts.OutputFile != "" {
+		fatal("--deadline-soft can't stop --output-file part way, as it can't be resumed")
+	}
+	if opts.Resume {
+		if opts.ToStdout || opts.OutputFile != "" || opts.OutputDevice != "" || opts.ToSquashfs != "" || opts.ToImage != "" || opts.ExtractTo != "" {
+			fatal("--resume only works when extracting to --directory")
+		}
+		if opts.OutputDir == "" {
+			if opts.OutputDir, err = os.Getwd(); err != nil {
+				fatal("Failed to get current working directory: ", err.Error())
+			}
+		}
+		openResumeJournal(rawUrl, downloader)
+		if offset := journal.resumeOffset(downloader); offset > 0 {
+			downloader = offsetDownloader{downloader, offset}
+		}
+	}
+
+	handlePauseSignals()
+	ctx := startSoftDeadline(handleInterruptSignals())
+	setupMaxRate()
+	if opts.BandwidthSched != "" {
+		startBandwidthSchedule(opts.BandwidthSched)
+	}
+	var downloadStart = time.Now()
+	var auditDifferences = 0
+	var totalDownloaded atomic.Int64
+	metricsDownloaded = &totalDownloaded
+	startProgress(&totalDownloaded)
+	chunkSize := opts.ChunkSize
+	if localArchive {
+		// Chunking only hides network latency, a local file is read front
+		// to back on a single stream with the kernel's readahead, leaving
+		// the cores to decompression and the write workers.
+		chunkSize = math.MaxInt64
+	}
+	if opts.OutputFile != "" {
+		DownloadToFile(ctx, countRequests(downloader, backendName(rawUrl)), opts.OutputFile, chunkSize, opts.NumWorkers, &totalDownloaded)
+		stopProgress()
+		verifyOutputFile(downloader)
+		logSlowestChunks()
+		logRequestCounts()
+		if rawUrl != "-" && !localArchive {
+			recordOriginStats(rawUrl, totalDownloaded.Load(), time.Since(downloadStart))
+		}
+		emitEvent("finished", nil)
+		flushMetrics(0)
+		return
+	}
+	var fileStream io.Reader = countingReader{GetDownloadStream(ctx, countRequests(downloader, backendName(rawUrl)), chunkSize, opts.NumWorkers), &totalDownloaded}
+	// Verification needs to see every byte, even ones the tar reader never
+	// gets to, so those streams are drained at the end.
+	var drainStream = false
+	if streamVerifier, ok := downloader.(StreamVerifier); ok {
+		fileStream = streamVerifier.VerifyStream(fileStream)
+		drainStream = true
+	}
+	var verifier *verifyingReader
+	if algorithm, expected := expectedChecksum(downloader); expected != "" {
+		verifier = newVerifyingReader(fileStream, algorithm, expected)
+		fileStream = verifier
+	}
 
 	log.Println("File name: " + filename)
 	log.Printf("Num Download Workers: %d", opts.NumWorkers)
 	log.Printf("Chunk Size (Mib): %d", opts.ChunkSize/1e6)
 	log.Printf("Num Disk Workers: %d", opts.WriteWorkers)
 
-	magicNumber, splicedStream := getMagicNumber(fileStream)
-
-	compressionType := getCompressionType(filename, magicNumber)
+	finalStream, layers := unwrapStream(fileStream, filename)
+	log.Println("Layers: " + strings.Join(layers, ", "))
+	emitEvent("compression", map[string]interface{}{"type": layers[len(layers)-1], "layers": layers})
+	if journal != nil {
+		journal.recordLayers(layers)
+	}
 
-	var finalStream io.Reader
-	if compressionType == Lz4 {
-		finalStream = lz4.NewReader(splicedStream)
-	} else if compressionType == Gzip {
-		finalStream, err = gzip.NewReader(splicedStream)
-		if err != nil {
-			log.Fatal("Error creating gzip stream: ", err.Error())
+	if opts.TeeStdout {
+		if opts.ToStdout || opts.ExtractFile != "" {
+			fatal("--tee-stdout already writes the stream to stdout, it can't be combined with --to-stdout or --extract-file")
 		}
-	} else if compressionType == Tar {
-		finalStream = splicedStream
-	} else {
-		log.Fatal("CompressionType not set, should be impossible")
+		finalStream = stdoutTee{finalStream}
 	}
-
-	if opts.ToStdout {
+	if opts.OutputDevice != "" {
+		WriteToDevice(finalStream, opts.OutputDevice, opts.DeviceWriteSize*1024)
+	} else if opts.ToSquashfs != "" {
+		WriteSquashfs(finalStream, opts.ToSquashfs)
+	} else if opts.ToImage != "" {
+		WriteImage(ctx, finalStream, opts.ToImage)
+	} else if opts.ExtractTo != "" {
+		uploader, prefix := GetObjectUploader(opts.ExtractTo)
+		ExtractToObjectStore(finalStream, uploader, prefix)
+	} else if opts.ExtractFile != "" {
+		if !ExtractFile(finalStream, opts.ExtractFile, os.Stdout) {
+			log.Printf("%s not found in the archive\n", opts.ExtractFile)
+			exit(ErrNotFound)
+		}
+		// The rest of the archive is never downloaded, so there's
+		// nothing to verify or drain.
+		if verifier != nil {
+			log.Println("Not verifying the checksum of the download, only part of it was read")
+		}
+		stopProgress()
+		logRequestCounts()
+		emitEvent("finished", nil)
+		flushMetrics(0)
+		return
+	} else if opts.ToStdout {
 		if _, err := io.Copy(os.Stdout, finalStream); err != nil {
-			log.Fatal("Failed to write file to stdout: ", err.Error())
+			fatalStream("Failed to write file to stdout: ", err)
 		}
 	} else {
 		if opts.OutputDir == "" {
 			if opts.OutputDir, err = os.Getwd(); err != nil {
-				log.Fatal("Failed to get current working directory: ", err.Error())
+				fatal("Failed to get current working directory: ", err.Error())
 			}
 		}
-		ExtractTar(finalStream)
+		if opts.Audit {
+			auditDifferences = AuditTar(finalStream)
+		} else {
+			finalStream = checkDiskSpace(finalStream, layers, &totalDownloaded)
+			ExtractTar(ctx, finalStream)
+		}
 	}
+	stopProgress()
+	if status := interruptedStatus(); status == softDeadlineStatus {
+		log.Println("Stopped at --deadline-soft, exiting")
+		flushMetrics(status)
+		os.Exit(status)
+	} else if status != 0 {
+		log.Println("Interrupted, exiting")
+		flushMetrics(status)
+		os.Exit(status)
+	}
+	if opts.TeeStdout {
+		finishTee(finalStream)
+	}
+	// gpg only reports a failed integrity check once all of its output has
+	// been read, and tar extraction stops at the end of archive marker.
+	for _, layer := range layers {
+		if layer == "gpg" {
+			if _, err := io.Copy(io.Discard, finalStream); err != nil {
+				fatal("Failed to read remainder of archive: ", err.Error())
+			}
+			break
+		}
+	}
+	if verifier != nil {
+		verifier.Verify()
+	} else if drainStream {
+		if _, err := io.Copy(io.Discard, fileStream); err != nil {
+			fatal("Failed to read remainder of download: ", err.Error())
+		}
+	}
+	logSlowestChunks()
+	logRequestCounts()
+	logFileSizeHistogram()
+	if rawUrl != "-" && !localArchive {
+		recordOriginStats(rawUrl, totalDownloaded.Load(), time.Since(downloadStart))
+	}
+	emitEvent("finished", nil)
+	if auditDifferences > 0 {
+		flushMetrics(1)
+		os.Exit(1)
+	}
+	flushMetrics(0)
 }
 
-// Reads first few bytes from file stream to get any possible
-// magic numbers, returns a spliced-together reader since
-// the original io.Reader has already been read from.
-func getMagicNumber(reader io.Reader) (string, io.Reader) {
-	buf := make([]byte, 4)
-	totalRead := 0
-	for totalRead < 4 {
-		read, err := reader.Read(buf[totalRead:])
-		if err != nil && err != io.EOF {
-			log.Fatal("Failed to read magic number:", err.Error())
-		}
-		totalRead += read
-		if err == io.EOF {
-			return "", io.LimitReader(bytes.NewReader(buf[:totalRead]), int64(totalRead))
-		}
-	}
-	magicNumber := hex.EncodeToString(buf)
-	splicedStream := io.MultiReader(bytes.NewReader(buf), reader)
-	return magicNumber, splicedStream
-}
-
-// Choose compression type by the following preference order:
+// Chooses the compression type of the outermost layer in the following
+// preference order:
 // 1. User provided compression type flag
-// 2. Inferred by magic number
-// 3. Inferred by file extension prefix in URL
-// 4. Default to raw tarball
-func getCompressionType(filename string, magicNumber string) CompressionType {
+// 2. Inferred by magic number in the first --sniff-length bytes
+// 3. Inferred by file extension in URL
+// 4. The format hint, if any
+// 5. Default to raw tarball
+func getCompressionType(filename string, head []byte, hint string) CompressionType {
 	if opts.Compression != "" {
-		if opts.Compression == "tar" {
-			log.Println("Forcing raw tar")
-			return Tar
-		} else if opts.Compression == "gzip" {
-			log.Println("Forcing gzip")
-			return Gzip
-		} else {
-			log.Println("Forcing lz4")
-			return Lz4
+		log.Println("Forcing", opts.Compression)
+		return parseCompressionType(opts.Compression)
+	}
+	if compressionType, ok := sniffCompressionType(head); ok {
+		log.Printf("Inferring %s by magic number", compressionType)
+		return compressionType
+	}
+	log.Println("Unrecognized magic number, falling back to file extension")
+	for _, extension := range formatExtensions {
+		if strings.HasSuffix(filename, extension.suffix) {
+			log.Printf("Inferring %s by file extension", extension.format)
+			return extension.format
 		}
-	} else {
-		if strings.HasPrefix(magicNumber, gzipMagicNumber) {
-			log.Println("Inferring gzip by magic number")
-			return Gzip
-		} else if strings.HasPrefix(magicNumber, lz4MagicNumber) {
-			log.Println("Inferring lz4 by magic number")
-			return Lz4
-		} else {
-			log.Println("Unrecognized magic number, falling back to file extension")
-			if strings.HasSuffix(filename, "lz4") {
-				log.Println("Inferring lz4 by file extension")
-				return Lz4
-			} else if strings.HasSuffix(filename, "gz") {
-				log.Println("Inferring gzip by file extension")
-				return Gzip
-			} else if strings.HasSuffix(filename, "tar") {
-				log.Println("Inferring raw tar by file extension")
-				return Tar
-			} else {
-				log.Println("Unrecognized file extension, assuming raw tar")
-				return Tar
-			}
+	}
+	if hint != "" {
+		log.Println("Unrecognized file extension, using format hint", hint)
+		return parseCompressionType(hint)
+	}
+	log.Println("Unrecognized file extension, assuming raw tar")
+	return Tar
+}
+
+// Matches the start of the stream against formatSignatures. Skippable
+// frames are stepped over to find the real first frame, but if one runs
+// past the end of head the format stays unknown.
+func sniffCompressionType(head []byte) (CompressionType, bool) {
+	frame := head
+	for len(frame) >= 8 && binary.LittleEndian.Uint32(frame)&0xfffffff0 == 0x184d2a50 {
+		frameLength := 8 + int64(binary.LittleEndian.Uint32(frame[4:]))
+		if frameLength >= int64(len(frame)) {
+			log.Println("Skippable frame extends past the sniffed bytes, raise --sniff-length to look behind it")
+			return Tar, false
+		}
+		frame = frame[frameLength:]
+	}
+	skipped := len(frame) != len(head)
+	for _, signature := range formatSignatures {
+		if skipped && !signature.frame {
+			continue
+		}
+		end := signature.offset + len(signature.magic)
+		if end <= len(frame) && string(frame[signature.offset:end]) == signature.magic {
+			return signature.format, true
+		}
+	}
+	if !skipped && isOpenPgpMessage(head) {
+		return Gpg, true
+	}
+	return Tar, false
+}
+
+// Drops the extension of a layer that's been unwrapped, e.g. backup.tgz
+// turns into backup.tar once the gzip layer is gone.
+func trimFormatExtension(filename string, compressionType CompressionType) string {
+	for _, extension := range formatExtensions {
+		if extension.format == compressionType && strings.HasSuffix(filename, extension.suffix) {
+			return strings.TrimSuffix(filename, extension.suffix) + extension.replacement
 		}
 	}
+	return filename
 }
 
 func processMinSpeedFlag() {
@@ -183,17 +569,17 @@ func processMinSpeedFlag() {
 	var err error
 	if strings.HasSuffix(opts.MinSpeed, "K") {
 		if bytesPerSecond, err = strconv.Atoi((opts.MinSpeed)[:len(opts.MinSpeed)-1]); err != nil {
-			log.Fatal("Failed to parse min speed argument", opts.MinSpeed, err.Error())
+			fatal("Failed to parse min speed argument", opts.MinSpeed, err.Error())
 		}
 		bytesPerSecond *= 1e3
 	} else if strings.HasSuffix(opts.MinSpeed, "M") {
 		if bytesPerSecond, err = strconv.Atoi((opts.MinSpeed)[:len(opts.MinSpeed)-1]); err != nil {
-			log.Fatal("Failed to parse min speed argument", opts.MinSpeed, err.Error())
+			fatal("Failed to parse min speed argument", opts.MinSpeed, err.Error())
 		}
 		bytesPerSecond *= 1e6
 	} else {
 		if bytesPerSecond, err = strconv.Atoi(opts.MinSpeed); err != nil {
-			log.Fatal("Failed to parse min speed argument", opts.MinSpeed, err.Error())
+			fatal("Failed to parse min speed argument", opts.MinSpeed, err.Error())
 		}
 	}
 	minSpeedBytesPerMillisecond = float64(bytesPerSecond) / 1e3
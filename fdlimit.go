@@ -0,0 +1,63 @@
+package fastar
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// Descriptors kept free on top of the ones already open when extraction
+// starts, for download connections, gpg pipes, the events fd and so on.
+const reservedDescriptors = 64
+
+// Files currently held open by write workers.
+var openFiles atomic.Int64
+
+// Caps the number of write workers by the descriptors left over, so
+// extraction slows down instead of failing with EMFILE. Each worker holds at
+// most one file open at a time.
+func writeWorkerBudget(workers int) int {
+	limit, ok := fileLimit()
+	if !ok {
+		return workers
+	}
+	budget := int64(limit) - int64(countOpenDescriptors()) - reservedDescriptors - 2*int64(opts.NumWorkers)
+	if budget < 1 {
+		budget = 1
+	}
+	if int64(workers) > budget {
+		log.Printf("Open file limit of %d only leaves room for %d write workers, down from %d\n", limit, budget, workers)
+		return int(budget)
+	}
+	return workers
+}
+
+func countOpenDescriptors() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// Opens a file for a write worker, keeping track of how many are open so
+// running out of descriptors can be reported usefully. Call closeTrackedFile
+// when done with it.
+func openTrackedFile(open func() (*os.File, error)) (*os.File, error) {
+	file, err := open()
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		limit, _ := fileLimit()
+		return nil, fmt.Errorf("%w (%d files open by write workers, limit %d), lower --write-workers", err, openFiles.Load(), limit)
+	} else if err == nil {
+		openFiles.Add(1)
+	}
+	return file, err
+}
+
+func closeTrackedFile(file *os.File) error {
+	openFiles.Add(-1)
+	return file.Close()
+}
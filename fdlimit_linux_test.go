@@ -0,0 +1,37 @@
+package fastar
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteWorkerBudget(t *testing.T) {
+	var original unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &original); err != nil {
+		t.Skip(err)
+	}
+	defer unix.Setrlimit(unix.RLIMIT_NOFILE, &original)
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.NumWorkers = 4
+
+	open := uint64(countOpenDescriptors())
+	lowered := unix.Rlimit{Cur: open + reservedDescriptors + 8 + 10, Max: original.Max}
+	if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skip(err)
+	}
+	if workers := writeWorkerBudget(100); workers != 10 {
+		t.Fatalf("Got %d write workers, wanted 10", workers)
+	}
+	if workers := writeWorkerBudget(5); workers != 5 {
+		t.Fatalf("Got %d write workers, wanted 5", workers)
+	}
+
+	raiseFileLimit()
+	var raised unix.Rlimit
+	unix.Getrlimit(unix.RLIMIT_NOFILE, &raised)
+	if raised.Cur != original.Max {
+		t.Fatalf("Soft limit is %d, wanted the hard limit %d", raised.Cur, original.Max)
+	}
+}
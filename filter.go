@@ -0,0 +1,129 @@
+package fastar
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Entries to leave out of an extraction (--exclude) or to restrict it to
+// (--include), like GNU tar's --exclude. Patterns are shell globs, where *
+// and ? also match / and a pattern matches an entry when it matches any
+// run of its path components, so "*.debug" excludes debug files at every
+// depth and "docs" excludes every docs directory with all its contents.
+// Patterns starting with "re:" are regular expressions searched for in the
+// whole entry name instead.
+//
+// Excludes win over includes. Skipped entries are never read into memory
+// or written.
+type entryPattern struct {
+	regex *regexp.Regexp
+	// Globs are matched against runs of components, regexes against the
+	// whole name.
+	glob bool
+}
+
+var excludePatterns, includePatterns []entryPattern
+
+func parseEntryPatterns(patterns []string) ([]entryPattern, error) {
+	var parsed []entryPattern
+	for _, pattern := range patterns {
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			regex, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			parsed = append(parsed, entryPattern{regex, false})
+			continue
+		}
+		regex, err := globRegexp(strings.Trim(pattern, "/"))
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, entryPattern{regex, true})
+	}
+	return parsed, nil
+}
+
+// Shell glob to an anchored regular expression, with * and ? matching /.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func (p entryPattern) matches(name string) bool {
+	if !p.glob {
+		return p.regex.MatchString(name)
+	}
+	components := strings.Split(name, "/")
+	for start := range components {
+		for end := start + 1; end <= len(components); end++ {
+			if p.regex.MatchString(strings.Join(components[start:end], "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setupEntryFilters() {
+	var err error
+	if excludePatterns, err = parseEntryPatterns(opts.Exclude); err != nil {
+		fatal("Failed to parse --exclude: ", err.Error())
+	}
+	if includePatterns, err = parseEntryPatterns(opts.Include); err != nil {
+		fatal("Failed to parse --include: ", err.Error())
+	}
+}
+
+// Whether --exclude/--include leave the entry at name (relative to the
+// archive root, after --strip-components) out of the extraction.
+func filteredOut(name string) bool {
+	if len(excludePatterns) == 0 && len(includePatterns) == 0 {
+		return false
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, pattern := range excludePatterns {
+		if pattern.matches(name) {
+			return true
+		}
+	}
+	if len(includePatterns) == 0 {
+		return false
+	}
+	for _, pattern := range includePatterns {
+		if pattern.matches(name) {
+			return false
+		}
+	}
+	return true
+}
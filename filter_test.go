@@ -0,0 +1,74 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestFilteredOut(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	tests := []struct {
+		exclude, include []string
+		name             string
+		expected         bool
+	}{
+		{nil, nil, "pkg/docs/index.html", false},
+		{[]string{"*/docs/*"}, nil, "pkg/docs/index.html", true},
+		{[]string{"*/docs/*"}, nil, "pkg/src/docs.go", false},
+		{[]string{"docs"}, nil, "a/b/docs/c/d.html", true},
+		{[]string{"docs"}, nil, "a/b/docs.txt", false},
+		{[]string{"*.debug"}, nil, "usr/lib/libc.so.debug", true},
+		{[]string{"*.debug"}, nil, "./usr/lib/libc.so", false},
+		{[]string{"lib[0-9].so"}, nil, "lib/lib7.so", true},
+		{[]string{"re:\\.(debug|pdb)$"}, nil, "bin/app.pdb", true},
+		{[]string{"re:^bin/"}, nil, "usr/bin/app", false},
+		{nil, []string{"*.so"}, "usr/lib/libc.so", false},
+		{nil, []string{"*.so"}, "usr/lib/libc.a", true},
+		{nil, []string{"usr/lib"}, "usr/lib/x/y.a", false},
+		{[]string{"*.debug"}, []string{"usr/lib"}, "usr/lib/libc.so.debug", true},
+	}
+	for _, test := range tests {
+		opts.Exclude, opts.Include = test.exclude, test.include
+		setupEntryFilters()
+		if actual := filteredOut(test.name); actual != test.expected {
+			t.Errorf("--exclude %v --include %v on %s: got %v, wanted %v", test.exclude, test.include, test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestExtractTarExclude(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "pkg/docs/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "pkg/docs/manual.pdf", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	tw.Write([]byte("pdf"))
+	tw.WriteHeader(&tar.Header{Name: "pkg/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 3})
+	tw.Write([]byte("elf"))
+	tw.WriteHeader(&tar.Header{Name: "pkg/manual.pdf", Typeflag: tar.TypeLink, Linkname: "pkg/docs/manual.pdf"})
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	opts.Exclude = []string{"*/docs/*"}
+	ExtractTar(context.Background(), &buf)
+
+	var extracted []string
+	filepath.Walk(opts.OutputDir, func(path string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			extracted = append(extracted, relativeToOutputDir(path))
+		}
+		return nil
+	})
+	sort.Strings(extracted)
+	if len(extracted) != 1 || extracted[0] != "pkg/app" {
+		t.Fatalf("Expected only pkg/app to be extracted, got %v", extracted)
+	}
+}
@@ -0,0 +1,86 @@
+package fastar
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --post-extract-fsync makes extracted files durable before fastar exits,
+// so an orchestrator marking the node ready on success doesn't lose them
+// to a crash right after:
+//
+//	files   fsyncs every regular file once it's written
+//	dirs    also fsyncs, at the end, every directory entries were
+//	        extracted into, so the files' names survive too
+//	syncfs  instead syncs the filesystem of --directory once at the end,
+//	        cheaper than fsyncing millions of small files one by one
+//
+// A failed sync fails the extraction.
+
+func syncFiles() bool {
+	return opts.PostFsync == "files" || opts.PostFsync == "dirs"
+}
+
+// Directories that got entries, recorded with --post-extract-fsync=dirs.
+// Only touched by the goroutine reading the archive.
+type syncDirSet map[string]bool
+
+// Records dir and its parents up to --directory, since MkdirAll may have
+// created any of them.
+func (dirs syncDirSet) add(dir string) {
+	if opts.PostFsync != "dirs" {
+		return
+	}
+	root := filepath.Clean(opts.OutputDir)
+	for dir = filepath.Clean(dir); !dirs[dir]; dir = filepath.Dir(dir) {
+		if dir != root && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			break
+		}
+		dirs[dir] = true
+		if dir == root {
+			break
+		}
+	}
+}
+
+func fsyncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Makes everything extracted durable at the end of the extraction.
+func syncExtracted(dirs syncDirSet) {
+	if opts.PostFsync == "" || opts.PostFsync == "none" || opts.PostFsync == "files" {
+		return
+	}
+	start := time.Now()
+	switch opts.PostFsync {
+	case "dirs":
+		// Deepest first, so a directory's own entry is synced after its
+		// contents.
+		var paths []string
+		for dir := range dirs {
+			paths = append(paths, dir)
+		}
+		sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+		for _, dir := range paths {
+			if err := fsyncPath(dir); err != nil {
+				fatalErr("Failed to fsync directory: ", err)
+			}
+		}
+	case "syncfs":
+		if err := syncFilesystem(opts.OutputDir); err != nil {
+			fatalErr("Failed to sync the filesystem of --directory: ", err)
+		}
+	}
+	log.Printf("Synced extracted files to disk (%s) in %s\n", opts.PostFsync, time.Since(start).Round(time.Millisecond))
+	emitEvent("synced", map[string]interface{}{"mode": opts.PostFsync, "millis": time.Since(start).Milliseconds()})
+}
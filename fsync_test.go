@@ -0,0 +1,48 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncDirSet(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.PostFsync = "dirs"
+	dirs := syncDirSet{}
+	dirs.add(filepath.Join(opts.OutputDir, "a", "b"))
+	dirs.add(filepath.Join(opts.OutputDir, "a", "c"))
+	if len(dirs) != 4 || !dirs[opts.OutputDir] || dirs[filepath.Dir(opts.OutputDir)] {
+		t.Fatalf("Expected the directories up to --directory, got %v", dirs)
+	}
+}
+
+func TestPostExtractFsync(t *testing.T) {
+	for _, mode := range []string{"none", "files", "dirs", "syncfs"} {
+		if mode == "syncfs" && !hasFeature("syncfs") {
+			continue
+		}
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "a/b/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+		tw.Write([]byte("hello"))
+		tw.WriteHeader(&tar.Header{Name: "c/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.Close()
+
+		oldOpts := opts
+		opts.OutputDir = t.TempDir()
+		opts.WriteWorkers = 2
+		opts.PostFsync = mode
+		ExtractTar(context.Background(), &buf)
+		contents, err := os.ReadFile(filepath.Join(opts.OutputDir, "a", "b", "file"))
+		opts = oldOpts
+		if err != nil || string(contents) != "hello" {
+			t.Fatalf("Got %q, %v with --post-extract-fsync=%s", contents, err, mode)
+		}
+	}
+}
@@ -1,19 +1,19 @@
-package main
+package fastar
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
-	"os"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/gax-go/v2"
-	"golang.org/x/sys/unix"
 	"google.golang.org/api/googleapi"
 )
 
@@ -78,14 +78,14 @@ func handleGcsError(err error, requestType string) {
 		if e, ok := err.(*googleapi.Error); ok || isErrObjNotFound {
 			if isErrObjNotFound {
 				log.Printf("404, %s failed, GCS object doesn't exist\n", requestType)
-				os.Exit(int(unix.ENOENT))
+				exit(ErrNotFound)
 			}
 			if e.Code == 404 {
 				log.Printf("404, %s failed, GCS object or bucket doesn't exist\n", requestType)
-				os.Exit(int(unix.ENOENT))
+				exit(ErrNotFound)
 			}
 		}
-		log.Fatal(fmt.Sprintf("GCS request %s failed: ", requestType), err.Error())
+		fatal(fmt.Sprintf("GCS request %s failed: ", requestType), err.Error())
 	}
 }
 
@@ -95,3 +95,27 @@ func getBucketAndObject(url string) (string, string) {
 	object := strings.Join(parts[1:], "/")
 	return bucket, object
 }
+
+// The CRC32C GCS keeps of the object as stored. Objects with a
+// Content-Encoding may be decompressed on the way, so they're left out.
+func (gcsDownloader GCSDownloader) objectCrc32c() (uint32, bool) {
+	attrs, err := gcsDownloader.objectWithRetry().Attrs(context.Background())
+	handleGcsError(err, "objectCrc32c")
+	return attrs.CRC32C, attrs.ContentEncoding == ""
+}
+
+// With --verify-object-checksum, the object's MD5, or its CRC32C for
+// composite objects which have no MD5.
+func (gcsDownloader GCSDownloader) ExpectedChecksum() (string, string) {
+	if !opts.VerifyObject {
+		return "", ""
+	}
+	attrs, err := gcsDownloader.objectWithRetry().Attrs(context.Background())
+	handleGcsError(err, "ExpectedChecksum")
+	if len(attrs.MD5) > 0 {
+		return "md5", hex.EncodeToString(attrs.MD5)
+	}
+	var crc32c [4]byte
+	binary.BigEndian.PutUint32(crc32c[:], attrs.CRC32C)
+	return "crc32c", hex.EncodeToString(crc32c[:])
+}
@@ -0,0 +1,285 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matches github://owner/repo@tag/asset and github-lfs://owner/repo@ref/path
+var githubUrlRegex = regexp.MustCompile(`^github(-lfs)?://([^/]+)/([^/@]+)@([^/]+)/(.+)$`)
+
+// Both default to github.com, can be pointed at GitHub Enterprise the same
+// way as in GitHub Actions.
+func githubApiUrl() string {
+	if api := os.Getenv("GITHUB_API_URL"); api != "" {
+		return strings.TrimSuffix(api, "/")
+	}
+	return "https://api.github.com"
+}
+
+func githubServerUrl() string {
+	if server := os.Getenv("GITHUB_SERVER_URL"); server != "" {
+		return strings.TrimSuffix(server, "/")
+	}
+	return "https://github.com"
+}
+
+func githubAuthHeaders() http.Header {
+	headers := http.Header{}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	return headers
+}
+
+func parseGithubUrl(url string) (owner, repo, ref, path string, err error) {
+	match := githubUrlRegex.FindStringSubmatch(url)
+	if match == nil {
+		return "", "", "", "", errors.New("GitHub urls must be of the form github://owner/repo@tag/asset or github-lfs://owner/repo@ref/path")
+	}
+	return match[2], match[3], match[4], match[5], nil
+}
+
+func mustParseGithubUrl(url string) (owner, repo, ref, path string) {
+	owner, repo, ref, path, err := parseGithubUrl(url)
+	if err != nil {
+		fatal(err.Error())
+	}
+	return owner, repo, ref, path
+}
+
+// Downloads a GitHub release asset, authenticating with $GITHUB_TOKEN.
+//
+// Requests go to the asset's API URL, which redirects to a short-lived
+// signed URL. Since every chunk is a new request against the API URL, each
+// chunk follows a fresh redirect and long downloads don't fail when the
+// first signed URL expires. The Authorization header isn't forwarded to the
+// redirect target since it's on a different host.
+type GithubReleaseDownloader struct {
+	HttpDownloader
+	size int64
+}
+
+func NewGithubReleaseDownloader(url string, client *http.Client) GithubReleaseDownloader {
+	owner, repo, tag, assetName := mustParseGithubUrl(url)
+	headers := githubAuthHeaders()
+	headers.Set("Accept", "application/vnd.github+json")
+	api := HttpDownloader{
+		Url:     githubApiUrl() + "/repos/" + owner + "/" + repo + "/releases/tags/" + tag,
+		client:  client,
+		headers: headers,
+	}
+	resp := api.retryHttpRequest(api.generateRequest("GET"))
+	defer resp.Body.Close()
+	var release struct {
+		Assets []struct {
+			Name string `json:"name"`
+			Url  string `json:"url"`
+			Size int64  `json:"size"`
+		} `json:"assets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		fatal("Failed to parse GitHub release: ", err.Error())
+	}
+	for _, asset := range release.Assets {
+		if asset.Name == assetName {
+			assetHeaders := githubAuthHeaders()
+			assetHeaders.Set("Accept", "application/octet-stream")
+			return GithubReleaseDownloader{
+				HttpDownloader{Url: asset.Url, client: client, headers: assetHeaders},
+				asset.Size,
+			}
+		}
+	}
+	log.Printf("404, release %s of %s/%s has no asset named %s\n", tag, owner, repo, assetName)
+	exit(ErrNotFound)
+	return GithubReleaseDownloader{}
+}
+
+// The size comes from the release metadata, a HEAD request would be
+// redirected to a URL only signed for GET.
+func (githubReleaseDownloader GithubReleaseDownloader) GetFileInfo() (int64, bool, bool) {
+	return githubReleaseDownloader.size, redirectSupportsRange(githubReleaseDownloader.HttpDownloader, githubReleaseDownloader.size), false
+}
+
+// Whether the server a request for the file is finally redirected to
+// answers a ranged GET for its first byte with a range, which the API and
+// the signed URL don't promise. Fails if it serves a different size than
+// the metadata the downloader was created from.
+func redirectSupportsRange(httpDownloader HttpDownloader, size int64) bool {
+	if size <= opts.ChunkSize {
+		return false
+	}
+	served, supportsRange := httpDownloader.getSizeWithRange()
+	if served != size {
+		log.Printf("%s is %d bytes, but its metadata says %d\n", httpDownloader.Url, served, size)
+		exit(ErrCorrupt)
+	}
+	return supportsRange
+}
+
+// Downloads a Git LFS tracked file from a GitHub repository. The pointer
+// file is fetched from the repository and resolved to the actual object
+// through the LFS batch API, and the download is verified against the
+// object's sha256 oid.
+type GitLfsDownloader struct {
+	HttpDownloader
+	oid  string
+	size int64
+}
+
+func NewGitLfsDownloader(url string, client *http.Client) Downloader {
+	owner, repo, ref, path := mustParseGithubUrl(url)
+	rawUrl := githubServerUrl() + "/" + owner + "/" + repo + "/raw/" + ref + "/" + path
+	raw := HttpDownloader{Url: rawUrl, client: client, headers: githubAuthHeaders()}
+	resp := raw.retryHttpRequest(raw.generateRequest("GET"))
+	pointer, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if err != nil {
+		fatal("Failed to read Git LFS pointer: ", err.Error())
+	}
+	oid, size, err := parseLfsPointer(pointer)
+	if errors.Is(err, errNotLfsPointer) {
+		// Not tracked by LFS, the raw file is the real content.
+		log.Println("File is not a Git LFS pointer, downloading it directly")
+		return raw
+	} else if err != nil {
+		fatal("Invalid Git LFS pointer: ", err.Error())
+	}
+
+	batchUrl := githubServerUrl() + "/" + owner + "/" + repo + ".git/info/lfs/objects/batch"
+	// The hrefs the batch API hands out expire, long downloads ask for a
+	// new one when that happens.
+	expiring := newExpiringUrl(func() (string, http.Header, time.Time) {
+		return lfsDownloadAction(client, batchUrl, oid, size)
+	})
+	return GitLfsDownloader{
+		HttpDownloader{Url: expiring.url, client: client, expiring: expiring},
+		oid,
+		size,
+	}
+}
+
+// Asks the LFS batch API where to download the object from, returning the
+// href, the headers to send to it and when it expires, zero if it doesn't.
+func lfsDownloadAction(client *http.Client, batchUrl string, oid string, size int64) (string, http.Header, time.Time) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"operation": "download",
+		"transfers": []string{"basic"},
+		"objects":   []map[string]interface{}{{"oid": oid, "size": size}},
+	})
+	req, err := http.NewRequest("POST", batchUrl, bytes.NewReader(body))
+	if err != nil {
+		fatal("Failed creating Git LFS batch request: ", err.Error())
+	}
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.SetBasicAuth("x-access-token", token)
+	}
+	batchResp, err := client.Do(req)
+	if err != nil {
+		fatal("Git LFS batch request failed: ", err.Error())
+	}
+	defer batchResp.Body.Close()
+	var batch struct {
+		Objects []struct {
+			Actions struct {
+				Download struct {
+					Href      string            `json:"href"`
+					Header    map[string]string `json:"header"`
+					ExpiresAt time.Time         `json:"expires_at"`
+					ExpiresIn int64             `json:"expires_in"`
+				} `json:"download"`
+			} `json:"actions"`
+			Error *struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"objects"`
+	}
+	if err := json.NewDecoder(batchResp.Body).Decode(&batch); err != nil || len(batch.Objects) != 1 {
+		fatalf("Unexpected Git LFS batch response with status %d", batchResp.StatusCode)
+	}
+	object := batch.Objects[0]
+	if object.Error != nil {
+		log.Printf("Git LFS object %s unavailable: %d %s\n", oid, object.Error.Code, object.Error.Message)
+		if object.Error.Code == 404 {
+			exit(ErrNotFound)
+		}
+		exit(ErrNetwork)
+	}
+	download := object.Actions.Download
+	headers := http.Header{}
+	for key, value := range download.Header {
+		headers.Set(key, value)
+	}
+	// expires_in wins if the server sends both, as the spec says.
+	expiresAt := download.ExpiresAt
+	if download.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(download.ExpiresIn) * time.Second)
+	}
+	return download.Href, headers, expiresAt
+}
+
+var errNotLfsPointer = errors.New("not a Git LFS pointer")
+
+var lfsOidRegex = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// Parses the oid and size out of a pointer file like:
+//
+//	version https://git-lfs.github.com/spec/v1
+//	oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393
+//	size 12345
+//
+// Fails with errNotLfsPointer for files that aren't a pointer at all.
+func parseLfsPointer(pointer []byte) (string, int64, error) {
+	if !bytes.HasPrefix(pointer, []byte("version https://git-lfs.github.com/spec/")) {
+		return "", 0, errNotLfsPointer
+	}
+	var oid string
+	var size int64 = -1
+	scanner := bufio.NewScanner(bytes.NewReader(pointer))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			if !lfsOidRegex.MatchString(value) {
+				return "", 0, fmt.Errorf("oid %q isn't a sha256", value)
+			}
+			oid = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			var err error
+			if size, err = strconv.ParseInt(value, 10, 64); err != nil || size < 0 {
+				return "", 0, fmt.Errorf("invalid size %q", value)
+			}
+		}
+	}
+	if oid == "" {
+		return "", 0, errors.New("pointer has no oid")
+	} else if size < 0 {
+		return "", 0, errors.New("pointer has no size")
+	}
+	return oid, size, nil
+}
+
+// LFS storage URLs are typically only signed for GET, and we already know
+// the size from the pointer.
+func (gitLfsDownloader GitLfsDownloader) GetFileInfo() (int64, bool, bool) {
+	return gitLfsDownloader.size, redirectSupportsRange(gitLfsDownloader.HttpDownloader, gitLfsDownloader.size), false
+}
+
+func (gitLfsDownloader GitLfsDownloader) ExpectedChecksum() (string, string) {
+	return "sha256", gitLfsDownloader.oid
+}
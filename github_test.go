@@ -0,0 +1,206 @@
+package fastar
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseGithubUrl(t *testing.T) {
+	for _, test := range []struct {
+		url                    string
+		owner, repo, ref, path string
+	}{
+		{"github://databricks/fastar@v1.2.3/fastar-linux-amd64", "databricks", "fastar", "v1.2.3", "fastar-linux-amd64"},
+		{"github-lfs://databricks/fastar@main/images/base.tar.lz4", "databricks", "fastar", "main", "images/base.tar.lz4"},
+		{"github-lfs://org/repo@0123abcd/a/b/c/d.bin", "org", "repo", "0123abcd", "a/b/c/d.bin"},
+		{"github://org/repo.name@release-2024.01/asset@2.tar", "org", "repo.name", "release-2024.01", "asset@2.tar"},
+		{"github://org/repo@v1", "", "", "", ""},
+		{"github://org/repo@v1/", "", "", "", ""},
+		{"github://org/repo/v1/asset", "", "", "", ""},
+		{"github://org@v1/asset", "", "", "", ""},
+		{"https://github.com/org/repo@v1/asset", "", "", "", ""},
+	} {
+		owner, repo, ref, path, err := parseGithubUrl(test.url)
+		if test.owner == "" {
+			if err == nil {
+				t.Fatalf("Expected %s not to parse, got %s %s %s %s", test.url, owner, repo, ref, path)
+			}
+			continue
+		}
+		if err != nil || owner != test.owner || repo != test.repo || ref != test.ref || path != test.path {
+			t.Fatalf("%s parsed as %q %q %q %q, %v", test.url, owner, repo, ref, path, err)
+		}
+	}
+}
+
+func TestParseLfsPointer(t *testing.T) {
+	oid := strings.Repeat("4d7a2146", 8)
+	for _, test := range []struct {
+		pointer string
+		size    int64
+		err     string
+	}{
+		{"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 12345\n", 12345, ""},
+		{"version https://git-lfs.github.com/spec/v1\r\nsize 0\r\noid sha256:" + oid + "\r\n", 0, ""},
+		{"version https://git-lfs.github.com/spec/v1\nsize 0\noid sha256:" + oid + "\n", 0, ""},
+		{"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\n", 0, "no size"},
+		{"version https://git-lfs.github.com/spec/v1\nsize 10\n", 0, "no oid"},
+		{"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 12kb\n", 0, "invalid size"},
+		{"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize -1\n", 0, "invalid size"},
+		{"version https://git-lfs.github.com/spec/v1\noid md5:" + oid[:32] + "\nsize 10\n", 0, "sha256"},
+		{"version https://git-lfs.github.com/spec/v1\noid sha256:" + oid[:63] + "\nsize 10\n", 0, "sha256"},
+		{"#!/bin/sh\necho not a pointer\n", 0, errNotLfsPointer.Error()},
+		{"", 0, errNotLfsPointer.Error()},
+	} {
+		actualOid, size, err := parseLfsPointer([]byte(test.pointer))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected %q to fail with %q, got %v", test.pointer, test.err, err)
+			}
+			continue
+		}
+		if err != nil || actualOid != oid || size != test.size {
+			t.Fatalf("%q parsed as %s %d, %v", test.pointer, actualOid, size, err)
+		}
+	}
+	if _, _, err := parseLfsPointer([]byte("<html>")); !errors.Is(err, errNotLfsPointer) {
+		t.Fatalf("Expected errNotLfsPointer, got %v", err)
+	}
+}
+
+func TestGithubReleaseRangeSupport(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	options.RetryCount = 1
+	// Failures are reported to the library call instead of exiting.
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	defer endCall()
+	opts.ChunkSize = 100
+
+	data := RandomString(1000)
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ranges":
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+		case "/whole":
+			// Ignores Range, as some storage behind a redirect does.
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.Write([]byte(data))
+		}
+	}))
+	defer storage.Close()
+	assetSize := int64(len(data))
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/") {
+			fmt.Fprintf(w, `{"assets": [{"name": "ranges", "url": "http://%s/assets/ranges", "size": %d}, {"name": "whole", "url": "http://%s/assets/whole", "size": %d}]}`,
+				r.Host, assetSize, r.Host, assetSize)
+			return
+		}
+		http.Redirect(w, r, storage.URL+"/"+strings.TrimPrefix(r.URL.Path, "/assets/"), http.StatusFound)
+	}))
+	defer api.Close()
+	t.Setenv("GITHUB_API_URL", api.URL)
+
+	for asset, expected := range map[string]bool{"ranges": true, "whole": false} {
+		downloader := NewGithubReleaseDownloader("github://org/repo@v1/"+asset, &http.Client{})
+		if size, supportsRange, _ := downloader.GetFileInfo(); size != assetSize || supportsRange != expected {
+			t.Fatalf("Expected %s to be %d bytes with range support %t, got %d bytes and %t", asset, assetSize, expected, size, supportsRange)
+		}
+	}
+
+	// The metadata doesn't match what's served.
+	assetSize++
+	downloader := NewGithubReleaseDownloader("github://org/repo@v1/ranges", &http.Client{})
+	runOwned(func() { downloader.GetFileInfo() })
+	if err := callError(); !errors.Is(err, syscall.EBADMSG) {
+		t.Fatalf("Expected a size mismatch to fail as corrupt, got %v", err)
+	}
+}
+
+func TestGitLfsRenewsExpiredHref(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	// Needs to be high enough to survive forced read failures.
+	options.RetryCount = 1000
+	options.RetryWait = 0
+	// Renewing has to work on the parallel download itself.
+	options.NoFallback = true
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	defer endCall()
+	opts.ChunkSize = 100
+
+	data := RandomString(2000)
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	// Hrefs are signed with the generation they were handed out in, only
+	// the current one is accepted.
+	var generation, batchCalls, storageRequests atomic.Int64
+	var expiresIn atomic.Int64
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := fmt.Sprint(generation.Load())
+		if r.URL.Query().Get("generation") != current || r.Header.Get("X-Signature") != current {
+			http.Error(w, "signature expired", http.StatusForbidden)
+			return
+		}
+		// Midway through the download the signatures handed out so far
+		// expire.
+		if storageRequests.Add(1) == 5 {
+			generation.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer storage.Close()
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/org/repo/raw/main/data.bin":
+			fmt.Fprintf(w, "version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(data))
+		case "/org/repo.git/info/lfs/objects/batch":
+			batchCalls.Add(1)
+			current := generation.Load()
+			fmt.Fprintf(w, `{"objects": [{"oid": %q, "size": %d, "actions": {"download": {"href": "%s/data.bin?generation=%d", "header": {"X-Signature": "%d"}, "expires_in": %d}}}]}`,
+				oid, len(data), storage.URL, current, current, expiresIn.Load())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer github.Close()
+	t.Setenv("GITHUB_SERVER_URL", github.URL)
+
+	// Hrefs that are refused once they expire, and ones that are known to
+	// expire before they're used.
+	for _, expiry := range []int64{3600, 10} {
+		expiresIn.Store(expiry)
+		batchCalls.Store(0)
+		storageRequests.Store(0)
+		downloader := NewGitLfsDownloader("github-lfs://org/repo@main/data.bin", &http.Client{})
+		downloaded, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4))
+		if err != nil || string(downloaded) != data {
+			t.Fatalf("Downloaded %d of %d bytes with hrefs expiring in %ds, %v", len(downloaded), len(data), expiry, err)
+		}
+		if err := callError(); err != nil {
+			t.Fatal(err)
+		}
+		if batchCalls.Load() < 2 {
+			t.Fatalf("Expected the href expiring in %ds to be renewed, the batch API was called %d times", expiry, batchCalls.Load())
+		}
+	}
+}
@@ -1,27 +1,38 @@
-module fastar
+module github.com/databricks/fastar
 
 go 1.16
 
 require (
 	cloud.google.com/go v0.111.0 // indirect
 	cloud.google.com/go/storage v1.35.1
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.7.0
+	github.com/Azure/azure-sdk-for-go/sdk/azidentity v1.3.0
+	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v1.2.0
 	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/aws/aws-sdk-go-v2 v1.26.0
 	github.com/aws/aws-sdk-go-v2/config v1.27.9
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.53.0
 	github.com/didip/tollbooth v4.0.2+incompatible
 	github.com/frankban/quicktest v1.14.6 // indirect
+	github.com/geoffgarside/ber v1.2.0 // indirect
 	github.com/googleapis/gax-go/v2 v2.12.0
+	github.com/hirochachacha/go-smb2 v1.1.0
 	github.com/jessevdk/go-flags v1.5.0
+	github.com/klauspost/compress v1.15.9
+	github.com/klauspost/pgzip v1.2.6
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
 	github.com/pierrec/lz4 v2.6.1+incompatible
+	github.com/ulikunitz/xz v0.5.12
 	go.opentelemetry.io/otel v1.21.0 // indirect
-	golang.org/x/oauth2 v0.15.0 // indirect
+	golang.org/x/crypto v0.16.0
+	golang.org/x/oauth2 v0.15.0
 	golang.org/x/sys v0.15.0
+	golang.org/x/time v0.5.0
 	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
 	google.golang.org/api v0.153.0
 	google.golang.org/genproto v0.0.0-20231211222908-989df2bf70f3 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20231211222908-989df2bf70f3 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20231211222908-989df2bf70f3 // indirect
-	google.golang.org/grpc v1.60.0 // indirect
+	google.golang.org/grpc v1.60.0
+	google.golang.org/protobuf v1.31.0
 )
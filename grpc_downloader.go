@@ -0,0 +1,124 @@
+package fastar
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"strings"
+	"time"
+
+	"github.com/databricks/fastar/sourcepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Downloader for services implementing the ByteRangeSource protocol in
+// sourcepb/source.proto. Handles grpc://host:port/key (plaintext) and
+// grpcs://host:port/key (TLS) URLs.
+type GrpcDownloader struct {
+	Url    string
+	key    string
+	client *sourcepb.Client
+}
+
+func NewGrpcDownloader(url string) GrpcDownloader {
+	var transportCreds credentials.TransportCredentials
+	if strings.HasPrefix(url, "grpcs://") {
+		transportCreds = credentials.NewTLS(&tls.Config{})
+	} else {
+		transportCreds = insecure.NewCredentials()
+	}
+	address, key := getAddressAndKey(url)
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(transportCreds))
+	if err != nil {
+		fatal("Failed to create gRPC connection: ", err.Error())
+	}
+	return GrpcDownloader{url, key, sourcepb.NewClient(conn)}
+}
+
+func (grpcDownloader GrpcDownloader) GetFileInfo() (int64, bool, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.ConnTimeout)*time.Second)
+	defer cancel()
+	info, err := grpcDownloader.client.GetInfo(ctx, &sourcepb.GetInfoRequest{Key: grpcDownloader.key})
+	handleGrpcError(err, "GetInfo")
+	return info.Size, info.SupportsRange, false
+}
+
+func (grpcDownloader GrpcDownloader) Get() io.ReadCloser {
+	return grpcDownloader.GetRange(0, 0)
+}
+
+// Errors opening or reading the stream surface from Read() so workers can
+// retry them like any other dropped connection.
+func (grpcDownloader GrpcDownloader) GetRange(start, end int64) io.ReadCloser {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := grpcDownloader.client.GetRange(ctx, &sourcepb.GetRangeRequest{
+		Key:   grpcDownloader.key,
+		Start: start,
+		End:   end,
+	})
+	return &grpcRangeReader{stream: stream, err: err, cancel: cancel}
+}
+
+func (grpcDownloader GrpcDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported by gRPC sources")
+}
+
+type grpcRangeReader struct {
+	stream *sourcepb.RangeClientStream
+	buf    []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+func (r *grpcRangeReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var resp *sourcepb.GetRangeResponse
+		if resp, r.err = r.stream.Recv(); r.err == nil {
+			r.buf = resp.Data
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *grpcRangeReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// If err is nil, this is a noop. Otherwise the method will print an appropriate error message
+// and exit with the appropriate error code.
+func handleGrpcError(err error, requestType string) {
+	if err == nil {
+		return
+	}
+	switch status.Code(err) {
+	case codes.NotFound:
+		log.Printf("404, %s failed, object doesn't exist: %s\n", requestType, err.Error())
+		exit(ErrNotFound)
+	case codes.Unauthenticated, codes.PermissionDenied:
+		log.Printf("%s failed to authenticate: %s\n", requestType, err.Error())
+		exit(ErrPermission)
+	case codes.ResourceExhausted:
+		log.Printf("%s throttled by download server: %s\n", requestType, err.Error())
+		exit(ErrThrottled)
+	}
+	fatalf("gRPC request %s failed: %s", requestType, err.Error())
+}
+
+func getAddressAndKey(url string) (string, string) {
+	url = strings.TrimPrefix(strings.TrimPrefix(url, "grpcs://"), "grpc://")
+	parts := strings.Split(url, "/")
+	return parts[0], strings.Join(parts[1:], "/")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/databricks/fastar/sourcepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Size of each GetRangeResponse message streamed back to clients.
+const sendSize = 1 << 20
+
+// Reference ByteRangeSource server, serves files under /tmp the same way
+// fileserver does for HTTP. Useful for e2e tests and as a starting point
+// for real implementations.
+type fileSource struct {
+	root string
+}
+
+func (s fileSource) open(key string) (*os.File, error) {
+	file, err := os.Open(filepath.Join(s.root, filepath.Clean("/"+key)))
+	if os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, key+" not found")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return file, nil
+}
+
+func (s fileSource) GetInfo(ctx context.Context, req *sourcepb.GetInfoRequest) (*sourcepb.GetInfoResponse, error) {
+	file, err := s.open(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &sourcepb.GetInfoResponse{Size: info.Size(), SupportsRange: true}, nil
+}
+
+func (s fileSource) GetRange(req *sourcepb.GetRangeRequest, stream sourcepb.RangeServerStream) error {
+	file, err := s.open(req.Key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = io.NewSectionReader(file, req.Start, 1<<62)
+	if req.End > 0 {
+		reader = io.NewSectionReader(file, req.Start, req.End-req.Start)
+	}
+	buf := make([]byte, sendSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			if err := stream.Send(&sourcepb.GetRangeResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+}
+
+func main() {
+	listener, err := net.Listen("tcp", ":9000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(sourcepb.Codec{}))
+	sourcepb.RegisterSourceServer(server, fileSource{"/tmp"})
+	log.Fatal(server.Serve(listener))
+}
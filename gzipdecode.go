@@ -0,0 +1,169 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/pgzip"
+)
+
+// A gzip member is one deflate stream, which can only be decoded front to
+// back. BGZF, which bgzip, htslib and some image pipelines write, splits
+// its content into members of at most 64KiB that record their compressed
+// size in a "BC" extra field, so the stream can be cut into members without
+// decoding it and the members decoded on --decompress-workers cores at
+// once. Other gzip streams are read with pgzip, which inflates ahead of
+// the tar reader and checksums on separate goroutines.
+const (
+	bgzfMaxBlockSize = 64 << 10
+	// Header up to the extra field, and CRC32 and ISIZE trailer.
+	gzipHeaderSize  = 12
+	gzipTrailerSize = 8
+	gzipFlagExtra   = 1 << 2
+	// Blocks pgzip reads ahead per worker.
+	pgzipBlockSize = 1 << 20
+)
+
+var bgzfBuffers, flateReaders sync.Pool
+
+func newGzipReader(stream io.Reader) (io.Reader, error) {
+	workers := decompressWorkers()
+	if workers <= 1 {
+		return gzip.NewReader(stream)
+	}
+	src := bufio.NewReaderSize(stream, 2*bgzfMaxBlockSize)
+	if _, ok := peekBgzfBlock(src); ok {
+		return newBgzfReader(src, workers), nil
+	}
+	return pgzip.NewReaderN(src, pgzipBlockSize, workers)
+}
+
+// Returns the size of the BGZF member at the front of src, without
+// consuming it, or false if it's anything else.
+func peekBgzfBlock(src *bufio.Reader) (int, bool) {
+	head, err := src.Peek(gzipHeaderSize)
+	// Only the extra field is allowed, anything else would move the data.
+	if err != nil || head[0] != 0x1f || head[1] != 0x8b || head[2] != 8 || head[3] != gzipFlagExtra {
+		return 0, false
+	}
+	extraSize := int(binary.LittleEndian.Uint16(head[10:]))
+	if head, err = src.Peek(gzipHeaderSize + extraSize); err != nil {
+		return 0, false
+	}
+	for extra := head[gzipHeaderSize:]; len(extra) >= 4; {
+		fieldSize := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+fieldSize {
+			break
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && fieldSize == 2 {
+			size := int(binary.LittleEndian.Uint16(extra[4:])) + 1
+			if size < gzipHeaderSize+extraSize+gzipTrailerSize {
+				return 0, false
+			}
+			return size, true
+		}
+		extra = extra[4+fieldSize:]
+	}
+	return 0, false
+}
+
+func newBgzfReader(src *bufio.Reader, workers int) io.Reader {
+	return decodeInOrder(workers, func(submit func(*decodeTask)) error {
+		return readBgzfBlocks(src, workers, submit)
+	})
+}
+
+// Splits the stream into tasks decoding its members. Should the stream
+// go on with members that aren't BGZF, e.g. because another gzip was
+// appended to it, the rest is decoded here with pgzip instead.
+func readBgzfBlocks(src *bufio.Reader, workers int, submit func(*decodeTask)) error {
+	for {
+		if _, err := src.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size, ok := peekBgzfBlock(src)
+		if !ok {
+			return readGzipRest(src, workers, submit)
+		}
+		block := make([]byte, size)
+		if _, err := io.ReadFull(src, block); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		submit(&decodeTask{
+			decode: func() ([]byte, error) { return decodeBgzfBlock(block) },
+			done:   func(decoded []byte) { bgzfBuffers.Put(decoded[:0]) },
+		})
+	}
+}
+
+func decodeBgzfBlock(block []byte) ([]byte, error) {
+	extraSize := int(binary.LittleEndian.Uint16(block[10:]))
+	trailer := block[len(block)-gzipTrailerSize:]
+	checksum := binary.LittleEndian.Uint32(trailer)
+	size := binary.LittleEndian.Uint32(trailer[4:])
+	if size > bgzfMaxBlockSize {
+		return nil, fmt.Errorf("gzip: BGZF block of %d bytes is over the 64KiB maximum", size)
+	}
+	compressed := bytes.NewReader(block[gzipHeaderSize+extraSize : len(block)-gzipTrailerSize])
+	inflater, _ := flateReaders.Get().(io.ReadCloser)
+	if inflater == nil {
+		inflater = flate.NewReader(compressed)
+	} else {
+		inflater.(flate.Resetter).Reset(compressed, nil)
+	}
+	defer flateReaders.Put(inflater)
+	buf, _ := bgzfBuffers.Get().([]byte)
+	if cap(buf) < bgzfMaxBlockSize {
+		buf = make([]byte, bgzfMaxBlockSize)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(inflater, buf); err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	// The block has to end where ISIZE says.
+	if n, err := inflater.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return nil, gzip.ErrHeader
+	}
+	if crc32.ChecksumIEEE(buf) != checksum {
+		return nil, gzip.ErrChecksum
+	}
+	return buf, nil
+}
+
+func readGzipRest(src io.Reader, workers int, submit func(*decodeTask)) error {
+	rest, err := pgzip.NewReaderN(src, pgzipBlockSize, workers)
+	if err != nil {
+		return err
+	}
+	for {
+		buf := make([]byte, pgzipBlockSize)
+		// Not io.ReadFull, which would hide a truncated stream's
+		// io.ErrUnexpectedEOF.
+		n := 0
+		for err == nil && n < len(buf) {
+			var read int
+			read, err = rest.Read(buf[n:])
+			n += read
+		}
+		if n > 0 {
+			submit(&decodeTask{decode: func() ([]byte, error) { return buf[:n], nil }})
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
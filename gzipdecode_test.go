@@ -0,0 +1,91 @@
+package fastar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Compresses data into BGZF members of at most 64KiB, followed by the
+// empty member bgzip ends its files with.
+func compressBgzf(t *testing.T, data string) []byte {
+	var stream bytes.Buffer
+	for {
+		chunk := data[:min(int64(len(data)), 60000)]
+		data = data[len(chunk):]
+		var member bytes.Buffer
+		writer := gzip.NewWriter(&member)
+		writer.Header.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		if _, err := writer.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		binary.LittleEndian.PutUint16(member.Bytes()[16:], uint16(member.Len()-1))
+		stream.Write(member.Bytes())
+		if chunk == "" {
+			return stream.Bytes()
+		}
+	}
+}
+
+func TestBgzfReader(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.DecodeWorkers = 4
+
+	first := strings.Repeat(RandomString(1000), 300)
+	second := RandomString(200000)
+	var stream bytes.Buffer
+	stream.Write(compressBgzf(t, first))
+	// An ordinary gzip appended to it.
+	writer := gzip.NewWriter(&stream)
+	writer.Write([]byte(second))
+	writer.Close()
+
+	reader, err := newGzipReader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := io.ReadAll(reader)
+	if err != nil || string(actual) != first+second {
+		t.Fatalf("Got %d bytes, %v", len(actual), err)
+	}
+
+	corrupted := compressBgzf(t, first)
+	// CRC32 of the last non-empty member.
+	corrupted[len(corrupted)-28-8] ^= 0xff
+	reader, _ = newGzipReader(bytes.NewReader(corrupted))
+	if _, err := io.ReadAll(reader); err != gzip.ErrChecksum {
+		t.Fatalf("Expected a checksum error, got %v", err)
+	}
+	reader, _ = newGzipReader(bytes.NewReader(corrupted[:len(corrupted)/2]))
+	if _, err := io.ReadAll(reader); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a truncated stream to fail, got %v", err)
+	}
+}
+
+func TestPgzipReader(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.DecodeWorkers = 4
+
+	data := RandomString(3 << 20)
+	var stream bytes.Buffer
+	writer := gzip.NewWriter(&stream)
+	writer.Write([]byte(data))
+	writer.Close()
+	reader, err := newGzipReader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reader.(*gzip.Reader); ok {
+		t.Fatal("Expected a parallel reader with 4 workers")
+	}
+	actual, err := io.ReadAll(reader)
+	if err != nil || string(actual) != data {
+		t.Fatalf("Got %d bytes, %v", len(actual), err)
+	}
+}
@@ -0,0 +1,81 @@
+package fastar
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Per-file digests (--hash-files) computed from the in memory buffers right
+// before they're written, so verifying a huge tree later doesn't need a
+// second full read of it. The manifest is in the format of the matching
+// coreutils tool, e.g. `sha256sum -c SHA256SUMS` run from the output
+// directory checks every regular file and hard link.
+var (
+	hashMutex    sync.Mutex
+	hashManifest = map[string]string{}
+)
+
+var hashManifestNames = map[string]string{
+	"sha256": "SHA256SUMS",
+	"sha1":   "SHA1SUMS",
+	"md5":    "MD5SUMS",
+}
+
+// name is relative to the root of the extraction.
+func recordFileHash(name string, buf []byte) {
+	hash := newHash(opts.HashFiles)
+	hash.Write(buf)
+	digest := hex.EncodeToString(hash.Sum(nil))
+	hashMutex.Lock()
+	defer hashMutex.Unlock()
+	hashManifest[name] = digest
+}
+
+// Hard links have the digest of their target, which has been written (and
+// hashed) by the time the link is created.
+func recordHashLink(target, name string) {
+	hashMutex.Lock()
+	defer hashMutex.Unlock()
+	if digest, ok := hashManifest[target]; ok {
+		hashManifest[name] = digest
+	}
+}
+
+// Defaults to e.g. SHA256SUMS in the output directory.
+func writeHashManifest() {
+	manifestPath := opts.HashManifest
+	if manifestPath == "" {
+		dir := opts.OutputDir
+		if dir == "" {
+			dir = "."
+		}
+		manifestPath = filepath.Join(dir, hashManifestNames[opts.HashFiles])
+	}
+	names := make([]string, 0, len(hashManifest))
+	for name := range hashManifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var manifest strings.Builder
+	for _, name := range names {
+		digest := hashManifest[name]
+		// Same escaping as coreutils: names with a backslash or newline
+		// get a leading backslash and those characters escaped.
+		if strings.ContainsAny(name, "\\\n") {
+			manifest.WriteString("\\")
+			name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		}
+		manifest.WriteString(digest + "  " + name + "\n")
+	}
+	if err := os.WriteFile(manifestPath, []byte(manifest.String()), 0644); err != nil {
+		fatal("Failed to write hash manifest: ", err.Error())
+	}
+	log.Printf("Wrote %s digests of %d files to %s\n", opts.HashFiles, len(names), manifestPath)
+	emitEvent("hash_manifest_written", map[string]interface{}{"path": manifestPath, "algorithm": opts.HashFiles, "files": len(names)})
+	hashManifest = map[string]string{}
+}
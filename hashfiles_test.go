@@ -0,0 +1,48 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFilesManifest(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	contents := map[string]string{"a": RandomString(1000), "dir/b": RandomString(5000), "back\\slash": "x"}
+	for _, name := range []string{"a", "dir/b", "back\\slash"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents[name]))})
+		tw.Write([]byte(contents[name]))
+	}
+	tw.WriteHeader(&tar.Header{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "a"})
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	opts.HashFiles = "sha256"
+	ExtractTar(context.Background(), &archive)
+
+	digest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	expected := digest(contents["a"]) + "  a\n" +
+		"\\" + digest("x") + "  back\\\\slash\n" +
+		digest(contents["dir/b"]) + "  dir/b\n" +
+		digest(contents["a"]) + "  dir/link\n"
+	manifest, err := os.ReadFile(filepath.Join(opts.OutputDir, "SHA256SUMS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(manifest) != expected {
+		t.Fatalf("Got manifest:\n%s\nwanted:\n%s", manifest, expected)
+	}
+}
@@ -0,0 +1,109 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --header-command prints headers to send with every HTTP(S) request, one
+// "Name: value" per line, e.g. a short-lived bearer token from a cloud CLI:
+//
+//	--header-command 'echo "Authorization: Bearer $(gcloud auth print-access-token)"'
+//
+// It runs again whenever the server answers 401 or 403, and after
+// --header-ttl seconds if given, so a transfer running for hours doesn't
+// fail once the token it started with expires. FASTAR_URL holds the URL
+// being downloaded.
+var commandHeaders struct {
+	mutex   sync.Mutex
+	header  http.Header
+	fetched time.Time
+	// Counts runs, so workers failing with the same stale headers at once
+	// only run the command once.
+	generation int64
+}
+
+// Parses the output of --header-command.
+func parseHeaderLines(output []byte) (http.Header, error) {
+	header := http.Header{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("expected \"Name: value\", got %q", line)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, scanner.Err()
+}
+
+// Runs --header-command for url. Must be called with the mutex held.
+func runHeaderCommand(url string) {
+	cmd := shellCommand(opts.HeaderCommand)
+	cmd.Env = append(os.Environ(), "FASTAR_URL="+url)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		fatal("--header-command failed: ", err.Error())
+	}
+	header, err := parseHeaderLines(output)
+	if err != nil {
+		fatal("Failed to parse --header-command output: ", err.Error())
+	}
+	if commandHeaders.generation > 0 {
+		log.Println("Refreshed headers with --header-command")
+		emitEvent("headers_refreshed", map[string]interface{}{"generation": commandHeaders.generation + 1})
+	}
+	commandHeaders.header = header
+	commandHeaders.fetched = time.Now()
+	commandHeaders.generation++
+}
+
+// Sets the headers from --header-command on req, running it first if it
+// hasn't yet or they're older than --header-ttl, or the credentials from
+// --credential-helper, then signs it for --sign. Returns their generation
+// to pass to refreshCommandHeaders, 0 without either.
+func applyCommandHeaders(req *http.Request) int64 {
+	defer signRequest(req)
+	if opts.CredHelper != "" {
+		return applyCredentials(req)
+	}
+	if opts.HeaderCommand == "" {
+		return 0
+	}
+	commandHeaders.mutex.Lock()
+	defer commandHeaders.mutex.Unlock()
+	expired := opts.HeaderTtl > 0 && time.Since(commandHeaders.fetched) > time.Duration(opts.HeaderTtl)*time.Second
+	if commandHeaders.generation == 0 || expired {
+		runHeaderCommand(req.URL.String())
+	}
+	for name, values := range commandHeaders.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	return commandHeaders.generation
+}
+
+// Runs --header-command (or --credential-helper) again after a request sent with the headers of
+// generation was refused, unless another request already did.
+func refreshCommandHeaders(req *http.Request, generation int64) {
+	if opts.CredHelper != "" {
+		refreshCredentials(req, generation)
+		return
+	}
+	commandHeaders.mutex.Lock()
+	defer commandHeaders.mutex.Unlock()
+	if commandHeaders.generation == generation {
+		runHeaderCommand(req.URL.String())
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaderLines(t *testing.T) {
+	header, err := parseHeaderLines([]byte("authorization: Bearer abc\n\nX-Extra:  one \nX-Extra: two\n"))
+	if err != nil || header.Get("Authorization") != "Bearer abc" || len(header.Values("X-Extra")) != 2 || header.Get("X-Extra") != "one" {
+		t.Fatalf("Got %v, %v", header, err)
+	}
+	if _, err := parseHeaderLines([]byte("no colon here")); err == nil {
+		t.Fatal("Expected a line without a colon to be rejected")
+	}
+}
+
+func TestHeaderCommandRefresh(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; commandHeaders.header, commandHeaders.generation = nil, 0 }()
+	opts.RetryCount = 3
+	opts.RetryWait = 0
+
+	// Each run of the command hands out the next token, the server only
+	// takes the second one and later.
+	counter := filepath.Join(t.TempDir(), "counter")
+	opts.HeaderCommand = `n=$(( $(cat ` + counter + ` 2>/dev/null || echo 0) + 1 )); echo $n > ` + counter + `; echo "X-Token: $n"; echo "X-Url: $FASTAR_URL"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") == "1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, r.Header.Get("X-Token")+" "+r.Header.Get("X-Url"))
+	}))
+	defer server.Close()
+
+	downloader := HttpDownloader{Url: server.URL, client: server.Client()}
+	body, err := io.ReadAll(downloader.Get())
+	if err != nil || string(body) != "2 "+server.URL {
+		t.Fatalf("Expected the request to be retried with refreshed headers, got %q, %v", body, err)
+	}
+	// Later requests keep the refreshed headers.
+	if body, _ := io.ReadAll(downloader.Get()); !strings.HasPrefix(string(body), "2 ") {
+		t.Fatalf("Expected the command not to run again, got %q", body)
+	}
+}
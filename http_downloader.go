@@ -1,4 +1,4 @@
-package main
+package fastar
 
 import (
 	"errors"
@@ -8,59 +8,158 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/avast/retry-go"
-	"golang.org/x/sys/unix"
 )
 
 type HttpDownloader struct {
 	Url           string
 	client        *http.Client
 	useGetForSize bool
+	// Sent with every request in addition to --headers.
+	headers http.Header
+	// Set if Url is only valid for a while, requests then go to its
+	// current URL instead.
+	expiring *expiringUrl
+}
+
+// Renewed this long before a URL expires, so requests don't start with one
+// that expires before it's answered.
+const expiryMargin = 30 * time.Second
+
+// A signed URL that's only valid for a while, like the hrefs the Git LFS
+// batch API hands out. renew gets a fresh one with the headers to send to
+// it, once it expires or the server refuses it.
+type expiringUrl struct {
+	mutex      sync.Mutex
+	url        string
+	headers    http.Header
+	expiresAt  time.Time
+	refused    bool
+	renew      func() (string, http.Header, time.Time)
+	headerKeys map[string]bool
+}
+
+func newExpiringUrl(renew func() (string, http.Header, time.Time)) *expiringUrl {
+	e := &expiringUrl{renew: renew, headerKeys: map[string]bool{}}
+	e.url, e.headers, e.expiresAt = renew()
+	for key := range e.headers {
+		e.headerKeys[key] = true
+	}
+	return e
+}
+
+// Points req at the current URL, renewing it first if needed.
+func (e *expiringUrl) apply(req *http.Request) {
+	e.mutex.Lock()
+	if e.refused || (!e.expiresAt.IsZero() && time.Now().Add(expiryMargin).After(e.expiresAt)) {
+		log.Println("Signed URL expired, renewing it")
+		e.url, e.headers, e.expiresAt = e.renew()
+		e.refused = false
+		for key := range e.headers {
+			e.headerKeys[key] = true
+		}
+	}
+	current, headers := e.url, e.headers
+	for key := range e.headerKeys {
+		req.Header.Del(key)
+	}
+	e.mutex.Unlock()
+	parsed, err := url.Parse(current)
+	if err != nil {
+		fatal("Invalid signed URL: ", err.Error())
+	}
+	req.URL, req.Host = parsed, parsed.Host
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+}
+
+// Renews the URL before the next request, unless another request already
+// did since refused was sent to it.
+func (e *expiringUrl) refuse(refused string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if current, err := url.Parse(e.url); err == nil && current.String() == refused {
+		e.refused = true
+	}
+}
+
+// Some servers, e.g. ones handing out URLs signed for GET only, refuse HEAD
+// with one of these. The size is learned with a ranged GET instead.
+var headRejectedStatuses = map[int]bool{
+	http.StatusForbidden:        true,
+	http.StatusMethodNotAllowed: true,
+	http.StatusNotImplemented:   true,
+}
+
+// URLs whose server rejected HEAD, so later calls go straight to GET.
+var headRejected sync.Map
+
+// Strong ETag, or else Last-Modified, of each URL as of when its size was
+// learned. Ranged requests send it as If-Range, so should the object
+// change mid-download the server answers with all of the new one instead
+// of a range, and the download fails rather than stitching together
+// ranges of two different versions.
+var objectValidators sync.Map
+
+func rememberValidator(url string, resp *http.Response) {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		objectValidators.Store(url, etag)
+	} else if modified := resp.Header.Get("Last-Modified"); modified != "" {
+		objectValidators.Store(url, modified)
+	}
+}
+
+func (httpDownloader HttpDownloader) setIfRange(req *http.Request) {
+	if validator, ok := objectValidators.Load(httpDownloader.Url); ok {
+		req.Header.Set("If-Range", validator.(string))
+	}
+}
+
+// Exits with ESTALE if a ranged request came back with the whole object
+// because its If-Range no longer matched.
+func (httpDownloader HttpDownloader) checkUnchanged(req *http.Request, resp *http.Response) {
+	ifRange := req.Header.Get("If-Range")
+	if resp.StatusCode != http.StatusOK || ifRange == "" {
+		return
+	}
+	resp.Body.Close()
+	if resp.Header.Get("ETag") == ifRange || resp.Header.Get("Last-Modified") == ifRange {
+		fatal(httpDownloader.Url, " answered a ranged request with the whole file")
+	}
+	log.Printf("%s changed during the download, it no longer matches %s\n", httpDownloader.Url, ifRange)
+	emitEvent("object_changed", map[string]interface{}{"url": httpDownloader.Url, "validator": ifRange})
+	exit(syscall.ESTALE)
 }
 
 func (httpDownloader HttpDownloader) GetFileInfo() (int64, bool, bool) {
 	var resp *http.Response
 	var contentLength int64
+	var supportsRange bool
 
 	// If useGetForSize is true, use GET with Range header to determine file size.
 	// This was inspired by https://stackoverflow.com/questions/15717230/pre-signing-amazon-s3-urls-for-both-head-and-get-verbs,
 	// which in turn allows usage of S3 presigned URLs which can only be signed for one HTTP method.
 	// This has been tested on AWS, Azure, and GCP.
-	if httpDownloader.useGetForSize {
-		// Use GET with Range header to determine file size
-		req := httpDownloader.generateRequest("GET")
-		req.Header.Add("Range", "bytes=0-0")
-		resp = httpDownloader.retryHttpRequest(req)
-
-		// Close the body since we only needed the headers
-		defer resp.Body.Close()
-		
-		// Parse Content-Range header to get total file size
-		contentRange := resp.Header.Get("Content-Range")
-		if contentRange != "" {
-			// Content-Range format: "bytes 0-0/total_size"
-			if parts := strings.Split(contentRange, "/"); len(parts) == 2 {
-				if size, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
-					contentLength = size
-				} else {
-					log.Fatal("Failed to parse Content-Range size: ", err.Error())
-				}
-			} else {
-				log.Fatal("Unexpected Content-Range format: ", contentRange)
-			}
-		} else {
-			log.Fatal("Content-Range missing on response when using GET for size. Failing download.")
-		}
-	} else {
+	_, rejected := headRejected.Load(httpDownloader.Url)
+	if !httpDownloader.useGetForSize && !rejected {
 		// Use traditional HEAD request
 		req := httpDownloader.generateRequest("HEAD")
-		resp = httpDownloader.retryHttpRequest(req)
-		contentLength = resp.ContentLength
+		if resp = httpDownloader.tryHead(req); resp != nil {
+			rememberValidator(httpDownloader.Url, resp)
+			contentLength = resp.ContentLength
+			supportsRange = resp.Header.Get("Accept-Ranges") != ""
+		}
+	}
+	if resp == nil {
+		contentLength, supportsRange = httpDownloader.getSizeWithRange()
 	}
 
 	if contentLength > opts.ChunkSize {
@@ -69,7 +168,7 @@ func (httpDownloader HttpDownloader) GetFileInfo() (int64, bool, bool) {
 		// the whole body and this may be overloading their servers.
 		// TODO: see if there's some way to determine multipart range support without
 		// necessarily returning the whole file in the body.
-		return contentLength, resp.Header.Get("Accept-Ranges") != "", false
+		return contentLength, supportsRange, false
 	} else {
 		// If the file is tiny it doesn't matter if we support any kind
 		// of range request
@@ -77,6 +176,60 @@ func (httpDownloader HttpDownloader) GetFileInfo() (int64, bool, bool) {
 	}
 }
 
+// Sends HEAD, returning nil if the server rejected the method. Other
+// failures are retried like any request.
+func (httpDownloader HttpDownloader) tryHead(req *http.Request) *http.Response {
+	applyCommandHeaders(req)
+	resp, err := httpDownloader.client.Do(req)
+	if err != nil {
+		return httpDownloader.retryHttpRequest(req)
+	}
+	resp.Body.Close()
+	if headRejectedStatuses[resp.StatusCode] {
+		log.Printf("Server rejected HEAD with %d, using GET with a Range header to determine file size\n", resp.StatusCode)
+		emitEvent("head_rejected", map[string]interface{}{"status": resp.StatusCode})
+		headRejected.Store(httpDownloader.Url, true)
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return httpDownloader.retryHttpRequest(req)
+	}
+	return resp
+}
+
+// Learns the file size from the Content-Range of a GET for its first
+// byte. A server that ignores the Range header answers with the whole
+// file, whose length is used instead, without range support.
+func (httpDownloader HttpDownloader) getSizeWithRange() (int64, bool) {
+	req := httpDownloader.generateRequest("GET")
+	req.Header.Add("Range", "bytes=0-0")
+	resp := httpDownloader.retryHttpRequest(req)
+
+	// Close the body since we only needed the headers
+	defer resp.Body.Close()
+	rememberValidator(httpDownloader.Url, resp)
+
+	// Parse Content-Range header to get total file size
+	contentRange := resp.Header.Get("Content-Range")
+	if contentRange == "" {
+		if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+			log.Println("Server ignored the Range header, downloading without RANGE support")
+			return resp.ContentLength, false
+		}
+		fatal("Content-Range missing on response when using GET for size. Failing download.")
+	}
+	// Content-Range format: "bytes 0-0/total_size"
+	parts := strings.Split(contentRange, "/")
+	if len(parts) != 2 {
+		fatal("Unexpected Content-Range format: ", contentRange)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		fatal("Failed to parse Content-Range size: ", err.Error())
+	}
+	return size, resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Accept-Ranges") != ""
+}
+
 func (httpDownloader HttpDownloader) Get() io.ReadCloser {
 	req := httpDownloader.generateRequest("GET")
 	return httpDownloader.retryHttpRequest(req).Body
@@ -87,8 +240,10 @@ func (httpDownloader HttpDownloader) GetRange(start, end int64) io.ReadCloser {
 
 	rangeString := GenerateRangeString([][]int64{{start, end}})
 	req.Header.Add("Range", rangeString)
+	httpDownloader.setIfRange(req)
 
 	resp := httpDownloader.retryHttpRequest(req)
+	httpDownloader.checkUnchanged(req, resp)
 	return resp.Body
 }
 
@@ -98,9 +253,11 @@ func (httpDownloader HttpDownloader) GetRanges(ranges [][]int64) (*multipart.Rea
 	rangeString := GenerateRangeString(ranges)
 	if len(ranges) != 0 {
 		req.Header.Add("Range", rangeString)
+		httpDownloader.setIfRange(req)
 	}
 
 	resp := httpDownloader.retryHttpRequest(req)
+	httpDownloader.checkUnchanged(req, resp)
 
 	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
@@ -118,9 +275,14 @@ func (httpDownloader HttpDownloader) GetRanges(ranges [][]int64) (*multipart.Rea
 func (httpDownloader HttpDownloader) generateRequest(requestMethod string) *http.Request {
 	req, err := http.NewRequest(requestMethod, httpDownloader.Url, nil)
 	if err != nil {
-		log.Fatal("Failed creating GET request:", err.Error())
+		fatal("Failed creating GET request:", err.Error())
 	}
 
+	for key, values := range httpDownloader.headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
 	for key, value := range opts.Headers {
 		req.Header.Add(key, value)
 	}
@@ -132,6 +294,10 @@ func (httpDownloader HttpDownloader) retryHttpRequest(req *http.Request) *http.R
 	var throttled = false
 	err := retry.Do(
 		func() error {
+			generation := applyCommandHeaders(req)
+			if httpDownloader.expiring != nil {
+				httpDownloader.expiring.apply(req)
+			}
 			curResp, err := httpDownloader.client.Do(req)
 			if err != nil {
 				return err
@@ -143,33 +309,77 @@ func (httpDownloader HttpDownloader) retryHttpRequest(req *http.Request) *http.R
 						log.Println("response body:", string(body))
 					}
 				}
-				if curResp.StatusCode == 404 {
-					log.Println("404, file not found")
-					os.Exit(int(unix.ENOENT))
-				}
+				curResp.Body.Close()
+				var err error
 				// Azure blob storage can return either 429 or 503 when throttling
 				// https://learn.microsoft.com/en-us/azure/storage/blobs/scalability-targets
 				if curResp.StatusCode == 429 || curResp.StatusCode == 503 {
 					throttled = true
-					return errors.New("throttled by download server " + strconv.Itoa(curResp.StatusCode))
+					emitEvent("throttled", map[string]interface{}{"status": curResp.StatusCode})
+					err = retryAfterError{errors.New("throttled by download server " + strconv.Itoa(curResp.StatusCode)), retryAfter(curResp)}
+				} else if generation > 0 && (curResp.StatusCode == http.StatusUnauthorized || curResp.StatusCode == http.StatusForbidden) {
+					// Likely an expired token, retried with fresh headers.
+					refreshCommandHeaders(req, generation)
+					return errors.New("refused with " + strconv.Itoa(curResp.StatusCode) + ", refreshed headers")
+				} else if httpDownloader.expiring != nil && (curResp.StatusCode == http.StatusUnauthorized || curResp.StatusCode == http.StatusForbidden) {
+					// Likely an expired signed URL, retried with a new one.
+					httpDownloader.expiring.refuse(req.URL.String())
+					return errors.New("refused with " + strconv.Itoa(curResp.StatusCode) + ", renewing the signed URL")
+				} else {
+					err = &Error{int(httpStatusClass(curResp.StatusCode)), "unknown non-2xx response " + strconv.Itoa(curResp.StatusCode)}
 				}
-				return errors.New("unknown non-2xx response " + strconv.Itoa(curResp.StatusCode))
+				if !retryableStatus(curResp.StatusCode) {
+					if curResp.StatusCode == 404 {
+						log.Println("404, file not found")
+						exit(ErrNotFound)
+					}
+					return retry.Unrecoverable(err)
+				}
+				return err
 			}
 			resp = curResp
+			attemptSucceeded()
 			return nil
 		},
-		retry.DelayType(retry.BackOffDelay),
+		retry.RetryIf(func(err error) bool {
+			// A throttling server isn't down, its hints are waited out.
+			var throttledErr retryAfterError
+			if errors.As(err, &throttledErr) {
+				return true
+			}
+			return retry.IsRecoverable(err) && attemptFailed(err.Error()) == nil
+		}),
+		retry.DelayType(retryDelay),
 		retry.Delay(time.Second*time.Duration(opts.RetryWait)),
 		retry.Attempts(uint(opts.RetryCount)),
-		retry.MaxDelay(time.Second*time.Duration(opts.MaxWait)),
 	)
 	if err != nil {
 		log.Println("Failed get request:", err.Error())
+		if tripped := retryBudgetTripped(); tripped != nil {
+			fail(tripped)
+		}
 		if throttled {
-			os.Exit(int(unix.EBUSY))
-		} else {
-			log.Fatal("unknown http response")
+			exit(ErrThrottled)
 		}
+		// Whatever kept failing, the source couldn't be downloaded from.
+		errno := classifyError(err)
+		if errno == 0 {
+			errno = ErrNetwork
+		}
+		fail(&Error{int(errno), "Failed get request: " + err.Error()})
 	}
 	return resp
 }
+
+// The class of failure a non-2xx HTTP status stands for.
+func httpStatusClass(status int) syscall.Errno {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrPermission
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return ErrThrottled
+	}
+	return ErrNetwork
+}
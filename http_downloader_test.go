@@ -0,0 +1,67 @@
+package fastar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIfRange(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	options.RetryCount = 1000000
+	// Failures are reported to the library call instead of exiting.
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	defer endCall()
+	opts.ChunkSize = 100
+
+	versions := [][]byte{[]byte(RandomString(1000)), []byte(RandomString(1000))}
+	var version atomic.Int64
+	var ifRange atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("If-Range"); header != "" {
+			ifRange.Store(header)
+		}
+		current := version.Load()
+		w.Header().Set("ETag", []string{`"v1"`, `"v2"`}[current])
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(versions[current]))
+	}))
+	defer server.Close()
+	downloader := getDownloader(server.URL, false, false)
+
+	downloaded, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4))
+	if err != nil || !bytes.Equal(downloaded, versions[0]) {
+		t.Fatalf("Downloaded %d bytes, %v", len(downloaded), err)
+	}
+	if ifRange.Load() != `"v1"` {
+		t.Fatalf("Expected ranged requests to send If-Range, got %v", ifRange.Load())
+	}
+
+	// The object changes once its size is known. With a single worker
+	// each chunk is only requested once the previous one has been read.
+	stream := GetDownloadStream(context.Background(), downloader, 100, 1)
+	if _, err := io.ReadFull(stream, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	version.Store(1)
+	go io.Copy(io.Discard, stream)
+	select {
+	case <-libraryFailed:
+	case <-time.After(time.Minute):
+		t.Fatal("Expected the download to fail")
+	}
+	if err := callError(); !errors.Is(err, syscall.ESTALE) {
+		t.Fatalf("Expected the download to fail with ESTALE, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package fastar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kernel's overflow ID, used for IDs not covered by any mapping the same
+// way an unmapped ID shows up inside a user namespace.
+const overflowId = 65534
+
+// A contiguous range of IDs, mapping [container, container+size) onto
+// [host, host+size). Same format as /proc/<pid>/uid_map.
+type idMapping struct {
+	container, host, size int
+}
+
+// Parses mappings of the form "CONTAINER:HOST:SIZE", e.g. "0:100000:65536".
+func parseIdMappings(mappings []string) ([]idMapping, error) {
+	var parsed []idMapping
+	for _, mapping := range mappings {
+		parts := strings.Split(mapping, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid id mapping %q, expected CONTAINER:HOST:SIZE", mapping)
+		}
+		var values [3]int
+		for i, part := range parts {
+			value, err := strconv.Atoi(part)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("invalid id mapping %q, expected CONTAINER:HOST:SIZE", mapping)
+			}
+			values[i] = value
+		}
+		parsed = append(parsed, idMapping{values[0], values[1], values[2]})
+	}
+	return parsed, nil
+}
+
+// Maps an ID from the archive to its host ID. No mappings means IDs are
+// used as is.
+func mapId(id int, mappings []idMapping) int {
+	if len(mappings) == 0 {
+		return id
+	}
+	for _, m := range mappings {
+		if id >= m.container && id < m.container+m.size {
+			return m.host + id - m.container
+		}
+	}
+	return overflowId
+}
+
+var uidMappings, gidMappings []idMapping
+
+func setupIdMappings() {
+	var err error
+	if uidMappings, err = parseIdMappings(opts.UidMap); err != nil {
+		fatal("Failed to parse --uid-map: ", err.Error())
+	}
+	if gidMappings, err = parseIdMappings(opts.GidMap); err != nil {
+		fatal("Failed to parse --gid-map: ", err.Error())
+	}
+}
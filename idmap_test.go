@@ -0,0 +1,30 @@
+package fastar
+
+import "testing"
+
+func TestIdMappings(t *testing.T) {
+	mappings, err := parseIdMappings([]string{"0:100000:1000", "1000:5000:10"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	cases := map[int]int{
+		0:    100000,
+		999:  100999,
+		1000: 5000,
+		1009: 5009,
+		1010: overflowId,
+	}
+	for id, expected := range cases {
+		if actual := mapId(id, mappings); actual != expected {
+			t.Fatalf("mapId(%d) got %d, wanted %d", id, actual, expected)
+		}
+	}
+	if actual := mapId(42, nil); actual != 42 {
+		t.Fatalf("mapId without mappings got %d, wanted 42", actual)
+	}
+	for _, input := range []string{"0:1", "a:b:c", "0:-1:5"} {
+		if _, err := parseIdMappings([]string{input}); err == nil {
+			t.Fatalf("parseIdMappings(%q) should have failed", input)
+		}
+	}
+}
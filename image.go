@@ -0,0 +1,122 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Builds a filesystem image out of the tarball rather than extracting it
+// into a directory. spec is FORMAT:PATH[:SIZE], where FORMAT is one of
+//
+//	ext4:PATH:SIZE  PATH is created as a SIZE byte file (or can be an
+//	                existing block device, then SIZE is optional), formatted
+//	                with mkfs.ext4 and loop mounted to extract into. Needs root,
+//	                and --overwrite if PATH exists.
+//	erofs:PATH      uncompressed EROFS image, built in userspace.
+//	squashfs:PATH   same as --to-squashfs.
+func WriteImage(ctx context.Context, stream io.Reader, spec string) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		fatal("--to-image must be of the form FORMAT:PATH[:SIZE]")
+	}
+	format, path := parts[0], parts[1]
+	switch format {
+	case "ext4":
+		size := int64(0)
+		if len(parts) == 3 {
+			var err error
+			if size, err = parseImageSize(parts[2]); err != nil {
+				fatal("Failed to parse image size: ", err.Error())
+			}
+		}
+		WriteExt4Image(ctx, stream, path, size)
+	case "erofs":
+		WriteErofs(stream, path)
+	case "squashfs":
+		WriteSquashfs(stream, path)
+	default:
+		fatal("Unsupported image format ", format, ", supported formats are ext4, erofs and squashfs")
+	}
+}
+
+// Formats path as ext4, loop mounts it and extracts the tarball into it
+// with the regular extraction code. If extraction fails the image is left
+// mounted at the logged mountpoint for inspection.
+func WriteExt4Image(ctx context.Context, stream io.Reader, path string, size int64) {
+	info, err := os.Stat(path)
+	isDevice := err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+	if err == nil && !opts.Overwrite {
+		// Formatting wipes whatever was there, e.g. a mistyped disk.
+		if isDevice {
+			log.Printf("%s is a block device, pass --overwrite to format it and lose what's on it\n", path)
+		} else {
+			log.Printf("Image %s already exists, pass --overwrite to replace it\n", path)
+		}
+		exit(syscall.EEXIST)
+	}
+	if !isDevice {
+		if size <= 0 {
+			fatal("ext4 images need a size, e.g. --to-image=ext4:rootfs.img:4G")
+		}
+		image, err := os.Create(path)
+		if err != nil {
+			fatal("Failed to create image: ", err.Error())
+		}
+		// Sparse, blocks only get allocated as the filesystem is populated.
+		err = image.Truncate(size)
+		image.Close()
+		if err != nil {
+			fatal("Failed to size image: ", err.Error())
+		}
+	}
+
+	if output, err := exec.Command("mkfs.ext4", "-q", "-F", path).CombinedOutput(); err != nil {
+		fatalf("mkfs.ext4 failed: %s\n%s", err.Error(), output)
+	}
+	mountpoint, err := os.MkdirTemp("", "fastar-image-")
+	if err != nil {
+		fatal("Failed to create mountpoint: ", err.Error())
+	}
+	defer os.Remove(mountpoint)
+	mountArgs := []string{path, mountpoint}
+	if !isDevice {
+		mountArgs = append([]string{"-o", "loop"}, mountArgs...)
+	}
+	if output, err := exec.Command("mount", mountArgs...).CombinedOutput(); err != nil {
+		fatalf("Failed to mount image: %s\n%s", err.Error(), output)
+	}
+	log.Printf("Mounted ext4 image %s at %s\n", path, mountpoint)
+
+	opts.OutputDir = mountpoint
+	ExtractTar(ctx, stream)
+
+	// Unmounting flushes everything to the image.
+	if output, err := exec.Command("umount", mountpoint).CombinedOutput(); err != nil {
+		fatalf("Failed to unmount image: %s\n%s", err.Error(), output)
+	}
+	log.Printf("Wrote ext4 image %s\n", path)
+}
+
+// Parses sizes like 512M or 4G, with binary units like truncate(1).
+func parseImageSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	shift := strings.IndexByte("KMGT", s[len(s)-1]) + 1
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, errors.New("invalid size " + s)
+	}
+	return value << (10 * shift), nil
+}
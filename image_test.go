@@ -0,0 +1,24 @@
+package fastar
+
+import "testing"
+
+func TestParseImageSize(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"4096": 4096,
+		"512M": 512 << 20,
+		"4G":   4 << 30,
+		"2gb":  2 << 30,
+		"1T":   1 << 40,
+		"":     0,
+		"G":    0,
+		"-1K":  0,
+		"1.5G": 0,
+	} {
+		actual, err := parseImageSize(input)
+		if expected == 0 && err == nil {
+			t.Fatalf("parseImageSize(%q) = %d, wanted an error", input, actual)
+		} else if expected != 0 && actual != expected {
+			t.Fatalf("parseImageSize(%q) = %d (%v), wanted %d", input, actual, err, expected)
+		}
+	}
+}
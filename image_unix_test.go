@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExt4ImageNeedsOverwrite(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	// Nothing gets formatted, even if the check is missed.
+	t.Setenv("PATH", t.TempDir())
+	dir := t.TempDir()
+	image := filepath.Join(dir, "rootfs.img")
+	if err := os.WriteFile(image, []byte("precious"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A block device node that no driver backs.
+	device := filepath.Join(dir, "disk")
+	if err := unix.Mknod(device, unix.S_IFBLK|0600, int(unix.Mkdev(240, 255))); err != nil {
+		t.Logf("Can't create a block device here, only checking images: %v", err)
+		device = ""
+	}
+
+	write := func(path string, overwrite bool) error {
+		options := DefaultOptions()
+		options.Overwrite = overwrite
+		if err := beginCall(options); err != nil {
+			t.Fatal(err)
+		}
+		defer endCall()
+		runOwned(func() { WriteExt4Image(context.Background(), strings.NewReader(""), path, 1<<20) })
+		return callError()
+	}
+	for _, path := range []string{image, device} {
+		if path == "" {
+			continue
+		}
+		if err := write(path, false); !errors.Is(err, syscall.EEXIST) {
+			t.Fatalf("Expected %s not to be formatted without --overwrite, got %v", path, err)
+		}
+		if err := write(path, true); err == nil || errors.Is(err, syscall.EEXIST) || !strings.Contains(err.Error(), "mkfs.ext4") {
+			t.Fatalf("Expected %s to get to mkfs.ext4 with --overwrite, got %v", path, err)
+		}
+	}
+	// With --overwrite the image is replaced before mkfs.ext4 runs.
+	if content, _ := os.ReadFile(image); string(content) == "precious" {
+		t.Fatal("--overwrite didn't replace the image")
+	}
+}
@@ -0,0 +1,147 @@
+package fastar
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directory tree of a tarball, for filesystem image writers that need to
+// know the whole tree before laying out inodes and directories.
+//
+// Hard links are represented by the same node appearing in multiple
+// directories.
+type imageNode struct {
+	header   *tar.Header
+	children map[string]*imageNode
+	nlink    uint32
+	// Where each image format put the node.
+	squashfs squashfsInode
+	erofs    erofsInode
+}
+
+func (node *imageNode) isDir() bool {
+	return node.header.Typeflag == tar.TypeDir
+}
+
+func newImageDir(modTime time.Time) *imageNode {
+	return &imageNode{
+		header:   &tar.Header{Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime},
+		children: map[string]*imageNode{},
+		nlink:    1,
+	}
+}
+
+// Reads a tar stream into a tree. The contents of regular files are only
+// passed to writeData as they're read, not kept in memory. Directories that
+// are only implied by the paths of their contents are created with mode 0755.
+func readImageTree(stream io.Reader, writeData func(node *imageNode, data io.Reader)) *imageNode {
+	setupIdMappings()
+	now := time.Now()
+	root := newImageDir(now)
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalStream("readImageTree: Next() failed: ", err)
+		}
+		dumpHeader(header)
+		header.Uid = mapId(header.Uid, uidMappings)
+		header.Gid = mapId(header.Gid, gidMappings)
+		name := imagePath(header.Name)
+		if name == "" {
+			continue
+		}
+		if name == "." {
+			if header.Typeflag == tar.TypeDir {
+				root.header = header
+			}
+			continue
+		}
+		checkPathLimits(name)
+		parent := root
+		components := strings.Split(name, "/")
+		for _, component := range components[:len(components)-1] {
+			child := parent.children[component]
+			if child == nil || !child.isDir() {
+				child = newImageDir(now)
+				parent.children[component] = child
+			}
+			parent = child
+		}
+		base := components[len(components)-1]
+		node := &imageNode{header: header, nlink: 1}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// Later entries override earlier ones, but keep what's already
+			// been added to an existing directory.
+			if existing := parent.children[base]; existing != nil && existing.isDir() {
+				existing.header = header
+				continue
+			}
+			node.children = map[string]*imageNode{}
+		case tar.TypeReg:
+			writeData(node, tarReader)
+		case tar.TypeLink:
+			target := lookupImageNode(root, imagePath(header.Linkname))
+			if target == nil || target.isDir() {
+				log.Printf("readImageTree: skipping hard link %s to missing %s\n", header.Name, header.Linkname)
+				continue
+			}
+			target.nlink++
+			node = target
+		case tar.TypeSymlink, tar.TypeBlock, tar.TypeChar, tar.TypeFifo:
+		default:
+			log.Println("readImageTree: skipping unknown type:", string(header.Typeflag), "in", header.Name)
+			continue
+		}
+		if existing := parent.children[base]; existing != nil && existing != node {
+			existing.nlink--
+		}
+		parent.children[base] = node
+	}
+	return root
+}
+
+func lookupImageNode(root *imageNode, name string) *imageNode {
+	node := root
+	for _, component := range strings.Split(name, "/") {
+		if node != nil && component != "." && component != "" {
+			node = node.children[component]
+		}
+	}
+	return node
+}
+
+// Normalizes a tar entry name to a relative path with --strip-components
+// applied, "." for the root and "" to skip the entry.
+func imagePath(name string) string {
+	name = path.Clean("/" + name)[1:]
+	if opts.StripComponents != 0 {
+		components := strings.Split(name, "/")
+		if len(components) <= opts.StripComponents {
+			return ""
+		}
+		name = path.Join(components[opts.StripComponents:]...)
+	}
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func sortedChildren(node *imageNode) []string {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
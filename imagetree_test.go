@@ -0,0 +1,167 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestImagePath(t *testing.T) {
+	oldStripComponents := opts.StripComponents
+	defer func() { opts.StripComponents = oldStripComponents }()
+	for _, strip := range []int{0, 1} {
+		opts.StripComponents = strip
+		for name, expected := range map[string][2]string{
+			"./":           {".", ""},
+			"/abs/file":    {"abs/file", "file"},
+			"a/../../b":    {"b", ""},
+			"dir/sub/":     {"dir/sub", "sub"},
+			"./dir//file":  {"dir/file", "file"},
+			"dir/./x/../y": {"dir/y", "y"},
+		} {
+			if actual := imagePath(name); actual != expected[strip] {
+				t.Fatalf("imagePath(%q) with %d stripped = %q, wanted %q", name, strip, actual, expected[strip])
+			}
+		}
+	}
+}
+
+func TestReadImageTree(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "dir/file", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		{Name: "dir/sym", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: "replaced", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		{Name: "replaced", Typeflag: tar.TypeFifo},
+	} {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte("data"))
+		}
+	}
+	tw.Close()
+
+	written := map[*imageNode]string{}
+	root := readImageTree(&buf, func(node *imageNode, data io.Reader) {
+		contents, _ := io.ReadAll(data)
+		written[node] = string(contents)
+	})
+	dir := lookupImageNode(root, "dir")
+	if dir == nil || !dir.isDir() || dir.header.Mode != 0700 || len(dir.children) != 2 {
+		t.Fatalf("Directory not merged with its later entry: %+v", dir)
+	}
+	file := lookupImageNode(root, "dir/file")
+	if written[file] != "data" || file.nlink != 2 {
+		t.Fatalf("Got file contents %q and %d links", written[file], file.nlink)
+	}
+	if lookupImageNode(root, "link") != file {
+		t.Fatal("Hard link doesn't share its target's node")
+	}
+	if node := lookupImageNode(root, "replaced"); node.header.Typeflag != tar.TypeFifo {
+		t.Fatalf("Got %c for replaced entry", node.header.Typeflag)
+	}
+}
+
+// An entry of a filesystem image as read back by a test, data is a regular
+// file's contents or a symlink's target.
+type imageTestEntry struct {
+	mode     uint32
+	uid, gid uint32
+	nlink    uint32
+	rdev     uint32
+	data     string
+}
+
+// Builds a tarball exercising what image writers have to get right: file
+// data spanning compressed and incompressible blocks, hard links, symlinks,
+// devices, implied directories, long names and a directory too big for a
+// single listing block. Returns it with the entries an image of it should
+// have, keyed by path with the root as ".", and its number of inodes.
+func imageTestTar(t *testing.T) ([]byte, map[string]imageTestEntry, int) {
+	random := make([]byte, squashfsBlockSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	big := string(random) + strings.Repeat("compressible ", 20000)
+	longName := strings.Repeat("n", 255)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(header *tar.Header, data string) {
+		header.Size = int64(len(data))
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0750}, "")
+	write(&tar.Header{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 100}, "key = value\n")
+	write(&tar.Header{Name: "etc/empty", Typeflag: tar.TypeReg, Mode: 0600}, "")
+	write(&tar.Header{Name: "bin/big", Typeflag: tar.TypeReg, Mode: 04755, Uid: 2000, Gid: 2000}, big)
+	write(&tar.Header{Name: "bin/link", Typeflag: tar.TypeLink, Linkname: "bin/big"}, "")
+	write(&tar.Header{Name: "bin/sym", Typeflag: tar.TypeSymlink, Linkname: "big", Mode: 0777}, "")
+	write(&tar.Header{Name: "dev/tty", Typeflag: tar.TypeChar, Mode: 0620, Devmajor: 4, Devminor: 300}, "")
+	write(&tar.Header{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 8, Devminor: 1}, "")
+	write(&tar.Header{Name: "dev/fifo", Typeflag: tar.TypeFifo, Mode: 0644}, "")
+	write(&tar.Header{Name: "dev/" + longName, Typeflag: tar.TypeReg, Mode: 0644}, "long")
+	for i := 0; i < 300; i++ {
+		write(&tar.Header{Name: fmt.Sprintf("many/file-%03d", i), Typeflag: tar.TypeReg, Mode: 0644}, fmt.Sprint(i))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bigEntry := imageTestEntry{mode: modeRegular | 04755, uid: 2000, gid: 2000, nlink: 2, data: big}
+	expected := map[string]imageTestEntry{
+		".":               {mode: modeDir | 0755, nlink: 6},
+		"etc":             {mode: modeDir | 0750, nlink: 2},
+		"etc/config":      {mode: modeRegular | 0640, uid: 1000, gid: 100, nlink: 1, data: "key = value\n"},
+		"etc/empty":       {mode: modeRegular | 0600, nlink: 1},
+		"bin":             {mode: modeDir | 0755, nlink: 2},
+		"bin/big":         bigEntry,
+		"bin/link":        bigEntry,
+		"bin/sym":         {mode: modeSymlink | 0777, nlink: 1, data: "big"},
+		"dev":             {mode: modeDir | 0755, nlink: 2},
+		"dev/tty":         {mode: modeChrdev | 0620, nlink: 1, rdev: 4<<8 | 300&0xff | (300&^0xff)<<12},
+		"dev/sda":         {mode: modeBlkdev | 0660, nlink: 1, rdev: 8<<8 | 1},
+		"dev/fifo":        {mode: modeFifo | 0644, nlink: 1},
+		"dev/" + longName: {mode: modeRegular | 0644, nlink: 1, data: "long"},
+		"many":            {mode: modeDir | 0755, nlink: 2},
+	}
+	for i := 0; i < 300; i++ {
+		expected[fmt.Sprintf("many/file-%03d", i)] = imageTestEntry{mode: modeRegular | 0644, nlink: 1, data: fmt.Sprint(i)}
+	}
+	return buf.Bytes(), expected, len(expected) - 1
+}
+
+// Compares the entries read back from an image with what imageTestTar
+// expects.
+func checkImageEntries(t *testing.T, actual, expected map[string]imageTestEntry) {
+	for name, entry := range expected {
+		got, ok := actual[name]
+		if !ok {
+			t.Fatalf("%s is missing from the image", name)
+		}
+		if got.mode != entry.mode || got.uid != entry.uid || got.gid != entry.gid || got.nlink != entry.nlink || got.rdev != entry.rdev {
+			t.Fatalf("%s has mode %o, owner %d:%d, %d links and rdev %x, wanted mode %o, owner %d:%d, %d links and rdev %x",
+				name, got.mode, got.uid, got.gid, got.nlink, got.rdev, entry.mode, entry.uid, entry.gid, entry.nlink, entry.rdev)
+		}
+		if got.data != entry.data {
+			t.Fatalf("%s has %d bytes of data that don't match the %d expected", name, len(got.data), len(entry.data))
+		}
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Image has %d entries, wanted %d", len(actual), len(expected))
+	}
+}
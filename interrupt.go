@@ -0,0 +1,45 @@
+package fastar
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// The first SIGINT or SIGTERM cancels the returned context, which aborts
+// the requests in flight and stops extraction once the files being written
+// are cleaned up. fastar then exits with 128 plus the signal number, like a
+// shell reports a process killed by it. A second signal exits right away.
+var interruptSignal atomic.Int32
+
+func handleInterruptSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := (<-sigs).(syscall.Signal)
+		interruptSignal.Store(int32(sig))
+		log.Printf("Received %s, stopping\n", signalName(sig))
+		emitEvent("interrupted", map[string]interface{}{"signal": signalName(sig)})
+		cancel()
+		<-sigs
+		log.Println("Received second signal, exiting immediately")
+		os.Exit(128 + int(sig))
+	}()
+	return ctx
+}
+
+// Status to exit with once interrupted, or stopped at --deadline-soft, 0 if
+// fastar wasn't.
+func interruptedStatus() int {
+	if sig := interruptSignal.Load(); sig != 0 {
+		return 128 + int(sig)
+	}
+	if softDeadline.stopped.Load() {
+		return softDeadlineStatus
+	}
+	return 0
+}
@@ -0,0 +1,257 @@
+package fastar
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cidCodecRaw      = 0x55
+	cidCodecDagPb    = 0x70
+	multihashSha1    = 0x11
+	multihashSha256  = 0x12
+	base58Alphabet   = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	ipfsProbeTimeout = 10 * time.Second
+)
+
+// Downloads ipfs://CID[/path] through public or private HTTP gateways.
+//
+// Every gateway is probed in parallel up front and the ones that answer are
+// ordered fastest first. Chunks are then striped round robin across the live
+// gateways, and a chunk that fails on one gateway is retried on the next
+// before falling back to the usual retry logic.
+//
+// Content addressed by a raw CID (e.g. from `ipfs add --raw-leaves` of a
+// single block, or `ipfs block put`) is verified against the CID's hash.
+// For dag-pb CIDs the hash covers the root UnixFS node rather than the file
+// bytes, so those can't be verified without walking the whole DAG.
+type IpfsDownloader struct {
+	Url         string
+	cid         string
+	gateways    []HttpDownloader
+	nextGateway *atomic.Uint64
+	codec       uint64
+	hashCode    uint64
+	digest      []byte
+}
+
+func NewIpfsDownloader(url string, client *http.Client) *IpfsDownloader {
+	contentPath := strings.TrimPrefix(url, "ipfs://")
+	cid := strings.SplitN(contentPath, "/", 2)[0]
+	codec, hashCode, digest, err := parseCid(cid)
+	if err != nil {
+		fatal("Failed to parse IPFS CID ", cid, ": ", err.Error())
+	}
+	if len(opts.IpfsGateways) == 0 {
+		fatal("No IPFS gateways configured, pass at least one with --ipfs-gateway")
+	}
+	var gateways []HttpDownloader
+	for _, gateway := range opts.IpfsGateways {
+		gateways = append(gateways, HttpDownloader{
+			Url:    strings.TrimSuffix(gateway, "/") + "/ipfs/" + contentPath,
+			client: client,
+		})
+	}
+	return &IpfsDownloader{url, cid, gateways, &atomic.Uint64{}, codec, hashCode, digest}
+}
+
+// Sends a HEAD request to every gateway at once, drops the ones that fail or
+// disagree on the file size and sorts the rest by response time.
+func (ipfsDownloader *IpfsDownloader) raceGateways() (int64, bool) {
+	type probe struct {
+		gateway       HttpDownloader
+		size          int64
+		supportsRange bool
+		latency       time.Duration
+	}
+	var probes []probe
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, gateway := range ipfsDownloader.gateways {
+		wg.Add(1)
+		go func(gateway HttpDownloader) {
+			defer wg.Done()
+			start := time.Now()
+			client := *gateway.client
+			client.Timeout = ipfsProbeTimeout
+			resp, err := client.Do(gateway.generateRequest("HEAD"))
+			if err != nil {
+				log.Printf("IPFS gateway %s failed: %s\n", gateway.Url, err.Error())
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 || resp.ContentLength < 0 {
+				log.Printf("IPFS gateway %s failed with status %d\n", gateway.Url, resp.StatusCode)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			probes = append(probes, probe{gateway, resp.ContentLength, resp.Header.Get("Accept-Ranges") != "", time.Since(start)})
+		}(gateway)
+	}
+	wg.Wait()
+	if len(probes) == 0 {
+		log.Println("No IPFS gateway could serve", ipfsDownloader.cid)
+		// Let the regular retry logic produce the error and exit code.
+		ipfsDownloader.gateways[0].retryHttpRequest(ipfsDownloader.gateways[0].generateRequest("HEAD"))
+		fatal("IPFS gateways unavailable")
+	}
+	sort.Slice(probes, func(i, j int) bool { return probes[i].latency < probes[j].latency })
+
+	// Gateways without range support can only be used if none of them have it.
+	supportsRange := false
+	for _, p := range probes {
+		supportsRange = supportsRange || p.supportsRange
+	}
+	var gateways []HttpDownloader
+	for _, p := range probes {
+		if p.size != probes[0].size {
+			log.Printf("IPFS gateway %s reported size %d instead of %d, skipping it\n", p.gateway.Url, p.size, probes[0].size)
+			continue
+		}
+		if supportsRange && !p.supportsRange {
+			log.Printf("IPFS gateway %s doesn't support range requests, skipping it\n", p.gateway.Url)
+			continue
+		}
+		gateways = append(gateways, p.gateway)
+		log.Printf("IPFS gateway %s responded in %s\n", p.gateway.Url, p.latency)
+	}
+	ipfsDownloader.gateways = gateways
+	return probes[0].size, supportsRange
+}
+
+func (ipfsDownloader *IpfsDownloader) GetFileInfo() (int64, bool, bool) {
+	size, supportsRange := ipfsDownloader.raceGateways()
+	return size, supportsRange && size > opts.ChunkSize, false
+}
+
+// Always streams from the fastest gateway.
+func (ipfsDownloader *IpfsDownloader) Get() io.ReadCloser {
+	return ipfsDownloader.gateways[0].Get()
+}
+
+func (ipfsDownloader *IpfsDownloader) GetRange(start, end int64) io.ReadCloser {
+	first := ipfsDownloader.nextGateway.Add(1)
+	count := uint64(len(ipfsDownloader.gateways))
+	for i := uint64(0); i < count; i++ {
+		gateway := ipfsDownloader.gateways[(first+i)%count]
+		req := gateway.generateRequest("GET")
+		req.Header.Add("Range", GenerateRangeString([][]int64{{start, end}}))
+		resp, err := gateway.client.Do(req)
+		if err != nil {
+			log.Printf("IPFS gateway %s failed: %s\n", gateway.Url, err.Error())
+			continue
+		}
+		// Anything but a partial response would hand the wrong bytes to the
+		// worker, e.g. a gateway that ignores Range and sends the whole file.
+		if resp.StatusCode != http.StatusPartialContent {
+			log.Printf("IPFS gateway %s returned status %d for a range request\n", gateway.Url, resp.StatusCode)
+			resp.Body.Close()
+			continue
+		}
+		return resp.Body
+	}
+	return ipfsDownloader.gateways[first%count].GetRange(start, end)
+}
+
+func (ipfsDownloader *IpfsDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported for IPFS gateways")
+}
+
+func (ipfsDownloader *IpfsDownloader) ExpectedChecksum() (string, string) {
+	if ipfsDownloader.codec != cidCodecRaw {
+		log.Printf("CID %s isn't a raw block, the download won't be verified against it\n", ipfsDownloader.cid)
+		return "", ""
+	}
+	switch ipfsDownloader.hashCode {
+	case multihashSha256:
+		return "sha256", hex.EncodeToString(ipfsDownloader.digest)
+	case multihashSha1:
+		return "sha1", hex.EncodeToString(ipfsDownloader.digest)
+	}
+	log.Printf("CID %s uses unsupported multihash 0x%x, the download won't be verified against it\n", ipfsDownloader.cid, ipfsDownloader.hashCode)
+	return "", ""
+}
+
+// Decodes a CIDv0 (base58 "Qm...") or CIDv1 in base32, base58 or base16
+// into its content codec and multihash.
+func parseCid(cid string) (codec, hashCode uint64, digest []byte, err error) {
+	var data []byte
+	if len(cid) == 46 && strings.HasPrefix(cid, "Qm") {
+		if data, err = decodeBase58(cid); err != nil {
+			return
+		}
+		codec = cidCodecDagPb
+	} else {
+		if len(cid) < 2 {
+			return 0, 0, nil, errors.New("CID too short")
+		}
+		switch cid[0] {
+		case 'b':
+			data, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(cid[1:]))
+		case 'B':
+			data, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(cid[1:])
+		case 'z':
+			data, err = decodeBase58(cid[1:])
+		case 'f', 'F':
+			data, err = hex.DecodeString(cid[1:])
+		default:
+			err = errors.New("unsupported multibase prefix " + cid[:1])
+		}
+		if err != nil {
+			return
+		}
+		version, n := binary.Uvarint(data)
+		if n <= 0 || version != 1 {
+			return 0, 0, nil, errors.New("unsupported CID version")
+		}
+		data = data[n:]
+		if codec, n = binary.Uvarint(data); n <= 0 {
+			return 0, 0, nil, errors.New("invalid CID codec")
+		}
+		data = data[n:]
+	}
+
+	hashCode, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, nil, errors.New("invalid multihash code")
+	}
+	data = data[n:]
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != length {
+		return 0, 0, nil, errors.New("invalid multihash length")
+	}
+	return codec, hashCode, data[n:], nil
+}
+
+func decodeBase58(s string) ([]byte, error) {
+	value := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, errors.New("invalid base58 character " + string(c))
+		}
+		value.Mul(value, radix)
+		value.Add(value, big.NewInt(int64(digit)))
+	}
+	decoded := value.Bytes()
+	// Leading '1's encode leading zero bytes.
+	zeros := 0
+	for zeros < len(s) && s[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), decoded...), nil
+}
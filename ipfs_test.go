@@ -0,0 +1,28 @@
+package fastar
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseCid(t *testing.T) {
+	const digest = "8439cfc8af3762682cc319f881f942649958cdac4dff5df134d961e6673094c6"
+	for cid, expectedCodec := range map[string]uint64{
+		"bafkreieehhh4rlzxmjuczqyz7ca7sqtetfmm3lcn75o7cngzmhtgomeuyy": cidCodecRaw,
+		"QmXEoevCvLhod8aUhC7jPY8Znec4GKBkfTgxpBrdse8NS1":              cidCodecDagPb,
+		"f01551220" + digest: cidCodecRaw,
+	} {
+		codec, hashCode, actual, err := parseCid(cid)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", cid, err)
+		}
+		if codec != expectedCodec || hashCode != multihashSha256 || hex.EncodeToString(actual) != digest {
+			t.Fatalf("Parsed %s as codec %x, hash %x, digest %x", cid, codec, hashCode, actual)
+		}
+	}
+	for _, invalid := range []string{"", "Qm0", "bafkrei", "x1234", "f02551220" + digest} {
+		if _, _, _, err := parseCid(invalid); err == nil {
+			t.Fatalf("Parsing %q should have failed", invalid)
+		}
+	}
+}
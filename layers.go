@@ -0,0 +1,179 @@
+package fastar
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Enough to see the "ustar" magic of a tar header.
+const tarHeaderSize = 512
+
+// Archives can be wrapped in more than one layer, e.g. backup.tar.gz.gpg
+// is a gzipped tarball encrypted with GPG. Layers are peeled off one at a
+// time, each detected by its magic bytes or failing that the outermost
+// remaining file extension, until a tar header shows up or nothing else is
+// recognized. --format-hint only applies to the outermost layer.
+//
+// Forcing --compression skips detection and unwraps exactly that one layer.
+// Returns the unwrapped stream and the layers found, outermost first.
+func unwrapStream(stream io.Reader, filename string) (io.Reader, []string) {
+	if opts.Compression != "" {
+		compressionType := getCompressionType(filename, nil, "")
+		return decompressStream(stream, compressionType), []string{compressionType.String()}
+	}
+	sniffLength := opts.SniffLength
+	if sniffLength < tarHeaderSize {
+		sniffLength = tarHeaderSize
+	}
+	hint := opts.FormatHint
+	var layers []string
+	for {
+		buffered := bufio.NewReaderSize(stream, sniffLength)
+		head, err := buffered.Peek(sniffLength)
+		if err != nil && err != io.EOF {
+			fatal("Failed to read start of stream: ", err.Error())
+		}
+		stream = buffered
+		if len(layers) == 8 {
+			log.Println("Too many nested layers, treating the rest as raw tar")
+			return stream, append(layers, Tar.String())
+		}
+
+		compressionType := getCompressionType(filename, head, hint)
+		hint = ""
+		layers = append(layers, compressionType.String())
+		if compressionType == Tar {
+			return stream, layers
+		}
+		stream = decompressStream(stream, compressionType)
+		filename = trimFormatExtension(filename, compressionType)
+	}
+}
+
+// What decompressStream can unwrap, every compression type but Zip.
+var decodableCompressionTypes = []CompressionType{Tar, Gzip, Lz4, Zstd, Xz, Bzip2, Gpg}
+
+func decompressStream(stream io.Reader, compressionType CompressionType) io.Reader {
+	switch compressionType {
+	case Tar:
+		return stream
+	case Lz4:
+		return newLz4Reader(stream)
+	case Zstd:
+		return newZstdReader(stream)
+	case Gzip:
+		gzipStream, err := newGzipReader(stream)
+		if err != nil {
+			fatal("Error creating gzip stream: ", err.Error())
+		}
+		return gzipStream
+	case Xz:
+		xzStream, err := xz.NewReader(stream)
+		if err != nil {
+			fatal("Error creating xz stream: ", err.Error())
+		}
+		return xzStream
+	case Bzip2:
+		return bzip2.NewReader(stream)
+	case Gpg:
+		return gpgDecrypt(stream)
+	case Zip:
+		fatal("Zip archives aren't supported, only tarballs can be extracted")
+	}
+	fatalf("Archive is %s compressed, which isn't supported", compressionType)
+	return nil
+}
+
+// Recognizes ASCII armored messages and binary messages starting with a
+// public key or symmetric key encrypted session key packet (RFC 4880 5.1,
+// 5.3), checking the packet version so UTF-8 tar names aren't mistaken for
+// one.
+func isOpenPgpMessage(head []byte) bool {
+	if strings.HasPrefix(string(head), "-----BEGIN PGP MESSAGE-----") {
+		return true
+	}
+	if len(head) < 3 || head[0]&0x80 == 0 {
+		return false
+	}
+	var tag byte
+	var body []byte
+	if head[0]&0x40 != 0 {
+		// New format, one byte lengths are below 192.
+		tag = head[0] & 0x3f
+		if head[1] >= 192 {
+			return false
+		}
+		body = head[2:]
+	} else {
+		tag = (head[0] >> 2) & 0x0f
+		lengthBytes := []int{1, 2, 4, 0}[head[0]&3]
+		if lengthBytes == 0 || len(head) < 2+lengthBytes {
+			return false
+		}
+		body = head[1+lengthBytes:]
+	}
+	switch tag {
+	case 1:
+		return body[0] == 3 || body[0] == 6
+	case 3:
+		return body[0] == 4 || body[0] == 5 || body[0] == 6
+	}
+	return false
+}
+
+// Decrypts with the gpg binary, so keys come from the usual keyring and
+// agent unless --gpg-passphrase-file is given for symmetric encryption.
+func gpgDecrypt(stream io.Reader) io.Reader {
+	args := []string{"--batch", "--quiet", "--decrypt"}
+	if opts.GpgPassFile != "" {
+		args = append(args, "--pinentry-mode", "loopback", "--passphrase-file", opts.GpgPassFile)
+	}
+	cmd := exec.Command("gpg", args...)
+	cmd.Stdin = stream
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fatal("Failed to set up gpg: ", err.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			fatal("Decrypting GPG encrypted archives needs gpg in PATH")
+		}
+		fatal("Failed to start gpg: ", err.Error())
+	}
+	return &commandReader{ReadCloser: stdout, cmd: cmd}
+}
+
+// Output of a filter command, which only reports failures (e.g. a failed
+// integrity check) once everything has been read.
+type commandReader struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	once sync.Once
+	err  error
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.once.Do(func() {
+			if waitErr := r.cmd.Wait(); waitErr != nil {
+				r.err = fmt.Errorf("%s failed: %w", r.cmd.Path, waitErr)
+			}
+		})
+		if r.err != nil {
+			return n, r.err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,176 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+)
+
+func TestUnwrapStream(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	gzipped := func(data []byte) []byte {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write(data)
+		w.Close()
+		return b.Bytes()
+	}
+	var lz4Gzipped bytes.Buffer
+	w := lz4.NewWriter(&lz4Gzipped)
+	w.Write(gzipped(archive.Bytes()))
+	w.Close()
+	var lz4Archive bytes.Buffer
+	w = lz4.NewWriter(&lz4Archive)
+	w.Write(archive.Bytes())
+	w.Close()
+	longSkippable := append(skippableFrame(make([]byte, 1000)), lz4Archive.Bytes()...)
+	var xzArchive bytes.Buffer
+	xw, _ := xz.NewWriter(&xzArchive)
+	xw.Write(archive.Bytes())
+	xw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+
+	for _, test := range []struct {
+		filename string
+		data     []byte
+		hint     string
+		layers   []string
+	}{
+		{"a.tar", archive.Bytes(), "", []string{"tar"}},
+		{"a.tar.gz", gzipped(archive.Bytes()), "", []string{"gzip", "tar"}},
+		{"noextension", gzipped(gzipped(archive.Bytes())), "", []string{"gzip", "gzip", "tar"}},
+		{"a.tar.gz.lz4", lz4Gzipped.Bytes(), "", []string{"lz4", "gzip", "tar"}},
+		{"raw.gz", gzipped([]byte("not a tarball")), "", []string{"gzip", "tar"}},
+		{"a.tgz.lz4", append(skippableFrame([]byte("meta")), lz4Gzipped.Bytes()...), "", []string{"lz4", "gzip", "tar"}},
+		{"skippable", longSkippable, "lz4", []string{"lz4", "tar"}},
+		{"a.txz", xzArchive.Bytes(), "", []string{"xz", "tar"}},
+	} {
+		opts.FormatHint = test.hint
+		stream, layers := unwrapStream(bytes.NewReader(test.data), test.filename)
+		if !reflect.DeepEqual(layers, test.layers) {
+			t.Fatalf("%s: got layers %v, wanted %v", test.filename, layers, test.layers)
+		}
+		if unwrapped, err := io.ReadAll(stream); err != nil {
+			t.Fatalf("%s: %v", test.filename, err)
+		} else if test.filename != "raw.gz" && !bytes.Equal(unwrapped, archive.Bytes()) {
+			t.Fatalf("%s: unwrapped stream doesn't match", test.filename)
+		}
+	}
+
+	// There's no bzip2 writer in the standard library, this is
+	// "hello bzip2\n" compressed by bzip2.
+	bzipped := "BZh91AY&SY\xab\x6b\xa1\xf1\x00\x00\x02\xd9\x80\x00\x10\x40\x00\x10\x00\x12\x64\xc0\x10\x20\x00\x31\x00\xd3\x4d\x04\x00\x1e\xa3\xef\x4e\x51\xa2\x07\x8b\xb9\x22\x9c\x28\x48\x55\xb5\xd0\xf8\x80"
+	opts.FormatHint = ""
+	stream, layers := unwrapStream(strings.NewReader(bzipped), "raw.bz2")
+	if !reflect.DeepEqual(layers, []string{"bzip2", "tar"}) {
+		t.Fatalf("raw.bz2: got layers %v", layers)
+	}
+	if unwrapped, err := io.ReadAll(stream); err != nil || string(unwrapped) != "hello bzip2\n" {
+		t.Fatalf("raw.bz2: got %q, %v", unwrapped, err)
+	}
+}
+
+func TestSniffCompressionType(t *testing.T) {
+	for _, test := range []struct {
+		head     string
+		expected CompressionType
+		ok       bool
+	}{
+		{"\xfd7zXZ\x00\x00\x04", Xz, true},
+		{"BZh91AY&SY", Bzip2, true},
+		{"PK\x03\x04\x14\x00", Zip, true},
+		{"\x28\xb5\x2f\xfd\x04\x58", Zstd, true},
+		{"\x50\x2a\x4d\x18\x02\x00\x00\x00ab\x28\xb5\x2f\xfd", Zstd, true},
+		{"\x5e\x2a\x4d\x18\x00\x00\x00\x00\x04\x22\x4d\x18", Lz4, true},
+		{"\x02\x21\x4c\x18\x07\x00\x00\x00", Lz4, true},
+		// Only zstd and lz4 frames may follow a skippable frame.
+		{"\x50\x2a\x4d\x18\x00\x00\x00\x00\x1f\x8b", Tar, false},
+		// Skippable frame longer than what was sniffed.
+		{"\x50\x2a\x4d\x18\x00\x10\x00\x00\x28\xb5\x2f\xfd", Tar, false},
+		{"-----BEGIN PGP MESSAGE-----\n", Gpg, true},
+		{"plain text", Tar, false},
+	} {
+		if actual, ok := sniffCompressionType([]byte(test.head)); actual != test.expected || ok != test.ok {
+			t.Fatalf("sniffCompressionType(%q) = %s, %t, wanted %s, %t", test.head, actual, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestTrimFormatExtension(t *testing.T) {
+	for _, test := range []struct {
+		filename        string
+		compressionType CompressionType
+		expected        string
+	}{
+		{"backup.tgz", Gzip, "backup.tar"},
+		{"backup.tar.gz.gpg", Gpg, "backup.tar.gz"},
+		{"backup.tar.zst", Zstd, "backup.tar"},
+		{"backup.tar.gz", Lz4, "backup.tar.gz"},
+	} {
+		if actual := trimFormatExtension(test.filename, test.compressionType); actual != test.expected {
+			t.Fatalf("trimFormatExtension(%s, %s) = %s, wanted %s", test.filename, test.compressionType, actual, test.expected)
+		}
+	}
+}
+
+func TestIsOpenPgpMessage(t *testing.T) {
+	for head, expected := range map[string]bool{
+		"-----BEGIN PGP MESSAGE-----\n": true,
+		"\x8c\x0d\x04\x09\x03\x08":      true,  // Old format SKESK
+		"\xc3\x2e\x06\x26\x09\x02":      true,  // New format SKESK v6
+		"\x85\x01\x0c\x03\xab\xcd":      true,  // Old format PKESK, 2 byte length
+		"\xc3\xa9t\xc3\xa9/file":        false, // UTF-8 tar entry name
+		"\x1f\x8b\x08\x00":              false,
+		"dir/file\x00\x00":              false,
+	} {
+		if actual := isOpenPgpMessage([]byte(head)); actual != expected {
+			t.Fatalf("isOpenPgpMessage(%q) = %t, wanted %t", head, actual, expected)
+		}
+	}
+}
+
+func TestSupportedCodecs(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+
+	advertised := map[string]bool{}
+	for _, codec := range getVersionInfo().Codecs {
+		advertised[codec] = true
+	}
+	for i := range compressionTypeNames {
+		compressionType := CompressionType(i)
+		if compressionType == Gpg {
+			// Decrypting needs a gpg binary and a key.
+			if !advertised[compressionType.String()] {
+				t.Fatal("gpg isn't advertised")
+			}
+			continue
+		}
+		if err := beginCall(DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+		runOwned(func() { decompressStream(bytes.NewReader(nil), compressionType) })
+		err := callError()
+		endCall()
+		if unsupported := err != nil && strings.Contains(err.Error(), "supported"); unsupported == advertised[compressionType.String()] {
+			t.Fatalf("%s is advertised: %t, but decompressing it failed with %v", compressionType, advertised[compressionType.String()], err)
+		}
+	}
+	if advertised["zip"] {
+		t.Fatal("zip is advertised, but can't be extracted")
+	}
+}
@@ -0,0 +1,191 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// Importable API, for services that embed fastar instead of running the
+// CLI. E.g. to extract a tarball from S3:
+//
+//	options := fastar.DefaultOptions()
+//	stream, err := fastar.Download(ctx, "s3://bucket/image.tar.lz4", options)
+//	if err != nil {
+//		return err
+//	}
+//	defer stream.Close()
+//	err = fastar.Extract(ctx, stream, "/mnt/image", options)
+//
+// NewRemoteTarFS serves single files out of a remote tarball the same way.
+//
+// Failures come back as an *Error, fastar's own work runs on goroutines
+// of the call so the caller's are never unwound. fastar keeps its settings
+// in package level state, so calls that overlap must pass the same
+// Options, and only one Extract runs at a time. A failure in any call in
+// flight fails all of them.
+
+// Only one extraction at a time, it shares the write worker tokens and
+// manifests with ExtractTar.
+var extractMutex sync.Mutex
+
+// Closed once the first call of a session has applied its options.
+var librarySetUp chan struct{}
+
+// Options with every field set to its command line default.
+func DefaultOptions() Options {
+	var options Options
+	if _, err := flags.NewParser(&options, flags.None).ParseArgs(nil); err != nil {
+		panic(err)
+	}
+	return options
+}
+
+// Starts a library call with options, or fails if a call with different
+// options is still in flight or options don't make sense.
+func beginCall(options Options) error {
+	libraryMutex.Lock()
+	if libraryCalls > 0 {
+		if !reflect.DeepEqual(options, libraryOptions) {
+			libraryMutex.Unlock()
+			return errors.New("fastar calls in flight at the same time must use the same Options")
+		}
+		libraryCalls++
+		setUp := librarySetUp
+		libraryMutex.Unlock()
+		<-setUp
+	} else {
+		libraryCalls = 1
+		libraryOptions = options
+		libraryFailed = make(chan struct{})
+		librarySetUp = make(chan struct{})
+		libraryErr = nil
+		opts = options
+		// Failing takes libraryMutex.
+		libraryMutex.Unlock()
+		runOwned(func() {
+			processMinSpeedFlag()
+			setupRetryPolicy()
+			setupMaxRate()
+		})
+		opts.ChunkSize *= 1e6 // Convert chunk size from MB to B
+		close(librarySetUp)
+	}
+	if err := callError(); err != nil {
+		endCall()
+		return err
+	}
+	return nil
+}
+
+// Runs f on a goroutine of its own and waits for it to return. A failure
+// unwinds the goroutine it happens on with runtime.Goexit, which must never
+// be one of the caller's.
+func runOwned(f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	<-done
+}
+
+func endCall() {
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+	libraryCalls--
+}
+
+// Failure of any call in the current session, nil if there's none.
+func callError() error {
+	libraryMutex.Lock()
+	defer libraryMutex.Unlock()
+	if libraryErr == nil {
+		return nil
+	}
+	return libraryErr
+}
+
+// Streams the file at url as is, with --download-workers parallel ranged
+// requests where the source supports them. Invalid options fail right
+// away, failures of the download itself, including ctx being canceled,
+// surface as the error of the next Read. Close the stream if it isn't read
+// to the end.
+func Download(ctx context.Context, url string, options Options) (io.ReadCloser, error) {
+	if err := beginCall(options); err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		defer endCall()
+		done := make(chan error, 1)
+		go func() {
+			downloader := getDownloader(url, opts.UseFips, opts.UseGetForSize)
+			stream := GetDownloadStream(ctx, downloader, opts.ChunkSize, opts.NumWorkers)
+			_, err := io.Copy(writer, contextReader{ctx, stream})
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if failure := callError(); failure != nil {
+				err = failure
+			}
+			writer.CloseWithError(err)
+		case <-libraryFailed:
+			writer.CloseWithError(callError())
+		}
+	}()
+	return reader, nil
+}
+
+// Extracts the tarball in stream, which may be compressed (or wrapped in
+// several layers) in any format fastar detects, into dest. It returns once
+// every file is written.
+func Extract(ctx context.Context, stream io.Reader, dest string, options Options) error {
+	if err := beginCall(options); err != nil {
+		return err
+	}
+	defer endCall()
+	extractMutex.Lock()
+	defer extractMutex.Unlock()
+
+	// Another call failing stops the extraction like canceling ctx, which
+	// is waited out so no file is left half written after returning.
+	extractCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		// Also closed if the extraction itself fails.
+		defer close(done)
+		finalStream, _ := unwrapStream(contextReader{extractCtx, stream}, "")
+		opts.OutputDir = dest
+		ExtractTar(extractCtx, finalStream)
+	}()
+	select {
+	case <-done:
+	case <-libraryFailed:
+		cancel()
+		<-done
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return callError()
+}
+
+// Fails reads once ctx is done, which makes the reader's consumer stop.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
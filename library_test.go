@@ -0,0 +1,116 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	options := DefaultOptions()
+	if options.WriteWorkers != 8 || options.ChunkSize != 200 || options.MinSpeed != "1K" {
+		t.Fatalf("Flag defaults weren't applied: %+v", options)
+	}
+}
+
+func TestDownloadAndExtract(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	contents := RandomString(100000)
+	tw.WriteHeader(&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+	tw.Write([]byte(contents))
+	tw.Close()
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image.tar.gz", time.Time{}, bytes.NewReader(archive.Bytes()))
+	}))
+	defer server.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	ctx := context.Background()
+
+	stream, err := Download(ctx, server.URL+"/image.tar.gz", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, archive.Bytes()) {
+		t.Fatalf("Downloaded %d bytes, wanted the %d byte archive", len(downloaded), archive.Len())
+	}
+
+	dest := t.TempDir()
+	stream, err = Download(ctx, server.URL+"/image.tar.gz", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err := Extract(ctx, stream, dest, options); err != nil {
+		t.Fatal(err)
+	}
+	if extracted, _ := os.ReadFile(filepath.Join(dest, "dir/file")); string(extracted) != contents {
+		t.Fatal("File wasn't extracted")
+	}
+}
+
+func TestExtractFailure(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+
+	// A header block with a bad checksum fails the tar reader, which has
+	// to come back as a corrupt archive error instead of exiting.
+	err := Extract(context.Background(), strings.NewReader(strings.Repeat("x", 1024)), t.TempDir(), options)
+	var fastarErr *Error
+	if !errors.As(err, &fastarErr) || !errors.Is(err, ErrCorrupt) || fastarErr.Class() != "corrupt" {
+		t.Fatalf("Got %v, wanted a fastar error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Extract(ctx, strings.NewReader(""), t.TempDir(), options); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Got %v, wanted context.Canceled", err)
+	}
+
+	options.WriteWorkers = 1
+	if err := Extract(context.Background(), strings.NewReader(""), t.TempDir(), options); err != nil {
+		t.Fatalf("Extraction after failures failed: %v", err)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "fast"
+
+	// Failing while options are applied mustn't unwind the caller's
+	// goroutine, or the test would end here.
+	if _, err := Download(context.Background(), "http://localhost/image.tar", options); err == nil {
+		t.Fatal("Expected invalid options to fail the download")
+	}
+	if err := Extract(context.Background(), strings.NewReader(""), t.TempDir(), options); err == nil {
+		t.Fatal("Expected invalid options to fail the extraction")
+	}
+
+	options.MinSpeed = "0"
+	if err := Extract(context.Background(), strings.NewReader(""), t.TempDir(), options); err != nil {
+		t.Fatalf("Extraction after failures failed: %v", err)
+	}
+}
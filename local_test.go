@@ -0,0 +1,26 @@
+package fastar
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalFileDownloader(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 1000000
+	data := RandomString(1000)
+	path := filepath.Join(t.TempDir(), "archive.tar")
+	os.WriteFile(path, []byte(data), 0644)
+
+	downloader := NewLocalFileDownloader(path)
+	if size, supportsRange, _ := downloader.GetFileInfo(); size != 1000 || !supportsRange {
+		t.Fatalf("Got size %d, range support %t", size, supportsRange)
+	}
+	if actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4)); err != nil || string(actual) != data {
+		t.Fatalf("Got %d bytes, %v", len(actual), err)
+	}
+}
@@ -0,0 +1,324 @@
+package fastar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+
+	"github.com/pierrec/lz4"
+)
+
+// lz4 frames split their content into blocks of at most 4MiB that, unless
+// a frame opts into linked blocks, decode independently of each other. With
+// --decompress-workers above 1 they're decoded on that many cores at once
+// and written out in order, so a single lz4 stream can keep up with a
+// download that's faster than one core decompresses.
+//
+// Streams may concatenate any number of frames, as well as legacy frames
+// of 8MiB blocks that older lz4 and Hadoop tooling write, so every stream
+// is split by readLz4Frames even when it's decoded on one worker.
+const (
+	lz4FrameMagic     = 0x184d2204
+	lz4LegacyMagic    = 0x184c2102
+	lz4SkippableMagic = 0x184d2a50
+	// Stored instead of compressed blocks have this bit set in their size.
+	lz4UncompressedBit = 1 << 31
+	lz4LegacyBlockSize = 8 << 20
+)
+
+var lz4Buffers sync.Pool
+
+func newLz4Reader(stream io.Reader) io.Reader {
+	return newParallelLz4Reader(stream, decompressWorkers())
+}
+
+func newParallelLz4Reader(stream io.Reader, workers int) io.Reader {
+	src := bufio.NewReader(stream)
+	return decodeInOrder(workers, func(submit func(*decodeTask)) error {
+		err := readLz4Frames(src, submit)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// Splits the stream into tasks decoding its blocks, followed by one
+// checking the content checksum at the end of each frame. Returns nil at
+// the end of the stream.
+func readLz4Frames(src io.Reader, submit func(*decodeTask)) error {
+	var word [4]byte
+	readWord := func() (uint32, error) {
+		_, err := io.ReadFull(src, word[:])
+		return binary.LittleEndian.Uint32(word[:]), err
+	}
+	var magic uint32
+	// Set when a legacy frame ended on the magic of the next frame.
+	pending := false
+	for first := true; ; first = false {
+		if !pending {
+			var err error
+			magic, err = readWord()
+			if err == io.EOF && !first {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		pending = false
+		if magic == lz4LegacyMagic {
+			next, err := readLz4LegacyBlocks(readWord, src, submit)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			magic, pending = next, true
+			continue
+		} else if magic&^0xf == lz4SkippableMagic {
+			size, err := readWord()
+			if err == nil {
+				_, err = io.CopyN(io.Discard, src, int64(size))
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		} else if magic != lz4FrameMagic {
+			return fmt.Errorf("lz4: invalid frame magic %#x", magic)
+		}
+		header, err := readLz4FrameHeader(src)
+		if err != nil {
+			return err
+		}
+		// Only touched by the checks, which run in stream order.
+		content := newXxh32()
+		for {
+			size, err := readWord()
+			if err != nil {
+				return err
+			}
+			if size == 0 {
+				break
+			}
+			compressed := size&lz4UncompressedBit == 0
+			size &^= lz4UncompressedBit
+			if int(size) > header.maxBlockSize {
+				return fmt.Errorf("lz4: block of %d bytes is over the frame's %d byte maximum", size, header.maxBlockSize)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(src, data); err != nil {
+				return err
+			}
+			var checksum uint32
+			if header.blockChecksum {
+				if checksum, err = readWord(); err != nil {
+					return err
+				}
+			}
+			task := &decodeTask{decode: func() ([]byte, error) {
+				if header.blockChecksum && xxh32Sum(data) != checksum {
+					return nil, errors.New("lz4: invalid block checksum")
+				}
+				if !compressed {
+					return data, nil
+				}
+				return decodeLz4Block(data, header.maxBlockSize)
+			}}
+			if header.contentChecksum {
+				task.check = func(decoded []byte) error {
+					content.write(decoded)
+					return nil
+				}
+			}
+			if compressed {
+				task.done = func(decoded []byte) { lz4Buffers.Put(decoded[:0]) }
+			}
+			submit(task)
+		}
+		if header.contentChecksum {
+			expected, err := readWord()
+			if err != nil {
+				return err
+			}
+			submit(&decodeTask{check: func([]byte) error {
+				if content.sum() != expected {
+					return errors.New("lz4: invalid frame checksum")
+				}
+				return nil
+			}})
+		}
+	}
+}
+
+// Submits the blocks of a legacy frame, which has neither checksums nor an
+// end mark: it runs until the stream ends, returning io.EOF, or until the
+// magic of another frame shows up where a block size would be, which is
+// returned.
+func readLz4LegacyBlocks(readWord func() (uint32, error), src io.Reader, submit func(*decodeTask)) (uint32, error) {
+	for {
+		size, err := readWord()
+		if err != nil {
+			return 0, err
+		}
+		if size == lz4FrameMagic || size == lz4LegacyMagic || size&^0xf == lz4SkippableMagic {
+			return size, nil
+		}
+		if int(size) > lz4.CompressBlockBound(lz4LegacyBlockSize) {
+			return 0, fmt.Errorf("lz4: legacy block of %d bytes is over the %d byte maximum", size, lz4.CompressBlockBound(lz4LegacyBlockSize))
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(src, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		submit(&decodeTask{
+			decode: func() ([]byte, error) { return decodeLz4Block(data, lz4LegacyBlockSize) },
+			done:   func(decoded []byte) { lz4Buffers.Put(decoded[:0]) },
+		})
+	}
+}
+
+type lz4FrameHeader struct {
+	blockChecksum   bool
+	contentChecksum bool
+	maxBlockSize    int
+}
+
+// Reads the frame descriptor following the magic number.
+func readLz4FrameHeader(src io.Reader) (lz4FrameHeader, error) {
+	var header lz4FrameHeader
+	descriptor := make([]byte, 2, 14)
+	if _, err := io.ReadFull(src, descriptor); err != nil {
+		return header, err
+	}
+	flags, blockDescriptor := descriptor[0], descriptor[1]
+	if version := flags >> 6; version != 1 {
+		return header, fmt.Errorf("lz4: unsupported frame version %d", version)
+	}
+	if flags>>5&1 == 0 {
+		return header, errors.New("lz4: frames with linked blocks aren't supported")
+	}
+	if flags&1 != 0 {
+		return header, errors.New("lz4: frames with a dictionary aren't supported")
+	}
+	header.blockChecksum = flags>>4&1 != 0
+	header.contentChecksum = flags>>2&1 != 0
+	sizeId := blockDescriptor >> 4 & 7
+	if sizeId < 4 {
+		return header, fmt.Errorf("lz4: invalid block max size id %d", sizeId)
+	}
+	header.maxBlockSize = 64 << 10 << (2 * (sizeId - 4))
+	if flags>>3&1 != 0 {
+		// The content size isn't needed, only checksummed.
+		descriptor = descriptor[:10]
+		if _, err := io.ReadFull(src, descriptor[2:]); err != nil {
+			return header, err
+		}
+	}
+	var checksum [1]byte
+	if _, err := io.ReadFull(src, checksum[:]); err != nil {
+		return header, err
+	}
+	if expected := byte(xxh32Sum(descriptor) >> 8); checksum[0] != expected {
+		return header, fmt.Errorf("lz4: invalid header checksum %#x, expected %#x", checksum[0], expected)
+	}
+	return header, nil
+}
+
+func decodeLz4Block(data []byte, maxSize int) ([]byte, error) {
+	buf, _ := lz4Buffers.Get().([]byte)
+	if cap(buf) < maxSize {
+		buf = make([]byte, maxSize)
+	}
+	n, err := lz4.UncompressBlock(data, buf[:maxSize])
+	if err != nil {
+		return nil, fmt.Errorf("lz4: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// Streaming xxHash32 with seed 0, which lz4 frames use for their header,
+// block and content checksums.
+const (
+	xxhPrime1 uint32 = 2654435761
+	xxhPrime2 uint32 = 2246822519
+	xxhPrime3 uint32 = 3266489917
+	xxhPrime4 uint32 = 668265263
+	xxhPrime5 uint32 = 374761393
+)
+
+type xxh32 struct {
+	v      [4]uint32
+	total  uint64
+	mem    [16]byte
+	memLen int
+}
+
+func newXxh32() *xxh32 {
+	var seed uint32
+	return &xxh32{v: [4]uint32{seed + xxhPrime1 + xxhPrime2, seed + xxhPrime2, seed, seed - xxhPrime1}}
+}
+
+func xxh32Sum(data []byte) uint32 {
+	h := newXxh32()
+	h.write(data)
+	return h.sum()
+}
+
+func xxh32Round(acc, input uint32) uint32 {
+	return bits.RotateLeft32(acc+input*xxhPrime2, 13) * xxhPrime1
+}
+
+func (h *xxh32) stripe(data []byte) {
+	for i := range h.v {
+		h.v[i] = xxh32Round(h.v[i], binary.LittleEndian.Uint32(data[4*i:]))
+	}
+}
+
+func (h *xxh32) write(data []byte) {
+	h.total += uint64(len(data))
+	if h.memLen+len(data) < len(h.mem) {
+		h.memLen += copy(h.mem[h.memLen:], data)
+		return
+	}
+	if h.memLen > 0 {
+		n := copy(h.mem[h.memLen:], data)
+		h.stripe(h.mem[:])
+		data = data[n:]
+		h.memLen = 0
+	}
+	for ; len(data) >= len(h.mem); data = data[len(h.mem):] {
+		h.stripe(data)
+	}
+	h.memLen = copy(h.mem[:], data)
+}
+
+func (h *xxh32) sum() uint32 {
+	var sum uint32
+	if h.total >= uint64(len(h.mem)) {
+		sum = bits.RotateLeft32(h.v[0], 1) + bits.RotateLeft32(h.v[1], 7) + bits.RotateLeft32(h.v[2], 12) + bits.RotateLeft32(h.v[3], 18)
+	} else {
+		sum = h.v[2] + xxhPrime5
+	}
+	sum += uint32(h.total)
+	rest := h.mem[:h.memLen]
+	for ; len(rest) >= 4; rest = rest[4:] {
+		sum = bits.RotateLeft32(sum+binary.LittleEndian.Uint32(rest)*xxhPrime3, 17) * xxhPrime4
+	}
+	for _, b := range rest {
+		sum = bits.RotateLeft32(sum+uint32(b)*xxhPrime5, 11) * xxhPrime1
+	}
+	sum ^= sum >> 15
+	sum *= xxhPrime2
+	sum ^= sum >> 13
+	sum *= xxhPrime3
+	sum ^= sum >> 16
+	return sum
+}
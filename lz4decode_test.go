@@ -0,0 +1,96 @@
+package fastar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pierrec/lz4"
+)
+
+func TestXxh32(t *testing.T) {
+	for input, expected := range map[string]uint32{"": 0x02cc5d05, "a": 0x550d7456, "abc": 0x32d153ff} {
+		if sum := xxh32Sum([]byte(input)); sum != expected {
+			t.Fatalf("xxh32(%q) = %#x, wanted %#x", input, sum, expected)
+		}
+	}
+	// Streamed in odd sizes it hashes the same as in one go.
+	data := []byte(RandomString(1000))
+	h := newXxh32()
+	for i := 0; i < len(data); i += 7 {
+		h.write(data[i:min(int64(i+7), int64(len(data)))])
+	}
+	if h.sum() != xxh32Sum(data) {
+		t.Fatal("Streamed xxh32 differs")
+	}
+}
+
+func compressLz4(t *testing.T, data string, blockChecksum bool) []byte {
+	var buf bytes.Buffer
+	writer := lz4.NewWriter(&buf)
+	writer.Header = lz4.Header{BlockMaxSize: 64 << 10, BlockChecksum: blockChecksum}
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestParallelLz4Reader(t *testing.T) {
+	first := strings.Repeat(RandomString(1000), 300)
+	second := RandomString(200000)
+	var stream bytes.Buffer
+	stream.Write(compressLz4(t, first, true))
+	// Skippable frame between the two.
+	binary.Write(&stream, binary.LittleEndian, []uint32{lz4SkippableMagic + 3, 4, 0})
+	stream.Write(compressLz4(t, second, false))
+
+	actual, err := io.ReadAll(newParallelLz4Reader(bytes.NewReader(stream.Bytes()), 4))
+	if err != nil || string(actual) != first+second {
+		t.Fatalf("Got %d bytes, %v", len(actual), err)
+	}
+
+	corrupted := compressLz4(t, first, false)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err := io.ReadAll(newParallelLz4Reader(bytes.NewReader(corrupted), 4)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Expected a checksum error, got %v", err)
+	}
+	if _, err := io.ReadAll(newParallelLz4Reader(bytes.NewReader(corrupted[:len(corrupted)/2]), 4)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a truncated stream to fail, got %v", err)
+	}
+}
+
+func compressLz4Legacy(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	writer := lz4.NewWriterLegacy(&buf)
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestLz4ConcatenatedFrames(t *testing.T) {
+	first := strings.Repeat(RandomString(1000), 300)
+	second := RandomString(200000)
+	third := RandomString(1000)
+	var stream bytes.Buffer
+	stream.Write(compressLz4Legacy(t, first))
+	stream.Write(compressLz4Legacy(t, second))
+	stream.Write(compressLz4(t, third, false))
+	stream.Write(compressLz4Legacy(t, first))
+
+	for _, workers := range []int{1, 4} {
+		actual, err := io.ReadAll(newParallelLz4Reader(bytes.NewReader(stream.Bytes()), workers))
+		if err != nil || string(actual) != first+second+third+first {
+			t.Fatalf("Got %d bytes with %d workers, %v", len(actual), workers, err)
+		}
+	}
+
+	legacy := compressLz4Legacy(t, second)
+	if _, err := io.ReadAll(newParallelLz4Reader(bytes.NewReader(legacy[:len(legacy)-10]), 4)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a truncated legacy frame to fail, got %v", err)
+	}
+}
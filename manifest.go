@@ -0,0 +1,211 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --manifest checks every extracted regular file and hard link against the
+// digest a trusted manifest lists for it, hashing the in memory buffer as
+// it's written. Manifests are either coreutils style (SHA256SUMS, SHA1SUMS,
+// MD5SUMS, or BSD style "SHA256 (name) = digest" lines), or a JSON object
+// mapping each path to its digest, optionally prefixed with the algorithm
+// as in "sha256:<hex>". Extraction fails at the end with a report of the
+// files that don't match, aren't listed, or are listed but weren't in the
+// archive.
+type manifestEntry struct {
+	algorithm string
+	digest    string
+	checked   bool
+}
+
+var manifestCheck struct {
+	mutex      sync.Mutex
+	entries    map[string]*manifestEntry
+	mismatched []string
+	unlisted   []string
+}
+
+// The algorithm of a digest without an "algorithm:" prefix, by its length.
+var digestAlgorithms = map[int]string{
+	64: "sha256",
+	40: "sha1",
+	32: "md5",
+}
+
+var bsdManifestLine = regexp.MustCompile(`^(SHA256|SHA1|MD5) \((.*)\) = ([0-9a-fA-F]+)$`)
+
+// The algorithm of a hex digest, possibly given as "algorithm:digest".
+func parseManifestDigest(digest string) (string, string, error) {
+	digest = strings.ToLower(digest)
+	algorithm, hexDigest, found := strings.Cut(digest, ":")
+	if !found {
+		hexDigest = digest
+		algorithm = digestAlgorithms[len(digest)]
+	}
+	if _, supported := hashManifestNames[algorithm]; !supported {
+		return "", "", fmt.Errorf("%q is not a sha256, sha1 or md5 digest", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil || len(hexDigest) != newHash(algorithm).Size()*2 {
+		return "", "", fmt.Errorf("%q is not a %s digest", digest, algorithm)
+	}
+	return algorithm, hexDigest, nil
+}
+
+// Paths are compared relative to the output directory with forward
+// slashes and without a leading "./".
+func manifestName(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+func parseManifest(data []byte) (map[string]*manifestEntry, error) {
+	entries := map[string]*manifestEntry{}
+	add := func(name, digest string) error {
+		algorithm, hexDigest, err := parseManifestDigest(digest)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+		entries[manifestName(name)] = &manifestEntry{algorithm: algorithm, digest: hexDigest}
+		return nil
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var digests map[string]string
+		if err := json.Unmarshal(trimmed, &digests); err != nil {
+			return nil, err
+		}
+		for name, digest := range digests {
+			if err := add(name, digest); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if match := bsdManifestLine.FindStringSubmatch(line); match != nil {
+			if err := add(match[2], strings.ToLower(match[1])+":"+match[3]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// coreutils escapes names with a backslash or newline, marking the
+		// line with a leading backslash.
+		escaped := strings.HasPrefix(line, "\\")
+		line = strings.TrimPrefix(line, "\\")
+		digest, name, found := strings.Cut(line, " ")
+		if !found || len(name) < 2 || (name[0] != ' ' && name[0] != '*') {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		name = name[1:]
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+		}
+		if err := add(name, digest); err != nil {
+			return nil, err
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func loadManifest() {
+	data, err := os.ReadFile(opts.Manifest)
+	if err != nil {
+		fatalErr("Failed to read --manifest: ", err)
+	}
+	entries, err := parseManifest(data)
+	if err != nil {
+		fatal("Failed to parse --manifest: ", err.Error())
+	}
+	manifestCheck.entries = entries
+	manifestCheck.mismatched = nil
+	manifestCheck.unlisted = nil
+}
+
+// name is relative to the root of the extraction.
+func verifyFileDigest(name string, buf []byte) {
+	name = manifestName(name)
+	manifestCheck.mutex.Lock()
+	entry, ok := manifestCheck.entries[name]
+	manifestCheck.mutex.Unlock()
+	if !ok {
+		manifestCheck.mutex.Lock()
+		manifestCheck.unlisted = append(manifestCheck.unlisted, name)
+		manifestCheck.mutex.Unlock()
+		return
+	}
+	hash := newHash(entry.algorithm)
+	hash.Write(buf)
+	matches := hex.EncodeToString(hash.Sum(nil)) == entry.digest
+	manifestCheck.mutex.Lock()
+	defer manifestCheck.mutex.Unlock()
+	entry.checked = true
+	if !matches {
+		manifestCheck.mismatched = append(manifestCheck.mismatched, name)
+	}
+}
+
+// Checks a file that's already on disk, a hard link or one extracted by an
+// earlier --resume run.
+func verifyExtractedFile(filename string) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fatalErr("Failed to read file to verify against --manifest: ", err)
+	}
+	verifyFileDigest(relativeToOutputDir(filename), data)
+}
+
+// Fails the extraction unless every file matched the manifest.
+func finishManifestCheck() {
+	var missing []string
+	for name, entry := range manifestCheck.entries {
+		if !entry.checked && !filteredOut(name) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(manifestCheck.mismatched)
+	sort.Strings(manifestCheck.unlisted)
+	emitEvent("manifest_verified", map[string]interface{}{
+		"files":      len(manifestCheck.entries),
+		"mismatched": manifestCheck.mismatched,
+		"unlisted":   manifestCheck.unlisted,
+		"missing":    missing,
+	})
+	var problems []string
+	for _, report := range []struct {
+		names        []string
+		kind, reason string
+	}{
+		{manifestCheck.mismatched, "mismatched", "doesn't match its digest"},
+		{manifestCheck.unlisted, "unlisted", "isn't listed"},
+		{missing, "missing", "is listed but wasn't extracted"},
+	} {
+		for _, name := range report.names {
+			log.Printf("--manifest: %s %s\n", name, report.reason)
+		}
+		if len(report.names) > 0 {
+			problems = append(problems, fmt.Sprintf("%d %s", len(report.names), report.kind))
+		}
+	}
+	if len(problems) > 0 {
+		message := "Extracted files don't match --manifest: " + strings.Join(problems, ", ")
+		log.Println(message)
+		fail(&Error{int(ErrCorrupt), message})
+	}
+	log.Printf("Verified %d files against --manifest\n", len(manifestCheck.entries))
+}
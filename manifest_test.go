@@ -0,0 +1,79 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	sha := sha256.Sum256([]byte("a"))
+	md := md5.Sum([]byte("b"))
+	shaHex, mdHex := hex.EncodeToString(sha[:]), hex.EncodeToString(md[:])
+	for _, manifest := range []string{
+		shaHex + "  ./a\n" + mdHex + " *dir/b\n",
+		"# comment\nSHA256 (a) = " + shaHex + "\r\nMD5 (dir/b) = " + mdHex + "\n",
+		`{"a": "sha256:` + shaHex + `", "./dir/b": "` + mdHex + `"}`,
+	} {
+		entries, err := parseManifest([]byte(manifest))
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", manifest, err)
+		}
+		if len(entries) != 2 || entries["a"].algorithm != "sha256" || entries["a"].digest != shaHex || entries["dir/b"].algorithm != "md5" || entries["dir/b"].digest != mdHex {
+			t.Fatalf("Unexpected entries for %q: %v", manifest, entries)
+		}
+	}
+	entries, err := parseManifest([]byte("\\" + shaHex + "  back\\\\slash\\nline\n"))
+	if err != nil || entries["back\\slash\nline"] == nil {
+		t.Fatalf("Expected an escaped name, got %v, %v", entries, err)
+	}
+	for _, manifest := range []string{"abc  a\n", shaHex + "a\n", `{"a": "sha512:` + shaHex + `"}`} {
+		if _, err := parseManifest([]byte(manifest)); err == nil {
+			t.Fatalf("Expected %q to be rejected", manifest)
+		}
+	}
+}
+
+func TestExtractManifest(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	contents := map[string]string{"a": RandomString(1000), "dir/b": RandomString(5000)}
+	archive := func() *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+		for _, name := range []string{"a", "dir/b"} {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents[name]))})
+			tw.Write([]byte(contents[name]))
+		}
+		tw.WriteHeader(&tar.Header{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "a"})
+		tw.Close()
+		return &buf
+	}
+	digest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	options := DefaultOptions()
+	options.Manifest = filepath.Join(t.TempDir(), "SHA256SUMS")
+
+	os.WriteFile(options.Manifest, []byte(digest(contents["a"])+"  a\n"+digest(contents["dir/b"])+"  dir/b\n"+digest(contents["a"])+"  dir/link\n"), 0644)
+	if err := Extract(context.Background(), archive(), t.TempDir(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is tampered with, the link isn't listed and c never shows up.
+	os.WriteFile(options.Manifest, []byte(digest(contents["a"])+"  a\n"+digest("tampered")+"  dir/b\n"+digest("c")+"  c\n"), 0644)
+	err := Extract(context.Background(), archive(), t.TempDir(), options)
+	var fastarErr *Error
+	if !errors.As(err, &fastarErr) || !errors.Is(err, ErrCorrupt) || fastarErr.Message != "Extracted files don't match --manifest: 1 mismatched, 1 unlisted, 1 missing" {
+		t.Fatalf("Expected a report of the mismatches, got %v", err)
+	}
+}
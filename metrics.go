@@ -0,0 +1,294 @@
+package fastar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Download and extraction metrics for fleet-wide monitoring, collected
+// from the event stream. --metrics-file keeps a JSON snapshot on disk,
+// rewritten every metricsFileInterval and once more when fastar exits, and
+// --metrics-addr serves them over HTTP while fastar runs, in Prometheus
+// text format on /metrics and as the same JSON on /metrics.json.
+const metricsFileInterval = 10 * time.Second
+
+// Upper bounds in seconds of the chunk latency histogram buckets.
+var chunkLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+type workerMetrics struct {
+	Bytes         int64   `json:"bytes"`
+	Seconds       float64 `json:"seconds"`
+	Chunks        int64   `json:"chunks"`
+	Retries       int64   `json:"retries"`
+	ThroughputMBs float64 `json:"throughput_mbps"`
+}
+
+type metricsSnapshot struct {
+	Url             string                    `json:"url"`
+	ElapsedSeconds  float64                   `json:"elapsed_seconds"`
+	Finished        bool                      `json:"finished"`
+	ExitStatus      int                       `json:"exit_status"`
+	FileSize        int64                     `json:"file_size"`
+	DownloadedBytes int64                     `json:"downloaded_bytes"`
+	Chunks          int64                     `json:"chunks"`
+	Retries         int64                     `json:"retries"`
+	Throttled       int64                     `json:"throttled"`
+	ChunkLatency    map[string]int64          `json:"chunk_latency_seconds"`
+	ChunkSeconds    float64                   `json:"chunk_seconds_sum"`
+	Workers         map[string]*workerMetrics `json:"workers"`
+	FilesExtracted  map[string]int64          `json:"files_extracted"`
+	ExtractedBytes  int64                     `json:"extracted_bytes"`
+	EntriesSkipped  int64                     `json:"entries_skipped"`
+}
+
+var metricsMutex sync.Mutex
+var metrics *metricsSnapshot
+var metricsStart time.Time
+
+// Bytes handed to the consumer so far, set by Main. Chunk events miss
+// downloads that fall back to a single stream.
+var metricsDownloaded *atomic.Int64
+
+func setupMetrics() {
+	if opts.MetricsFile == "" && opts.MetricsAddr == "" {
+		return
+	}
+	metricsStart = time.Now()
+	metrics = &metricsSnapshot{
+		ChunkLatency:   map[string]int64{},
+		Workers:        map[string]*workerMetrics{},
+		FilesExtracted: map[string]int64{},
+	}
+	if opts.MetricsAddr != "" {
+		listener, err := net.Listen("tcp", opts.MetricsAddr)
+		if err != nil {
+			fatal("Failed to listen on --metrics-addr: ", err.Error())
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			writePrometheusMetrics(w, takeMetricsSnapshot())
+		})
+		mux.HandleFunc("/metrics.json", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(takeMetricsSnapshot())
+		})
+		go http.Serve(listener, mux)
+		log.Println("Serving metrics on", listener.Addr())
+	}
+	if opts.MetricsFile != "" {
+		go func() {
+			for range time.Tick(metricsFileInterval) {
+				if metrics == nil {
+					return
+				}
+				writeMetricsFile()
+			}
+		}()
+	}
+}
+
+// Folds an event into the metrics, called for every emitted event.
+func recordMetric(event string, fields map[string]interface{}) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	worker := func() *workerMetrics {
+		id := fmt.Sprint(fields["worker"])
+		if metrics.Workers[id] == nil {
+			metrics.Workers[id] = &workerMetrics{}
+		}
+		return metrics.Workers[id]
+	}
+	switch event {
+	case "start":
+		metrics.Url = fmt.Sprint(fields["url"])
+	case "file_info":
+		metrics.FileSize = metricInt(fields["size"])
+	case "chunk_finished":
+		bytes := metricInt(fields["end"]) - metricInt(fields["start"])
+		seconds := metricFloat(fields["millis"]) / 1e3
+		metrics.Chunks++
+		metrics.ChunkSeconds += seconds
+		bucket := "+Inf"
+		for _, bound := range chunkLatencyBuckets {
+			if seconds <= bound {
+				bucket = fmt.Sprint(bound)
+				break
+			}
+		}
+		metrics.ChunkLatency[bucket]++
+		w := worker()
+		w.Bytes += bytes
+		w.Seconds += seconds
+		w.Chunks++
+	case "retry":
+		metrics.Retries++
+		worker().Retries++
+	case "throttled":
+		metrics.Throttled++
+	case "worker_finished":
+		worker().ThroughputMBs = metricFloat(fields["mbps"])
+	case "file_extracted":
+		metrics.FilesExtracted[fmt.Sprint(fields["type"])]++
+		metrics.ExtractedBytes += metricInt(fields["size"])
+	case "entry_skipped":
+		metrics.EntriesSkipped++
+	case "finished":
+		metrics.Finished = true
+	}
+}
+
+func metricInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func metricFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+// Deep copy of the metrics so far, safe to encode without the lock.
+func takeMetricsSnapshot() metricsSnapshot {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	snapshot := *metrics
+	snapshot.ElapsedSeconds = time.Since(metricsStart).Seconds()
+	snapshot.DownloadedBytes = 0
+	for _, w := range metrics.Workers {
+		snapshot.DownloadedBytes += w.Bytes
+	}
+	if metricsDownloaded != nil {
+		snapshot.DownloadedBytes = metricsDownloaded.Load()
+	}
+	snapshot.ChunkLatency = map[string]int64{}
+	for bucket, count := range metrics.ChunkLatency {
+		snapshot.ChunkLatency[bucket] = count
+	}
+	snapshot.Workers = map[string]*workerMetrics{}
+	for id, w := range metrics.Workers {
+		copied := *w
+		snapshot.Workers[id] = &copied
+	}
+	snapshot.FilesExtracted = map[string]int64{}
+	for kind, count := range metrics.FilesExtracted {
+		snapshot.FilesExtracted[kind] = count
+	}
+	return snapshot
+}
+
+// Replaces --metrics-file atomically, so readers never see half a file.
+func writeMetricsFile() {
+	snapshot := takeMetricsSnapshot()
+	encoded, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(opts.MetricsFile), ".metrics-")
+	if err != nil {
+		log.Println("Failed to write --metrics-file:", err.Error())
+		return
+	}
+	tmp.Write(append(encoded, '\n'))
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), opts.MetricsFile); err != nil {
+		log.Println("Failed to write --metrics-file:", err.Error())
+		os.Remove(tmp.Name())
+	}
+}
+
+// Writes the final snapshot on the way out, status is what fastar exits
+// with.
+func flushMetrics(status int) {
+	if metrics == nil || opts.MetricsFile == "" {
+		return
+	}
+	metricsMutex.Lock()
+	metrics.ExitStatus = status
+	metricsMutex.Unlock()
+	writeMetricsFile()
+}
+
+func writePrometheusMetrics(w io.Writer, snapshot metricsSnapshot) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("fastar_file_size_bytes", "gauge", "Size of the file being downloaded.")
+	fmt.Fprintf(w, "fastar_file_size_bytes %d\n", snapshot.FileSize)
+	metric("fastar_downloaded_bytes_total", "counter", "Bytes downloaded so far.")
+	fmt.Fprintf(w, "fastar_downloaded_bytes_total %d\n", snapshot.DownloadedBytes)
+	metric("fastar_elapsed_seconds", "gauge", "Time since fastar started.")
+	fmt.Fprintf(w, "fastar_elapsed_seconds %g\n", snapshot.ElapsedSeconds)
+	metric("fastar_retries_total", "counter", "Chunk download attempts that were retried.")
+	fmt.Fprintf(w, "fastar_retries_total %d\n", snapshot.Retries)
+	metric("fastar_throttled_total", "counter", "Responses throttling the download.")
+	fmt.Fprintf(w, "fastar_throttled_total %d\n", snapshot.Throttled)
+
+	metric("fastar_chunk_latency_seconds", "histogram", "Time to download each chunk, including retries.")
+	cumulative := int64(0)
+	for _, bound := range chunkLatencyBuckets {
+		cumulative += snapshot.ChunkLatency[fmt.Sprint(bound)]
+		fmt.Fprintf(w, "fastar_chunk_latency_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "fastar_chunk_latency_seconds_bucket{le=\"+Inf\"} %d\n", snapshot.Chunks)
+	fmt.Fprintf(w, "fastar_chunk_latency_seconds_sum %g\n", snapshot.ChunkSeconds)
+	fmt.Fprintf(w, "fastar_chunk_latency_seconds_count %d\n", snapshot.Chunks)
+
+	var workers []string
+	for id := range snapshot.Workers {
+		workers = append(workers, id)
+	}
+	sort.Strings(workers)
+	metric("fastar_worker_downloaded_bytes_total", "counter", "Bytes downloaded by each worker.")
+	for _, id := range workers {
+		fmt.Fprintf(w, "fastar_worker_downloaded_bytes_total{worker=%q} %d\n", id, snapshot.Workers[id].Bytes)
+	}
+	metric("fastar_worker_download_seconds_total", "counter", "Time each worker spent downloading chunks.")
+	for _, id := range workers {
+		fmt.Fprintf(w, "fastar_worker_download_seconds_total{worker=%q} %g\n", id, snapshot.Workers[id].Seconds)
+	}
+	metric("fastar_worker_retries_total", "counter", "Retries of each worker.")
+	for _, id := range workers {
+		fmt.Fprintf(w, "fastar_worker_retries_total{worker=%q} %d\n", id, snapshot.Workers[id].Retries)
+	}
+
+	var kinds []string
+	for kind := range snapshot.FilesExtracted {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	metric("fastar_files_extracted_total", "counter", "Entries extracted, by type.")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "fastar_files_extracted_total{type=%q} %d\n", kind, snapshot.FilesExtracted[kind])
+	}
+	metric("fastar_extracted_bytes_total", "counter", "Bytes of extracted file contents.")
+	fmt.Fprintf(w, "fastar_extracted_bytes_total %d\n", snapshot.ExtractedBytes)
+	metric("fastar_entries_skipped_total", "counter", "Archive entries that weren't extracted.")
+	fmt.Fprintf(w, "fastar_entries_skipped_total %d\n", snapshot.EntriesSkipped)
+}
@@ -0,0 +1,63 @@
+package fastar
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts, metrics = oldOpts, nil }()
+	opts.MetricsFile = filepath.Join(t.TempDir(), "metrics.json")
+	setupMetrics()
+
+	emitEvent("start", map[string]interface{}{"url": "s3://bucket/image.tar", "filename": "image.tar"})
+	emitEvent("file_info", map[string]interface{}{"size": int64(300)})
+	emitEvent("chunk_finished", map[string]interface{}{"worker": int64(0), "start": int64(0), "end": int64(100), "millis": float64(200)})
+	emitEvent("retry", map[string]interface{}{"worker": int64(1), "offset": int64(150), "reason": "too slow"})
+	emitEvent("chunk_finished", map[string]interface{}{"worker": int64(1), "start": int64(100), "end": int64(200), "millis": float64(3000)})
+	emitEvent("file_extracted", map[string]interface{}{"path": "a", "type": "file", "size": 42})
+	emitEvent("file_extracted", map[string]interface{}{"path": "b", "type": "dir", "size": 0})
+	emitEvent("finished", nil)
+	flushMetrics(0)
+
+	contents, err := os.ReadFile(opts.MetricsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot metricsSnapshot
+	if err := json.Unmarshal(contents, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.Finished || snapshot.Url != "s3://bucket/image.tar" || snapshot.FileSize != 300 || snapshot.DownloadedBytes != 200 {
+		t.Fatalf("Unexpected totals: %+v", snapshot)
+	}
+	if snapshot.Chunks != 2 || snapshot.Retries != 1 || snapshot.Workers["1"].Retries != 1 || snapshot.Workers["0"].Bytes != 100 {
+		t.Fatalf("Unexpected chunk metrics: %+v", snapshot)
+	}
+	if snapshot.ChunkLatency["0.25"] != 1 || snapshot.ChunkLatency["5"] != 1 {
+		t.Fatalf("Unexpected latency buckets: %v", snapshot.ChunkLatency)
+	}
+	if snapshot.FilesExtracted["file"] != 1 || snapshot.FilesExtracted["dir"] != 1 || snapshot.ExtractedBytes != 42 {
+		t.Fatalf("Unexpected extraction metrics: %+v", snapshot)
+	}
+
+	var prometheus bytes.Buffer
+	writePrometheusMetrics(&prometheus, takeMetricsSnapshot())
+	for _, line := range []string{
+		`fastar_chunk_latency_seconds_bucket{le="0.25"} 1`,
+		`fastar_chunk_latency_seconds_bucket{le="2.5"} 1`,
+		`fastar_chunk_latency_seconds_bucket{le="5"} 2`,
+		`fastar_chunk_latency_seconds_count 2`,
+		`fastar_worker_retries_total{worker="1"} 1`,
+		`fastar_files_extracted_total{type="file"} 1`,
+	} {
+		if !strings.Contains(prometheus.String(), line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, prometheus.String())
+		}
+	}
+}
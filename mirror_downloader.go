@@ -0,0 +1,142 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// How long a mirror that failed a request is left out of the rotation.
+const mirrorCooldown = 30 * time.Second
+
+// Implemented by downloaders that can report a failed range request
+// instead of exiting, which is what lets mirrors fail over. A single
+// attempt, retrying is up to the caller.
+type rangeTrier interface {
+	tryGetRange(start, end int64) (io.ReadCloser, error)
+}
+
+// Downloads one object from several replicas of it, e.g. the same object
+// in buckets in different regions, passed as `fastar URL1 URL2 ...`.
+// Chunks are striped round robin across the mirrors, so together they can
+// fill a NIC a single endpoint can't. A mirror that errors or throttles is
+// skipped for mirrorCooldown and the chunk is requested from the next one.
+//
+// Every mirror has to be reachable up front and report the same size.
+// Failover needs mirrors whose backend implements rangeTrier (HTTP(S) and
+// S3), requests to others fail the way they would on their own.
+type MirrorDownloader struct {
+	urls    []string
+	mirrors []Downloader
+	next    *atomic.Uint64
+	mutex   *sync.Mutex
+	// When each mirror may be used again after failing.
+	failedUntil []time.Time
+}
+
+func NewMirrorDownloader(urls []string, useFips bool, useGetForSize bool) *MirrorDownloader {
+	mirrors := make([]Downloader, len(urls))
+	for i, url := range urls {
+		mirrors[i] = getDownloader(url, useFips, useGetForSize)
+	}
+	return &MirrorDownloader{urls, mirrors, &atomic.Uint64{}, &sync.Mutex{}, make([]time.Time, len(urls))}
+}
+
+func (mirrorDownloader *MirrorDownloader) GetFileInfo() (int64, bool, bool) {
+	size, supportsRange, _ := mirrorDownloader.mirrors[0].GetFileInfo()
+	for i, mirror := range mirrorDownloader.mirrors[1:] {
+		mirrorSize, mirrorSupportsRange, _ := mirror.GetFileInfo()
+		if mirrorSize != size {
+			fatalf("Mirror %s has size %d but %s has %d, they must be replicas of the same object", mirrorDownloader.urls[i+1], mirrorSize, mirrorDownloader.urls[0], size)
+		}
+		supportsRange = supportsRange && mirrorSupportsRange
+	}
+	return size, supportsRange, false
+}
+
+func (mirrorDownloader *MirrorDownloader) Get() io.ReadCloser {
+	return mirrorDownloader.mirrors[0].Get()
+}
+
+func (mirrorDownloader *MirrorDownloader) GetRange(start, end int64) io.ReadCloser {
+	first := int(mirrorDownloader.next.Add(1) - 1)
+	count := len(mirrorDownloader.mirrors)
+	// Healthy mirrors first, ones cooling down only once they all failed.
+	for _, coolingDown := range []bool{false, true} {
+		for i := 0; i < count; i++ {
+			index := (first + i) % count
+			trier, ok := mirrorDownloader.mirrors[index].(rangeTrier)
+			if !ok || mirrorDownloader.isCoolingDown(index) != coolingDown {
+				continue
+			}
+			body, err := trier.tryGetRange(start, end)
+			if err == nil {
+				return body
+			}
+			mirrorDownloader.markFailed(index, err)
+		}
+	}
+	return mirrorDownloader.mirrors[first%count].GetRange(start, end)
+}
+
+func (mirrorDownloader *MirrorDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported across mirrors")
+}
+
+func (mirrorDownloader *MirrorDownloader) isCoolingDown(index int) bool {
+	mirrorDownloader.mutex.Lock()
+	defer mirrorDownloader.mutex.Unlock()
+	return time.Now().Before(mirrorDownloader.failedUntil[index])
+}
+
+func (mirrorDownloader *MirrorDownloader) markFailed(index int, err error) {
+	mirrorDownloader.mutex.Lock()
+	defer mirrorDownloader.mutex.Unlock()
+	mirrorDownloader.failedUntil[index] = time.Now().Add(mirrorCooldown)
+	log.Printf("Mirror %s failed, skipping it for %s: %s\n", mirrorDownloader.urls[index], mirrorCooldown, err.Error())
+	emitEvent("mirror_failed", map[string]interface{}{"url": mirrorDownloader.urls[index], "reason": err.Error()})
+}
+
+func (httpDownloader HttpDownloader) tryGetRange(start, end int64) (io.ReadCloser, error) {
+	req := httpDownloader.generateRequest("GET")
+	req.Header.Add("Range", GenerateRangeString([][]int64{{start, end}}))
+	httpDownloader.setIfRange(req)
+	resp, err := httpDownloader.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	httpDownloader.checkUnchanged(req, resp)
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == 429 || resp.StatusCode == 503 {
+			return nil, errors.New("throttled by download server " + strconv.Itoa(resp.StatusCode))
+		}
+		return nil, fmt.Errorf("status %d for a range request", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (s3Downloader S3Downloader) tryGetRange(start, end int64) (io.ReadCloser, error) {
+	bucket, key := getBucketAndKey(s3Downloader.Url)
+	resp, err := s3Downloader.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Range:        aws.String(GenerateRangeString([][]int64{{start, end}})),
+		RequestPayer: requestPayer(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
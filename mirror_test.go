@@ -0,0 +1,60 @@
+package fastar
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMirrorFailover(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 1000
+	opts.ChunkSize = 100
+
+	data := RandomString(1000)
+	var served, throttled atomic.Int64
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		var start, end int
+		fmt.Sscanf(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "%d-%d", &start, &end)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(data[start : end+1]))
+		served.Add(1)
+	}
+	healthy := httptest.NewServer(http.HandlerFunc(serve))
+	defer healthy.Close()
+	throttling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			throttled.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serve(w, r)
+	}))
+	defer throttling.Close()
+
+	downloader := NewMirrorDownloader([]string{throttling.URL + "/file", healthy.URL + "/file"}, false, false)
+	actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4))
+	if err != nil || string(actual) != data {
+		t.Fatalf("Mirrored download returned wrong data, err %v", err)
+	}
+	// Workers already on their way to it may still hit it once.
+	if throttled.Load() == 0 || throttled.Load() > 4 {
+		t.Fatalf("Expected the throttling mirror to be skipped after failing, got %d requests", throttled.Load())
+	}
+	if served.Load() == 0 {
+		t.Fatal("Expected the healthy mirror to serve the chunks")
+	}
+}
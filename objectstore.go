@@ -0,0 +1,286 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 caps single PUTs at 5GiB and multipart uploads at 10000 parts of at
+// least 5MiB each.
+const (
+	s3MaxPutSize   = 5 << 30
+	s3MinPartSize  = 5 << 20
+	s3MaxPartCount = 10000
+)
+
+// Destination of --extract-to. Members are uploaded straight from memory,
+// so nothing is ever written to local disk.
+//
+// Failures are fatal, like failed writes when extracting to disk. The
+// clients already retry transient errors.
+type ObjectUploader interface {
+	// Store buf as the object at key.
+	Put(key string, buf []byte, header *tar.Header)
+
+	// Server side copy of an already uploaded object, used for hard links.
+	Copy(srcKey, dstKey string)
+}
+
+// Returns the uploader for an s3:// or gs:// URL and the key prefix to put
+// every member under.
+func GetObjectUploader(rawUrl string) (ObjectUploader, string) {
+	var netTransport = sharedNetTransport()
+	var httpClient = http.Client{
+		Transport: netTransport,
+	}
+	var prefix string
+	var uploader ObjectUploader
+	if strings.HasPrefix(rawUrl, "s3://") {
+		bucket, key := getBucketAndKey(rawUrl)
+		uploader, prefix = S3Uploader{bucket, newS3Client(&httpClient, opts.UseFips)}, key
+	} else if strings.HasPrefix(rawUrl, "gs://") {
+		bucket, object := getBucketAndObject(rawUrl)
+		uploader, prefix = GCSUploader{bucket, newGCSClient(netTransport)}, object
+	} else {
+		fatal("--extract-to only supports s3:// and gs:// URLs, got ", rawUrl)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return uploader, prefix
+}
+
+// Extracts the tarball into an object store prefix. Regular files are
+// uploaded by up to --write-workers goroutines in parallel. Object stores
+// have no directories or symlinks, so directories are implied by the keys
+// of the files in them and symlinks are skipped with a warning.
+func ExtractToObjectStore(stream io.Reader, uploader ObjectUploader, prefix string) {
+	setupEntryFilters()
+	uploadTokens := make(chan bool, opts.WriteWorkers)
+	for i := 0; i < opts.WriteWorkers; i++ {
+		uploadTokens <- true
+	}
+	// Hard links are copies of an earlier member, which has to be fully
+	// uploaded first, so they stop the world just like on disk.
+	var wg sync.WaitGroup
+	var lastLog = time.Now()
+	var uploadStart = time.Now()
+	var bytesUploaded atomic.Uint64
+	seen := seenPaths{}
+
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatalStream("ExtractToObjectStore: Next() failed: ", err)
+		}
+		dumpHeader(header)
+
+		name := header.Name
+		linkName := header.Linkname
+		if opts.StripComponents != 0 {
+			name = path.Join(strings.Split(name, "/")[opts.StripComponents:]...)
+			if linkName != "" {
+				linkName = path.Join(strings.Split(linkName, "/")[opts.StripComponents:]...)
+			}
+		}
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		if name == "" || filteredOut(name) {
+			continue
+		}
+		checkPathLimits(name)
+		key := prefix + name
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeLink {
+			if extract, _ := seen.admit(key, header.Name, wg.Wait); !extract {
+				continue
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// Nothing to create, the keys of the files in it imply it.
+		case tar.TypeReg:
+			buf := make([]byte, header.Size)
+			if _, err := io.ReadFull(tarReader, buf); err != nil {
+				fatal("Failed to read from resp:", err.Error())
+			}
+			<-uploadTokens
+			wg.Add(1)
+			go func(name, key string, buf []byte, header *tar.Header) {
+				defer wg.Done()
+				defer func() { uploadTokens <- true }()
+				uploader.Put(key, buf, header)
+				if opts.HashFiles != "" {
+					recordFileHash(name, buf)
+				}
+				bytesUploaded.Add(uint64(len(buf)))
+				emitEvent("file_extracted", map[string]interface{}{"path": key, "type": "file", "size": len(buf)})
+			}(name, key, buf, header)
+		case tar.TypeLink:
+			linkName = strings.TrimPrefix(path.Clean("/"+linkName), "/")
+			if filteredOut(linkName) {
+				log.Printf("ExtractToObjectStore: skipping hard link %s, its target %s is filtered out\n", name, linkName)
+				emitEvent("entry_skipped", map[string]interface{}{"path": key, "type": string(header.Typeflag), "reason": "link target filtered out"})
+				break
+			}
+			wg.Wait()
+			uploader.Copy(prefix+linkName, key)
+			if opts.HashFiles != "" {
+				recordHashLink(linkName, name)
+			}
+			emitEvent("file_extracted", map[string]interface{}{"path": key, "type": "hardlink", "size": 0})
+		default:
+			log.Printf("ExtractToObjectStore: skipping type %s in %s, object stores can't represent it\n", string(header.Typeflag), header.Name)
+			emitEvent("entry_skipped", map[string]interface{}{"path": key, "type": string(header.Typeflag), "reason": "not representable in object store"})
+		}
+		if time.Since(lastLog) >= 30*time.Second {
+			log.Printf("Average upload speed %.3fMBps\n", float64(bytesUploaded.Load())/1e6/time.Since(uploadStart).Seconds())
+			lastLog = time.Now()
+		}
+	}
+	wg.Wait()
+	if opts.HashFiles != "" {
+		writeHashManifest()
+	}
+}
+
+// Kept on every object so the original file can be restored from it.
+func objectMetadata(header *tar.Header) map[string]string {
+	return map[string]string{
+		"mode":  strconv.FormatInt(int64(header.FileInfo().Mode().Perm()), 8),
+		"mtime": strconv.FormatInt(header.ModTime.Unix(), 10),
+	}
+}
+
+type S3Uploader struct {
+	bucket string
+	client *s3.Client
+}
+
+func (s3Uploader S3Uploader) Put(key string, buf []byte, header *tar.Header) {
+	if len(buf) > s3MaxPutSize {
+		s3Uploader.putMultipart(key, buf, header)
+		return
+	}
+	_, err := s3Uploader.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(s3Uploader.bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(buf),
+		ContentLength: aws.Int64(int64(len(buf))),
+		Metadata:      objectMetadata(header),
+	})
+	if err != nil {
+		fatalf("Failed to upload s3://%s/%s: %s", s3Uploader.bucket, key, err.Error())
+	}
+}
+
+func (s3Uploader S3Uploader) putMultipart(key string, buf []byte, header *tar.Header) {
+	ctx := context.Background()
+	upload, err := s3Uploader.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s3Uploader.bucket),
+		Key:      aws.String(key),
+		Metadata: objectMetadata(header),
+	})
+	if err != nil {
+		fatalf("Failed to start multipart upload of s3://%s/%s: %s", s3Uploader.bucket, key, err.Error())
+	}
+	partSize := opts.ChunkSize
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	if minPartSize := (int64(len(buf)) + s3MaxPartCount - 1) / s3MaxPartCount; partSize < minPartSize {
+		partSize = minPartSize
+	}
+	var parts []types.CompletedPart
+	for start := int64(0); start < int64(len(buf)); start += partSize {
+		end := start + partSize
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		partNumber := aws.Int32(int32(len(parts) + 1))
+		resp, err := s3Uploader.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s3Uploader.bucket),
+			Key:           aws.String(key),
+			UploadId:      upload.UploadId,
+			PartNumber:    partNumber,
+			Body:          bytes.NewReader(buf[start:end]),
+			ContentLength: aws.Int64(end - start),
+		})
+		if err != nil {
+			s3Uploader.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s3Uploader.bucket),
+				Key:      aws.String(key),
+				UploadId: upload.UploadId,
+			})
+			fatalf("Failed to upload part %d of s3://%s/%s: %s", *partNumber, s3Uploader.bucket, key, err.Error())
+		}
+		parts = append(parts, types.CompletedPart{ETag: resp.ETag, PartNumber: partNumber})
+	}
+	_, err = s3Uploader.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s3Uploader.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		fatalf("Failed to complete multipart upload of s3://%s/%s: %s", s3Uploader.bucket, key, err.Error())
+	}
+}
+
+func (s3Uploader S3Uploader) Copy(srcKey, dstKey string) {
+	segments := strings.Split(s3Uploader.bucket+"/"+srcKey, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	_, err := s3Uploader.client.CopyObject(context.Background(), &s3.CopyObjectInput{
+		Bucket:     aws.String(s3Uploader.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(strings.Join(segments, "/")),
+	})
+	if err != nil {
+		fatalf("Failed to copy s3://%s/%s to %s: %s", s3Uploader.bucket, srcKey, dstKey, err.Error())
+	}
+}
+
+type GCSUploader struct {
+	bucket string
+	client *storage.Client
+}
+
+func (gcsUploader GCSUploader) Put(key string, buf []byte, header *tar.Header) {
+	writer := gcsUploader.client.Bucket(gcsUploader.bucket).Object(key).NewWriter(context.Background())
+	writer.Metadata = objectMetadata(header)
+	if _, err := writer.Write(buf); err != nil {
+		writer.Close()
+		fatalf("Failed to upload gs://%s/%s: %s", gcsUploader.bucket, key, err.Error())
+	}
+	if err := writer.Close(); err != nil {
+		fatalf("Failed to upload gs://%s/%s: %s", gcsUploader.bucket, key, err.Error())
+	}
+}
+
+func (gcsUploader GCSUploader) Copy(srcKey, dstKey string) {
+	src := gcsUploader.client.Bucket(gcsUploader.bucket).Object(srcKey)
+	if _, err := gcsUploader.client.Bucket(gcsUploader.bucket).Object(dstKey).CopierFrom(src).Run(context.Background()); err != nil {
+		fatalf("Failed to copy gs://%s/%s to %s: %s", gcsUploader.bucket, srcKey, dstKey, err.Error())
+	}
+}
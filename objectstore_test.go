@@ -0,0 +1,67 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"sync"
+	"testing"
+)
+
+type memoryUploader struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (uploader *memoryUploader) Put(key string, buf []byte, header *tar.Header) {
+	uploader.mutex.Lock()
+	defer uploader.mutex.Unlock()
+	uploader.objects[key] = buf
+}
+
+func (uploader *memoryUploader) Copy(srcKey, dstKey string) {
+	uploader.mutex.Lock()
+	defer uploader.mutex.Unlock()
+	src, ok := uploader.objects[srcKey]
+	if !ok {
+		panic("copy of missing object " + srcKey)
+	}
+	uploader.objects[dstKey] = src
+}
+
+func TestExtractToObjectStore(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "root/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "root/dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	contents := map[string]string{}
+	for _, name := range []string{"root/a", "root/dir/b", "root/dir/c"} {
+		contents[name] = RandomString(10000)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents[name]))})
+		tw.Write([]byte(contents[name]))
+	}
+	tw.WriteHeader(&tar.Header{Name: "root/link", Typeflag: tar.TypeLink, Linkname: "root/dir/b"})
+	tw.WriteHeader(&tar.Header{Name: "root/symlink", Typeflag: tar.TypeSymlink, Linkname: "a"})
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.WriteWorkers = 2
+	opts.StripComponents = 1
+	uploader := &memoryUploader{objects: map[string][]byte{}}
+	ExtractToObjectStore(&archive, uploader, "prefix/")
+
+	expected := map[string]string{
+		"prefix/a":     contents["root/a"],
+		"prefix/dir/b": contents["root/dir/b"],
+		"prefix/dir/c": contents["root/dir/c"],
+		"prefix/link":  contents["root/dir/b"],
+	}
+	if len(uploader.objects) != len(expected) {
+		t.Fatalf("Got %d objects, wanted %d", len(uploader.objects), len(expected))
+	}
+	for key, data := range expected {
+		if string(uploader.objects[key]) != data {
+			t.Fatalf("Object %s has the wrong contents", key)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package fastar
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Counts the bytes written at any offset, for the progress bar.
+type countingWriterAt struct {
+	writer io.WriterAt
+	count  *atomic.Int64
+}
+
+func (w countingWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	n, err := w.writer.WriteAt(p, offset)
+	w.count.Add(int64(n))
+	return n, err
+}
+
+// Downloads the file as is to path (--output-file), for payloads that
+// aren't archives like disk images. Unlike GetDownloadStream, workers
+// write each chunk at its offset as soon as it's downloaded instead of
+// taking turns on a pipe, so a slow chunk doesn't hold up the others.
+// written counts the bytes written. A failed download removes path rather
+// than leave a file of the right size with holes in it.
+func DownloadToFile(ctx context.Context, downloader Downloader, path string, chunkSize int64, numWorkers int, written *atomic.Int64) {
+	size, supportsRange, supportsMultipart := getFileInfo(downloader)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		fatalErr("Failed to create --output-file: ", err)
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(path)
+	}
+	if !supportsRange || size < chunkSize {
+		copyToFile(ctx, downloader, file, written, cleanup)
+	} else if err := downloadChunksAt(ctx, downloader, countingWriterAt{file, written}, size, supportsMultipart, chunkSize, numWorkers); err != nil {
+		if !canFallBack(ctx, err) {
+			cleanup()
+			fatalStream("Failed to download to --output-file: ", err)
+		}
+		logFallback(written.Load(), err)
+		written.Store(0)
+		copyToFile(ctx, downloader, file, written, cleanup)
+	}
+	if syncFiles() {
+		if err := file.Sync(); err != nil {
+			fatalErr("Failed to fsync --output-file: ", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		fatalErr("Failed to write --output-file: ", err)
+	}
+	log.Printf("Wrote %d bytes to %s\n", written.Load(), path)
+}
+
+// Downloads on a single stream from the start of file, calling cleanup
+// before failing.
+func copyToFile(ctx context.Context, downloader Downloader, file *os.File, written *atomic.Int64, cleanup func()) {
+	stream := countingReader{rateLimitedReader{closeOnCancel(ctx, downloader.Get())}, written}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		fatalErr("Failed to write --output-file: ", err)
+	}
+	if _, err := io.Copy(file, stream); err != nil {
+		cleanup()
+		fatalStream("Failed to write --output-file: ", err)
+	}
+}
+
+// Runs the download workers with sink in place of the pipe, returning the
+// failure that stopped them.
+func downloadChunksAt(ctx context.Context, downloader Downloader, sink io.WriterAt, size int64, supportsMultipart bool, chunkSize int64, numWorkers int) error {
+	prewarmConnections(ctx, downloader, int(min(int64(numWorkers), (size+chunkSize-1)/chunkSize)))
+	crc := newStreamCrc32c(downloader)
+	cpuSets := pinnedCpuSets()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-failed():
+			cancel(callError())
+		case <-ctx.Done():
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		var cpus *cpuSet
+		if len(cpuSets) > 0 {
+			cpus = &cpuSets[i%len(cpuSets)]
+		}
+		wg.Add(1)
+		go func(start int64) {
+			defer wg.Done()
+			writePartial(ctx, cancel, cpus, downloader, crc, supportsMultipart, size, start, chunkSize, numWorkers, sink, nil, nil, nil)
+		}(int64(i) * chunkSize)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if crc != nil {
+		crc.addChunks()
+		return crc.verify()
+	}
+	return nil
+}
+
+// Checks --output-file against the download's checksums, which are over
+// the bytes in order and so read back from disk.
+func verifyOutputFile(downloader Downloader) {
+	streamVerifier, verifies := downloader.(StreamVerifier)
+	algorithm, expected := expectedChecksum(downloader)
+	if !verifies && expected == "" {
+		return
+	}
+	file, err := os.Open(opts.OutputFile)
+	if err != nil {
+		fatalErr("Failed to open --output-file to verify it: ", err)
+	}
+	defer file.Close()
+	var stream io.Reader = file
+	if verifies {
+		stream = streamVerifier.VerifyStream(stream)
+	}
+	if expected != "" {
+		verifier := newVerifyingReader(stream, algorithm, expected)
+		verifier.Verify()
+	} else if _, err := io.Copy(io.Discard, stream); err != nil {
+		fatalStream("Failed to verify --output-file: ", err)
+	}
+}
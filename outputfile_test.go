@@ -0,0 +1,33 @@
+package fastar
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDownloadToFile(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 1000000
+	path := filepath.Join(t.TempDir(), "disk.img")
+	for _, fileSize := range []int64{0, 1, 99, 1000} {
+		data := RandomString(fileSize)
+		for _, downloader := range []TestDownloader{{data, false, false}, {data, true, false}, {data, true, true}} {
+			for _, chunkSize := range []int64{10, 100, 5000} {
+				for _, numWorkers := range []int{1, 3, 16} {
+					// Stale contents past the download are truncated.
+					os.WriteFile(path, []byte(RandomString(fileSize+100)), 0644)
+					var written atomic.Int64
+					DownloadToFile(context.Background(), downloader, path, chunkSize, numWorkers, &written)
+					if actual, err := os.ReadFile(path); err != nil || string(actual) != data || written.Load() != fileSize {
+						t.Fatalf("Failed with fileSize: %d, range: %v, multipart: %v, chunkSize: %d, numWorkers: %d, wrote %d bytes",
+							fileSize, downloader.RangeSupport, downloader.MultipartSupport, chunkSize, numWorkers, written.Load())
+					}
+				}
+			}
+		}
+	}
+}
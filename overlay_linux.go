@@ -0,0 +1,61 @@
+package fastar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// OCI image layers mark deleted files with ".wh.<name>" entries and
+// directories whose lower layer contents should be hidden with a
+// ".wh..wh..opq" entry. Overlayfs instead expects a 0/0 character device
+// in place of deleted files and a trusted.overlay.opaque xattr on opaque
+// directories.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Translate OCI whiteout entries into their overlayfs equivalent when
+// extracting with --overlay-whiteouts. path is where the entry itself would
+// be extracted to and localName its name relative to --directory. Returns
+// true if the entry was a whiteout and has been fully handled.
+func handleWhiteout(path string, localName string, header *tar.Header) bool {
+	dir, base := filepath.Split(path)
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return false
+	}
+	if base == whiteoutOpaque {
+		if err := unix.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+			fatalf("Failed to mark %s as opaque: %s", dir, err.Error())
+		}
+		return true
+	}
+	// The whiteout may only ever name an entry next to it, anything else
+	// would have the removal below delete the directory or its parents.
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+		fatalf("ExtractTarGz: %s is not a valid whiteout", header.Name)
+	}
+	target := filepath.Join(dir, name)
+	if !opts.UnsafePaths {
+		var err error
+		if target, err = safeEntryPath(filepath.Join(filepath.Dir(localName), name), false, dirCache{}); err != nil {
+			fatalf("ExtractTarGz: can't extract %s: %s", header.Name, err.Error())
+		}
+	}
+	if opts.Overwrite {
+		if _, err := os.Lstat(target); err == nil {
+			os.RemoveAll(target)
+		}
+	}
+	if err := unix.Mknod(target, unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
+		fatalf("Failed to create whiteout for %s: %s", target, err.Error())
+	}
+	os.Lchown(target, header.Uid, header.Gid)
+	emitEvent("file_extracted", map[string]interface{}{"path": target, "type": "whiteout", "size": 0})
+	return true
+}
@@ -0,0 +1,112 @@
+package fastar
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whiteout handling fails through the library so a bad entry doesn't end
+// the test binary.
+func beginWhiteoutCall(t *testing.T, dir string) {
+	options := DefaultOptions()
+	options.Overwrite = true
+	if err := beginCall(options); err != nil {
+		t.Fatal(err)
+	}
+	opts.OutputDir = dir
+}
+
+func whiteout(dir, localName string) error {
+	var handled bool
+	runOwned(func() {
+		handled = handleWhiteout(filepath.Join(dir, localName), localName, &tar.Header{Name: localName})
+	})
+	if err := callError(); err != nil {
+		return err
+	}
+	if !handled {
+		return errors.New("not handled as a whiteout")
+	}
+	return nil
+}
+
+func TestHandleWhiteout(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	dir := t.TempDir()
+	beginWhiteoutCall(t, dir)
+	defer endCall()
+	if err := os.MkdirAll(filepath.Join(dir, "layer", "deleted-dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "layer", "deleted"), []byte("lower"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if handleWhiteout(filepath.Join(dir, "layer", "regular"), "layer/regular", &tar.Header{}) {
+		t.Fatal("A regular entry was handled as a whiteout")
+	}
+	for _, name := range []string{"deleted", "deleted-dir", "never-existed"} {
+		if err := whiteout(dir, "layer/.wh."+name); errors.Is(err, syscall.EPERM) {
+			t.Skip("Creating whiteouts needs CAP_MKNOD")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var stat unix.Stat_t
+		if err := unix.Lstat(filepath.Join(dir, "layer", name), &stat); err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFCHR || stat.Rdev != 0 {
+			t.Fatalf("%s is mode %o, rdev %d instead of a 0/0 character device", name, stat.Mode, stat.Rdev)
+		}
+	}
+
+	if err := whiteout(dir, "layer/"+whiteoutOpaque); err != nil {
+		t.Skipf("Can't set trusted xattrs here: %v", err)
+	}
+	value := make([]byte, 8)
+	n, err := unix.Getxattr(filepath.Join(dir, "layer"), "trusted.overlay.opaque", value)
+	if err != nil || string(value[:n]) != "y" {
+		t.Fatalf("Opaque whiteout left trusted.overlay.opaque=%q, %v", value[:n], err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "layer", whiteoutOpaque)); !os.IsNotExist(err) {
+		t.Fatal("The opaque whiteout entry itself was extracted")
+	}
+}
+
+func TestHandleWhiteoutTraversal(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	root := t.TempDir()
+	dir := filepath.Join(root, "out")
+	victim := filepath.Join(root, "outside", "victim")
+	if err := os.MkdirAll(filepath.Join(dir, "layer"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(victim, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"layer/.wh.", "layer/.wh..", "layer/.wh...", ".wh...", "escape/.wh.victim"} {
+		beginWhiteoutCall(t, dir)
+		err := whiteout(dir, name)
+		endCall()
+		if err == nil {
+			t.Fatalf("Whiteout %s was accepted", name)
+		}
+		for _, path := range []string{filepath.Join(dir, "layer"), dir, victim} {
+			if info, err := os.Lstat(path); err != nil || !info.IsDir() {
+				t.Fatalf("Whiteout %s removed %s", name, path)
+			}
+		}
+	}
+}
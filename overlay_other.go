@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fastar
+
+import "archive/tar"
+
+// Overlayfs whiteouts only mean something on Linux.
+func handleWhiteout(path string, localName string, header *tar.Header) bool {
+	fatal("--overlay-whiteouts is only supported on Linux")
+	return false
+}
@@ -0,0 +1,92 @@
+package fastar
+
+import (
+	"io"
+	"runtime"
+)
+
+// A unit of a stream made of independently compressed blocks, like lz4
+// frame blocks or BGZF members. decode runs on one of the workers; check
+// and done run on the writer in stream order, around writing out what
+// decode returned. Tasks without decode only run check, e.g. to compare a
+// checksum over the content written so far.
+type decodeTask struct {
+	decode func() ([]byte, error)
+	check  func([]byte) error
+	// Called once the decoded data is written out, to recycle its buffer.
+	done   func([]byte)
+	result chan decodeResult
+}
+
+type decodeResult struct {
+	data []byte
+	err  error
+}
+
+func decompressWorkers() int {
+	if opts.DecodeWorkers <= 0 {
+		return runtime.NumCPU()
+	}
+	return opts.DecodeWorkers
+}
+
+// Decodes a stream's blocks on that many workers at once and returns their
+// output in order. split reads the stream, hands each block's task to
+// submit in order, and returns the error that stopped it, if any.
+func decodeInOrder(workers int, split func(submit func(*decodeTask)) error) io.Reader {
+	// Room for a couple of blocks per worker between reading and writing.
+	order := make(chan *decodeTask, 2*workers)
+	jobs := make(chan *decodeTask, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range jobs {
+				data, err := task.decode()
+				task.result <- decodeResult{data, err}
+			}
+		}()
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		defer close(jobs)
+		defer close(order)
+		err := split(func(task *decodeTask) {
+			if task.decode != nil {
+				task.result = make(chan decodeResult, 1)
+				jobs <- task
+			}
+			order <- task
+		})
+		if err != nil {
+			order <- &decodeTask{check: func([]byte) error { return err }}
+		}
+	}()
+	go writeInOrder(order, writer)
+	return reader
+}
+
+func writeInOrder(order <-chan *decodeTask, writer *io.PipeWriter) {
+	for task := range order {
+		var result decodeResult
+		if task.decode != nil {
+			result = <-task.result
+		}
+		err := result.err
+		if err == nil && task.check != nil {
+			err = task.check(result.data)
+		}
+		if err == nil && len(result.data) > 0 {
+			_, err = writer.Write(result.data)
+		}
+		if task.done != nil && result.data != nil {
+			task.done(result.data)
+		}
+		if err != nil {
+			writer.CloseWithError(err)
+			// Let the reader and workers run out instead of blocking.
+			for range order {
+			}
+			return
+		}
+	}
+	writer.Close()
+}
@@ -0,0 +1,66 @@
+package fastar
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Regular files are written by background workers while every other entry
+// is extracted by the goroutine reading the archive. An entry at the path
+// of a write still in flight, a rewrite of the file or a symlink or hard
+// link replacing it, waits for that write to finish first, so two
+// goroutines never work on the same path at once. Windows and macOS
+// filesystems usually ignore case, so paths differing only in case are
+// treated as the same there.
+type pathWrites struct {
+	mutex    sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func newPathWrites() *pathWrites {
+	return &pathWrites{inflight: map[string]chan struct{}{}}
+}
+
+// Normalizes path into the key writes to it are tracked by.
+func pathKey(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// Blocks until no write to path is in flight.
+func (w *pathWrites) wait(path string) {
+	w.mutex.Lock()
+	done := w.inflight[pathKey(path)]
+	w.mutex.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Registers a write to path, waiting out any in flight already. The
+// returned func marks it finished.
+func (w *pathWrites) begin(path string) func() {
+	key := pathKey(path)
+	for {
+		w.mutex.Lock()
+		done := w.inflight[key]
+		if done == nil {
+			done = make(chan struct{})
+			w.inflight[key] = done
+			w.mutex.Unlock()
+			return func() {
+				w.mutex.Lock()
+				delete(w.inflight, key)
+				w.mutex.Unlock()
+				close(done)
+			}
+		}
+		w.mutex.Unlock()
+		<-done
+	}
+}
@@ -0,0 +1,29 @@
+package fastar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathWrites(t *testing.T) {
+	writes := newPathWrites()
+	finished := writes.begin("/out/a/../file")
+	writes.wait("/out/other")
+
+	began := make(chan bool)
+	go func() {
+		writes.begin("/out/file")()
+		began <- true
+	}()
+	select {
+	case <-began:
+		t.Fatal("Expected a second write to the same path to wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	finished()
+	<-began
+	writes.wait("/out/file")
+	if len(writes.inflight) != 0 {
+		t.Fatalf("Expected no writes in flight, got %v", writes.inflight)
+	}
+}
@@ -0,0 +1,40 @@
+package fastar
+
+import (
+	"log"
+	"sync"
+)
+
+// Lets operators temporarily free up bandwidth without losing progress.
+// SIGUSR1 pauses the download and SIGUSR2 resumes it. While paused, workers
+// finish whatever chunk request is already in flight but don't issue any new
+// ones, and anything already downloaded stays parked in their buffers.
+var pauseLock sync.Mutex
+var pauseCond = sync.NewCond(&pauseLock)
+var paused = false
+
+func setPaused(p bool) {
+	pauseLock.Lock()
+	defer pauseLock.Unlock()
+	if paused == p {
+		return
+	}
+	paused = p
+	if paused {
+		log.Println("Pausing download, send SIGUSR2 to resume")
+		emitEvent("paused", nil)
+	} else {
+		log.Println("Resuming download")
+		emitEvent("resumed", nil)
+		pauseCond.Broadcast()
+	}
+}
+
+// Blocks the calling worker until the download is not paused.
+func waitWhilePaused() {
+	pauseLock.Lock()
+	defer pauseLock.Unlock()
+	for paused {
+		pauseCond.Wait()
+	}
+}
@@ -0,0 +1,76 @@
+package fastar
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the chunks requested, pausing the download once the chunk at
+// pauseAt is.
+type pausingDownloader struct {
+	TestDownloader
+	pauseAt int64
+	mutex   *sync.Mutex
+	starts  map[int64]bool
+}
+
+func (downloader pausingDownloader) GetRange(start, end int64) io.ReadCloser {
+	downloader.mutex.Lock()
+	downloader.starts[start/100*100] = true
+	downloader.mutex.Unlock()
+	if start == downloader.pauseAt {
+		setPaused(true)
+	}
+	return downloader.TestDownloader.GetRange(start, end)
+}
+
+func (downloader pausingDownloader) requested() int {
+	downloader.mutex.Lock()
+	defer downloader.mutex.Unlock()
+	return len(downloader.starts)
+}
+
+func TestPauseAndResume(t *testing.T) {
+	oldRetryCount := opts.RetryCount
+	opts.RetryCount = math.MaxInt32
+	defer func() { opts.RetryCount = oldRetryCount }()
+	defer setPaused(false)
+
+	data := RandomString(2000)
+	// Paused before the download starts, and once the chunk at byte 500
+	// is requested.
+	for _, pauseAt := range []int64{-1, 500} {
+		downloader := pausingDownloader{TestDownloader{data, true, false}, pauseAt, &sync.Mutex{}, map[int64]bool{}}
+		setPaused(pauseAt < 0)
+		result := make(chan string)
+		go func() {
+			downloaded, _ := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4))
+			result <- string(downloaded)
+		}()
+
+		// Workers finish the chunks they're on, then stop requesting.
+		time.Sleep(100 * time.Millisecond)
+		requested := downloader.requested()
+		time.Sleep(100 * time.Millisecond)
+		if downloader.requested() != requested || requested >= len(data)/100 {
+			t.Fatalf("Chunks were requested while paused at %d: %d, then %d of %d", pauseAt, requested, downloader.requested(), len(data)/100)
+		}
+		if pauseAt < 0 && requested != 0 {
+			t.Fatalf("Requested %d chunks paused from the start", requested)
+		}
+
+		setPaused(false)
+		select {
+		case downloaded := <-result:
+			if downloaded != data {
+				t.Fatalf("Downloaded %d bytes after resuming at %d, wanted %d", len(downloaded), pauseAt, len(data))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Download paused at %d didn't finish after resuming", pauseAt)
+		}
+	}
+}
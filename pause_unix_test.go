@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func isPaused() bool {
+	pauseLock.Lock()
+	defer pauseLock.Unlock()
+	return paused
+}
+
+func TestPauseSignals(t *testing.T) {
+	defer setPaused(false)
+	handlePauseSignals()
+	for _, test := range []struct {
+		signal unix.Signal
+		paused bool
+	}{{unix.SIGUSR1, true}, {unix.SIGUSR1, true}, {unix.SIGUSR2, false}, {unix.SIGUSR1, true}} {
+		if err := unix.Kill(os.Getpid(), test.signal); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for isPaused() != test.paused && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if isPaused() != test.paused {
+			t.Fatalf("Expected paused to be %t after %s", test.paused, signalName(test.signal))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package fastar
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reported by fastar capabilities on top of the features of every unix.
+var linuxFeatures = []string{"direct_io", "fallocate", "syncfs", "output_device", "pin_workers", "overlay_whiteouts"}
+
+// Allocates size bytes for file up front, extending it to size.
+func preallocateFile(file *os.File, size int64) error {
+	return unix.Fallocate(int(file.Fd()), 0, 0, size)
+}
+
+// Opens a file for writes that bypass the page cache. Fails with EINVAL on
+// filesystems without O_DIRECT, e.g. tmpfs.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag|unix.O_DIRECT, perm)
+}
+
+// Switches a file opened with openDirect back to buffered I/O, for writes
+// that aren't a multiple of the block size.
+func disableDirect(file *os.File) error {
+	flags, err := unix.FcntlInt(file.Fd(), unix.F_GETFL, 0)
+	if err == nil {
+		_, err = unix.FcntlInt(file.Fd(), unix.F_SETFL, flags&^unix.O_DIRECT)
+	}
+	return err
+}
+
+// Lets readahead run far ahead of a file read once front to back.
+func adviseSequential(file *os.File) {
+	unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+// Syncs the whole filesystem dir is on, for --post-extract-fsync=syncfs.
+func syncFilesystem(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return unix.Syncfs(int(file.Fd()))
+}
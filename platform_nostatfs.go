@@ -0,0 +1,16 @@
+//go:build !windows && !linux && !darwin && !freebsd && !dragonfly
+// +build !windows,!linux,!darwin,!freebsd,!dragonfly
+
+package fastar
+
+import "syscall"
+
+// Other systems' statfs doesn't have the fields these need, so slow
+// filesystems aren't detected and free space isn't checked.
+func filesystemType(dir string) (int64, error) {
+	return 0, syscall.ENOTSUP
+}
+
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, syscall.ENOTSUP
+}
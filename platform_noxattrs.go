@@ -0,0 +1,21 @@
+//go:build !windows && !linux && !darwin && !freebsd && !netbsd
+// +build !windows,!linux,!darwin,!freebsd,!netbsd
+
+package fastar
+
+import "syscall"
+
+// golang.org/x/sys/unix has no xattr calls for the other systems.
+const xattrsSupported = false
+
+func lsetxattr(path, name string, value []byte) error {
+	return syscall.ENOTSUP
+}
+
+func llistxattr(path string, dest []byte) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+func lgetxattr(path, name string, dest []byte) (int, error) {
+	return 0, syscall.ENOTSUP
+}
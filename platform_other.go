@@ -0,0 +1,32 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package fastar
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocate, O_DIRECT and syncfs are Linux only, checkPlatformFlags
+// rejects the flags relying on them up front.
+var linuxFeatures = []string{}
+
+func preallocateFile(file *os.File, size int64) error {
+	return syscall.ENOTSUP
+}
+
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, syscall.EINVAL
+}
+
+func disableDirect(file *os.File) error {
+	return nil
+}
+
+func adviseSequential(file *os.File) {}
+
+func syncFilesystem(dir string) error {
+	return errors.New("syncfs is only supported on Linux, use --post-extract-fsync=dirs")
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package fastar
+
+import "golang.org/x/sys/unix"
+
+// Returns the statfs f_type of the filesystem dir is on.
+func filesystemType(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(uint32(stat.Type)), nil
+}
+
+// Bytes an unprivileged user can still write to the filesystem dir is on.
+func freeDiskSpace(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,106 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extracted entries get the owners recorded in the archive.
+const ownersSupported = true
+
+// Reported by fastar capabilities, for flags that only work on some
+// platforms.
+var platformFeatures = unixFeatures()
+
+func unixFeatures() []string {
+	features := []string{"owners", "fakeroot_db", "ext4_image", "pause_signals"}
+	if xattrsSupported {
+		features = append(features, "xattrs")
+	}
+	return append(features, linuxFeatures...)
+}
+
+// Makes opening a file fail rather than follow a symlink in its place.
+const openNoFollow = syscall.O_NOFOLLOW
+
+// Archive paths already use the platform's separator.
+func platformPath(name string) (string, error) {
+	return name, nil
+}
+
+// Never true here, creating symlinks needs no special privilege.
+func symlinkUnprivileged(err error) bool {
+	return false
+}
+
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+func unixMode(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Mode)
+	}
+	return int64(info.Mode().Perm())
+}
+
+func fileDevice(info os.FileInfo) uint64 {
+	return uint64(info.Sys().(*syscall.Stat_t).Dev)
+}
+
+// Runs command with the shell, like --header-command.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+func signalName(sig syscall.Signal) string {
+	return unix.SignalName(sig)
+}
+
+func handlePauseSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGUSR1, unix.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			setPaused(sig == unix.SIGUSR1)
+		}
+	}()
+}
+
+// Returns the soft RLIMIT_NOFILE, false if it's unknown or unlimited.
+func fileLimit() (uint64, bool) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil || limit.Cur > 1<<31 {
+		return 0, false
+	}
+	// int64 on the BSDs.
+	return uint64(limit.Cur), true
+}
+
+// Distro defaults often leave the soft RLIMIT_NOFILE at 1024, so raise it
+// to the hard limit before spinning up any workers.
+func raiseFileLimit() {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		log.Println("Failed to read open file limit: ", err.Error())
+		return
+	}
+	if limit.Cur < limit.Max {
+		raised := unix.Rlimit{Cur: limit.Max, Max: limit.Max}
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &raised); err != nil {
+			log.Printf("Failed to raise open file limit from %d to %d: %s\n", limit.Cur, limit.Max, err.Error())
+		}
+	}
+}
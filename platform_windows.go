@@ -0,0 +1,120 @@
+package fastar
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows has no numeric owners to give extracted entries.
+const ownersSupported = false
+
+// Reported by fastar capabilities. Symlinks need Developer Mode or
+// administrator rights.
+var platformFeatures = []string{}
+
+// Windows has no O_NOFOLLOW, only the resolved path keeps files inside
+// --directory.
+const openNoFollow = 0
+
+// Translates an archive path to Windows separators. Names that would mean
+// something else once translated, like a backslash turning into a
+// directory or a colon naming a drive or an alternate data stream, are
+// rejected rather than extracted somewhere unexpected.
+func platformPath(name string) (string, error) {
+	if i := strings.IndexAny(name, `\:`); i >= 0 {
+		return "", fmt.Errorf("%q isn't allowed in Windows paths", name[i])
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// Whether creating a symlink failed because the process can't, which
+// unless Developer Mode is on takes running as administrator.
+func symlinkUnprivileged(err error) bool {
+	return errors.Is(err, windows.ERROR_PRIVILEGE_NOT_HELD)
+}
+
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func unixMode(info os.FileInfo) int64 {
+	return int64(info.Mode().Perm())
+}
+
+// Files on Windows have no device number, all of them share a gate.
+func fileDevice(info os.FileInfo) uint64 {
+	return 0
+}
+
+func lsetxattr(path, name string, value []byte) error {
+	return syscall.ENOTSUP
+}
+
+func llistxattr(path string, dest []byte) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+func lgetxattr(path, name string, dest []byte) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+func preallocateFile(file *os.File, size int64) error {
+	return syscall.ENOTSUP
+}
+
+// Unbuffered writes aren't supported, callers fall back to buffered ones.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, syscall.EINVAL
+}
+
+func disableDirect(file *os.File) error {
+	return nil
+}
+
+func adviseSequential(file *os.File) {}
+
+// No filesystem is recognized as slow.
+func filesystemType(dir string) (int64, error) {
+	return 0, nil
+}
+
+func freeDiskSpace(dir string) (int64, error) {
+	var available uint64
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(path, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
+
+func syncFilesystem(dir string) error {
+	return errors.New("syncfs is only supported on Linux, use --post-extract-fsync=dirs")
+}
+
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+func signalName(sig syscall.Signal) string {
+	return map[syscall.Signal]string{syscall.SIGINT: "SIGINT", syscall.SIGTERM: "SIGTERM"}[sig]
+}
+
+// There's no SIGUSR1 or SIGUSR2 to pause and resume with.
+func handlePauseSignals() {}
+
+// Windows has no per-process limit on open handles worth budgeting for.
+func fileLimit() (uint64, bool) {
+	return 0, false
+}
+
+func raiseFileLimit() {}
@@ -0,0 +1,14 @@
+package fastar
+
+import "testing"
+
+func TestPlatformPath(t *testing.T) {
+	if path, err := platformPath("etc/app/config.json"); err != nil || path != `etc\app\config.json` {
+		t.Fatalf("Got %q, %v", path, err)
+	}
+	for _, name := range []string{`etc\..\..\evil`, "C:/Windows/evil", "file.txt:stream"} {
+		if _, err := platformPath(name); err == nil {
+			t.Fatalf("Expected %q to be rejected", name)
+		}
+	}
+}
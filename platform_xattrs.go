@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd || netbsd
+// +build linux darwin freebsd netbsd
+
+package fastar
+
+import "golang.org/x/sys/unix"
+
+const xattrsSupported = true
+
+func lsetxattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+func llistxattr(path string, dest []byte) (int, error) {
+	return unix.Llistxattr(path, dest)
+}
+
+func lgetxattr(path, name string, dest []byte) (int, error) {
+	return unix.Lgetxattr(path, name, dest)
+}
@@ -0,0 +1,151 @@
+package fastar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// A config file profile: flag defaults for sources whose host matches
+// pattern.
+type profile struct {
+	pattern string
+	args    []string
+}
+
+// Names of the profiles applied to this run, logged once logging is set up.
+var appliedProfiles []string
+
+// The flags those profiles set.
+var appliedProfileArgs []string
+
+// Where the config file is looked for without --config, e.g.
+// ~/.config/fastar/config on Linux.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fastar", "config")
+}
+
+// Reads the profiles of a config file. Each section is named by a host
+// pattern as path.Match takes it, and sets flags by their long name:
+//
+//	# Tuning that works well for Azure blob storage.
+//	[*.blob.core.windows.net]
+//	chunk-size = 16
+//	download-workers = 32
+//	retry-count = 20
+//
+// Boolean flags take true or false. Settings before the first section
+// apply to every source.
+func loadProfiles(reader io.Reader, name string) ([]profile, error) {
+	scanner := bufio.NewScanner(reader)
+	parser := flags.NewParser(&Options{}, flags.None)
+	profiles := []profile{{pattern: "*"}}
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			pattern := strings.TrimSpace(text[1 : len(text)-1])
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, fmt.Errorf("%s:%d: invalid host pattern %q", name, line, pattern)
+			}
+			profiles = append(profiles, profile{pattern: pattern})
+			continue
+		}
+		key, value, _ := strings.Cut(text, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		option := parser.FindOptionByLongName(key)
+		if option == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", name, line, key)
+		}
+		current := &profiles[len(profiles)-1]
+		if option.Field().Type.Kind() != reflect.Bool {
+			current.args = append(current.args, "--"+key+"="+value)
+		} else if value == "" || value == "true" {
+			current.args = append(current.args, "--"+key)
+		} else if value != "false" {
+			return nil, fmt.Errorf("%s:%d: %s takes true or false, not %q", name, line, key, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// Returns the flags of the profiles matching rawUrl's host, in the order
+// the config file lists them so later profiles override earlier ones.
+func profileArgs(profiles []profile, rawUrl string) (args []string, matched []string) {
+	host := ""
+	if parsed, err := url.Parse(rawUrl); err == nil {
+		host = parsed.Hostname()
+	}
+	for _, p := range profiles {
+		if ok, _ := path.Match(p.pattern, host); ok && len(p.args) > 0 {
+			args = append(args, p.args...)
+			matched = append(matched, p.pattern)
+		}
+	}
+	return args, matched
+}
+
+// Re-parses the command line on top of the profiles in the config file
+// that match the source, so flags given explicitly still win. List flags
+// like --resolve add to the profile's. Returns the positional arguments.
+func applyProfiles(args []string, commandLine []string) []string {
+	name := opts.Config
+	if name == "" {
+		if name = defaultConfigPath(); name == "" {
+			return args
+		}
+	}
+	file, err := os.Open(name)
+	if os.IsNotExist(err) && opts.Config == "" {
+		return args
+	}
+	if err != nil {
+		fatal("Failed to read config: ", err.Error())
+	}
+	defer file.Close()
+	profiles, err := loadProfiles(file, name)
+	if err != nil {
+		fatal("Failed to read config: ", err.Error())
+	}
+	source := args[0]
+	if source == "extract" && len(args) > 1 {
+		source = args[1]
+	}
+	extra, matched := profileArgs(profiles, source)
+	if len(extra) == 0 {
+		return args
+	}
+	opts = Options{}
+	args, err = flags.NewParser(&opts, flags.HelpFlag|flags.IgnoreUnknown).ParseArgs(append(extra, commandLine...))
+	if err != nil {
+		fatal("Failed to apply config profile: ", err)
+	}
+	appliedProfiles = matched
+	appliedProfileArgs = extra
+	return args
+}
+
+func logAppliedProfiles() {
+	if len(appliedProfiles) > 0 {
+		log.Printf("Applied config profiles %s\n", strings.Join(appliedProfiles, ", "))
+		emitEvent("profiles_applied", map[string]interface{}{"profiles": appliedProfiles})
+	}
+}
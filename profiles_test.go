@@ -0,0 +1,63 @@
+package fastar
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+# Defaults for every source.
+retry-wait = 2
+
+[*.blob.core.windows.net]
+chunk-size = 16
+download-workers = 32
+use-fips-endpoint = true
+
+[fast.example.com]
+download-workers = 64
+`
+
+func TestLoadProfiles(t *testing.T) {
+	profiles, err := loadProfiles(strings.NewReader(testConfig), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, matched := profileArgs(profiles, "https://account.blob.core.windows.net/container/image.tar.gz")
+	if !reflect.DeepEqual(args, []string{"--retry-wait=2", "--chunk-size=16", "--download-workers=32", "--use-fips-endpoint"}) ||
+		!reflect.DeepEqual(matched, []string{"*", "*.blob.core.windows.net"}) {
+		t.Fatalf("Got %v from %v", args, matched)
+	}
+	if args, _ := profileArgs(profiles, "s3://bucket/image.tar.gz"); !reflect.DeepEqual(args, []string{"--retry-wait=2"}) {
+		t.Fatalf("Expected only the defaults for S3, got %v", args)
+	}
+
+	for _, config := range []string{"no-such-flag = 1", "[]", "use-fips-endpoint = maybe"} {
+		if _, err := loadProfiles(strings.NewReader(config), "config"); err == nil {
+			t.Fatalf("Expected %q to be rejected", config)
+		}
+	}
+}
+
+func TestApplyProfiles(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	config := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(config, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	commandLine := []string{"--config", config, "--download-workers", "8", "https://account.blob.core.windows.net/c/image.tar.gz"}
+	opts = DefaultOptions()
+	opts.Config = config
+	args := applyProfiles(commandLine[4:], commandLine)
+	// The command line wins over the profile.
+	if opts.NumWorkers != 8 || opts.ChunkSize != 16 || opts.RetryWait != 2 || !opts.UseFips {
+		t.Fatalf("Profile not applied: %+v", opts)
+	}
+	if !reflect.DeepEqual(args, commandLine[4:]) {
+		t.Fatalf("Got positional arguments %v", args)
+	}
+}
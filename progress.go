@@ -0,0 +1,229 @@
+package fastar
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --progress redraws a progress bar on stderr and --progress-json emits a
+// "progress" event every progressInterval. Overall speed and ETA are
+// averaged over the whole download, worker speeds over the last interval.
+const progressInterval = time.Second
+
+// Above this many workers the bar shows the range of their speeds instead
+// of each one, so it still fits on a line.
+const progressMaxWorkers = 8
+
+const progressBarWidth = 30
+
+// Size of the file being downloaded, 0 while it's unknown.
+var progressSize atomic.Int64
+
+// Bytes each download worker has read off the wire, by worker number.
+var workerProgress sync.Map
+
+// Bytes handed to the consumer so far.
+var progressDownloaded *atomic.Int64
+
+var progressLock sync.Mutex
+var progressLine string
+var progressStop chan struct{}
+var progressStopped chan struct{}
+
+// Returns the counter worker adds the bytes it reads to.
+func workerProgressCounter(worker int64) *atomic.Int64 {
+	counter, _ := workerProgress.LoadOrStore(worker, &atomic.Int64{})
+	return counter.(*atomic.Int64)
+}
+
+// Checks the progress flags before logging is set up, --progress-json
+// writes its events to stderr like --porcelain unless --events-fd is
+// given.
+func setupProgress() {
+	if opts.Progress && (opts.Porcelain || opts.ProgressJson) {
+		fatal("--progress draws on stderr, it can't be combined with --porcelain or --progress-json")
+	}
+	if opts.ProgressJson && opts.EventsFd == 0 {
+		opts.Porcelain = true
+	}
+}
+
+// Starts reporting the progress of downloaded until stopProgress.
+func startProgress(downloaded *atomic.Int64) {
+	if !opts.Progress && !opts.ProgressJson {
+		return
+	}
+	progressDownloaded = downloaded
+	progressStop = make(chan struct{})
+	progressStopped = make(chan struct{})
+	if opts.Progress {
+		log.SetOutput(progressLogWriter{})
+	}
+	start := time.Now()
+	go func() {
+		defer close(progressStopped)
+		lastWorkerBytes := map[int64]int64{}
+		lastTick := start
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case now = <-ticker.C:
+			case <-progressStop:
+				now = time.Now()
+			}
+			workers := map[int64]float64{}
+			workerProgress.Range(func(key, value interface{}) bool {
+				worker, bytes := key.(int64), value.(*atomic.Int64).Load()
+				workers[worker] = float64(bytes-lastWorkerBytes[worker]) / 1e6 / now.Sub(lastTick).Seconds()
+				lastWorkerBytes[worker] = bytes
+				return true
+			})
+			lastTick = now
+			reportProgress(progressDownloaded.Load(), progressSize.Load(), now.Sub(start), workers)
+			select {
+			case <-progressStop:
+				return
+			default:
+			}
+		}
+	}()
+}
+
+// Reports the final progress and leaves the bar on its own line.
+func stopProgress() {
+	if progressStop == nil {
+		return
+	}
+	close(progressStop)
+	<-progressStopped
+	progressStop = nil
+	if opts.Progress {
+		progressLock.Lock()
+		defer progressLock.Unlock()
+		os.Stderr.WriteString("\n")
+		progressLine = ""
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func reportProgress(downloaded, size int64, elapsed time.Duration, workers map[int64]float64) {
+	mbps := float64(downloaded) / 1e6 / elapsed.Seconds()
+	eta := -1.0
+	if size > 0 && mbps > 0 {
+		eta = float64(size-downloaded) / 1e6 / mbps
+		if eta < 0 {
+			eta = 0
+		}
+	}
+	if opts.ProgressJson {
+		workerMbps := map[string]float64{}
+		for worker, speed := range workers {
+			workerMbps[fmt.Sprint(worker)] = speed
+		}
+		emitEvent("progress", map[string]interface{}{
+			"downloaded":  downloaded,
+			"size":        size,
+			"mbps":        mbps,
+			"eta_seconds": eta,
+			"workers":     workerMbps,
+		})
+	}
+	if opts.Progress {
+		drawProgress(progressBar(downloaded, size, mbps, eta, workers))
+	}
+}
+
+// Renders e.g. "[=======>      ]  45.2%  1.2 GB / 2.7 GB  85.3 MB/s  ETA 0:18
+// workers 21.2 22.0 20.9 23.1 MB/s". Without a known size only the bytes
+// and speeds are shown.
+func progressBar(downloaded, size int64, mbps, eta float64, workers map[int64]float64) string {
+	var line strings.Builder
+	if size > 0 {
+		fraction := float64(downloaded) / float64(size)
+		if fraction > 1 {
+			fraction = 1
+		}
+		filled := int(fraction * progressBarWidth)
+		bar := strings.Repeat("=", filled)
+		if filled < progressBarWidth {
+			bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+		}
+		fmt.Fprintf(&line, "[%s] %5.1f%%  %s / %s", bar, fraction*100, formatProgressBytes(downloaded), formatProgressBytes(size))
+	} else {
+		line.WriteString(formatProgressBytes(downloaded))
+	}
+	fmt.Fprintf(&line, "  %.1f MB/s", mbps)
+	if eta >= 0 {
+		seconds := int(eta + 0.5)
+		fmt.Fprintf(&line, "  ETA %d:%02d", seconds/60, seconds%60)
+	}
+	if len(workers) > 1 {
+		var ids []int64
+		for worker := range workers {
+			ids = append(ids, worker)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		line.WriteString("  workers")
+		if len(ids) > progressMaxWorkers {
+			slowest, fastest := workers[ids[0]], workers[ids[0]]
+			for _, worker := range ids {
+				if workers[worker] < slowest {
+					slowest = workers[worker]
+				}
+				if workers[worker] > fastest {
+					fastest = workers[worker]
+				}
+			}
+			fmt.Fprintf(&line, " %.1f-%.1f", slowest, fastest)
+		} else {
+			for _, worker := range ids {
+				fmt.Fprintf(&line, " %.1f", workers[worker])
+			}
+		}
+		line.WriteString(" MB/s")
+	}
+	return line.String()
+}
+
+func formatProgressBytes(n int64) string {
+	value := float64(n)
+	for _, unit := range []string{"B", "kB", "MB", "GB"} {
+		if value < 1000 || unit == "GB" {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", n)
+			}
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+		value /= 1000
+	}
+	return ""
+}
+
+func drawProgress(line string) {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	progressLine = line
+	os.Stderr.WriteString("\r\033[K" + line)
+}
+
+// Prints log lines above the progress bar instead of through it.
+type progressLogWriter struct{}
+
+func (progressLogWriter) Write(p []byte) (int, error) {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	os.Stderr.WriteString("\r\033[K")
+	n, err := os.Stderr.Write(p)
+	if progressLine != "" {
+		os.Stderr.WriteString(progressLine)
+	}
+	return n, err
+}
@@ -0,0 +1,18 @@
+package fastar
+
+import "testing"
+
+func TestProgressBar(t *testing.T) {
+	line := progressBar(1500e6, 3000e6, 100, 15, map[int64]float64{0: 51.5, 1: 48.5})
+	expected := "[===============>              ]  50.0%  1.5 GB / 3.0 GB  100.0 MB/s  ETA 0:15  workers 51.5 48.5 MB/s"
+	if line != expected {
+		t.Fatalf("Got %q, wanted %q", line, expected)
+	}
+	workers := map[int64]float64{}
+	for i := int64(0); i < 16; i++ {
+		workers[i] = float64(10 + i)
+	}
+	if line := progressBar(2048, 0, 0.5, -1, workers); line != "2.0 kB  0.5 MB/s  workers 10.0-25.0 MB/s" {
+		t.Fatalf("Got %q for an unknown size", line)
+	}
+}
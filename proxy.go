@@ -0,0 +1,216 @@
+package fastar
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// `fastar proxy URL` serves the object at URL over plain HTTP on --listen,
+// with Range support, so tools that only take a URL still get fastar's
+// parallel download. Large ranges are fetched by parallel workers like any
+// download, small ones from a cache of proxyBlockSize blocks, since tools
+// reading an archive's index or a file's footer tend to read the same few
+// blocks over and over.
+const proxyBlockSize = 4 << 20
+
+// A fixed byte range of an object whose size is already known, so each
+// request served doesn't look it up again.
+type sectionDownloader struct {
+	downloader Downloader
+	start, end int64
+}
+
+func (d sectionDownloader) GetFileInfo() (int64, bool, bool) {
+	return d.end - d.start, true, false
+}
+
+func (d sectionDownloader) Get() io.ReadCloser {
+	return d.downloader.GetRange(d.start, d.end)
+}
+
+func (d sectionDownloader) GetRange(start, end int64) io.ReadCloser {
+	return d.downloader.GetRange(start+d.start, end+d.start)
+}
+
+func (d sectionDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported by the proxy")
+}
+
+// LRU cache of proxyBlockSize aligned blocks of the object.
+type blockCache struct {
+	mutex     sync.Mutex
+	maxBlocks int
+	blocks    map[int64]*list.Element
+	lru       *list.List
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+func newBlockCache(maxBytes int64) *blockCache {
+	return &blockCache{
+		maxBlocks: int(maxBytes / proxyBlockSize),
+		blocks:    map[int64]*list.Element{},
+		lru:       list.New(),
+	}
+}
+
+func (c *blockCache) get(index int64) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.blocks[index]; ok {
+		c.lru.MoveToFront(element)
+		return element.Value.(*cachedBlock).data
+	}
+	return nil
+}
+
+func (c *blockCache) add(index int64, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.blocks[index]; ok || c.maxBlocks == 0 {
+		return
+	}
+	c.blocks[index] = c.lru.PushFront(&cachedBlock{index, data})
+	for c.lru.Len() > c.maxBlocks {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedBlock)
+		delete(c.blocks, oldest.index)
+	}
+}
+
+type proxy struct {
+	downloader Downloader
+	size       int64
+	cache      *blockCache
+}
+
+// Serves the object at rawUrl on --listen until fastar is killed.
+func ServeProxy(rawUrl string) {
+	downloader := countRequests(getDownloader(rawUrl, opts.UseFips, opts.UseGetForSize), backendName(rawUrl))
+	size, supportsRange, _ := downloader.GetFileInfo()
+	if !supportsRange {
+		fatal("The source doesn't support RANGE requests, there's nothing to gain from proxying it")
+	}
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		fatal("Failed to listen on --listen: ", err.Error())
+	}
+	prewarmConnections(context.Background(), downloader, opts.NumWorkers)
+	filename := ""
+	if parsed, err := url.Parse(rawUrl); err == nil {
+		filename = path.Base(parsed.Path)
+	}
+	log.Printf("Serving %s (%d bytes) on http://%s/%s\n", rawUrl, size, listener.Addr(), filename)
+	emitEvent("proxy_listening", map[string]interface{}{"url": rawUrl, "address": listener.Addr().String(), "size": size})
+	p := &proxy{downloader: downloader, size: size, cache: newBlockCache(opts.ProxyCache * 1e6)}
+	if err := http.Serve(listener, p); err != nil {
+		fatal("Proxy failed: ", err.Error())
+	}
+}
+
+// Serves the object at every path, tools often go by the file extension.
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	start, end, ranged, err := parseRange(r.Header.Get("Range"), p.size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", p.size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, p.size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.Method == http.MethodHead || start == end {
+		return
+	}
+	log.Printf("Proxying bytes %d-%d to %s\n", start, end-1, r.RemoteAddr)
+	if end-start <= proxyBlockSize {
+		err = p.serveCached(w, start, end)
+	} else {
+		_, err = io.Copy(w, GetDownloadStream(r.Context(), sectionDownloader{p.downloader, start, end}, opts.ChunkSize, opts.NumWorkers))
+	}
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Failed to proxy bytes %d-%d to %s: %s\n", start, end-1, r.RemoteAddr, err.Error())
+	}
+}
+
+// Writes bytes start to end, at most two blocks, through the cache.
+func (p *proxy) serveCached(w io.Writer, start, end int64) error {
+	for index := start / proxyBlockSize; index*proxyBlockSize < end; index++ {
+		block := p.cache.get(index)
+		if block == nil {
+			blockStart := index * proxyBlockSize
+			body := p.downloader.GetRange(blockStart, min(blockStart+proxyBlockSize, p.size))
+			data, err := io.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+			block = data
+			p.cache.add(index, block)
+		}
+		from := max64(start-index*proxyBlockSize, 0)
+		to := min(end-index*proxyBlockSize, int64(len(block)))
+		if _, err := w.Write(block[from:to]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses a Range header into the byte range [start, end) to serve. Without
+// one, or with several ranges which the proxy answers with the whole
+// object, ranged is false.
+func parseRange(header string, size int64) (start, end int64, ranged bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false, fmt.Errorf("invalid range %q", header)
+	}
+	if first == "" {
+		// The last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, fmt.Errorf("invalid range %q", header)
+		}
+		return max64(size-n, 0), size, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("range %q not satisfiable for %d bytes", header, size)
+	}
+	end = size
+	if last != "" {
+		lastByte, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || lastByte < start {
+			return 0, 0, false, fmt.Errorf("invalid range %q", header)
+		}
+		end = min(lastByte+1, size)
+	}
+	return start, end, true, nil
+}
@@ -0,0 +1,84 @@
+package fastar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	for header, expected := range map[string][3]int64{
+		"":               {0, 1000, 0},
+		"bytes=0-99":     {0, 100, 1},
+		"bytes=900-":     {900, 1000, 1},
+		"bytes=-100":     {900, 1000, 1},
+		"bytes=990-2000": {990, 1000, 1},
+		"bytes=0-1,5-9":  {0, 1000, 0},
+		"items=0-1":      {0, 1000, 0},
+	} {
+		start, end, ranged, err := parseRange(header, 1000)
+		if err != nil || start != expected[0] || end != expected[1] || ranged != (expected[2] == 1) {
+			t.Fatalf("%q: got %d-%d ranged %v, %v", header, start, end, ranged, err)
+		}
+	}
+	for _, header := range []string{"bytes=1000-", "bytes=5-1", "bytes=abc", "bytes=-0"} {
+		if _, _, _, err := parseRange(header, 1000); err == nil {
+			t.Fatalf("Expected %q to be rejected", header)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts = DefaultOptions()
+	opts.RetryCount = 1000000
+	data := []byte(RandomString(1000))
+	var upstreamRequests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer upstream.Close()
+	p := &proxy{downloader: getDownloader(upstream.URL, false, false), size: int64(len(data)), cache: newBlockCache(proxyBlockSize)}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	get := func(rangeHeader string) (int, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/image.tar", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+	if status, body := get(""); status != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("Got %d with %d bytes for the whole object", status, len(body))
+	}
+	before := upstreamRequests.Load()
+	for _, span := range [][2]int{{0, 99}, {500, 999}, {10, 10}} {
+		status, body := get(fmt.Sprintf("bytes=%d-%d", span[0], span[1]))
+		if status != http.StatusPartialContent || !bytes.Equal(body, data[span[0]:span[1]+1]) {
+			t.Fatalf("Got %d with %q for bytes %d-%d", status, body, span[0], span[1])
+		}
+	}
+	if upstreamRequests.Load() != before {
+		t.Fatal("Expected small ranges to be served from the cache")
+	}
+	if status, _ := get("bytes=5000-"); status != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Got %d for a range past the end", status)
+	}
+}
@@ -0,0 +1,191 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Token bucket shared by every download worker, so limits apply to the
+// aggregate throughput of the whole process rather than per connection.
+// Unlimited unless a bandwidth schedule is configured.
+var downloadLimiter = rate.NewLimiter(rate.Inf, 0)
+
+// Cap from --max-rate on whatever rate is in effect, including the ones
+// of --bandwidth-schedule windows.
+var maxDownloadRate = rate.Limit(rate.Inf)
+
+// Block until n more bytes are allowed to be downloaded.
+func waitForBandwidth(n int) {
+	for n > 0 {
+		// WaitN refuses requests larger than the bucket, so take
+		// tokens at most a burst at a time.
+		take := n
+		if burst := downloadLimiter.Burst(); downloadLimiter.Limit() != rate.Inf && take > burst {
+			take = burst
+		}
+		if err := downloadLimiter.WaitN(context.Background(), take); err != nil {
+			fatal("Failed waiting for bandwidth limiter: ", err.Error())
+		}
+		n -= take
+	}
+}
+
+// Applies --max-rate, unlimited if it's not set.
+func setupMaxRate() {
+	maxDownloadRate = rate.Inf
+	if opts.MaxRate != "" {
+		limit, err := parseRate(opts.MaxRate)
+		if err != nil {
+			fatal("Failed to parse --max-rate: ", err.Error())
+		}
+		maxDownloadRate = limit
+	}
+	setDownloadRate(rate.Inf)
+}
+
+func setDownloadRate(limit rate.Limit) {
+	if limit > maxDownloadRate {
+		limit = maxDownloadRate
+	}
+	if limit == downloadLimiter.Limit() {
+		return
+	}
+	if limit == rate.Inf {
+		log.Println("Download rate unlimited")
+	} else {
+		log.Printf("Limiting download rate to %.3fMBps\n", float64(limit)/1e6)
+		// Allow up to a second worth of data to be read in a single burst.
+		burst := int(limit)
+		if burst < 1 {
+			burst = 1
+		}
+		downloadLimiter.SetBurst(burst)
+	}
+	downloadLimiter.SetLimit(limit)
+}
+
+// Wraps the single stream download path so it's subject to the same limits
+// as the parallel workers.
+type rateLimitedReader struct {
+	io.ReadCloser
+}
+
+func (r rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	waitForBandwidth(n)
+	return n, err
+}
+
+// Parses rates such as "500K", "200MB/s", "1G" or "unlimited" into bytes per
+// second. K, M and G are decimal multipliers to match --min-speed.
+func parseRate(s string) (rate.Limit, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "UNLIMITED" {
+		return rate.Inf, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/S"), "B")
+	multiplier := 1.0
+	if strings.HasSuffix(s, "K") {
+		multiplier = 1e3
+	} else if strings.HasSuffix(s, "M") {
+		multiplier = 1e6
+	} else if strings.HasSuffix(s, "G") {
+		multiplier = 1e9
+	}
+	if multiplier != 1.0 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate.Limit(value * multiplier), nil
+}
+
+// A daily time window with its own download rate. Times are minutes since
+// local midnight and windows where end < start wrap around midnight.
+type bandwidthWindow struct {
+	start, end int
+	limit      rate.Limit
+}
+
+func (w bandwidthWindow) contains(minute int) bool {
+	if w.start == w.end {
+		return true
+	} else if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// Parses schedules of the form "09:00-18:00=200MB/s,18:00-09:00=unlimited".
+func parseBandwidthSchedule(schedule string) ([]bandwidthWindow, error) {
+	var windows []bandwidthWindow
+	for _, entry := range strings.Split(schedule, ",") {
+		span, limitString, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			return nil, fmt.Errorf("missing rate in schedule entry %q", entry)
+		}
+		startString, endString, found := strings.Cut(span, "-")
+		if !found {
+			return nil, fmt.Errorf("invalid time range in schedule entry %q", entry)
+		}
+		start, err := parseTimeOfDay(startString)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(endString)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := parseRate(limitString)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, bandwidthWindow{start, end, limit})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, errors.New("invalid time of day " + s + ", expected HH:MM")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Applies the download rate for the current time of day and keeps it
+// updated in the background as windows start and end. Times outside of
+// every window are unlimited.
+func startBandwidthSchedule(schedule string) {
+	windows, err := parseBandwidthSchedule(schedule)
+	if err != nil {
+		fatal("Failed to parse bandwidth schedule: ", err.Error())
+	}
+	apply := func() {
+		now := time.Now()
+		minute := now.Hour()*60 + now.Minute()
+		for _, w := range windows {
+			if w.contains(minute) {
+				setDownloadRate(w.limit)
+				return
+			}
+		}
+		setDownloadRate(rate.Inf)
+	}
+	apply()
+	go func() {
+		for range time.Tick(time.Minute) {
+			apply()
+		}
+	}()
+}
@@ -0,0 +1,73 @@
+package fastar
+
+import (
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]rate.Limit{
+		"500":       500,
+		"500K":      500e3,
+		"200MB/s":   200e6,
+		"1.5G":      1.5e9,
+		"unlimited": rate.Inf,
+	}
+	for input, expected := range cases {
+		if actual, err := parseRate(input); err != nil || actual != expected {
+			t.Fatalf("parseRate(%q) got %v, %v, wanted %v", input, actual, err, expected)
+		}
+	}
+	for _, input := range []string{"", "fast", "-5M", "0"} {
+		if _, err := parseRate(input); err == nil {
+			t.Fatalf("parseRate(%q) should have failed", input)
+		}
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	windows, err := parseBandwidthSchedule("09:00-18:00=200MB/s,18:00-09:00=unlimited")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(windows) != 2 {
+		t.Fatalf("Got %d windows, wanted 2", len(windows))
+	}
+	if !windows[0].contains(9*60) || windows[0].contains(18*60) || windows[0].contains(3*60) {
+		t.Fatalf("Business hours window matched wrong times")
+	}
+	if !windows[1].contains(18*60) || !windows[1].contains(3*60) || windows[1].contains(12*60) {
+		t.Fatalf("Overnight window matched wrong times")
+	}
+	if windows[0].limit != 200e6 || windows[1].limit != rate.Inf {
+		t.Fatalf("Got limits %v and %v", windows[0].limit, windows[1].limit)
+	}
+	if _, err := parseBandwidthSchedule("09:00=1M"); err == nil {
+		t.Fatalf("Schedule without a time range should have failed")
+	}
+}
+
+func TestMaxRate(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; setupMaxRate() }()
+	opts.MaxRate = "500M"
+	setupMaxRate()
+	if limit := downloadLimiter.Limit(); limit != 500e6 {
+		t.Fatalf("Got limit %v, wanted 500MBps", limit)
+	}
+	// Schedule windows are capped but can go lower.
+	setDownloadRate(1e9)
+	if limit := downloadLimiter.Limit(); limit != 500e6 {
+		t.Fatalf("Got limit %v, wanted 500MBps", limit)
+	}
+	setDownloadRate(100e6)
+	if limit := downloadLimiter.Limit(); limit != 100e6 {
+		t.Fatalf("Got limit %v, wanted 100MBps", limit)
+	}
+	opts.MaxRate = ""
+	setupMaxRate()
+	if limit := downloadLimiter.Limit(); limit != rate.Inf {
+		t.Fatalf("Got limit %v, wanted unlimited", limit)
+	}
+}
@@ -1,12 +1,15 @@
-package main
+package fastar
 
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"mime/multipart"
+	"strings"
+	"sync"
 )
 
 // Helper struct to abstract away the complexity of single vs multi part
@@ -25,8 +28,15 @@ type Reader struct {
 	Chunk                        io.ReadCloser
 	MultipartReader              *multipart.Reader
 	MultipartChunk               *multipart.Part
+	// MultipartChunk trimmed to the chunk's range.
+	partReader io.Reader
+	// Set by Abort() from another goroutine, guards Chunk against it.
+	abortMutex sync.Mutex
+	aborted    bool
 }
 
+var errAborted = errors.New("download aborted")
+
 func NewReader(size, start, chunkSize int64, numWorkers int, supportsMultipart bool, downloader Downloader) *Reader {
 	r := &Reader{
 		Start:             start,
@@ -58,24 +68,90 @@ func (r *Reader) AdvanceNextChunk() {
 }
 
 func (r *Reader) RequestChunk() {
+	end := min(r.CurChunkStart+r.ChunkSize, r.Size)
 	if r.UseMultipart() {
-		if multiChunk, err := r.MultipartReader.NextPart(); err == nil {
-			r.MultipartChunk = multiChunk
-		} else {
-			log.Fatal("Error getting next multipart chunk:", err.Error())
+		multiChunk, err := r.MultipartReader.NextPart()
+		if err != nil {
+			fatal("Error getting next multipart chunk:", err.Error())
 		}
-	} else {
-		r.Chunk = r.Downloader.GetRange(r.CurPos, min(r.CurChunkStart+r.ChunkSize, r.Size))
+		r.MultipartChunk = multiChunk
+		if r.partReader, err = alignPart(multiChunk, r.CurPos, end); err == nil {
+			return
+		}
+		// Parts are consumed in order, so once one is off the rest of the
+		// response can't be trusted either.
+		log.Printf("Misordered multipart response (%s), falling back to single range requests\n", err.Error())
+		emitEvent("multipart_fallback", map[string]interface{}{"offset": r.CurPos, "reason": err.Error()})
+		multiChunk.Close()
+		r.SupportsMultipart = false
+		r.MultipartReader = nil
+	}
+	chunk := r.Downloader.GetRange(r.CurPos, end)
+	r.abortMutex.Lock()
+	defer r.abortMutex.Unlock()
+	if r.aborted {
+		chunk.Close()
+	}
+	r.Chunk = chunk
+}
+
+// Checks the Content-Range of a multipart response part against the range
+// [start, end) it's expected to hold. A part covering more, e.g. because
+// the server merged adjacent ranges, is trimmed to it. Parts without a
+// Content-Range can only be taken on faith.
+func alignPart(part *multipart.Part, start, end int64) (io.Reader, error) {
+	contentRange := part.Header.Get("Content-Range")
+	if contentRange == "" {
+		return part, nil
+	}
+	partStart, partEnd, err := parseContentRange(contentRange)
+	if err != nil {
+		return nil, err
+	}
+	if partStart > start || partEnd < end {
+		return nil, fmt.Errorf("part has bytes %d-%d, expected %d-%d", partStart, partEnd-1, start, end-1)
+	}
+	if _, err := io.CopyN(io.Discard, part, start-partStart); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(part, end-start), nil
+}
+
+// Parses "bytes first-last/size" into the range [first, last+1).
+func parseContentRange(contentRange string) (int64, int64, error) {
+	var first, last int64
+	spec, _, _ := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "/")
+	if _, err := fmt.Sscanf(spec, "%d-%d", &first, &last); err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+	return first, last + 1, nil
+}
+
+// Fails every Read from now on. The body of a single range request in
+// flight is closed so a Read blocked on it returns right away, a multipart
+// one fails its next Read.
+func (r *Reader) Abort() {
+	r.abortMutex.Lock()
+	defer r.abortMutex.Unlock()
+	r.aborted = true
+	if r.Chunk != nil {
+		r.Chunk.Close()
 	}
 }
 
 func (r *Reader) Read(d []byte) (int, error) {
+	r.abortMutex.Lock()
+	aborted := r.aborted
+	r.abortMutex.Unlock()
+	if aborted {
+		return 0, errAborted
+	}
 	if flag.Lookup("test.v") != nil && rand.Intn(100) < 95 {
 		// We're running as part of a unit test, randomly fail read calls 95% of the time
 		return 0, errors.New("forced read fail for testing")
 	}
 	if r.UseMultipart() {
-		return r.MultipartChunk.Read(d)
+		return r.partReader.Read(d)
 	} else {
 		return r.Chunk.Read(d)
 	}
@@ -116,7 +192,7 @@ func getMultipartReader(
 	}
 	var reader, err = (downloader).GetRanges(ranges)
 	if err != nil {
-		log.Fatal("Failed to get ranges from file:", err.Error())
+		fatal("Failed to get ranges from file:", err.Error())
 	}
 	return reader
 }
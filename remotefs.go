@@ -0,0 +1,316 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Read buffer used when streaming individual files out of a RemoteTarFS.
+// Each buffer fill is a single ranged request so this shouldn't be tiny.
+const remoteFsReadSize = 4 << 20
+
+// io.ReaderAt over a remote object, each call is served by a single
+// ranged request.
+type rangeReaderAt struct {
+	downloader Downloader
+	size       int64
+	// Set when the reader belongs to a RemoteTarFS from NewRemoteTarFS,
+	// every request is then a library call of its own.
+	ctx     context.Context
+	options *Options
+}
+
+func (r rangeReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if r.options == nil {
+		return r.readAt(p, off)
+	}
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := beginCall(*r.options); err != nil {
+		return 0, err
+	}
+	defer endCall()
+	runOwned(func() { n, err = r.readAt(p, off) })
+	if failure := callError(); failure != nil {
+		return 0, failure
+	}
+	return n, err
+}
+
+func (r rangeReaderAt) readAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), r.size)
+	body := r.downloader.GetRange(off, end)
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:end-off])
+	if err == nil && end-off < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Where a single archive member lives inside the remote tarball. Entries
+// indexed from an eStargz or zstd:chunked TOC have their compressed chunks
+// instead of an offset.
+type remoteTarEntry struct {
+	header *tar.Header
+	offset int64
+	chunks []tocChunk
+}
+
+// RemoteTarFS is an fs.FS over a remote, uncompressed tarball.
+//
+// NewRemoteTarFS() builds an index of the archive by walking its headers
+// with small ranged requests, seeking over file contents. After that,
+// opening a file only downloads that file's byte range, so single files
+// can be pulled out of huge archives cheaply. Compressed archives can't be
+// indexed this way since they don't support random access, except for
+// eStargz and zstd:chunked layers which carry their own index (see
+// estargz.go).
+type RemoteTarFS struct {
+	reader rangeReaderAt
+	// Decompresses a single chunk of a TOC indexed archive.
+	decompress func(compressed []byte) (io.Reader, error)
+	entries    map[string]remoteTarEntry
+	// Children of every directory, including ones only implied by the
+	// paths of their contents.
+	dirs map[string][]string
+}
+
+// NewRemoteTarFS indexes the tarball at url with options, reading files from
+// the returned FS makes more requests with the same options until ctx is
+// done. Failures come back as an *Error, like those of Download.
+func NewRemoteTarFS(ctx context.Context, url string, options Options) (*RemoteTarFS, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := beginCall(options); err != nil {
+		return nil, err
+	}
+	defer endCall()
+	var fsys *RemoteTarFS
+	var err error
+	runOwned(func() {
+		downloader := getDownloader(url, opts.UseFips, opts.UseGetForSize)
+		size, supportsRange, _ := downloader.GetFileInfo()
+		fsys, err = newRemoteTarFS(rangeReaderAt{downloader, size, ctx, &options}, supportsRange)
+	})
+	if failure := callError(); failure != nil {
+		return nil, failure
+	}
+	return fsys, err
+}
+
+func newRemoteTarFS(reader rangeReaderAt, supportsRange bool) (*RemoteTarFS, error) {
+	size := reader.size
+	if size < 0 {
+		return nil, errors.New("remote archive doesn't report its size")
+	} else if !supportsRange && size > 0 {
+		return nil, errors.New("remote archive doesn't support RANGE requests")
+	}
+	fsys := &RemoteTarFS{
+		reader:  reader,
+		entries: map[string]remoteTarEntry{},
+		dirs:    map[string][]string{".": nil},
+	}
+	if found, err := fsys.indexFromToc(); found || err != nil {
+		return fsys, err
+	}
+	// tar.Reader uses Seek() to skip over file contents, so only header
+	// blocks actually get downloaded here.
+	section := io.NewSectionReader(fsys.reader, 0, size)
+	tarReader := tar.NewReader(section)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if name == "." || !fs.ValidPath(name) {
+			continue
+		}
+		offset, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeLink {
+			// Hard links are just another name for the data of an earlier
+			// entry, so index them as a copy of it.
+			target, ok := fsys.entries[path.Clean(strings.TrimPrefix(header.Linkname, "/"))]
+			if !ok {
+				continue
+			}
+			linkHeader := *target.header
+			linkHeader.Name = header.Name
+			header, offset = &linkHeader, target.offset
+		}
+		fsys.addEntry(name, remoteTarEntry{header: header, offset: offset})
+	}
+	fsys.sortDirs()
+	return fsys, nil
+}
+
+func (fsys *RemoteTarFS) addEntry(name string, entry remoteTarEntry) {
+	_, isEntry := fsys.entries[name]
+	_, isDir := fsys.dirs[name]
+	if !isEntry && !isDir {
+		fsys.addToParent(name)
+	}
+	// Later entries override earlier ones, same as extracting would.
+	fsys.entries[name] = entry
+	if entry.header.Typeflag == tar.TypeDir {
+		if _, ok := fsys.dirs[name]; !ok {
+			fsys.dirs[name] = nil
+		}
+	}
+}
+
+func (fsys *RemoteTarFS) sortDirs() {
+	for _, children := range fsys.dirs {
+		sort.Strings(children)
+	}
+}
+
+// Registers name as a child of its parent dir, creating any implied parent
+// dirs along the way.
+func (fsys *RemoteTarFS) addToParent(name string) {
+	for name != "." {
+		parent := path.Dir(name)
+		_, parentKnown := fsys.dirs[parent]
+		fsys.dirs[parent] = append(fsys.dirs[parent], path.Base(name))
+		if parentKnown {
+			return
+		}
+		name = parent
+	}
+}
+
+func (fsys *RemoteTarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	resolved, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if children, ok := fsys.dirs[resolved]; ok {
+		return &remoteTarDir{fsys: fsys, name: resolved, children: children}, nil
+	}
+	entry := fsys.entries[resolved]
+	if entry.header.Typeflag != tar.TypeReg && entry.header.Typeflag != tar.TypeRegA {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("not a regular file")}
+	}
+	var section *io.SectionReader
+	if entry.chunks != nil {
+		section = io.NewSectionReader(&tocFile{fsys: fsys, chunks: entry.chunks, size: entry.header.Size}, 0, entry.header.Size)
+	} else {
+		section = io.NewSectionReader(fsys.reader, entry.offset, entry.header.Size)
+	}
+	return &remoteTarFile{
+		info:    entry.header.FileInfo(),
+		section: section,
+		reader:  bufio.NewReaderSize(section, int(min(entry.header.Size, remoteFsReadSize))),
+	}, nil
+}
+
+// Follows symlinks within the archive to the entry they point at.
+func (fsys *RemoteTarFS) resolve(name string) (string, error) {
+	for hops := 0; hops < 40; hops++ {
+		if _, ok := fsys.dirs[name]; ok {
+			return name, nil
+		}
+		entry, ok := fsys.entries[name]
+		if !ok {
+			return "", fs.ErrNotExist
+		}
+		switch entry.header.Typeflag {
+		case tar.TypeSymlink:
+			target := entry.header.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			name = path.Clean(strings.TrimPrefix(target, "/"))
+		default:
+			return name, nil
+		}
+	}
+	return "", errors.New("too many levels of links")
+}
+
+type remoteTarFile struct {
+	info    fs.FileInfo
+	section *io.SectionReader
+	reader  *bufio.Reader
+}
+
+func (f *remoteTarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *remoteTarFile) Read(p []byte) (int, error) { return f.reader.Read(p) }
+func (f *remoteTarFile) Close() error               { return nil }
+
+func (f *remoteTarFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.section.ReadAt(p, off)
+}
+
+type remoteTarDir struct {
+	fsys     *RemoteTarFS
+	name     string
+	children []string
+	offset   int
+}
+
+func (d *remoteTarDir) Stat() (fs.FileInfo, error) {
+	if entry, ok := d.fsys.entries[d.name]; ok && entry.header.Typeflag == tar.TypeDir {
+		return entry.header.FileInfo(), nil
+	}
+	return impliedDirInfo(path.Base(d.name)), nil
+}
+
+func (d *remoteTarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *remoteTarDir) Close() error { return nil }
+
+func (d *remoteTarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.children[d.offset:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(remaining) {
+		remaining = remaining[:n]
+	}
+	entries := make([]fs.DirEntry, 0, len(remaining))
+	for _, child := range remaining {
+		childPath := path.Join(d.name, child)
+		if entry, ok := d.fsys.entries[childPath]; ok {
+			entries = append(entries, fs.FileInfoToDirEntry(entry.header.FileInfo()))
+		} else {
+			entries = append(entries, fs.FileInfoToDirEntry(impliedDirInfo(child)))
+		}
+	}
+	d.offset += len(remaining)
+	return entries, nil
+}
+
+// FileInfo for directories that have no entry of their own in the archive.
+type impliedDirInfo string
+
+func (i impliedDirInfo) Name() string       { return string(i) }
+func (i impliedDirInfo) Size() int64        { return 0 }
+func (i impliedDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (i impliedDirInfo) ModTime() time.Time { return time.Time{} }
+func (i impliedDirInfo) IsDir() bool        { return true }
+func (i impliedDirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,130 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestRemoteTarFS(t *testing.T) {
+	files := map[string]string{
+		"a/b/c.txt":     "hello",
+		"a/d.txt":       RandomString(10000),
+		"top.txt":       "",
+		"implied/x.txt": "x",
+	}
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	writer.WriteHeader(&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, data := range files {
+		writer.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+		writer.Write([]byte(data))
+	}
+	writer.WriteHeader(&tar.Header{Name: "link.txt", Typeflag: tar.TypeLink, Linkname: "a/b/c.txt"})
+	writer.Close()
+
+	fsys, err := openTestRemoteTarFS(TestDownloader{buf.String(), true, false})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for name, expected := range files {
+		if actual, err := fs.ReadFile(fsys, name); err != nil || string(actual) != expected {
+			t.Fatalf("ReadFile(%s) got %q, %v", name, actual, err)
+		}
+	}
+	if actual, err := fs.ReadFile(fsys, "link.txt"); err != nil || string(actual) != "hello" {
+		t.Fatalf("ReadFile(link.txt) got %q, %v", actual, err)
+	}
+	if _, err := fsys.Open("missing.txt"); err == nil {
+		t.Fatalf("Opening missing file should fail")
+	}
+	file, _ := fsys.Open("a/d.txt")
+	part := make([]byte, 10)
+	if _, err := file.(io.ReaderAt).ReadAt(part, 500); err != nil || string(part) != files["a/d.txt"][500:510] {
+		t.Fatalf("ReadAt got %q, %v", part, err)
+	}
+	if err := fstest.TestFS(fsys, "a/b/c.txt", "a/d.txt", "top.txt", "implied/x.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteTarFSOverHttp(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	options.RetryCount = 1
+	options.ChunkSize = 1
+
+	// Files no bigger than a chunk are never treated as supporting ranges.
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	data := RandomString(2 << 20)
+	writer.WriteHeader(&tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+	writer.Write([]byte(data))
+	writer.Close()
+	var failRanges, ignoreRanges atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" && failRanges.Load() {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		if ignoreRanges.Load() {
+			w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
+			w.Write(buf.Bytes())
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fsys, err := NewRemoteTarFS(ctx, server.URL+"/archive.tar", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := fs.ReadFile(fsys, "dir/file.txt"); err != nil || string(actual) != data {
+		t.Fatalf("ReadFile got %d bytes, %v", len(actual), err)
+	}
+
+	// Failed requests come back as errors instead of exiting.
+	failRanges.Store(true)
+	var fastarErr *Error
+	if _, err := fs.ReadFile(fsys, "dir/file.txt"); !errors.As(err, &fastarErr) || !errors.Is(err, ErrNetwork) {
+		t.Fatalf("Expected a failing range request to return a network *Error, got %v", err)
+	}
+	if _, err := NewRemoteTarFS(ctx, server.URL+"/archive.tar", options); !errors.As(err, &fastarErr) {
+		t.Fatalf("Expected indexing to fail with an *Error, got %v", err)
+	}
+	failRanges.Store(false)
+	if actual, err := fs.ReadFile(fsys, "dir/file.txt"); err != nil || string(actual) != data {
+		t.Fatalf("ReadFile after a failure got %d bytes, %v", len(actual), err)
+	}
+
+	ignoreRanges.Store(true)
+	if _, err := NewRemoteTarFS(ctx, server.URL+"/archive.tar", options); err == nil {
+		t.Fatal("Expected a server without range support to be rejected")
+	}
+	ignoreRanges.Store(false)
+
+	cancel()
+	if _, err := fs.ReadFile(fsys, "dir/file.txt"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected reads to stop once ctx is canceled, got %v", err)
+	}
+}
+
+// Indexes an archive served by a test downloader, without a library call.
+func openTestRemoteTarFS(downloader Downloader) (*RemoteTarFS, error) {
+	size, supportsRange, _ := downloader.GetFileInfo()
+	return newRemoteTarFS(rangeReaderAt{downloader: downloader, size: size}, supportsRange)
+}
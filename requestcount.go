@@ -0,0 +1,104 @@
+package fastar
+
+import (
+	"io"
+	"log"
+	"mime/multipart"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Requests made to each backend by class, summarized at the end of the run
+// so teams can work out what their --chunk-size costs them on backends
+// that bill per request. Retries count as requests too, since they're
+// billed like any other.
+type requestCounts struct {
+	// File metadata lookups. Some backends serve these with a GET.
+	Head atomic.Int64
+	// Whole file downloads.
+	Get atomic.Int64
+	// Single range downloads, one per chunk and retry.
+	RangedGet atomic.Int64
+	// Multipart range downloads, one per worker and retry.
+	MultipartGet atomic.Int64
+}
+
+var (
+	requestCountsMutex sync.Mutex
+	backendRequests    = map[string]*requestCounts{}
+)
+
+// Name requests to rawUrl are accounted under, its URL scheme.
+func backendName(rawUrl string) string {
+	if rawUrl == "-" {
+		return "stdin"
+	}
+	if parsed, err := url.Parse(rawUrl); err == nil && parsed.Scheme != "" {
+		return parsed.Scheme
+	}
+	return "unknown"
+}
+
+// Wraps downloader to count the requests made through it.
+func countRequests(downloader Downloader, backend string) Downloader {
+	requestCountsMutex.Lock()
+	defer requestCountsMutex.Unlock()
+	counts, ok := backendRequests[backend]
+	if !ok {
+		counts = &requestCounts{}
+		backendRequests[backend] = counts
+	}
+	return requestCountingDownloader{downloader, counts}
+}
+
+type requestCountingDownloader struct {
+	downloader Downloader
+	counts     *requestCounts
+}
+
+func (d requestCountingDownloader) GetFileInfo() (int64, bool, bool) {
+	d.counts.Head.Add(1)
+	return d.downloader.GetFileInfo()
+}
+
+func (d requestCountingDownloader) Get() io.ReadCloser {
+	d.counts.Get.Add(1)
+	return d.downloader.Get()
+}
+
+func (d requestCountingDownloader) GetRange(start, end int64) io.ReadCloser {
+	d.counts.RangedGet.Add(1)
+	return d.downloader.GetRange(start, end)
+}
+
+func (d requestCountingDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	d.counts.MultipartGet.Add(1)
+	return d.downloader.GetRanges(ranges)
+}
+
+func logRequestCounts() {
+	requestCountsMutex.Lock()
+	defer requestCountsMutex.Unlock()
+	var backends []string
+	for backend := range backendRequests {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	summary := map[string]interface{}{}
+	for _, backend := range backends {
+		counts := backendRequests[backend]
+		log.Printf("Requests to %s: %d head, %d get, %d ranged get, %d multipart get\n",
+			backend, counts.Head.Load(), counts.Get.Load(), counts.RangedGet.Load(), counts.MultipartGet.Load())
+		summary[backend] = map[string]int64{
+			"head":          counts.Head.Load(),
+			"get":           counts.Get.Load(),
+			"ranged_get":    counts.RangedGet.Load(),
+			"multipart_get": counts.MultipartGet.Load(),
+		}
+	}
+	if len(summary) > 0 {
+		emitEvent("request_counts", summary)
+	}
+}
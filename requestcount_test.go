@@ -0,0 +1,31 @@
+package fastar
+
+import (
+	"context"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestCountRequests(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; backendRequests = map[string]*requestCounts{} }()
+	opts.RetryCount = math.MaxInt64
+	backendRequests = map[string]*requestCounts{}
+
+	data := RandomString(1000)
+	downloader := countRequests(TestDownloader{data, true, false}, backendName("s3://bucket/key"))
+	if _, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4)); err != nil {
+		t.Fatal(err)
+	}
+	counts := backendRequests["s3"]
+	// Every chunk takes at least one ranged GET, retries of the randomly
+	// failing test reads take more.
+	if counts.Head.Load() != 1 || counts.Get.Load() != 0 || counts.RangedGet.Load() < 10 || counts.MultipartGet.Load() != 0 {
+		t.Fatalf("Got %d head, %d get, %d ranged get, %d multipart get", counts.Head.Load(), counts.Get.Load(), counts.RangedGet.Load(), counts.MultipartGet.Load())
+	}
+	if backend := backendName("-"); backend != "stdin" {
+		t.Fatalf("Got backend %s for stdin", backend)
+	}
+	logRequestCounts()
+}
@@ -0,0 +1,196 @@
+package fastar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const resumeStateFile = ".fastar-state"
+
+// Journal of an extraction (--resume), kept in OUTPUTDIR/.fastar-state so a
+// killed fastar can pick up where it left off:
+//
+//	fastar-state 1 <size> <url>
+//	layers tar
+//	done "dir/file"
+//	checkpoint 1048576
+//
+// Entries are marked done once they're on disk, and are skipped when the
+// archive is read again. A checkpoint is an offset in the tar stream that
+// every entry before it has been written out by. For raw tarballs on
+// sources with range support the download restarts at the last
+// checkpoint. Compressed streams can't be entered mid way, so they're read
+// from the start again but nothing already extracted is rewritten.
+//
+// The journal is removed once the extraction completes.
+type resumeJournal struct {
+	mutex sync.Mutex
+	file  *os.File
+	// State from the interrupted run.
+	resumed    bool
+	done       map[string]bool
+	checkpoint int64
+	layers     string
+	// Offset in the tar stream the download restarted at.
+	base int64
+	// Start offsets of the entries currently being written.
+	pending    map[int64]bool
+	lastStart  int64
+	lastLogged int64
+}
+
+var journal *resumeJournal
+
+// Loads the journal left by an earlier run from the same source, or starts
+// a new one if there's none or it's for something else.
+func openResumeJournal(rawUrl string, downloader Downloader) {
+	size, _, _ := downloader.GetFileInfo()
+	statePath := filepath.Join(opts.OutputDir, resumeStateFile)
+	header := fmt.Sprintf("fastar-state 1 %d %s", size, rawUrl)
+	journal = &resumeJournal{done: map[string]bool{}, pending: map[int64]bool{}}
+
+	if file, err := os.Open(statePath); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<20)
+		if scanner.Scan() && scanner.Text() == header {
+			journal.resumed = true
+			for scanner.Scan() {
+				kind, value, _ := strings.Cut(scanner.Text(), " ")
+				switch kind {
+				case "layers":
+					journal.layers = value
+				case "done":
+					// A line cut short by the kill is simply ignored.
+					if name, err := strconv.Unquote(value); err == nil {
+						journal.done[name] = true
+					}
+				case "checkpoint":
+					if offset, err := strconv.ParseInt(value, 10, 64); err == nil {
+						journal.checkpoint = offset
+					}
+				}
+			}
+			journal.lastLogged = journal.checkpoint
+			log.Printf("Resuming extraction, %d entries were already extracted\n", len(journal.done))
+		} else {
+			log.Println("Ignoring resume state of a different source in", statePath)
+		}
+		file.Close()
+	}
+
+	if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
+		fatal("Failed to create output directory: ", err.Error())
+	}
+	file, err := os.OpenFile(statePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fatal("Failed to open resume state: ", err.Error())
+	}
+	if !journal.resumed {
+		file.Truncate(0)
+		fmt.Fprintln(file, header)
+	}
+	journal.file = file
+	emitEvent("resume", map[string]interface{}{"path": statePath, "done": len(journal.done), "checkpoint": journal.checkpoint})
+}
+
+// Offset to restart the download at, 0 unless the journal says the archive
+// is a raw tarball and the source can serve it from there.
+func (j *resumeJournal) resumeOffset(downloader Downloader) int64 {
+	if j.checkpoint == 0 {
+		return 0
+	}
+	if j.layers != Tar.String() {
+		log.Println("Archive is compressed, reading it from the start and skipping extracted entries")
+		return 0
+	}
+	if _, ok := downloader.(StreamVerifier); ok {
+		log.Println("Source verifies the whole stream, reading it from the start and skipping extracted entries")
+		return 0
+	}
+	if chunkChecksums != nil {
+		log.Println("Verifying --chunk-checksums, reading from the start and skipping extracted entries")
+		return 0
+	}
+	if _, expected := expectedChecksum(downloader); expected != "" {
+		log.Println("Download has a checksum to verify, reading it from the start and skipping extracted entries")
+		return 0
+	}
+	if _, supportsRange, _ := downloader.GetFileInfo(); !supportsRange {
+		log.Println("Source doesn't support RANGE, reading it from the start and skipping extracted entries")
+		return 0
+	}
+	log.Printf("Resuming download at byte %d\n", j.checkpoint)
+	j.base = j.checkpoint
+	return j.checkpoint
+}
+
+func (j *resumeJournal) recordLayers(layers []string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.layers = strings.Join(layers, ",")
+	fmt.Fprintln(j.file, "layers", j.layers)
+}
+
+// start is the offset of the entry's first header block in the tar stream.
+func (j *resumeJournal) entryStarted(start int64) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.pending[start] = true
+	j.lastStart = start
+}
+
+func (j *resumeJournal) entryFinished(start int64, name string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	delete(j.pending, start)
+	fmt.Fprintln(j.file, "done", strconv.Quote(name))
+	checkpoint := j.lastStart
+	for pendingStart := range j.pending {
+		if pendingStart < checkpoint {
+			checkpoint = pendingStart
+		}
+	}
+	if checkpoint > j.lastLogged {
+		fmt.Fprintln(j.file, "checkpoint", checkpoint)
+		j.lastLogged = checkpoint
+	}
+}
+
+// Everything's extracted, so there's nothing left to resume.
+func (j *resumeJournal) remove() {
+	j.file.Close()
+	os.Remove(j.file.Name())
+}
+
+// Serves a downloader's file from offset onwards, as if it started there.
+type offsetDownloader struct {
+	downloader Downloader
+	offset     int64
+}
+
+func (d offsetDownloader) GetFileInfo() (int64, bool, bool) {
+	size, supportsRange, _ := d.downloader.GetFileInfo()
+	return size - d.offset, supportsRange, false
+}
+
+func (d offsetDownloader) Get() io.ReadCloser {
+	size, _, _ := d.downloader.GetFileInfo()
+	return d.downloader.GetRange(d.offset, size)
+}
+
+func (d offsetDownloader) GetRange(start, end int64) io.ReadCloser {
+	return d.downloader.GetRange(start+d.offset, end+d.offset)
+}
+
+func (d offsetDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported when resuming")
+}
@@ -0,0 +1,93 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeJournal(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; journal = nil }()
+	opts.OutputDir = t.TempDir()
+	downloader := TestDownloader{Data: RandomString(100), RangeSupport: true}
+	openResumeJournal("s3://bucket/archive.tar", downloader)
+	journal.recordLayers([]string{"tar"})
+	journal.entryStarted(0)
+	journal.entryStarted(1024)
+	journal.entryStarted(2048)
+	// Finishing out of order only moves the checkpoint past entries that
+	// are all on disk.
+	journal.entryFinished(1024, "b")
+	journal.entryFinished(0, "a")
+	journal.entryFinished(2048, "c")
+	journal.file.Close()
+
+	state, _ := os.ReadFile(filepath.Join(opts.OutputDir, resumeStateFile))
+	expected := "fastar-state 1 100 s3://bucket/archive.tar\n" +
+		"layers tar\n" +
+		"done \"b\"\n" +
+		"done \"a\"\n" +
+		"checkpoint 2048\n" +
+		"done \"c\"\n"
+	if string(state) != expected {
+		t.Fatalf("Got journal:\n%s\nwanted:\n%s", state, expected)
+	}
+
+	openResumeJournal("s3://bucket/archive.tar", downloader)
+	if !journal.done["a"] || !journal.done["b"] || !journal.done["c"] || journal.checkpoint != 2048 {
+		t.Fatalf("Journal wasn't loaded: %v %d", journal.done, journal.checkpoint)
+	}
+	journal.file.Close()
+	openResumeJournal("s3://bucket/other.tar", downloader)
+	if journal.resumed || len(journal.done) != 0 {
+		t.Fatal("Journal of a different source was loaded")
+	}
+	journal.file.Close()
+}
+
+func TestResumeExtraction(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	contents := map[string]string{"a": RandomString(1000), "b": RandomString(3000), "c": RandomString(2000)}
+	var offsets []int64
+	for _, name := range []string{"a", "b", "c"} {
+		tw.Flush()
+		offsets = append(offsets, int64(archive.Len()))
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents[name]))})
+		tw.Write([]byte(contents[name]))
+	}
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts; journal = nil }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	opts.RetryCount = math.MaxInt64
+	// The previous run extracted a and c, but got killed while writing b.
+	state := fmt.Sprintf("fastar-state 1 %d test.tar\nlayers tar\ndone \"a\"\ncheckpoint %d\ndone \"c\"\n", archive.Len(), offsets[1])
+	os.WriteFile(filepath.Join(opts.OutputDir, resumeStateFile), []byte(state), 0644)
+
+	var downloader Downloader = TestDownloader{Data: archive.String(), RangeSupport: true}
+	openResumeJournal("test.tar", downloader)
+	offset := journal.resumeOffset(downloader)
+	if offset != offsets[1] {
+		t.Fatalf("Resumed at %d, wanted %d", offset, offsets[1])
+	}
+	downloader = offsetDownloader{downloader, offset}
+	ExtractTar(context.Background(), GetDownloadStream(context.Background(), downloader, 1024, 2))
+
+	if extracted, _ := os.ReadFile(filepath.Join(opts.OutputDir, "b")); string(extracted) != contents["b"] {
+		t.Fatal("b wasn't extracted")
+	}
+	for _, name := range []string{"a", "c", resumeStateFile} {
+		if _, err := os.Stat(filepath.Join(opts.OutputDir, name)); err == nil {
+			t.Fatalf("%s shouldn't exist", name)
+		}
+	}
+}
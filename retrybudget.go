@@ -0,0 +1,108 @@
+package fastar
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --retry-count bounds the attempts at a single chunk or request, so with
+// the origin down every worker would work through all of its own before the
+// transfer fails. Failed attempts are also counted across workers: the
+// circuit breaker (--circuit-breaker) trips after that many in a row with
+// none succeeding in between, and --retry-budget caps them over the whole
+// transfer, each finished chunk earning one back. Either fails the transfer
+// right away with a summary of what kept failing.
+var retryBudget struct {
+	mutex sync.Mutex
+	// Failed attempts the budget has left, unused without --retry-budget.
+	tokens int
+	// Failed attempts since the last success, by reason.
+	consecutive int
+	reasons     map[string]int
+	tripped     *Error
+}
+
+// Resets the budget for a new transfer.
+func setupRetryBudget() {
+	retryBudget.mutex.Lock()
+	defer retryBudget.mutex.Unlock()
+	retryBudget.tokens = opts.RetryBudget
+	retryBudget.consecutive = 0
+	retryBudget.reasons = map[string]int{}
+	retryBudget.tripped = nil
+}
+
+// Counts a failed attempt, returning the error to fail the transfer with
+// once the circuit breaker trips or the budget runs out, and from then on.
+func attemptFailed(reason string) *Error {
+	retryBudget.mutex.Lock()
+	defer retryBudget.mutex.Unlock()
+	if retryBudget.tripped != nil {
+		return retryBudget.tripped
+	}
+	if retryBudget.reasons == nil {
+		retryBudget.reasons = map[string]int{}
+	}
+	retryBudget.consecutive++
+	retryBudget.reasons[reason]++
+	retryBudget.tokens--
+	var message string
+	if opts.CircuitBreaker > 0 && retryBudget.consecutive >= opts.CircuitBreaker {
+		message = fmt.Sprintf("Circuit breaker tripped: %d attempts in a row failed across all workers, the source looks down", retryBudget.consecutive)
+	} else if opts.RetryBudget > 0 && retryBudget.tokens < 0 {
+		message = fmt.Sprintf("Retry budget of %d failed attempts used up", opts.RetryBudget)
+	} else {
+		return nil
+	}
+	message += " (" + summarizeReasons(retryBudget.reasons) + ")"
+	log.Println(message)
+	emitEvent("circuit_open", map[string]interface{}{"failures": retryBudget.consecutive, "reasons": retryBudget.reasons})
+	retryBudget.tripped = &Error{int(ErrNetwork), message}
+	return retryBudget.tripped
+}
+
+// Counts a successful attempt, closing the streak of failures and earning
+// back one failed attempt of --retry-budget.
+func attemptSucceeded() {
+	retryBudget.mutex.Lock()
+	defer retryBudget.mutex.Unlock()
+	retryBudget.consecutive = 0
+	retryBudget.reasons = map[string]int{}
+	if retryBudget.tokens < opts.RetryBudget {
+		retryBudget.tokens++
+	}
+}
+
+// The error the transfer failed with once the breaker tripped or the
+// budget ran out, nil before.
+func retryBudgetTripped() *Error {
+	retryBudget.mutex.Lock()
+	defer retryBudget.mutex.Unlock()
+	return retryBudget.tripped
+}
+
+// The three most common reasons, e.g. "12x connection refused, 4x too slow".
+func summarizeReasons(reasons map[string]int) string {
+	names := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		names = append(names, reason)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if reasons[names[i]] != reasons[names[j]] {
+			return reasons[names[i]] > reasons[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var summary []string
+	for i, reason := range names {
+		if i == 3 {
+			summary = append(summary, fmt.Sprintf("%d other reasons", len(names)-3))
+			break
+		}
+		summary = append(summary, fmt.Sprintf("%dx %s", reasons[reason], reason))
+	}
+	return strings.Join(summary, ", ")
+}
@@ -0,0 +1,85 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; setupRetryBudget() }()
+	opts.CircuitBreaker = 3
+	setupRetryBudget()
+
+	// Successes in between keep it closed.
+	for i := 0; i < 10; i++ {
+		if attemptFailed("connection reset") != nil || attemptFailed("too slow") != nil {
+			t.Fatal("Expected the breaker to stay closed")
+		}
+		attemptSucceeded()
+	}
+	attemptFailed("connection refused")
+	attemptFailed("connection refused")
+	tripped := attemptFailed("status 502")
+	if tripped == nil || !errors.Is(tripped, ErrNetwork) || !strings.HasSuffix(tripped.Message, "(2x connection refused, 1x status 502)") {
+		t.Fatalf("Expected the breaker to trip with a summary, got %v", tripped)
+	}
+	attemptSucceeded()
+	if attemptFailed("connection refused") != tripped || retryBudgetTripped() != tripped {
+		t.Fatal("Expected the breaker to stay open")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; setupRetryBudget() }()
+	opts.RetryBudget = 2
+	setupRetryBudget()
+
+	attemptFailed("too slow")
+	attemptFailed("too slow")
+	// A finished chunk earns one back.
+	attemptSucceeded()
+	if attemptFailed("too slow") != nil {
+		t.Fatal("Expected the budget to have one failure left")
+	}
+	if tripped := attemptFailed("too slow"); tripped == nil || tripped.Message != "Retry budget of 2 failed attempts used up (2x too slow)" {
+		t.Fatalf("Expected the budget to run out, got %v", tripped)
+	}
+}
+
+// A source that's down, every range request failing.
+type downDownloader struct {
+	TestDownloader
+}
+
+func (downDownloader) GetRange(start, end int64) io.ReadCloser {
+	return io.NopCloser(errorReader{errors.New("connection refused")})
+}
+
+func TestCircuitBreakerStopsDownload(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; setupRetryBudget() }()
+	opts.RetryCount = 1000000
+	opts.CircuitBreaker = 20
+	setupRetryBudget()
+
+	result := make(chan error)
+	go func() {
+		_, err := io.ReadAll(GetDownloadStream(context.Background(), downDownloader{TestDownloader{RandomString(10000), true, false}}, 100, 4))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		var fastarErr *Error
+		if !errors.As(err, &fastarErr) || !strings.HasPrefix(fastarErr.Message, "Circuit breaker tripped: 20 attempts in a row failed") {
+			t.Fatalf("Expected the circuit breaker to fail the download, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download didn't stop once the circuit breaker tripped")
+	}
+}
@@ -0,0 +1,115 @@
+package fastar
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go"
+)
+
+// Longest Retry-After honored, so a misconfigured server can't park the
+// download for hours. Longer hints wait this long.
+const maxRetryAfter = 10 * time.Minute
+
+// Status code ranges from --retry-on, inclusive. Empty retries every
+// non-2xx response but 404.
+var retryOnStatuses [][2]int
+
+// Parses --retry-on.
+func setupRetryPolicy() {
+	retryOnStatuses = nil
+	for _, spec := range opts.RetryOn {
+		statuses, err := parseStatusRanges(spec)
+		if err != nil {
+			fatal("Failed to parse --retry-on: ", err.Error())
+		}
+		retryOnStatuses = append(retryOnStatuses, statuses...)
+	}
+	setupRetryBudget()
+}
+
+// Parses comma separated status codes like "429,500-504,5xx" into
+// inclusive ranges.
+func parseStatusRanges(spec string) ([][2]int, error) {
+	var statuses [][2]int
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		var first, last int
+		var err error
+		if class := strings.TrimSuffix(strings.ToLower(field), "xx"); len(field) == 3 && len(class) == 1 {
+			first, err = strconv.Atoi(class)
+			first *= 100
+			last = first + 99
+		} else if from, to, ok := strings.Cut(field, "-"); ok {
+			if first, err = strconv.Atoi(from); err == nil {
+				last, err = strconv.Atoi(to)
+			}
+		} else {
+			first, err = strconv.Atoi(field)
+			last = first
+		}
+		if err != nil || first < 100 || last > 599 || last < first {
+			return nil, fmt.Errorf("invalid status code %q", field)
+		}
+		statuses = append(statuses, [2]int{first, last})
+	}
+	return statuses, nil
+}
+
+func retryableStatus(status int) bool {
+	if len(retryOnStatuses) == 0 {
+		return status != http.StatusNotFound
+	}
+	for _, statuses := range retryOnStatuses {
+		if status >= statuses[0] && status <= statuses[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// An error for a response that told how long to wait before trying again.
+type retryAfterError struct {
+	error
+	wait time.Duration
+}
+
+// Returns how long a 429 or 503 response asks to wait before the next
+// request, as delay seconds or an HTTP date, or 0 without a valid hint.
+func retryAfter(resp *http.Response) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
+	}
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+// Backs off exponentially from --retry-wait up to --max-wait, unless the
+// server said how long to wait.
+func retryDelay(n uint, err error, config *retry.Config) time.Duration {
+	var hinted retryAfterError
+	if errors.As(err, &hinted) && hinted.wait > 0 {
+		return hinted.wait
+	}
+	delay := retry.BackOffDelay(n, err, config)
+	if maxWait := time.Second * time.Duration(opts.MaxWait); delay > maxWait {
+		return maxWait
+	}
+	return delay
+}
@@ -0,0 +1,94 @@
+package fastar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	statuses, err := parseStatusRanges("429, 500-504,5xx")
+	if err != nil || !reflect.DeepEqual(statuses, [][2]int{{429, 429}, {500, 504}, {500, 599}}) {
+		t.Fatalf("Got %v, %v", statuses, err)
+	}
+	for _, spec := range []string{"", "abc", "504-500", "7xx", "42"} {
+		if _, err := parseStatusRanges(spec); err == nil {
+			t.Fatalf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for header, expected := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"86400":                         maxRetryAfter,
+		"soon":                          0,
+		"Wed, 21 Oct 2015 07:28:00 GMT": 0,
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": {header}}}
+		if wait := retryAfter(resp); wait != expected {
+			t.Fatalf("Retry-After %q: got %s, wanted %s", header, wait, expected)
+		}
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if wait := retryAfter(&http.Response{Header: http.Header{"Retry-After": {date}}}); wait < 50*time.Second || wait > time.Minute {
+		t.Fatalf("Retry-After %q: got %s", date, wait)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	options.RetryWait = 0
+	data := []byte(RandomString(1000))
+
+	var requests atomic.Int64
+	throttling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first response fails the HEAD, the second the retry of it.
+		if requests.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer throttling.Close()
+	start := time.Now()
+	stream, err := Download(context.Background(), throttling.URL, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := io.ReadAll(stream)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("Downloaded %d bytes, %v", len(downloaded), err)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatalf("Expected the retry to wait out Retry-After, took %s", time.Since(start))
+	}
+
+	requests.Store(0)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	options.RetryOn = []string{"429,503"}
+	if stream, err = Download(context.Background(), failing.URL, options); err == nil {
+		_, err = io.ReadAll(stream)
+	}
+	var fastarErr *Error
+	// The HEAD and a single retry of it.
+	if !errors.As(err, &fastarErr) || requests.Load() != 2 {
+		t.Fatalf("Expected a 500 to fail without retrying, got %v after %d requests", err, requests.Load())
+	}
+}
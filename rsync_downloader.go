@@ -0,0 +1,609 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	defaultRsyncPort = "873"
+	// Protocol 29 is the newest version without varint encoding, negotiated
+	// checksums or multiplexing in both directions, and rsync daemons still
+	// accept clients speaking it.
+	rsyncProtocol       = 29
+	rsyncMplexBase      = 7
+	rsyncMsgData        = 0
+	rsyncMsgErrorXfer   = 1
+	rsyncMsgInfo        = 2
+	rsyncMsgError       = 3
+	rsyncMsgWarning     = 4
+	rsyncItemTransfer   = 1 << 15
+	rsyncItemBasisType  = 1 << 11
+	rsyncItemXname      = 1 << 12
+	rsyncMinBlockLength = 700
+	rsyncMaxBlockLength = 8192
+	rsyncMaxLiteral     = 1 << 24
+)
+
+// File list entry flags.
+const (
+	rsyncXmitExtendedFlags = 1 << 2
+	rsyncXmitSameMode      = 1 << 1
+	rsyncXmitSameName      = 1 << 5
+	rsyncXmitLongName      = 1 << 6
+	rsyncXmitSameTime      = 1 << 7
+)
+
+// Downloads a single file from an rsync daemon, handles
+// rsync://[user@]host[:port]/module/path URLs.
+//
+// rsync transfers are a single stream, so there are no parallel workers. In
+// exchange, if --rsync-basis points at an older local copy of the file, its
+// block checksums are sent to the server and only the parts that changed
+// are downloaded, the rest is copied out of the local copy as the stream is
+// read. The rebuilt file is checked against the server's whole file
+// checksum.
+//
+// Modules requiring authentication use the user from the URL (or $USER) and
+// the password in $RSYNC_PASSWORD, like the rsync client.
+type RsyncDownloader struct {
+	Url  string
+	conn *rsyncConn
+	size int64
+}
+
+func NewRsyncDownloader(rawUrl string) RsyncDownloader {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		fatal("Failed to parse rsync url: ", err.Error())
+	}
+	parts := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		fatal("rsync url must be of the form rsync://[user@]host[:port]/module/path")
+	}
+	user := os.Getenv("USER")
+	if parsed.User != nil {
+		user = parsed.User.Username()
+	}
+
+	host := parsed.Host
+	if parsed.Port() == "" {
+		host = net.JoinHostPort(parsed.Hostname(), defaultRsyncPort)
+	}
+	netConn, err := dial("tcp", host)
+	if err != nil {
+		fatal("Failed to connect to rsync daemon: ", err.Error())
+	}
+	conn := newRsyncConn(netConn)
+	size, err := conn.open(parts[0], parts[1], user, os.Getenv("RSYNC_PASSWORD"))
+	handleRsyncError(err)
+	return RsyncDownloader{rawUrl, conn, size}
+}
+
+func (rsyncDownloader RsyncDownloader) GetFileInfo() (int64, bool, bool) {
+	return rsyncDownloader.size, false, false
+}
+
+func (rsyncDownloader RsyncDownloader) Get() io.ReadCloser {
+	var basis io.ReaderAt
+	var basisSize int64
+	if opts.RsyncBasis != "" {
+		file, err := os.Open(opts.RsyncBasis)
+		if err != nil {
+			fatal("Failed to open rsync basis file: ", err.Error())
+		}
+		info, err := file.Stat()
+		if err != nil {
+			fatal("Failed to stat rsync basis file: ", err.Error())
+		}
+		basis, basisSize = file, info.Size()
+		log.Printf("Delta transfer against %s (%d bytes)\n", opts.RsyncBasis, basisSize)
+	}
+	reader, err := rsyncDownloader.conn.request(basis, basisSize)
+	handleRsyncError(err)
+	return reader
+}
+
+func (rsyncDownloader RsyncDownloader) GetRange(start, end int64) io.ReadCloser {
+	fatal("Range requests not supported by rsync")
+	return nil
+}
+
+func (rsyncDownloader RsyncDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported by rsync")
+}
+
+func handleRsyncError(err error) {
+	if err == nil {
+		return
+	}
+	message := err.Error()
+	if strings.Contains(message, "Unknown module") || strings.Contains(message, "No such file") {
+		log.Println("404, rsync file not found:", message)
+		exit(ErrNotFound)
+	} else if strings.Contains(message, "auth failed") || strings.Contains(message, "access denied") {
+		log.Println("rsync authentication failed:", message)
+		exit(ErrPermission)
+	}
+	fatal("rsync transfer failed: ", message)
+}
+
+// Client side of a connection to an rsync daemon, acting as the receiver.
+// Data from the server is multiplexed with log messages once the transfer
+// starts, reads transparently strip those out.
+type rsyncConn struct {
+	conn        net.Conn
+	in          *bufio.Reader
+	out         *bufio.Writer
+	multiplexed bool
+	// Bytes left in the current data frame.
+	pending int
+	seed    uint32
+	// Last error the server sent, used to explain a failed transfer.
+	lastError string
+}
+
+func newRsyncConn(conn net.Conn) *rsyncConn {
+	return &rsyncConn{conn: conn, in: bufio.NewReader(conn), out: bufio.NewWriter(conn)}
+}
+
+func (c *rsyncConn) Read(p []byte) (int, error) {
+	if !c.multiplexed {
+		return c.in.Read(p)
+	}
+	for c.pending == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.in, header[:]); err != nil {
+			if err == io.EOF && c.lastError != "" {
+				return 0, errors.New(c.lastError)
+			}
+			return 0, err
+		}
+		tag := int(header[3]) - rsyncMplexBase
+		length := int(binary.LittleEndian.Uint32(header[:]) & 0xffffff)
+		if tag == rsyncMsgData {
+			c.pending = length
+			continue
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(c.in, message); err != nil {
+			return 0, err
+		}
+		switch tag {
+		case rsyncMsgInfo, rsyncMsgWarning:
+			log.Print("rsync: ", strings.TrimRight(string(message), "\n"))
+		case rsyncMsgError, rsyncMsgErrorXfer:
+			c.lastError = strings.TrimRight(string(message), "\n")
+			log.Print("rsync error: ", c.lastError)
+		}
+	}
+	if len(p) > c.pending {
+		p = p[:c.pending]
+	}
+	n, err := c.in.Read(p)
+	c.pending -= n
+	return n, err
+}
+
+func (c *rsyncConn) readInt() (int32, error) {
+	var buf [4]byte
+	_, err := io.ReadFull(c, buf[:])
+	return int32(binary.LittleEndian.Uint32(buf[:])), err
+}
+
+// 32 bit value, or -1 followed by a 64 bit one.
+func (c *rsyncConn) readLongint() (int64, error) {
+	value, err := c.readInt()
+	if err != nil || value != -1 {
+		return int64(value), err
+	}
+	var buf [8]byte
+	_, err = io.ReadFull(c, buf[:])
+	return int64(binary.LittleEndian.Uint64(buf[:])), err
+}
+
+func (c *rsyncConn) readByte() (byte, error) {
+	var buf [1]byte
+	_, err := io.ReadFull(c, buf[:])
+	return buf[0], err
+}
+
+func (c *rsyncConn) readShort() (uint16, error) {
+	var buf [2]byte
+	_, err := io.ReadFull(c, buf[:])
+	return binary.LittleEndian.Uint16(buf[:]), err
+}
+
+func (c *rsyncConn) writeInt(value int32) {
+	binary.Write(c.out, binary.LittleEndian, value)
+}
+
+func (c *rsyncConn) readLine() (string, error) {
+	line, err := c.in.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// Greets the daemon, selects the module and asks it to send path. Returns
+// the size of the file once the server sent its file list.
+func (c *rsyncConn) open(module, path, user, password string) (int64, error) {
+	fmt.Fprintf(c.out, "@RSYNCD: %d.0\n", rsyncProtocol)
+	if err := c.out.Flush(); err != nil {
+		return 0, err
+	}
+	greeting, err := c.readLine()
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(strings.TrimPrefix(greeting, "@RSYNCD: "))
+	if !strings.HasPrefix(greeting, "@RSYNCD: ") || len(fields) == 0 {
+		return 0, errors.New("unexpected rsync greeting " + greeting)
+	}
+	if version, err := strconv.Atoi(strings.SplitN(fields[0], ".", 2)[0]); err != nil || version < rsyncProtocol {
+		return 0, errors.New("rsync daemon protocol " + fields[0] + " is too old, at least 29 is required")
+	}
+
+	fmt.Fprintf(c.out, "%s\n", module)
+	if err := c.out.Flush(); err != nil {
+		return 0, err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return 0, err
+		}
+		if line == "@RSYNCD: OK" {
+			break
+		} else if strings.HasPrefix(line, "@RSYNCD: AUTHREQD ") {
+			fmt.Fprintf(c.out, "%s %s\n", user, rsyncAuthResponse(password, strings.TrimPrefix(line, "@RSYNCD: AUTHREQD ")))
+			if err := c.out.Flush(); err != nil {
+				return 0, err
+			}
+		} else if strings.HasPrefix(line, "@ERROR") || line == "@RSYNCD: EXIT" {
+			return 0, errors.New(line)
+		} else {
+			// Message of the day.
+			log.Println("rsync:", line)
+		}
+	}
+
+	for _, arg := range []string{"--server", "--sender", "-t", ".", module + "/" + path, ""} {
+		fmt.Fprintf(c.out, "%s\n", arg)
+	}
+	if err := c.out.Flush(); err != nil {
+		return 0, err
+	}
+	seed, err := c.readInt()
+	if err != nil {
+		return 0, err
+	}
+	c.seed = uint32(seed)
+	c.multiplexed = true
+	// Empty filter list.
+	c.writeInt(0)
+	if err := c.out.Flush(); err != nil {
+		return 0, err
+	}
+	return c.readFileList()
+}
+
+// Reads the sender's file list, which should hold just the requested file.
+func (c *rsyncConn) readFileList() (int64, error) {
+	type entry struct {
+		name string
+		size int64
+		mode uint32
+	}
+	var entries []entry
+	var last entry
+	for {
+		flags, err := c.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if flags == 0 {
+			break
+		}
+		xflags := uint16(flags)
+		if xflags&rsyncXmitExtendedFlags != 0 {
+			high, err := c.readByte()
+			if err != nil {
+				return 0, err
+			}
+			xflags |= uint16(high) << 8
+		}
+		var prefixLength byte
+		if xflags&rsyncXmitSameName != 0 {
+			if prefixLength, err = c.readByte(); err != nil {
+				return 0, err
+			}
+		}
+		var suffixLength int32
+		if xflags&rsyncXmitLongName != 0 {
+			suffixLength, err = c.readInt()
+		} else {
+			var length byte
+			length, err = c.readByte()
+			suffixLength = int32(length)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if int(prefixLength) > len(last.name) || suffixLength < 0 || suffixLength > math.MaxInt16 {
+			return 0, errors.New("invalid rsync file list entry")
+		}
+		suffix := make([]byte, suffixLength)
+		if _, err := io.ReadFull(c, suffix); err != nil {
+			return 0, err
+		}
+		current := entry{name: last.name[:prefixLength] + string(suffix), mode: last.mode}
+		if current.size, err = c.readLongint(); err != nil {
+			return 0, err
+		}
+		if xflags&rsyncXmitSameTime == 0 {
+			if _, err := c.readInt(); err != nil {
+				return 0, err
+			}
+		}
+		if xflags&rsyncXmitSameMode == 0 {
+			mode, err := c.readInt()
+			if err != nil {
+				return 0, err
+			}
+			current.mode = uint32(mode)
+		}
+		entries = append(entries, current)
+		last = current
+	}
+	// I/O error flag, set if the sender couldn't read some of the files.
+	if _, err := c.readInt(); err != nil {
+		return 0, err
+	}
+
+	if len(entries) == 0 {
+		if c.lastError != "" {
+			return 0, errors.New(c.lastError)
+		}
+		return 0, errors.New("No such file on rsync server")
+	} else if len(entries) > 1 {
+		return 0, errors.New("rsync path matched more than one file")
+	} else if entries[0].mode&modeTypeMask != modeRegular {
+		return 0, errors.New("rsync path is not a regular file")
+	}
+	log.Printf("rsync file %s is %d bytes\n", entries[0].name, entries[0].size)
+	return entries[0].size, nil
+}
+
+// Sends block checksums of the basis file, if any, and returns a reader
+// rebuilding the file from the sender's literal data and block matches.
+func (c *rsyncConn) request(basis io.ReaderAt, basisSize int64) (io.ReadCloser, error) {
+	blockLength := rsyncBlockLength(basisSize)
+	count := (basisSize + blockLength - 1) / blockLength
+	c.writeInt(0)
+	binary.Write(c.out, binary.LittleEndian, uint16(rsyncItemTransfer))
+	c.writeInt(int32(count))
+	c.writeInt(int32(blockLength))
+	c.writeInt(md4.Size)
+	c.writeInt(int32(basisSize % blockLength))
+	block := make([]byte, blockLength)
+	for offset := int64(0); offset < basisSize; offset += blockLength {
+		n, err := basis.ReadAt(block, offset)
+		if err != nil && !(err == io.EOF && offset+int64(n) == basisSize) {
+			return nil, err
+		}
+		c.writeInt(int32(rsyncRollingChecksum(block[:n])))
+		c.out.Write(rsyncBlockChecksum(block[:n], c.seed))
+	}
+	if err := c.out.Flush(); err != nil {
+		return nil, err
+	}
+
+	ndx, err := c.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if ndx != 0 {
+		if c.lastError != "" {
+			return nil, errors.New(c.lastError)
+		}
+		return nil, errors.New("rsync sender skipped the file")
+	}
+	iflags, err := c.readShort()
+	if err != nil {
+		return nil, err
+	}
+	if iflags&rsyncItemBasisType != 0 {
+		if _, err := c.readByte(); err != nil {
+			return nil, err
+		}
+	}
+	if iflags&rsyncItemXname != 0 {
+		return nil, errors.New("unexpected alternate name from rsync sender")
+	}
+	// Echo of the checksum header.
+	for i := 0; i < 4; i++ {
+		if _, err := c.readInt(); err != nil {
+			return nil, err
+		}
+	}
+
+	fileHash := md4.New()
+	binary.Write(fileHash, binary.LittleEndian, c.seed)
+	return &rsyncDeltaReader{
+		conn:        c,
+		basis:       basis,
+		basisSize:   basisSize,
+		blockLength: blockLength,
+		hash:        fileHash,
+	}, nil
+}
+
+// Block size scales with the square root of the file like the rsync client
+// picks it, rounded to a multiple of 8.
+func rsyncBlockLength(size int64) int64 {
+	length := int64(math.Sqrt(float64(size))) &^ 7
+	if length < rsyncMinBlockLength {
+		return rsyncMinBlockLength
+	} else if length > rsyncMaxBlockLength {
+		return rsyncMaxBlockLength
+	}
+	return length
+}
+
+// rsync's weak checksum, note that bytes are summed as signed chars.
+func rsyncRollingChecksum(block []byte) uint32 {
+	var s1, s2 uint32
+	for _, b := range block {
+		s1 += uint32(int8(b))
+		s2 += s1
+	}
+	return s1&0xffff | s2<<16
+}
+
+// MD4 of the block followed by the checksum seed.
+func rsyncBlockChecksum(block []byte, seed uint32) []byte {
+	sum := md4.New()
+	sum.Write(block)
+	if seed != 0 {
+		binary.Write(sum, binary.LittleEndian, seed)
+	}
+	return sum.Sum(nil)
+}
+
+// Daemon auth response, base64 (unpadded) MD4 of four zero bytes, the
+// password and the challenge.
+func rsyncAuthResponse(password, challenge string) string {
+	sum := md4.New()
+	sum.Write([]byte{0, 0, 0, 0})
+	sum.Write([]byte(password))
+	sum.Write([]byte(challenge))
+	return base64.RawStdEncoding.EncodeToString(sum.Sum(nil))
+}
+
+// Applies the sender's token stream: positive tokens are followed by that
+// many bytes of literal data, negative ones copy block -(token+1) of the
+// basis and zero ends the file.
+type rsyncDeltaReader struct {
+	conn        *rsyncConn
+	basis       io.ReaderAt
+	basisSize   int64
+	blockLength int64
+	hash        hash.Hash
+	literal     int64
+	// Matched basis data not returned yet.
+	matched []byte
+	done    bool
+}
+
+func (r *rsyncDeltaReader) Read(p []byte) (int, error) {
+	for !r.done && r.literal == 0 && len(r.matched) == 0 {
+		if err := r.nextToken(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if len(r.matched) > 0 {
+		n = copy(p, r.matched)
+		r.matched = r.matched[n:]
+	} else if r.literal > 0 {
+		if int64(len(p)) > r.literal {
+			p = p[:r.literal]
+		}
+		n, err = r.conn.Read(p)
+		r.literal -= int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	} else {
+		return 0, io.EOF
+	}
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+func (r *rsyncDeltaReader) nextToken() error {
+	token, err := r.conn.readInt()
+	if err != nil {
+		return err
+	}
+	if token > 0 {
+		if token > rsyncMaxLiteral {
+			return errors.New("invalid rsync literal length " + strconv.Itoa(int(token)))
+		}
+		r.literal = int64(token)
+		return nil
+	} else if token < 0 {
+		offset := int64(-(token + 1)) * r.blockLength
+		if r.basis == nil || offset >= r.basisSize {
+			return errors.New("rsync sender referenced a block outside the basis file")
+		}
+		length := min(r.blockLength, r.basisSize-offset)
+		r.matched = make([]byte, length)
+		_, err := r.basis.ReadAt(r.matched, offset)
+		return err
+	}
+
+	expected := make([]byte, md4.Size)
+	if _, err := io.ReadFull(r.conn, expected); err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, r.hash.Sum(nil)) {
+		log.Println("rsync whole file checksum mismatch")
+		exit(ErrCorrupt)
+	}
+	r.done = true
+	r.conn.finish()
+	return nil
+}
+
+// Walks through the end of transfer phases so the daemon logs a clean exit.
+// The file is already complete, so failures are only logged.
+func (c *rsyncConn) finish() {
+	err := func() error {
+		for phase := 0; phase < 3; phase++ {
+			c.writeInt(-1)
+			if err := c.out.Flush(); err != nil {
+				return err
+			}
+			if ndx, err := c.readInt(); err != nil {
+				return err
+			} else if ndx != -1 {
+				return errors.New("unexpected index " + strconv.Itoa(int(ndx)))
+			}
+		}
+		// Transfer stats.
+		for i := 0; i < 5; i++ {
+			if _, err := c.readLongint(); err != nil {
+				return err
+			}
+		}
+		c.writeInt(-1)
+		return c.out.Flush()
+	}()
+	if err != nil {
+		log.Println("rsync didn't shut down cleanly:", err.Error())
+	}
+}
+
+func (r *rsyncDeltaReader) Close() error {
+	if closer, ok := r.basis.(io.Closer); ok {
+		closer.Close()
+	}
+	return r.conn.conn.Close()
+}
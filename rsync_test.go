@@ -0,0 +1,148 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/md4"
+)
+
+// Plays the daemon side of a protocol 29 transfer where the new file reuses
+// two blocks of the basis.
+func fakeRsyncDaemon(t *testing.T, conn net.Conn, basis, data []byte, tokens []interface{}) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	readInt := func() int32 {
+		var value int32
+		if err := binary.Read(in, binary.LittleEndian, &value); err != nil {
+			t.Errorf("Failed to read from client: %v", err)
+		}
+		return value
+	}
+	var frame bytes.Buffer
+	put := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&frame, binary.LittleEndian, value)
+		}
+	}
+	flush := func(tag byte) {
+		binary.Write(conn, binary.LittleEndian, uint32(frame.Len())|uint32(rsyncMplexBase+tag)<<24)
+		conn.Write(frame.Bytes())
+		frame.Reset()
+	}
+
+	// net.Pipe isn't buffered, so unlike a real daemon this waits for the
+	// client's greeting before sending its own.
+	if line, _ := in.ReadString('\n'); line != "@RSYNCD: 29.0\n" {
+		t.Errorf("Unexpected client greeting %q", line)
+	}
+	conn.Write([]byte("@RSYNCD: 31.0 md5 md4\n"))
+	if line, _ := in.ReadString('\n'); line != "mod\n" {
+		t.Errorf("Unexpected module %q", line)
+	}
+	conn.Write([]byte("Welcome\n@RSYNCD: OK\n"))
+	var args []string
+	for line, _ := in.ReadString('\n'); line != "\n"; line, _ = in.ReadString('\n') {
+		args = append(args, line)
+	}
+	if args[len(args)-1] != "mod/dir/file.tar\n" {
+		t.Errorf("Unexpected args %q", args)
+	}
+	const seed = 12345
+	binary.Write(conn, binary.LittleEndian, int32(seed))
+	if readInt() != 0 {
+		t.Errorf("Expected empty filter list")
+	}
+
+	frame.WriteString("hello from the server\n")
+	flush(rsyncMsgInfo)
+	put(byte(rsyncXmitSameTime), byte(8), []byte("file.tar"), int32(len(data)), int32(0100644), byte(0), int32(0))
+	flush(rsyncMsgData)
+
+	if ndx, iflags := readInt(), uint16(0); ndx != 0 {
+		t.Errorf("Unexpected file index %d", ndx)
+	} else if binary.Read(in, binary.LittleEndian, &iflags); iflags != rsyncItemTransfer {
+		t.Errorf("Unexpected iflags %x", iflags)
+	}
+	count, blockLength, sumLength, remainder := readInt(), readInt(), readInt(), readInt()
+	if int(count)*int(blockLength) != len(basis) || sumLength != md4.Size || remainder != 0 {
+		t.Errorf("Unexpected checksum header %d %d %d %d", count, blockLength, sumLength, remainder)
+	}
+	for i := int32(0); i < count; i++ {
+		block := basis[i*blockLength : (i+1)*blockLength]
+		sum := make([]byte, md4.Size)
+		if uint32(readInt()) != rsyncRollingChecksum(block) {
+			t.Errorf("Wrong rolling checksum for block %d", i)
+		}
+		if io.ReadFull(in, sum); !bytes.Equal(sum, rsyncBlockChecksum(block, seed)) {
+			t.Errorf("Wrong strong checksum for block %d", i)
+		}
+	}
+
+	put(int32(0), uint16(rsyncItemTransfer), count, blockLength, sumLength, remainder)
+	for _, token := range tokens {
+		if literal, ok := token.(string); ok {
+			put(int32(len(literal)), []byte(literal))
+		} else {
+			put(int32(-(token.(int) + 1)))
+		}
+	}
+	fileSum := md4.New()
+	binary.Write(fileSum, binary.LittleEndian, uint32(seed))
+	fileSum.Write(data)
+	put(int32(0), fileSum.Sum(nil))
+	flush(rsyncMsgData)
+
+	for phase := 0; phase < 3; phase++ {
+		if readInt() != -1 {
+			t.Errorf("Expected end of phase %d", phase)
+		}
+		put(int32(-1))
+		flush(rsyncMsgData)
+	}
+	put(int32(0), int32(0), int32(0), int32(0), int32(0))
+	flush(rsyncMsgData)
+	if readInt() != -1 {
+		t.Errorf("Expected final goodbye")
+	}
+}
+
+func TestRsyncDeltaTransfer(t *testing.T) {
+	basis := make([]byte, 3*rsyncMinBlockLength)
+	rand.Read(basis)
+	data := append(append(append([]byte("hello"), basis[700:1400]...), "world"...), basis[1400:]...)
+	tokens := []interface{}{"hello", 1, "world", 2}
+
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		fakeRsyncDaemon(t, server, basis, data, tokens)
+		close(done)
+	}()
+	conn := newRsyncConn(client)
+	size, err := conn.open("mod", "dir/file.tar", "user", "")
+	if err != nil {
+		t.Fatalf("Failed to open rsync module: %v", err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Got size %d, wanted %d", size, len(data))
+	}
+	reader, err := conn.request(bytes.NewReader(basis), int64(len(basis)))
+	if err != nil {
+		t.Fatalf("Failed to request file: %v", err)
+	}
+	result, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.Equal(result, data) {
+		t.Fatalf("Rebuilt file doesn't match")
+	}
+	reader.Close()
+	<-done
+}
@@ -1,17 +1,18 @@
-package main
+package fastar
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"io"
 	"log"
 	"mime/multipart"
-	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"golang.org/x/sys/unix"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Downloader struct {
@@ -43,8 +44,9 @@ func (s3Downloader S3Downloader) GetRanges(ranges [][]int64) (*multipart.Reader,
 func (s3Downloader S3Downloader) getObject(rangeString *string) *s3.GetObjectOutput {
 	bucket, key := getBucketAndKey(s3Downloader.Url)
 	params := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		RequestPayer: requestPayer(),
 	}
 	if rangeString != nil {
 		params.Range = aws.String(*rangeString)
@@ -53,22 +55,90 @@ func (s3Downloader S3Downloader) getObject(rangeString *string) *s3.GetObjectOut
 	if err != nil {
 		if strings.Contains(err.Error(), "404") {
 			log.Println("404, fast failing:", err.Error())
-			os.Exit(int(unix.ENOENT))
+			exit(ErrNotFound)
 		} else if strings.Contains(err.Error(), "SignatureDoesNotMatch") {
 			log.Println("Failed to authenticate:", err.Error())
-			os.Exit(int(unix.EACCES))
+			exit(ErrPermission)
 		} else if strings.Contains(err.Error(), "no VPC endpoint policy allows") {
 			log.Println("Failed to reach bucket due to VPC endpoint misconfiguration:", err.Error())
-			os.Exit(int(unix.EHOSTUNREACH))
+			exit(ErrNetwork)
 		}
-		log.Fatal("Unexpected error getting S3 object: ", err.Error())
+		fatal("Unexpected error getting S3 object: ", err.Error())
 	}
 	return resp
 }
 
+// With --request-payer=requester, acknowledges that the caller is charged
+// for requests to requester pays buckets, which reject them otherwise.
+func requestPayer() types.RequestPayer {
+	return types.RequestPayer(opts.RequestPayer)
+}
+
 func getBucketAndKey(url string) (string, string) {
 	parts := strings.Split(strings.Replace(url, "s3://", "", 1), "/")
 	bucket := parts[0]
 	key := strings.Join(parts[1:], "/")
 	return bucket, key
 }
+
+// The object's ETag when it's the MD5 of its content, which S3 makes it
+// for objects uploaded in a single part without SSE-KMS or SSE-C. It's
+// verified even without --verify-object-checksum, as it comes with the
+// object for free. With the flag, a full object SHA256 or SHA1 checksum
+// the object was uploaded with takes precedence. Checksums of multipart
+// uploads are composite ("...-N") and can't be checked.
+func (s3Downloader S3Downloader) ExpectedChecksum() (string, string) {
+	if !opts.VerifyObject && opts.NoEtagCheck {
+		return "", ""
+	}
+	bucket, key := getBucketAndKey(s3Downloader.Url)
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		RequestPayer: requestPayer(),
+	}
+	if opts.VerifyObject {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	resp, err := s3Downloader.client.HeadObject(context.Background(), input)
+	if err != nil && !opts.VerifyObject {
+		log.Printf("Failed to get S3 object ETag, not verifying the download: %s\n", err.Error())
+		return "", ""
+	} else if err != nil {
+		fatal("Failed to get S3 object checksum: ", err.Error())
+	}
+	if opts.VerifyObject {
+		for _, checksum := range []struct {
+			algorithm string
+			value     *string
+		}{{"sha256", resp.ChecksumSHA256}, {"sha1", resp.ChecksumSHA1}} {
+			if checksum.value == nil || strings.Contains(*checksum.value, "-") {
+				continue
+			}
+			if digest, err := base64.StdEncoding.DecodeString(*checksum.value); err == nil {
+				return checksum.algorithm, hex.EncodeToString(digest)
+			}
+		}
+	}
+	encrypted := resp.ServerSideEncryption == types.ServerSideEncryptionAwsKms || resp.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse || resp.SSECustomerAlgorithm != nil
+	if md5 := etagMd5(aws.ToString(resp.ETag), encrypted); md5 != "" && !opts.NoEtagCheck {
+		return "md5", md5
+	}
+	if opts.VerifyObject {
+		log.Println("S3 object has no full object checksum to verify against")
+	}
+	return "", ""
+}
+
+// Returns the MD5 an ETag stands for, or "" if it's not one. Warns about
+// multipart ETags, which hash the parts' MD5s rather than the content.
+func etagMd5(etag string, encrypted bool) string {
+	etag = strings.Trim(etag, "\"")
+	if _, err := hex.DecodeString(etag); err == nil && len(etag) == 32 && !encrypted {
+		return strings.ToLower(etag)
+	}
+	if hash, parts, multipart := strings.Cut(etag, "-"); multipart && len(hash) == 32 {
+		log.Printf("S3 object was uploaded in %s parts, its ETag can't be verified. Upload it with a full object checksum and pass --verify-object-checksum to verify it\n", parts)
+	}
+	return ""
+}
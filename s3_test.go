@@ -0,0 +1,70 @@
+package fastar
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestS3CustomEndpoint(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 1000000
+	opts.S3PathStyle = true
+	opts.RequestPayer = "requester"
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+
+	data := RandomString(1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/path/to/archive.tar" {
+			t.Errorf("Expected a path style request, got %s", r.URL.Path)
+		}
+		if payer := r.Header.Get("X-Amz-Request-Payer"); payer != "requester" {
+			t.Errorf("Expected requester pays header, got %q", payer)
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/s3/") {
+			t.Errorf("Expected a request signed for us-east-1, got %q", r.Header.Get("Authorization"))
+		}
+		start, end := 0, len(data)-1
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		}
+		w.Write([]byte(data[start : end+1]))
+	}))
+	defer server.Close()
+	opts.S3Endpoint = server.URL
+
+	downloader := getDownloader("s3://bucket/path/to/archive.tar", false, false)
+	if actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 300, 2)); err != nil || string(actual) != data {
+		t.Fatalf("Got %d bytes, %v", len(actual), err)
+	}
+}
+
+func TestEtagMd5(t *testing.T) {
+	for _, test := range []struct {
+		etag      string
+		encrypted bool
+		expected  string
+	}{
+		{`"9E107D9D372BB6826BD81D3542A419D6"`, false, "9e107d9d372bb6826bd81d3542a419d6"},
+		{`"9e107d9d372bb6826bd81d3542a419d6"`, true, ""},
+		{`"9e107d9d372bb6826bd81d3542a419d6-12"`, false, ""},
+		{"", false, ""},
+	} {
+		if actual := etagMd5(test.etag, test.encrypted); actual != test.expected {
+			t.Fatalf("etagMd5(%s, %t) = %q, wanted %q", test.etag, test.encrypted, actual, test.expected)
+		}
+	}
+}
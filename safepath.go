@@ -0,0 +1,107 @@
+package fastar
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Entries are kept inside --directory unless --unsafe-paths is given: names
+// and hard link targets may not be absolute or climb out with "..", and
+// symlinks already extracted are followed as if --directory were the root,
+// so a symlink to / or ../.. can't be used to write outside of it either.
+// Like the kernel, gives up after this many symlinks in one path.
+const maxSymlinkHops = 40
+
+var errOutsideDirectory = errors.New("path is outside of --directory")
+
+// Whether an archive name is absolute or climbs above the directory it's
+// extracted to.
+func escapesDirectory(name string) bool {
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return true
+	}
+	clean := path.Clean(filepath.ToSlash(name))
+	return clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+// Whether a relative symlink target, taken relative to the symlink at name,
+// climbs above --directory. Absolute targets are fine, they're resolved
+// against --directory when fastar writes through them.
+func symlinkEscapes(name, target string) bool {
+	if path.IsAbs(target) {
+		return false
+	}
+	return escapesDirectory(path.Join(path.Dir(filepath.ToSlash(name)), target))
+}
+
+// Resolves the symlinks already extracted along rel, a path relative to
+// --directory, treating --directory as the root. Returns the equivalent path
+// without symlinks, or errOutsideDirectory if ".." climbs above the root.
+// Components that don't exist yet are taken as they are.
+func resolveInside(rel string) (string, error) {
+	pending := strings.Split(filepath.ToSlash(rel), "/")
+	var resolved []string
+	hops := 0
+	missing := false
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", errOutsideDirectory
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		resolved = append(resolved, component)
+		if missing {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(opts.OutputDir, filepath.FromSlash(strings.Join(resolved, "/"))))
+		if os.IsNotExist(err) {
+			// Nothing below a missing component exists either.
+			missing = true
+			continue
+		} else if err != nil {
+			// Not a symlink.
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		resolved = resolved[:len(resolved)-1]
+		if path.IsAbs(filepath.ToSlash(target)) {
+			resolved = nil
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+	return filepath.FromSlash(strings.Join(resolved, "/")), nil
+}
+
+// Returns where to extract localName inside --directory, following the
+// symlinks in its directory, and in localName itself if followFinal.
+// Directories in dirs were created by fastar and need no resolving.
+func safeEntryPath(localName string, followFinal bool, dirs dirCache) (string, error) {
+	full := filepath.Join(opts.OutputDir, localName)
+	if followFinal && dirs[full] {
+		return full, nil
+	}
+	dir, base := filepath.Split(localName)
+	if !followFinal && dirs[filepath.Clean(filepath.Join(opts.OutputDir, dir))] {
+		return full, nil
+	}
+	if followFinal {
+		dir, base = localName, ""
+	}
+	resolved, err := resolveInside(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(opts.OutputDir, resolved, base), nil
+}
@@ -0,0 +1,83 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapesDirectory(t *testing.T) {
+	for name, escapes := range map[string]bool{
+		"a/b":        false,
+		"./a/../b":   false,
+		"a/..":       false,
+		"..":         true,
+		"../a":       true,
+		"a/../../b":  true,
+		"/etc/hosts": true,
+	} {
+		if escapesDirectory(name) != escapes {
+			t.Errorf("escapesDirectory(%q) = %v", name, !escapes)
+		}
+	}
+	if !symlinkEscapes("a/link", "../../b") || symlinkEscapes("a/link", "../b") || symlinkEscapes("a/link", "/etc") {
+		t.Error("symlinkEscapes resolved targets relative to the wrong directory")
+	}
+}
+
+func TestResolveInside(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	os.Mkdir(filepath.Join(opts.OutputDir, "dir"), 0755)
+	os.Symlink("/", filepath.Join(opts.OutputDir, "root"))
+	os.Symlink("../..", filepath.Join(opts.OutputDir, "dir", "up"))
+	os.Symlink(".", filepath.Join(opts.OutputDir, "b"))
+	os.Symlink("b/..", filepath.Join(opts.OutputDir, "a"))
+	os.Symlink("loop", filepath.Join(opts.OutputDir, "loop"))
+
+	for rel, expected := range map[string]string{
+		"dir/file":         "dir/file",
+		"root/etc/passwd":  "etc/passwd",
+		"missing/../x":     "x",
+		"dir/missing/file": "dir/missing/file",
+	} {
+		if resolved, err := resolveInside(rel); err != nil || resolved != filepath.FromSlash(expected) {
+			t.Errorf("resolveInside(%q) = %q, %v, expected %q", rel, resolved, err, expected)
+		}
+	}
+	for _, rel := range []string{"..", "dir/up/file", "root/../etc", "a/file", "loop/file"} {
+		if resolved, err := resolveInside(rel); err == nil {
+			t.Errorf("Expected resolveInside(%q) to fail, got %q", rel, resolved)
+		}
+	}
+}
+
+func TestExtractTarThroughSymlink(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/"})
+	tw.WriteHeader(&tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "etc/lib/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	ExtractTar(context.Background(), &buf)
+
+	if target, err := os.Readlink(filepath.Join(opts.OutputDir, "etc")); err != nil || target != "/" {
+		t.Fatalf("Expected etc to link to /, got %q, %v", target, err)
+	}
+	if contents, err := os.ReadFile(filepath.Join(opts.OutputDir, "hosts")); err != nil || string(contents) != "hello" {
+		t.Fatalf("Expected etc/hosts to be written to hosts inside the directory, got %q, %v", contents, err)
+	}
+	if info, err := os.Stat(filepath.Join(opts.OutputDir, "lib")); err != nil || !info.IsDir() {
+		t.Fatalf("Expected etc/lib to be created as lib inside the directory, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package fastar
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Default release location and the ed25519 public key used to verify
+// release checksums. Both are meant to be baked in at build time, e.g.
+//
+//	go build -ldflags "-X github.com/databricks/fastar.releaseUrl=https://... -X github.com/databricks/fastar.releasePublicKey=<base64>"
+var (
+	releaseUrl       = ""
+	releasePublicKey = ""
+)
+
+// Replace the running binary with the latest release.
+//
+// A release directory is expected to contain, for each platform:
+//
+//	fastar-<os>-<arch>             the binary
+//	fastar-<os>-<arch>.sha256      sha256sum-style checksum of the binary
+//	fastar-<os>-<arch>.sha256.sig  ed25519 signature of the checksum file
+//
+// The binary is pulled with the regular parallel downloader, hashed while
+// it streams to a temp file next to the current executable, and only
+// renamed over the executable once both the signature and checksum match.
+func SelfUpdate() {
+	baseUrl := opts.ReleaseUrl
+	if baseUrl == "" {
+		baseUrl = releaseUrl
+	}
+	if baseUrl == "" {
+		fatal("No release URL configured, pass --release-url")
+	}
+	publicKey := opts.ReleasePubKey
+	if publicKey == "" {
+		publicKey = releasePublicKey
+	}
+	if publicKey == "" {
+		fatal("No release public key configured, pass --release-public-key")
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		fatal("Invalid release public key, expected base64 encoded ed25519 key")
+	}
+
+	assetUrl := strings.TrimSuffix(baseUrl, "/") + "/fastar-" + runtime.GOOS + "-" + runtime.GOARCH
+	executable, err := os.Executable()
+	if err != nil {
+		fatal("Failed to locate current executable: ", err.Error())
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		fatal("Failed to resolve current executable: ", err.Error())
+	}
+	if err := updateExecutable(assetUrl, ed25519.PublicKey(key), executable, opts); err != nil {
+		var fastarErr *Error
+		if !errors.As(err, &fastarErr) {
+			fastarErr = &Error{1, err.Error()}
+		}
+		log.Println("Self-update failed:", fastarErr.Message)
+		fail(fastarErr)
+	}
+}
+
+// Replaces executable with the release at assetUrl once its checksum file
+// is signed by key and matches it. Downloads go through the library API
+// with options, so failures come back here, and the temp file is removed,
+// rather than exiting.
+func updateExecutable(assetUrl string, key ed25519.PublicKey, executable string, options Options) error {
+	checksumFile, err := downloadSmallFile(assetUrl+".sha256", options)
+	if err != nil {
+		return err
+	}
+	signature, err := downloadSmallFile(assetUrl+".sha256.sig", options)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, checksumFile, signature) {
+		return errors.New("release checksum signature verification failed, refusing to update")
+	}
+	fields := strings.Fields(string(checksumFile))
+	if len(fields) == 0 {
+		return errors.New("release checksum file is empty")
+	}
+	expectedSum := strings.ToLower(fields[0])
+
+	// Temp file must live in the same directory so the final rename is atomic.
+	tmp, err := os.CreateTemp(filepath.Dir(executable), ".fastar-update-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for update: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	log.Println("Downloading", assetUrl)
+	stream, err := Download(context.Background(), assetUrl, options)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), stream); err != nil {
+		return fmt.Errorf("failed to download update: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write update: %w", err)
+	}
+	if actualSum := hex.EncodeToString(hash.Sum(nil)); actualSum != expectedSum {
+		return fmt.Errorf("checksum mismatch for downloaded release, expected %s got %s", expectedSum, actualSum)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("failed to chmod update: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), executable); err != nil {
+		return fmt.Errorf("failed to replace current executable: %w", err)
+	}
+	log.Println("Updated", executable, "to release with checksum", expectedSum)
+	return nil
+}
+
+func downloadSmallFile(url string, options Options) ([]byte, error) {
+	stream, err := Download(context.Background(), url, options)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,90 @@
+package fastar
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSelfUpdate(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := []byte(RandomString(10000))
+	sum := sha256.Sum256(release)
+	checksumFile := []byte(hex.EncodeToString(sum[:]) + "  fastar\n")
+	files := map[string][]byte{
+		"/fastar":            release,
+		"/fastar.sha256":     checksumFile,
+		"/fastar.sha256.sig": ed25519.Sign(private, checksumFile),
+	}
+	tampered := []byte(RandomString(10000))
+	var serveTampered atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if r.URL.Path == "/fastar" && serveTampered.Load() {
+			data = tampered
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "fastar")
+	running := []byte("running binary")
+	checkNotReplaced := func(reason string) {
+		if data, _ := os.ReadFile(executable); !bytes.Equal(data, running) {
+			t.Fatalf("%s replaced the executable", reason)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Fatalf("%s left %d files behind next to the executable", reason, len(entries)-1)
+		}
+	}
+	if err := os.WriteFile(executable, running, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	serveTampered.Store(true)
+	if err := updateExecutable(server.URL+"/fastar", public, executable, options); err == nil {
+		t.Fatal("Expected a tampered binary to be rejected")
+	}
+	checkNotReplaced("A tampered binary")
+	serveTampered.Store(false)
+
+	otherPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := updateExecutable(server.URL+"/fastar", otherPublic, executable, options); err == nil {
+		t.Fatal("Expected a checksum file signed by another key to be rejected")
+	}
+	checkNotReplaced("A bad signature")
+
+	if err := updateExecutable(server.URL+"/missing", public, executable, options); err == nil {
+		t.Fatal("Expected a missing release to fail")
+	}
+	checkNotReplaced("A missing release")
+
+	if err := updateExecutable(server.URL+"/fastar", public, executable, options); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(executable); !bytes.Equal(data, release) {
+		t.Fatal("Expected the executable to be replaced by the release")
+	}
+}
@@ -0,0 +1,581 @@
+package fastar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultSftpPort = "22"
+
+// SFTP version 3 packet types and status codes, the version every server
+// speaks.
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpStat    = 17
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpAttrs   = 105
+
+	sftpStatusOk               = 0
+	sftpStatusEof              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+
+	sftpFlagRead  = 1
+	sftpAttrSize  = 1
+	sftpReadSize  = 32 << 10
+	sftpMaxPacket = 256 << 10
+	// Reads kept in flight per connection, so a range isn't limited to
+	// sftpReadSize per round trip.
+	sftpMaxInflight = 64
+)
+
+// Downloader for files reachable over SSH, handles
+// sftp://[user@]host[:port]/path URLs (scp:// too, served over the same
+// SFTP subsystem). Paths are absolute, /~/path is relative to the home
+// directory like with curl.
+//
+// Authenticates with the keys in ssh-agent, then --ssh-key or the default
+// ~/.ssh/id_* keys that aren't encrypted, then the password in the URL if
+// there is one. The user defaults to $USER. Host keys are checked against
+// --ssh-known-hosts.
+//
+// Every worker reads its ranges over its own SSH connection, taken from a
+// pool so it's reused for the worker's next chunk.
+type SftpDownloader struct {
+	Url    string
+	path   string
+	addr   string
+	config *ssh.ClientConfig
+	pool   chan *sftpConn
+}
+
+func NewSftpDownloader(rawUrl string) SftpDownloader {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		fatal("Failed to parse SFTP url: ", err.Error())
+	}
+	path := parsed.Path
+	if strings.HasPrefix(path, "/~/") {
+		path = strings.TrimPrefix(path, "/~/")
+	}
+	if path == "" || path == "/" {
+		fatal("SFTP url must be of the form sftp://[user@]host[:port]/path")
+	}
+	user := os.Getenv("USER")
+	password := ""
+	if parsed.User != nil {
+		user = parsed.User.Username()
+		password, _ = parsed.User.Password()
+	}
+	addr := parsed.Host
+	if parsed.Port() == "" {
+		addr = net.JoinHostPort(parsed.Hostname(), defaultSftpPort)
+	}
+	numWorkers := opts.NumWorkers
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	return SftpDownloader{
+		Url:  rawUrl,
+		path: path,
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            sshAuthMethods(password),
+			HostKeyCallback: sshHostKeyCallback(),
+		},
+		pool: make(chan *sftpConn, numWorkers),
+	}
+}
+
+func sshAuthMethods(password string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			log.Println("Failed to connect to ssh-agent:", err.Error())
+		}
+	}
+	keyFiles := []string{opts.SshKey}
+	if opts.SshKey == "" {
+		home, _ := os.UserHomeDir()
+		keyFiles = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, keyFile := range keyFiles {
+		pem, err := os.ReadFile(keyFile)
+		if os.IsNotExist(err) && opts.SshKey == "" {
+			continue
+		} else if err != nil {
+			fatal("Failed to read SSH key: ", err.Error())
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		var passphraseMissing *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseMissing) {
+			log.Printf("Skipping encrypted SSH key %s, add it to ssh-agent to use it\n", keyFile)
+			continue
+		} else if err != nil {
+			fatalf("Failed to parse SSH key %s: %s", keyFile, err.Error())
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods
+}
+
+func sshHostKeyCallback() ssh.HostKeyCallback {
+	path := opts.SshKnownHosts
+	if path == "none" {
+		log.Println("Not verifying the SSH host key, --ssh-known-hosts is none")
+		return ssh.InsecureIgnoreHostKey()
+	}
+	if path == "" {
+		home, _ := os.UserHomeDir()
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		fatal("Failed to read SSH known hosts, pass --ssh-known-hosts: ", err.Error())
+	}
+	return callback
+}
+
+func (sftpDownloader SftpDownloader) GetFileInfo() (int64, bool, bool) {
+	conn := sftpDownloader.acquire()
+	size, err := conn.stat(sftpDownloader.path)
+	sftpDownloader.release(conn)
+	handleSftpError(err, "GetFileInfo")
+	return size, true, false
+}
+
+func (sftpDownloader SftpDownloader) Get() io.ReadCloser {
+	size, _, _ := sftpDownloader.GetFileInfo()
+	return sftpDownloader.GetRange(0, size)
+}
+
+func (sftpDownloader SftpDownloader) GetRange(start, end int64) io.ReadCloser {
+	conn := sftpDownloader.acquire()
+	handle, err := conn.open(sftpDownloader.path)
+	if err != nil {
+		sftpDownloader.release(conn)
+		handleSftpError(err, "GetRange")
+	}
+	return &sftpRangeReader{
+		downloader: sftpDownloader,
+		conn:       conn,
+		handle:     handle,
+		next:       start,
+		end:        end,
+		responses:  map[uint32][]byte{},
+	}
+}
+
+func (sftpDownloader SftpDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported by SFTP")
+}
+
+// Takes an idle connection from the pool or opens a new one.
+func (sftpDownloader SftpDownloader) acquire() *sftpConn {
+	select {
+	case conn := <-sftpDownloader.pool:
+		return conn
+	default:
+	}
+	conn, err := dialSftp(sftpDownloader.addr, sftpDownloader.config)
+	handleSftpError(err, "connect")
+	return conn
+}
+
+// Puts conn back into the pool, or closes it if it broke or the pool is
+// full.
+func (sftpDownloader SftpDownloader) release(conn *sftpConn) {
+	if !conn.broken {
+		select {
+		case sftpDownloader.pool <- conn:
+			return
+		default:
+		}
+	}
+	conn.client.Close()
+}
+
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e sftpStatusError) Error() string {
+	return fmt.Sprintf("SFTP status %d: %s", e.code, e.message)
+}
+
+// If err is nil, this is a noop. Otherwise the method will print an appropriate error message
+// and exit with the appropriate error code.
+func handleSftpError(err error, requestType string) {
+	if err == nil {
+		return
+	}
+	var statusErr sftpStatusError
+	if errors.As(err, &statusErr) && statusErr.code == sftpStatusNoSuchFile {
+		log.Printf("404, SFTP %s failed, file doesn't exist: %s\n", requestType, err.Error())
+		exit(ErrNotFound)
+	} else if errors.As(err, &statusErr) && statusErr.code == sftpStatusPermissionDenied || strings.Contains(err.Error(), "unable to authenticate") {
+		log.Printf("SFTP %s failed to authenticate: %s\n", requestType, err.Error())
+		exit(ErrPermission)
+	}
+	fatalf("SFTP %s failed: %s", requestType, err.Error())
+}
+
+// An SFTP session over its own SSH connection, used by one goroutine at a
+// time.
+type sftpConn struct {
+	client *ssh.Client
+	in     io.WriteCloser
+	out    *bufio.Reader
+	nextId uint32
+	// Set once a request failed halfway, the session can't be reused.
+	broken bool
+}
+
+func dialSftp(addr string, config *ssh.ClientConfig) (*sftpConn, error) {
+	netConn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(netConn, addr, config)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	conn, err := startSftp(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func startSftp(client *ssh.Client) (*sftpConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+	conn := &sftpConn{client: client, in: in, out: bufio.NewReaderSize(out, sftpReadSize+1024)}
+	// INIT is the one packet without a request id.
+	if err := conn.send(sftpInit, sftpUint32(3)); err != nil {
+		return nil, err
+	}
+	packetType, payload, err := conn.receive()
+	if err != nil {
+		return nil, err
+	}
+	if packetType != sftpVersion || len(payload) < 4 {
+		return nil, fmt.Errorf("unexpected SFTP packet %d in place of the version", packetType)
+	}
+	return conn, nil
+}
+
+func sftpUint32(value uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, value)
+}
+
+func sftpString(buf []byte, value string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+// Parses the string at the start of buf, returning it and the rest.
+func sftpParseString(buf []byte) (string, []byte, error) {
+	if len(buf) < 4 || uint32(len(buf)-4) < binary.BigEndian.Uint32(buf) {
+		return "", nil, errors.New("truncated SFTP string")
+	}
+	length := binary.BigEndian.Uint32(buf)
+	return string(buf[4 : 4+length]), buf[4+length:], nil
+}
+
+func (c *sftpConn) send(packetType byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(append(packet, packetType), payload...)
+	if _, err := c.in.Write(packet); err != nil {
+		c.broken = true
+		return err
+	}
+	return nil
+}
+
+// Sends a request with a fresh id in front of payload and returns the id.
+func (c *sftpConn) sendRequest(packetType byte, payload []byte) (uint32, error) {
+	c.nextId++
+	return c.nextId, c.send(packetType, append(sftpUint32(c.nextId), payload...))
+}
+
+func (c *sftpConn) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.out, header[:]); err != nil {
+		c.broken = true
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > sftpMaxPacket {
+		c.broken = true
+		return 0, nil, fmt.Errorf("SFTP packet of %d bytes", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.out, payload); err != nil {
+		c.broken = true
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// Receives the response to a request, which has its id in front, and
+// returns it with the id stripped.
+func (c *sftpConn) receiveResponse() (uint32, byte, []byte, error) {
+	packetType, payload, err := c.receive()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(payload) < 4 {
+		c.broken = true
+		return 0, 0, nil, errors.New("truncated SFTP response")
+	}
+	return binary.BigEndian.Uint32(payload), packetType, payload[4:], nil
+}
+
+// Sends a request and waits for its response, failing on a status other
+// than OK or a response of a type other than expected.
+func (c *sftpConn) call(packetType byte, payload []byte, expected byte) ([]byte, error) {
+	id, err := c.sendRequest(packetType, payload)
+	if err != nil {
+		return nil, err
+	}
+	responseId, responseType, response, err := c.receiveResponse()
+	if err != nil {
+		return nil, err
+	}
+	if responseId != id {
+		c.broken = true
+		return nil, fmt.Errorf("SFTP response for request %d, expected %d", responseId, id)
+	}
+	if responseType == sftpStatus {
+		if err := sftpStatusErr(response); err != nil {
+			return nil, err
+		}
+	}
+	if responseType != expected {
+		return nil, fmt.Errorf("unexpected SFTP response type %d", responseType)
+	}
+	return response, nil
+}
+
+// Returns the error a STATUS response carries, nil for OK.
+func sftpStatusErr(response []byte) error {
+	if len(response) < 4 {
+		return errors.New("truncated SFTP status")
+	}
+	code := binary.BigEndian.Uint32(response)
+	if code == sftpStatusOk {
+		return nil
+	}
+	message, _, _ := sftpParseString(response[4:])
+	return sftpStatusError{code, message}
+}
+
+func (c *sftpConn) stat(path string) (int64, error) {
+	attrs, err := c.call(sftpStat, sftpString(nil, path), sftpAttrs)
+	if err != nil {
+		return 0, err
+	}
+	if len(attrs) < 12 || binary.BigEndian.Uint32(attrs)&sftpAttrSize == 0 {
+		return 0, errors.New("SFTP server didn't report the file size")
+	}
+	return int64(binary.BigEndian.Uint64(attrs[4:])), nil
+}
+
+func (c *sftpConn) open(path string) (string, error) {
+	payload := sftpString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, sftpFlagRead)
+	// No attributes.
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+	response, err := c.call(sftpOpen, payload, sftpHandle)
+	if err != nil {
+		return "", err
+	}
+	handle, _, err := sftpParseString(response)
+	return handle, err
+}
+
+func (c *sftpConn) close(handle string) error {
+	_, err := c.call(sftpClose, sftpString(nil, handle), sftpStatus)
+	return err
+}
+
+type sftpPendingRead struct {
+	id     uint32
+	offset int64
+	length int64
+}
+
+// Reads a range of an open file with up to sftpMaxInflight READ requests
+// outstanding, handing their data out in offset order.
+type sftpRangeReader struct {
+	downloader SftpDownloader
+	conn       *sftpConn
+	handle     string
+	// Next offset to request and the end of the range.
+	next, end int64
+	// Requests in offset order, and the responses that arrived for them
+	// ahead of those before.
+	pending   []sftpPendingRead
+	responses map[uint32][]byte
+	buf       []byte
+	err       error
+	closeOnce sync.Once
+}
+
+func (r *sftpRangeReader) request(offset, length int64) error {
+	payload := sftpString(nil, r.handle)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(offset))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(length))
+	id, err := r.conn.sendRequest(sftpRead, payload)
+	if err != nil {
+		return err
+	}
+	r.pending = append(r.pending, sftpPendingRead{id, offset, length})
+	return nil
+}
+
+// Waits for the response to the request with id, keeping the ones for
+// other requests that arrive before it.
+func (r *sftpRangeReader) await(id uint32) (byte, []byte, error) {
+	for {
+		if response, ok := r.responses[id]; ok {
+			delete(r.responses, id)
+			return response[0], response[1:], nil
+		}
+		responseId, responseType, response, err := r.conn.receiveResponse()
+		if err != nil {
+			return 0, nil, err
+		}
+		r.responses[responseId] = append([]byte{responseType}, response...)
+	}
+}
+
+func (r *sftpRangeReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		for len(r.pending) < sftpMaxInflight && r.next < r.end {
+			length := min(sftpReadSize, r.end-r.next)
+			if r.err = r.request(r.next, length); r.err != nil {
+				return 0, r.err
+			}
+			r.next += length
+		}
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+		read := r.pending[0]
+		r.pending = r.pending[1:]
+		responseType, response, err := r.await(read.id)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		switch responseType {
+		case sftpData:
+			data, _, err := sftpParseString(response)
+			if err != nil || int64(len(data)) > read.length {
+				r.conn.broken = true
+				r.err = errors.New("malformed SFTP data response")
+				return 0, r.err
+			}
+			r.buf = []byte(data)
+			// Servers may return less than asked for, the rest is requested
+			// again ahead of the reads already in flight.
+			if rest := read.length - int64(len(data)); rest > 0 {
+				if r.err = r.request(read.offset+int64(len(data)), rest); r.err != nil {
+					return 0, r.err
+				}
+				last := r.pending[len(r.pending)-1]
+				copy(r.pending[1:], r.pending[:len(r.pending)-1])
+				r.pending[0] = last
+			}
+		case sftpStatus:
+			r.err = sftpStatusErr(response)
+			var statusErr sftpStatusError
+			if errors.As(r.err, &statusErr) && statusErr.code == sftpStatusEof {
+				r.err = io.ErrUnexpectedEOF
+			}
+			if r.err == nil {
+				r.err = errors.New("SFTP read returned no data")
+			}
+			return 0, r.err
+		default:
+			r.conn.broken = true
+			r.err = fmt.Errorf("unexpected SFTP response type %d", responseType)
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Hands the connection back for the next range once this one was read to
+// the end. A reader closed halfway, say for a retry after a stall, has
+// reads in flight that may never be answered, so its connection is closed
+// instead. Can be called more than once.
+func (r *sftpRangeReader) Close() error {
+	r.closeOnce.Do(func() {
+		if len(r.pending) > 0 || r.err != nil {
+			r.conn.broken = true
+		} else if err := r.conn.close(r.handle); err != nil {
+			r.conn.broken = true
+		}
+		r.downloader.release(r.conn)
+	})
+	return nil
+}
@@ -0,0 +1,157 @@
+package fastar
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Answers SFTP requests for the single file /data/file.tar, returning at
+// most 10000 bytes per read like servers capping their reads do.
+func fakeSftpServer(channel ssh.Channel, data []byte) {
+	defer channel.Close()
+	in := bufio.NewReader(channel)
+	reply := func(packetType byte, payload []byte) {
+		packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+		channel.Write(append(append(packet, packetType), payload...))
+	}
+	status := func(id, code uint32) {
+		payload := binary.BigEndian.AppendUint32(sftpUint32(id), code)
+		reply(sftpStatus, sftpString(sftpString(payload, "status"), ""))
+	}
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(in, header[:]); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+		if _, err := io.ReadFull(in, payload); err != nil {
+			return
+		}
+		if header[4] == sftpInit {
+			reply(sftpVersion, sftpUint32(3))
+			continue
+		}
+		id := binary.BigEndian.Uint32(payload)
+		path, rest, _ := sftpParseString(payload[4:])
+		switch header[4] {
+		case sftpStat:
+			if path != "/data/file.tar" {
+				status(id, sftpStatusNoSuchFile)
+				continue
+			}
+			attrs := binary.BigEndian.AppendUint32(sftpUint32(id), sftpAttrSize)
+			reply(sftpAttrs, binary.BigEndian.AppendUint64(attrs, uint64(len(data))))
+		case sftpOpen:
+			reply(sftpHandle, sftpString(sftpUint32(id), "handle"))
+		case sftpRead:
+			offset := int64(binary.BigEndian.Uint64(rest))
+			end := min(offset+min(int64(binary.BigEndian.Uint32(rest[8:])), 10000), int64(len(data)))
+			if offset >= end {
+				status(id, sftpStatusEof)
+				continue
+			}
+			reply(sftpData, sftpString(sftpUint32(id), string(data[offset:end])))
+		case sftpClose:
+			status(id, sftpStatusOk)
+		}
+	}
+}
+
+func TestSftpDownloader(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.NumWorkers = 3
+	opts.RetryCount = 1000000
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	clientPublic, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	clientSshPublic, _ := ssh.NewPublicKey(clientPublic)
+	dir := t.TempDir()
+	block, _ := ssh.MarshalPrivateKey(clientKey, "")
+	opts.SshKey = filepath.Join(dir, "id_ed25519")
+	os.WriteFile(opts.SshKey, pem.EncodeToMemory(block), 0600)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "fastar" || string(key.Marshal()) != string(clientSshPublic.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	opts.SshKnownHosts = filepath.Join(dir, "known_hosts")
+	os.WriteFile(opts.SshKnownHosts, []byte(knownhosts.Line([]string{listener.Addr().String()}, hostSigner.PublicKey())+"\n"), 0600)
+
+	data := []byte(RandomString(300000))
+	var connections atomic.Int32
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(netConn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for newChannel := range channels {
+					channel, requests, _ := newChannel.Accept()
+					go func() {
+						for request := range requests {
+							ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+							request.Reply(ok, nil)
+							if ok {
+								go fakeSftpServer(channel, data)
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	downloader := NewSftpDownloader("sftp://fastar@" + listener.Addr().String() + "/data/file.tar")
+	if size, rangeSupport, _ := downloader.GetFileInfo(); size != int64(len(data)) || !rangeSupport {
+		t.Fatalf("Expected %d bytes with range support, got %d", len(data), size)
+	}
+	for _, span := range [][2]int64{{0, 50000}, {123, 250123}} {
+		chunk := downloader.GetRange(span[0], span[1])
+		actual, err := io.ReadAll(chunk)
+		chunk.Close()
+		if err != nil || string(actual) != string(data[span[0]:span[1]]) {
+			t.Fatalf("Range %v doesn't match the file: %v", span, err)
+		}
+	}
+	if count := connections.Load(); count != 1 {
+		t.Fatalf("Expected the connection to be reused across ranges, opened %d", count)
+	}
+
+	actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 40000, 3))
+	if err != nil || string(actual) != string(data) {
+		t.Fatalf("Download doesn't match the file: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package fastar
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// --sign=s3:REGION signs every HTTP(S) request with AWS Signature Version 4
+// and the keys from --s3-access-key and --s3-secret-key, so S3 compatible
+// gateways can be read from their plain https URLs without presigning them
+// first or an AWS config on the host.
+var s3Signer = v4.NewSigner()
+
+// The SHA256 of an empty body, which GET and HEAD requests sign.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// The region of --sign, checking it's for S3.
+func signRegion(sign string) string {
+	service, region, _ := strings.Cut(sign, ":")
+	if service != "s3" || region == "" {
+		fatalf("--sign must be s3:REGION, got %q", sign)
+	}
+	return region
+}
+
+// Credentials given with --s3-access-key and --s3-secret-key, nil without
+// them to fall back on the AWS config and environment.
+func staticS3Credentials() aws.CredentialsProvider {
+	if opts.S3AccessKey == "" {
+		return nil
+	}
+	return aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{
+			AccessKeyID:     opts.S3AccessKey,
+			SecretAccessKey: opts.S3SecretKey,
+			SessionToken:    opts.S3SessionToken,
+			Source:          "fastar flags",
+		}, nil
+	})
+}
+
+func checkS3Keys() {
+	if (opts.S3AccessKey == "") != (opts.S3SecretKey == "") {
+		fatal("--s3-access-key and --s3-secret-key must be passed together")
+	}
+	if opts.S3SessionToken != "" && opts.S3AccessKey == "" {
+		fatal("--s3-session-token needs --s3-access-key and --s3-secret-key")
+	}
+	if opts.Sign != "" {
+		signRegion(opts.Sign)
+		if opts.S3AccessKey == "" {
+			fatal("--sign needs --s3-access-key and --s3-secret-key")
+		}
+	}
+}
+
+// Signs req for --sign, after every other header is set since they're
+// signed too. Requests with a body, the streaming PUT of fastar create,
+// leave it unsigned as S3 allows over TLS.
+func signRequest(req *http.Request) {
+	if opts.Sign == "" {
+		return
+	}
+	payloadHash := emptyPayloadHash
+	if req.Body != nil && req.Body != http.NoBody {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	credentials, _ := staticS3Credentials().Retrieve(req.Context())
+	if err := s3Signer.SignHTTP(req.Context(), credentials, req, payloadHash, "s3", signRegion(opts.Sign), time.Now()); err != nil {
+		fatal("Failed to sign request for --sign: ", err.Error())
+	}
+}
@@ -0,0 +1,57 @@
+package fastar
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSignRequest(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.Sign = "s3:eu-west-1"
+	opts.S3AccessKey = "AKIDEXAMPLE"
+	opts.S3SecretKey = "secret"
+	opts.S3SessionToken = "token"
+
+	req, _ := http.NewRequest("GET", "https://minio.internal:9000/bucket/image.tar", nil)
+	req.Header.Set("Range", "bytes=0-99")
+	applyCommandHeaders(req)
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(authorization, "/eu-west-1/s3/aws4_request") {
+		t.Fatalf("Unexpected Authorization %q", authorization)
+	}
+	if !strings.Contains(authorization, "range") {
+		t.Fatalf("Expected the Range header to be signed, got %q", authorization)
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "token" || req.Header.Get("X-Amz-Content-Sha256") != emptyPayloadHash {
+		t.Fatalf("Unexpected signing headers %v", req.Header)
+	}
+
+	// Signing again for a retry replaces the signature rather than adding one.
+	applyCommandHeaders(req)
+	if len(req.Header.Values("Authorization")) != 1 {
+		t.Fatalf("Expected one Authorization header, got %v", req.Header.Values("Authorization"))
+	}
+
+	put, _ := http.NewRequest("PUT", "https://minio.internal:9000/bucket/image.tar", strings.NewReader("data"))
+	signRequest(put)
+	if put.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+		t.Fatalf("Expected the PUT body to be unsigned, got %v", put.Header)
+	}
+}
+
+func TestS3ClientStaticCredentials(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.S3AccessKey = "AKIDEXAMPLE"
+	opts.S3SecretKey = "secret"
+	opts.S3Endpoint = "https://minio.internal:9000"
+
+	client := newS3Client(http.DefaultClient, false)
+	credentials, err := client.Options().Credentials.Retrieve(context.Background())
+	if err != nil || credentials.AccessKeyID != "AKIDEXAMPLE" || credentials.SecretAccessKey != "secret" {
+		t.Fatalf("Expected the credentials of the flags, got %+v, %v", credentials, err)
+	}
+}
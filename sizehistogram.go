@@ -0,0 +1,85 @@
+package fastar
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Extracted files bucketed by size, logged at the end of extraction with
+// how fast each bucket was written. Archives dominated by small files are
+// bound by per-file syscalls and want more --write-workers, ones with big
+// files by write bandwidth.
+var fileSizeBuckets = []int64{4 << 10, 64 << 10, 1 << 20, 16 << 20, 256 << 20}
+
+type fileSizeBucket struct {
+	files      atomic.Int64
+	bytes      atomic.Int64
+	writeNanos atomic.Int64
+}
+
+// One more than the bounds, the last bucket holds everything bigger.
+var fileSizeHistogram = make([]fileSizeBucket, len(fileSizeBuckets)+1)
+
+func recordFileSize(size int, took time.Duration) {
+	bucket := len(fileSizeBuckets)
+	for i, bound := range fileSizeBuckets {
+		if int64(size) <= bound {
+			bucket = i
+			break
+		}
+	}
+	fileSizeHistogram[bucket].files.Add(1)
+	fileSizeHistogram[bucket].bytes.Add(int64(size))
+	fileSizeHistogram[bucket].writeNanos.Add(int64(took))
+}
+
+func fileSizeBucketName(bucket int) string {
+	if bucket == len(fileSizeBuckets) {
+		return ">" + formatSize(fileSizeBuckets[bucket-1])
+	}
+	return "<=" + formatSize(fileSizeBuckets[bucket])
+}
+
+func formatSize(size int64) string {
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if size < 1<<10 || unit == "GiB" {
+			return fmt.Sprintf("%d%s", size, unit)
+		}
+		size >>= 10
+	}
+	return ""
+}
+
+// Logs the histogram of the files extracted so far. Throughput is per
+// writer, summed over the time each file took to write, so it's comparable
+// between buckets regardless of how many writers were busy at once.
+func logFileSizeHistogram() {
+	var buckets []map[string]interface{}
+	for i := range fileSizeHistogram {
+		files := fileSizeHistogram[i].files.Load()
+		if files == 0 {
+			continue
+		}
+		bytes := fileSizeHistogram[i].bytes.Load()
+		seconds := time.Duration(fileSizeHistogram[i].writeNanos.Load()).Seconds()
+		mbps := 0.0
+		if seconds > 0 {
+			mbps = float64(bytes) / 1e6 / seconds
+		}
+		if len(buckets) == 0 {
+			log.Println("Extracted files by size:")
+		}
+		log.Printf("  %-9s %d files, %d bytes, %.3fMBps per writer\n", fileSizeBucketName(i), files, bytes, mbps)
+		buckets = append(buckets, map[string]interface{}{
+			"bucket": fileSizeBucketName(i),
+			"files":  files,
+			"bytes":  bytes,
+			"mbps":   mbps,
+		})
+	}
+	if len(buckets) > 0 {
+		emitEvent("file_size_histogram", map[string]interface{}{"buckets": buckets})
+	}
+}
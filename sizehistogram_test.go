@@ -0,0 +1,27 @@
+package fastar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileSizeHistogram(t *testing.T) {
+	defer func() { fileSizeHistogram = make([]fileSizeBucket, len(fileSizeBuckets)+1) }()
+	fileSizeHistogram = make([]fileSizeBucket, len(fileSizeBuckets)+1)
+	for _, size := range []int{0, 100, 4 << 10, 4<<10 + 1, 2 << 20, 1 << 30} {
+		recordFileSize(size, time.Millisecond)
+	}
+	expected := []int64{3, 1, 0, 1, 0, 1}
+	for i, files := range expected {
+		if got := fileSizeHistogram[i].files.Load(); got != files {
+			t.Fatalf("Bucket %s has %d files, wanted %d", fileSizeBucketName(i), got, files)
+		}
+	}
+	if name := fileSizeBucketName(len(fileSizeBuckets)); name != ">256MiB" {
+		t.Fatalf("Got bucket name %s", name)
+	}
+	if name := fileSizeBucketName(0); name != "<=4KiB" {
+		t.Fatalf("Got bucket name %s", name)
+	}
+	logFileSizeHistogram()
+}
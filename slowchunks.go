@@ -0,0 +1,82 @@
+package fastar
+
+import (
+	"container/heap"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The --slow-chunks slowest chunks of the download, to correlate stragglers
+// with the origin shards serving those byte ranges. Logged every minute
+// while they change, and once more at the end of the run.
+type chunkLatency struct {
+	Worker   int64   `json:"worker"`
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Millis   float64 `json:"millis"`
+	Attempts int     `json:"attempts"`
+}
+
+// Min-heap on latency, so the fastest of the slowest chunks is the one
+// that gets evicted.
+type chunkLatencyHeap []chunkLatency
+
+func (h chunkLatencyHeap) Len() int            { return len(h) }
+func (h chunkLatencyHeap) Less(i, j int) bool  { return h[i].Millis < h[j].Millis }
+func (h chunkLatencyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *chunkLatencyHeap) Push(x interface{}) { *h = append(*h, x.(chunkLatency)) }
+func (h *chunkLatencyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+var (
+	slowChunksMutex   sync.Mutex
+	slowChunks        chunkLatencyHeap
+	slowChunksChanged bool
+	slowChunksLogged  = time.Now()
+)
+
+func recordChunkLatency(chunk chunkLatency) {
+	if opts.SlowChunks <= 0 {
+		return
+	}
+	slowChunksMutex.Lock()
+	defer slowChunksMutex.Unlock()
+	if len(slowChunks) < opts.SlowChunks {
+		heap.Push(&slowChunks, chunk)
+		slowChunksChanged = true
+	} else if chunk.Millis > slowChunks[0].Millis {
+		slowChunks[0] = chunk
+		heap.Fix(&slowChunks, 0)
+		slowChunksChanged = true
+	}
+	if slowChunksChanged && time.Since(slowChunksLogged) >= time.Minute {
+		logSlowChunksLocked("so far")
+	}
+}
+
+// Logs the slowest chunks of the whole download.
+func logSlowestChunks() {
+	slowChunksMutex.Lock()
+	defer slowChunksMutex.Unlock()
+	if len(slowChunks) > 0 {
+		logSlowChunksLocked("overall")
+	}
+}
+
+func logSlowChunksLocked(when string) {
+	chunks := append([]chunkLatency(nil), slowChunks...)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Millis > chunks[j].Millis })
+	log.Printf("Slowest %d chunks %s:\n", len(chunks), when)
+	for _, chunk := range chunks {
+		log.Printf("  bytes %d-%d by worker %d took %.0fms over %d attempts\n", chunk.Start, chunk.End, chunk.Worker, chunk.Millis, chunk.Attempts)
+	}
+	emitEvent("slow_chunks", map[string]interface{}{"final": when == "overall", "chunks": chunks})
+	slowChunksChanged = false
+	slowChunksLogged = time.Now()
+}
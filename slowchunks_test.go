@@ -0,0 +1,25 @@
+package fastar
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestRecordChunkLatency(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; slowChunks = nil }()
+	opts.SlowChunks = 3
+	slowChunks = nil
+	for i, millis := range []float64{50, 10, 300, 20, 100, 5, 200} {
+		recordChunkLatency(chunkLatency{Worker: int64(i), Start: int64(i) * 10, End: int64(i+1) * 10, Millis: millis, Attempts: 1})
+	}
+	var millis []float64
+	for _, chunk := range slowChunks {
+		millis = append(millis, chunk.Millis)
+	}
+	sort.Float64s(millis)
+	if len(millis) != 3 || millis[0] != 100 || millis[1] != 200 || millis[2] != 300 {
+		t.Fatalf("Kept %v, wanted the 3 slowest chunks", millis)
+	}
+	logSlowestChunks()
+}
@@ -0,0 +1,106 @@
+package fastar
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+// Filesystems where every operation is a round trip to a server, by
+// statfs f_type. s3fs, goofys, gcsfuse and the like all show up as FUSE.
+var slowFilesystems = map[int64]string{
+	0x65735546: "fuse",
+	0x6969:     "nfs",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x01021997: "9p",
+	0x00c36400: "ceph",
+	0x0bd00bd0: "lustre",
+}
+
+// Write settings used on slow filesystems. A few writers with big writes
+// keep such a filesystem busy without piling up requests behind each other.
+const (
+	slowFsWriteWorkers = 4
+	slowFsWriteSlice   = 64 << 20
+)
+
+// Name of the slow filesystem --directory is on, empty for local ones.
+var slowTarget string
+
+// Set once chown or chmod failed on a slow filesystem that doesn't
+// support them, after which extraction stops trying.
+var chownUnsupported, chmodUnsupported atomic.Bool
+
+// Returns the name of the filesystem dir is on if it's a slow one. dir
+// may not exist yet, in which case its closest existing parent decides.
+func slowFilesystem(dir string) string {
+	for {
+		fsType, err := filesystemType(dir)
+		if err == nil {
+			return slowFilesystems[fsType]
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, syscall.ENOENT) || parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Adapts extraction to --directory being on a network or FUSE filesystem:
+// fewer write workers, larger writes, and chown/chmod are given up on once
+// the filesystem rejects them. Returns the number of write workers to use.
+func tuneForTargetFilesystem(writeWorkers int) int {
+	chownUnsupported.Store(false)
+	chmodUnsupported.Store(false)
+	writeSlice = writeSliceSize
+	slowTarget = ""
+	if opts.NoFsTuning {
+		return writeWorkers
+	}
+	slowTarget = slowFilesystem(opts.OutputDir)
+	if slowTarget == "" {
+		return writeWorkers
+	}
+	writeSlice = slowFsWriteSlice
+	// The autoscaler already backs off on its own as latency climbs.
+	if !opts.AutoscaleWrites && writeWorkers > slowFsWriteWorkers {
+		log.Printf("%s is on %s, writing with %d workers instead of %d, pass --no-fs-tuning to keep them\n", opts.OutputDir, slowTarget, slowFsWriteWorkers, writeWorkers)
+		writeWorkers = slowFsWriteWorkers
+	}
+	return writeWorkers
+}
+
+// Whether err means the filesystem doesn't support an operation at all,
+// as opposed to this particular call not being allowed.
+func unsupportedOnTarget(err error) bool {
+	return slowTarget != "" && (errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM))
+}
+
+func chownEntry(path string, uid, gid int, lchown bool) {
+	if !ownersSupported || chownUnsupported.Load() {
+		return
+	}
+	var err error
+	if lchown {
+		err = os.Lchown(path, uid, gid)
+	} else {
+		err = os.Chown(path, uid, gid)
+	}
+	if err != nil && unsupportedOnTarget(err) && !chownUnsupported.Swap(true) {
+		log.Printf("%s doesn't support chown, not setting owners: %s\n", slowTarget, err.Error())
+	}
+}
+
+func chmodEntry(path string, mode os.FileMode) {
+	if chmodUnsupported.Load() {
+		return
+	}
+	if err := os.Chmod(path, mode); err != nil && unsupportedOnTarget(err) && !chmodUnsupported.Swap(true) {
+		log.Printf("%s doesn't support chmod, not setting modes: %s\n", slowTarget, err.Error())
+	}
+}
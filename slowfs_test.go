@@ -0,0 +1,35 @@
+package fastar
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTuneForTargetFilesystem(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts; slowTarget = "" }()
+	opts.OutputDir = filepath.Join(t.TempDir(), "not", "created", "yet")
+	if name := slowFilesystem(opts.OutputDir); name != "" {
+		t.Skip("Test directory is on ", name)
+	}
+	if workers := tuneForTargetFilesystem(16); workers != 16 || writeSlice != writeSliceSize {
+		t.Fatalf("Expected a local filesystem to keep its settings, got %d workers and %d byte writes", workers, writeSlice)
+	}
+
+	// Rejections only disable chown and chmod on slow filesystems.
+	if unsupportedOnTarget(syscall.EPERM) {
+		t.Fatal("Expected EPERM on a local filesystem to be a per-call failure")
+	}
+	slowTarget = "fuse"
+	if !unsupportedOnTarget(syscall.ENOTSUP) || unsupportedOnTarget(syscall.ENOENT) {
+		t.Fatal("Expected only ENOTSUP, ENOSYS and EPERM to mean unsupported")
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(path, nil, 0644)
+	chmodEntry(path, 0600)
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 || chmodUnsupported.Load() {
+		t.Fatalf("Expected chmod to be applied, got %v", info.Mode())
+	}
+}
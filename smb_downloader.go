@@ -0,0 +1,130 @@
+package fastar
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+const defaultSmbPort = "445"
+
+// NTSTATUS codes the server answers with, see [MS-ERREF].
+const (
+	smbStatusLogonFailure   = 0xc000006d
+	smbStatusBadNetworkName = 0xc00000cc
+)
+
+// Downloader for Windows/Samba file shares, handles
+// smb://[domain;]user@server[:port]/share/path URLs.
+//
+// Authenticates with NTLM. The password is read from $SMB_PASSWORD unless
+// given in the URL. Kerberos isn't supported by the underlying SMB client.
+//
+// A single SMB session is shared by all workers, each ranged read opens its
+// own handle on the file.
+type SmbDownloader struct {
+	Url   string
+	path  string
+	share *smb2.Share
+}
+
+func NewSmbDownloader(rawUrl string) SmbDownloader {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		fatal("Failed to parse SMB url: ", err.Error())
+	}
+	parts := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		fatal("SMB url must be of the form smb://[domain;]user@server/share/path")
+	}
+	shareName, path := parts[0], parts[1]
+
+	initiator := &smb2.NTLMInitiator{Password: os.Getenv("SMB_PASSWORD")}
+	if parsed.User != nil {
+		initiator.User = parsed.User.Username()
+		if password, ok := parsed.User.Password(); ok {
+			initiator.Password = password
+		}
+	}
+	// smb:// URLs conventionally put the domain in front of the user.
+	if domain, user, found := strings.Cut(initiator.User, ";"); found {
+		initiator.Domain, initiator.User = domain, user
+	}
+
+	host := parsed.Host
+	if parsed.Port() == "" {
+		host = net.JoinHostPort(parsed.Hostname(), defaultSmbPort)
+	}
+	conn, err := dial("tcp", host)
+	if err != nil {
+		fatal("Failed to connect to SMB server: ", err.Error())
+	}
+	dialer := &smb2.Dialer{Initiator: initiator}
+	session, err := dialer.Dial(conn)
+	handleSmbError(err, "login")
+	share, err := session.Mount(shareName)
+	handleSmbError(err, "mount")
+	return SmbDownloader{rawUrl, path, share}
+}
+
+func (smbDownloader SmbDownloader) GetFileInfo() (int64, bool, bool) {
+	info, err := smbDownloader.share.Stat(smbDownloader.path)
+	handleSmbError(err, "GetFileInfo")
+	if info.IsDir() {
+		fatal("SMB path is a directory, not a file")
+	}
+	return info.Size(), true, false
+}
+
+func (smbDownloader SmbDownloader) Get() io.ReadCloser {
+	file, err := smbDownloader.share.Open(smbDownloader.path)
+	handleSmbError(err, "Get")
+	return file
+}
+
+func (smbDownloader SmbDownloader) GetRange(start, end int64) io.ReadCloser {
+	file, err := smbDownloader.share.Open(smbDownloader.path)
+	handleSmbError(err, "GetRange")
+	return smbRangeReader{io.NewSectionReader(file, start, end-start), file}
+}
+
+func (smbDownloader SmbDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported by SMB")
+}
+
+type smbRangeReader struct {
+	*io.SectionReader
+	file *smb2.File
+}
+
+func (r smbRangeReader) Close() error {
+	return r.file.Close()
+}
+
+// If err is nil, this is a noop. Otherwise the method will print an appropriate error message
+// and exit with the appropriate error code.
+func handleSmbError(err error, requestType string) {
+	if err == nil {
+		return
+	}
+	var status uint32
+	var responseErr *smb2.ResponseError
+	if errors.As(err, &responseErr) {
+		status = responseErr.Code
+	}
+	if os.IsNotExist(err) || status == smbStatusBadNetworkName {
+		log.Printf("404, SMB %s failed, share or file doesn't exist: %s\n", requestType, err.Error())
+		exit(ErrNotFound)
+	} else if os.IsPermission(err) || status == smbStatusLogonFailure {
+		log.Printf("SMB %s failed to authenticate: %s\n", requestType, err.Error())
+		exit(ErrPermission)
+	}
+	fatalf("SMB %s failed: %s", requestType, err.Error())
+}
@@ -0,0 +1,300 @@
+package fastar
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	smbNegotiate    = 0
+	smbSessionSetup = 1
+	smbTreeConnect  = 3
+	smbCreate       = 5
+	smbClose        = 6
+	smbRead         = 8
+
+	smbStatusMoreProcessingRequired = 0xc0000016
+	smbStatusEndOfFile              = 0xc0000011
+	smbStatusObjectNameNotFound     = 0xc0000034
+	smbStatusNotSupported           = 0xc00000bb
+)
+
+var smbServerChallenge = []byte("fastar!!")
+
+func smbUtf16(s string) []byte {
+	var encoded []byte
+	for _, unit := range utf16.Encode([]rune(s)) {
+		encoded = binary.LittleEndian.AppendUint16(encoded, unit)
+	}
+	return encoded
+}
+
+func smbString(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// The NTLM message in an SPNEGO token, fields of NTLM messages are offsets
+// from its start so anything following it doesn't matter.
+func smbNtlmMessage(token []byte) []byte {
+	if start := bytes.Index(token, []byte("NTLMSSP\x00")); start >= 0 {
+		return token[start:]
+	}
+	return nil
+}
+
+// A length, max length, offset field of an NTLM message.
+func smbNtlmField(message []byte, at int) []byte {
+	length := int(binary.LittleEndian.Uint16(message[at:]))
+	offset := int(binary.LittleEndian.Uint32(message[at+4:]))
+	if offset+length > len(message) {
+		return nil
+	}
+	return message[offset : offset+length]
+}
+
+// The SPNEGO answer to the client's NTLM negotiate message, carrying a
+// challenge with the flags the client asked for.
+func smbChallengeToken(negotiate []byte) []byte {
+	targetName := smbUtf16("FAKE")
+	challenge := append([]byte("NTLMSSP\x00"), 2, 0, 0, 0)
+	challenge = binary.LittleEndian.AppendUint16(challenge, uint16(len(targetName)))
+	challenge = binary.LittleEndian.AppendUint16(challenge, uint16(len(targetName)))
+	challenge = binary.LittleEndian.AppendUint32(challenge, 56)
+	challenge = append(challenge, negotiate[12:16]...)
+	challenge = append(challenge, smbServerChallenge...)
+	challenge = append(challenge, make([]byte, 8)...)
+	// Target info with nothing but the terminating pair.
+	challenge = binary.LittleEndian.AppendUint16(challenge, 4)
+	challenge = binary.LittleEndian.AppendUint16(challenge, 4)
+	challenge = binary.LittleEndian.AppendUint32(challenge, uint32(56+len(targetName)))
+	challenge = append(challenge, make([]byte, 8)...)
+	challenge = append(append(challenge, targetName...), 0, 0, 0, 0)
+
+	inner, _ := asn1.Marshal(struct {
+		NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+		SupportedMech asn1.ObjectIdentifier `asn1:"explicit,tag:1"`
+		ResponseToken []byte                `asn1:"explicit,tag:2"`
+	}{1, asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}, challenge})
+	token, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: inner})
+	return token
+}
+
+// Whether an NTLMv2 authenticate message proves the password of user in
+// domain.
+func smbAuthenticated(authenticate []byte, domain, user, password string) bool {
+	if len(authenticate) < 64 {
+		return false
+	}
+	response := smbNtlmField(authenticate, 20)
+	if len(response) < 16 || smbString(smbNtlmField(authenticate, 28)) != domain || smbString(smbNtlmField(authenticate, 36)) != user {
+		return false
+	}
+	passwordHash := md4.New()
+	passwordHash.Write(smbUtf16(password))
+	ntowf := hmac.New(md5.New, passwordHash.Sum(nil))
+	ntowf.Write(smbUtf16(strings.ToUpper(user) + domain))
+	proof := hmac.New(md5.New, ntowf.Sum(nil))
+	proof.Write(smbServerChallenge)
+	proof.Write(response[16:])
+	return hmac.Equal(proof.Sum(nil), response[:16])
+}
+
+// Answers SMB 2.1 requests from a single client, which has to log in as
+// CORP\fastar with the password "secret". The share has the file
+// dir/file.tar and the directory dir.
+func fakeSmbServer(conn net.Conn, data []byte) {
+	defer conn.Close()
+	reply := func(request []byte, status uint32, body []byte) {
+		header := append([]byte{}, request[:64]...)
+		binary.LittleEndian.PutUint32(header[8:], status)
+		// Grants the credits asked for, at least one.
+		if binary.LittleEndian.Uint16(header[14:]) == 0 {
+			header[14] = 1
+		}
+		binary.LittleEndian.PutUint32(header[16:], 1)
+		binary.LittleEndian.PutUint64(header[40:], 1)
+		copy(header[48:], make([]byte, 16))
+		if status != 0 && status != smbStatusMoreProcessingRequired {
+			body = []byte{9, 0, 0, 0, 0, 0, 0, 0, 0}
+		}
+		packet := binary.BigEndian.AppendUint32(nil, uint32(64+len(body)))
+		conn.Write(append(append(packet, header...), body...))
+	}
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(conn, request); err != nil || len(request) < 64 {
+			return
+		}
+		body := request[64:]
+		switch binary.LittleEndian.Uint16(request[12:]) {
+		case smbNegotiate:
+			response := make([]byte, 64)
+			response[0] = 65
+			// Signing is enabled but not required, dialect 2.1.
+			response[2] = 1
+			binary.LittleEndian.PutUint16(response[4:], 0x0210)
+			for _, at := range []int{28, 32, 36} {
+				binary.LittleEndian.PutUint32(response[at:], 65536)
+			}
+			reply(request, 0, response)
+		case smbSessionSetup:
+			token := body[binary.LittleEndian.Uint16(body[12:])-64:]
+			message := smbNtlmMessage(token[:binary.LittleEndian.Uint16(body[14:])])
+			if len(message) < 16 {
+				return
+			}
+			status, securityBuffer := uint32(smbStatusMoreProcessingRequired), []byte(nil)
+			if binary.LittleEndian.Uint32(message[8:]) == 1 {
+				securityBuffer = smbChallengeToken(message)
+			} else if smbAuthenticated(message, "CORP", "fastar", "secret") {
+				status = 0
+			} else {
+				status = smbStatusLogonFailure
+			}
+			response := []byte{9, 0, 0, 0, 72, 0}
+			response = binary.LittleEndian.AppendUint16(response, uint16(len(securityBuffer)))
+			reply(request, status, append(response, securityBuffer...))
+		case smbTreeConnect:
+			path := smbString(request[binary.LittleEndian.Uint16(body[4:]):][:binary.LittleEndian.Uint16(body[6:])])
+			if !strings.HasSuffix(path, `\share`) {
+				reply(request, smbStatusBadNetworkName, nil)
+				continue
+			}
+			binary.LittleEndian.PutUint32(request[36:], 1)
+			reply(request, 0, []byte{16, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0x01, 0x1f, 0})
+		case smbCreate:
+			name := smbString(request[binary.LittleEndian.Uint16(body[44:]):][:binary.LittleEndian.Uint16(body[46:])])
+			response := make([]byte, 88)
+			response[0] = 89
+			switch name {
+			case `dir\file.tar`:
+				binary.LittleEndian.PutUint64(response[48:], uint64(len(data)))
+				binary.LittleEndian.PutUint32(response[56:], 0x80)
+			case `dir`:
+				binary.LittleEndian.PutUint32(response[56:], 0x10)
+			default:
+				reply(request, smbStatusObjectNameNotFound, nil)
+				continue
+			}
+			response[64] = 1
+			reply(request, 0, response)
+		case smbRead:
+			offset := int64(binary.LittleEndian.Uint64(body[8:]))
+			end := min(offset+int64(binary.LittleEndian.Uint32(body[4:])), int64(len(data)))
+			if offset >= end {
+				reply(request, smbStatusEndOfFile, nil)
+				continue
+			}
+			response := []byte{17, 0, 80, 0}
+			response = binary.LittleEndian.AppendUint32(response, uint32(end-offset))
+			response = append(response, make([]byte, 8)...)
+			reply(request, 0, append(response, data[offset:end]...))
+		case smbClose:
+			response := make([]byte, 60)
+			response[0] = 60
+			reply(request, 0, response)
+		default:
+			reply(request, smbStatusNotSupported, nil)
+		}
+	}
+}
+
+func TestSmbDownloader(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = 1000000
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	data := []byte(RandomString(300000))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fakeSmbServer(conn, data)
+		}
+	}()
+	server := listener.Addr().String()
+
+	downloader := NewSmbDownloader("smb://CORP;fastar:secret@" + server + "/share/dir/file.tar")
+	if size, rangeSupport, _ := downloader.GetFileInfo(); size != int64(len(data)) || !rangeSupport {
+		t.Fatalf("Expected %d bytes with range support, got %d", len(data), size)
+	}
+	for _, span := range [][2]int64{{0, 50000}, {123, 250123}} {
+		chunk := downloader.GetRange(span[0], span[1])
+		actual, err := io.ReadAll(chunk)
+		chunk.Close()
+		if err != nil || string(actual) != string(data[span[0]:span[1]]) {
+			t.Fatalf("Range %v doesn't match the file: %v", span, err)
+		}
+	}
+	body := downloader.Get()
+	actual, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(actual) != string(data) {
+		t.Fatalf("Get doesn't match the file: %v", err)
+	}
+	actual, err = io.ReadAll(GetDownloadStream(context.Background(), downloader, 40000, 3))
+	if err != nil || string(actual) != string(data) {
+		t.Fatalf("Download doesn't match the file: %v", err)
+	}
+
+	// Without a password in the URL it's taken from $SMB_PASSWORD.
+	t.Setenv("SMB_PASSWORD", "secret")
+	downloader = NewSmbDownloader("smb://CORP;fastar@" + server + "/share/dir/file.tar")
+	if size, _, _ := downloader.GetFileInfo(); size != int64(len(data)) {
+		t.Fatalf("Expected %d bytes logged in with $SMB_PASSWORD, got %d", len(data), size)
+	}
+
+	for _, test := range []struct {
+		url string
+		err error
+	}{
+		{"smb://CORP;fastar:wrong@" + server + "/share/dir/file.tar", ErrPermission},
+		{"smb://fastar:secret@" + server + "/share/dir/file.tar", ErrPermission},
+		{"smb://CORP;fastar:secret@" + server + "/other/dir/file.tar", ErrNotFound},
+		{"smb://CORP;fastar:secret@" + server + "/share/dir/missing.tar", ErrNotFound},
+		{"smb://CORP;fastar:secret@" + server + "/share/dir", nil},
+	} {
+		options := DefaultOptions()
+		options.RetryCount = 1
+		if err := beginCall(options); err != nil {
+			t.Fatal(err)
+		}
+		runOwned(func() { NewSmbDownloader(test.url).GetFileInfo() })
+		err := callError()
+		endCall()
+		if test.err == nil {
+			if err == nil || !strings.Contains(err.Error(), "directory") {
+				t.Fatalf("Expected %s to fail as a directory, got %v", test.url, err)
+			}
+		} else if !errors.Is(err, test.err) {
+			t.Fatalf("Expected %s to fail with %v, got %v", test.url, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Once --deadline-soft passes, workers stop requesting new chunks. The
+// chunks in flight are finished and passed on in order, then the first
+// chunk that wasn't started stops the download like SIGINT would: the
+// extraction stops cleanly, keeping the --resume journal, and fastar exits
+// with ETIMEDOUT after reporting how much of the file it got through, so a
+// scheduler can tell a job that ran out of time, and how far it got, from
+// one that failed.
+const softDeadlineStatus = int(syscall.ETIMEDOUT)
+
+var errSoftDeadline = errors.New("--deadline-soft reached")
+
+var softDeadline struct {
+	passed  atomic.Bool
+	stopped atomic.Bool
+	once    sync.Once
+	cancel  context.CancelCauseFunc
+}
+
+// Returns ctx, canceled once the download stopped at --deadline-soft.
+func startSoftDeadline(ctx context.Context) context.Context {
+	softDeadline.passed.Store(false)
+	softDeadline.stopped.Store(false)
+	softDeadline.once = sync.Once{}
+	ctx, cancel := context.WithCancelCause(ctx)
+	softDeadline.cancel = cancel
+	if opts.DeadlineSoft > 0 {
+		time.AfterFunc(time.Duration(opts.DeadlineSoft)*time.Second, passSoftDeadline)
+	}
+	return ctx
+}
+
+func passSoftDeadline() {
+	if softDeadline.passed.Swap(true) {
+		return
+	}
+	log.Printf("--deadline-soft of %ds reached, finishing the chunks in flight\n", opts.DeadlineSoft)
+}
+
+// Whether workers should stop requesting new chunks.
+func softDeadlinePassed() bool {
+	return softDeadline.passed.Load()
+}
+
+// Stops the download once the first delivered bytes of size, everything
+// requested before the deadline, have been passed on.
+func stopAtSoftDeadline(delivered int64, size int64) {
+	softDeadline.once.Do(func() {
+		fraction := 1.0
+		if size > 0 {
+			fraction = float64(delivered) / float64(size)
+		}
+		log.Printf("Stopped at --deadline-soft after %d of %d bytes (%.1f%%)\n", delivered, size, fraction*100)
+		if journal != nil {
+			log.Println("Rerun with --resume to carry on from here")
+		}
+		emitEvent("deadline_reached", map[string]interface{}{"downloaded": delivered, "size": size, "fraction": fraction})
+		softDeadline.stopped.Store(true)
+		if softDeadline.cancel != nil {
+			softDeadline.cancel(errSoftDeadline)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package fastar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestSoftDeadline(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.RetryCount = math.MaxInt64
+	ctx := startSoftDeadline(context.Background())
+	defer startSoftDeadline(context.Background())
+
+	data := RandomString(100000)
+	stream := GetDownloadStream(ctx, TestDownloader{data, true, false}, 100, 4)
+	head := make([]byte, 1000)
+	if _, err := io.ReadFull(stream, head); err != nil {
+		t.Fatal(err)
+	}
+	passSoftDeadline()
+	rest, err := io.ReadAll(stream)
+	actual := string(head) + string(rest)
+	if !errors.Is(err, errSoftDeadline) {
+		t.Fatalf("Expected the download to stop at the deadline, got %v", err)
+	}
+	if len(actual) == len(data) || len(actual)%100 != 0 || actual != data[:len(actual)] {
+		t.Fatalf("Expected whole chunks from the start of the file before the deadline, got %d bytes", len(actual))
+	}
+	if status := interruptedStatus(); status != softDeadlineStatus {
+		t.Fatalf("Expected to exit with %d, got %d", softDeadlineStatus, status)
+	}
+}
@@ -0,0 +1,295 @@
+// Package sourcepb implements the ByteRangeSource gRPC protocol defined in
+// source.proto.
+//
+// The messages are encoded by hand rather than generated with protoc to
+// keep the build free of code generation, but they are wire compatible
+// with source.proto so servers can be written in any language using the
+// standard protobuf toolchain.
+package sourcepb
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const ServiceName = "fastar.source.v1.ByteRangeSource"
+
+type GetInfoRequest struct {
+	Key string
+}
+
+type GetInfoResponse struct {
+	Size          int64
+	SupportsRange bool
+}
+
+type GetRangeRequest struct {
+	Key        string
+	Start, End int64
+}
+
+type GetRangeResponse struct {
+	Data []byte
+}
+
+func (m *GetInfoRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Key)
+	return b
+}
+
+func (m *GetInfoRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			m.Key = v
+			return n, nil
+		}
+		return -1, nil
+	})
+}
+
+func (m *GetInfoResponse) marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(m.Size))
+	b = appendVarint(b, 2, protowire.EncodeBool(m.SupportsRange))
+	return b
+}
+
+func (m *GetInfoResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.VarintType || (num != 1 && num != 2) {
+			return -1, nil
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if num == 1 {
+			m.Size = int64(v)
+		} else {
+			m.SupportsRange = protowire.DecodeBool(v)
+		}
+		return n, nil
+	})
+}
+
+func (m *GetRangeRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Key)
+	b = appendVarint(b, 2, uint64(m.Start))
+	b = appendVarint(b, 3, uint64(m.End))
+	return b
+}
+
+func (m *GetRangeRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			m.Key = v
+			return n, nil
+		} else if (num == 2 || num == 3) && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if num == 2 {
+				m.Start = int64(v)
+			} else {
+				m.End = int64(v)
+			}
+			return n, nil
+		}
+		return -1, nil
+	})
+}
+
+func (m *GetRangeResponse) marshal() []byte {
+	var b []byte
+	if len(m.Data) > 0 {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Data)
+	}
+	return b
+}
+
+func (m *GetRangeResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			m.Data = append(m.Data[:0], v...)
+			return n, nil
+		}
+		return -1, nil
+	})
+}
+
+// proto3 omits fields set to their zero value.
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// Walks every field in b, calling consume for each. consume returns the
+// number of bytes of the field value it parsed, or -1 to skip an unknown
+// field.
+func consumeFields(b []byte, consume func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := consume(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == -1 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+type message interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+// Codec encodes the messages in this package. It has to be forced on both
+// clients (grpc.ForceCodec) and servers (grpc.ForceServerCodec) since the
+// message types don't implement proto.Message.
+type Codec struct{}
+
+func (Codec) Name() string { return "proto" }
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(message); ok {
+		return m.marshal(), nil
+	}
+	return nil, fmt.Errorf("sourcepb: unsupported message type %T", v)
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(message); ok {
+		return m.unmarshal(data)
+	}
+	return fmt.Errorf("sourcepb: unsupported message type %T", v)
+}
+
+// Client side of the protocol.
+type Client struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{cc}
+}
+
+func (c *Client) GetInfo(ctx context.Context, in *GetInfoRequest) (*GetInfoResponse, error) {
+	out := new(GetInfoResponse)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/GetInfo", in, out, grpc.ForceCodec(Codec{})); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Client) GetRange(ctx context.Context, in *GetRangeRequest) (*RangeClientStream, error) {
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[0], "/"+ServiceName+"/GetRange", grpc.ForceCodec(Codec{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &RangeClientStream{stream}, nil
+}
+
+type RangeClientStream struct {
+	stream grpc.ClientStream
+}
+
+func (s *RangeClientStream) Recv() (*GetRangeResponse, error) {
+	m := new(GetRangeResponse)
+	if err := s.stream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server side of the protocol.
+type SourceServer interface {
+	GetInfo(context.Context, *GetInfoRequest) (*GetInfoResponse, error)
+	GetRange(*GetRangeRequest, RangeServerStream) error
+}
+
+type RangeServerStream interface {
+	Send(*GetRangeResponse) error
+	Context() context.Context
+}
+
+type rangeServerStream struct {
+	grpc.ServerStream
+}
+
+func (s rangeServerStream) Send(m *GetRangeResponse) error {
+	return s.ServerStream.SendMsg(m)
+}
+
+// Registers srv on s. s must have been created with
+// grpc.ForceServerCodec(sourcepb.Codec{}).
+func RegisterSourceServer(s *grpc.Server, srv SourceServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*SourceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetInfo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(GetInfoRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(SourceServer).GetInfo(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/GetInfo"}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(SourceServer).GetInfo(ctx, req.(*GetInfoRequest))
+				})
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetRange",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := new(GetRangeRequest)
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(SourceServer).GetRange(in, rangeServerStream{stream})
+			},
+		},
+	},
+	Metadata: "source.proto",
+}
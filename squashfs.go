@@ -0,0 +1,408 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	squashfsMagic        = 0x73717368
+	squashfsBlockSize    = 128 << 10
+	squashfsBlockLog     = 17
+	squashfsMetadataSize = 8192
+	squashfsZlib         = 1
+	squashfsNoFragments  = 1 << 4
+	squashfsNoXattrs     = 1 << 9
+	squashfsInvalid      = 0xffffffffffffffff
+	squashfsInvalidIndex = 0xffffffff
+	// Set in a data block's size if it's stored uncompressed.
+	squashfsUncompressedBlock = 1 << 24
+	// Set in a metadata block's header if it's stored uncompressed.
+	squashfsUncompressedMeta = 1 << 15
+	squashfsSuperblockSize   = 96
+	squashfsPadding          = 4096
+)
+
+// Basic inode types, also used for directory entries. Directories and files
+// are always written as the extended variants (basic type + 7).
+const (
+	squashfsDirType = iota + 1
+	squashfsFileType
+	squashfsSymlinkType
+	squashfsBlockDevType
+	squashfsCharDevType
+	squashfsFifoType
+	squashfsSocketType
+	squashfsExtendedOffset = 7
+)
+
+type squashfsInode struct {
+	// Regular files, filled in as their data blocks are written.
+	blocksStart int64
+	blockSizes  []uint32
+	// Assigned when writing metadata.
+	number  uint32
+	block   uint32
+	offset  uint16
+	written bool
+}
+
+// A data block on its way through the compression workers. Blocks are
+// written out in the order they're queued in.
+type squashfsBlock struct {
+	node         *imageNode
+	first        bool
+	data         []byte
+	uncompressed bool
+	ready        chan bool
+}
+
+// Converts a tar stream into a SquashFS 4.0 image (zlib compressed, no
+// fragments or xattrs) without extracting it to disk first.
+//
+// File contents are split into blocks which are compressed by
+// --write-workers goroutines and appended to the image in order as the tar
+// is read. Only the directory tree is held in memory, inodes and directory
+// listings are written after the data once the whole tree is known.
+func WriteSquashfs(stream io.Reader, imagePath string) {
+	image, err := os.Create(imagePath)
+	if err != nil {
+		fatal("Failed to create SquashFS image: ", err.Error())
+	}
+	defer image.Close()
+	if _, err := image.Seek(squashfsSuperblockSize, io.SeekStart); err != nil {
+		fatal("Failed to seek SquashFS image: ", err.Error())
+	}
+
+	jobs := make(chan *squashfsBlock, opts.WriteWorkers)
+	ordered := make(chan *squashfsBlock, opts.WriteWorkers*2)
+	for i := 0; i < opts.WriteWorkers; i++ {
+		go compressSquashfsBlocks(jobs)
+	}
+	offset := int64(squashfsSuperblockSize)
+	var writerDone sync.WaitGroup
+	writerDone.Add(1)
+	go func() {
+		defer writerDone.Done()
+		for block := range ordered {
+			<-block.ready
+			if block.first {
+				block.node.squashfs.blocksStart = offset
+			}
+			if _, err := image.Write(block.data); err != nil {
+				fatal("Failed to write SquashFS image: ", err.Error())
+			}
+			offset += int64(len(block.data))
+			size := uint32(len(block.data))
+			if block.uncompressed {
+				size |= squashfsUncompressedBlock
+			}
+			block.node.squashfs.blockSizes = append(block.node.squashfs.blockSizes, size)
+		}
+	}()
+
+	root := readImageTree(stream, func(node *imageNode, data io.Reader) {
+		for first := true; ; first = false {
+			buf := make([]byte, squashfsBlockSize)
+			n, err := io.ReadFull(data, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				fatal("Failed to read from resp:", err.Error())
+			}
+			if n == 0 {
+				break
+			}
+			block := &squashfsBlock{node: node, first: first, data: buf[:n], ready: make(chan bool)}
+			jobs <- block
+			ordered <- block
+		}
+	})
+	close(jobs)
+	close(ordered)
+	writerDone.Wait()
+
+	writer := &squashfsWriter{idIndex: map[uint32]uint16{}}
+	writer.number(root)
+	writer.writeInode(root, writer.inodeCount+1)
+	inodeTable := writer.inodes.finish()
+	directoryTable := writer.directories.finish()
+	var ids metadataWriter
+	for _, id := range writer.ids {
+		binary.Write(&ids, binary.LittleEndian, id)
+	}
+	idTable := ids.finish()
+
+	inodeTableStart := offset
+	directoryTableStart := inodeTableStart + int64(len(inodeTable))
+	idBlocksStart := directoryTableStart + int64(len(directoryTable))
+	idTableStart := idBlocksStart + int64(len(idTable))
+	var tail bytes.Buffer
+	tail.Write(inodeTable)
+	tail.Write(directoryTable)
+	tail.Write(idTable)
+	for _, start := range ids.blockStarts {
+		binary.Write(&tail, binary.LittleEndian, uint64(idBlocksStart+int64(start)))
+	}
+	bytesUsed := offset + int64(tail.Len())
+	if padding := bytesUsed % squashfsPadding; padding != 0 {
+		tail.Write(make([]byte, squashfsPadding-padding))
+	}
+	if _, err := image.Write(tail.Bytes()); err != nil {
+		fatal("Failed to write SquashFS image: ", err.Error())
+	}
+
+	var superblock bytes.Buffer
+	for _, field := range []interface{}{
+		uint32(squashfsMagic),
+		writer.inodeCount,
+		uint32(time.Now().Unix()),
+		uint32(squashfsBlockSize),
+		uint32(0), // Fragment count
+		uint16(squashfsZlib),
+		uint16(squashfsBlockLog),
+		uint16(squashfsNoFragments | squashfsNoXattrs),
+		uint16(len(writer.ids)),
+		uint16(4), // Major version
+		uint16(0), // Minor version
+		uint64(root.squashfs.block)<<16 | uint64(root.squashfs.offset),
+		uint64(bytesUsed),
+		uint64(idTableStart),
+		uint64(squashfsInvalid), // Xattr table
+		uint64(inodeTableStart),
+		uint64(directoryTableStart),
+		uint64(idBlocksStart),   // Empty fragment table
+		uint64(squashfsInvalid), // Export table
+	} {
+		binary.Write(&superblock, binary.LittleEndian, field)
+	}
+	if _, err := image.WriteAt(superblock.Bytes(), 0); err != nil {
+		fatal("Failed to write SquashFS superblock: ", err.Error())
+	}
+	if err := image.Sync(); err != nil {
+		fatal("Failed to sync SquashFS image: ", err.Error())
+	}
+	log.Printf("Wrote SquashFS image %s with %d inodes (%d bytes)\n", imagePath, writer.inodeCount, bytesUsed)
+}
+
+// Stores blocks compressed unless that doesn't make them smaller.
+func compressSquashfsBlocks(jobs chan *squashfsBlock) {
+	var compressed bytes.Buffer
+	compressor := zlib.NewWriter(&compressed)
+	for block := range jobs {
+		compressed.Reset()
+		compressor.Reset(&compressed)
+		compressor.Write(block.data)
+		compressor.Close()
+		if compressed.Len() < len(block.data) {
+			block.data = append([]byte(nil), compressed.Bytes()...)
+		} else {
+			block.uncompressed = true
+		}
+		close(block.ready)
+	}
+}
+
+type squashfsWriter struct {
+	inodes      metadataWriter
+	directories metadataWriter
+	inodeCount  uint32
+	ids         []uint32
+	idIndex     map[uint32]uint16
+}
+
+// Assigns inode numbers in the same depth first order inodes are written
+// in, so entries of a directory get nearby numbers.
+func (w *squashfsWriter) number(node *imageNode) {
+	for _, name := range sortedChildren(node) {
+		if child := node.children[name]; child.squashfs.number == 0 {
+			w.number(child)
+		}
+	}
+	w.inodeCount++
+	node.squashfs.number = w.inodeCount
+}
+
+func squashfsKind(node *imageNode) uint16 {
+	switch node.header.Typeflag {
+	case tar.TypeDir:
+		return squashfsDirType
+	case tar.TypeReg:
+		return squashfsFileType
+	case tar.TypeSymlink:
+		return squashfsSymlinkType
+	case tar.TypeBlock:
+		return squashfsBlockDevType
+	case tar.TypeChar:
+		return squashfsCharDevType
+	default:
+		return squashfsFifoType
+	}
+}
+
+func (w *squashfsWriter) id(id int) uint16 {
+	index, ok := w.idIndex[uint32(id)]
+	if !ok {
+		index = uint16(len(w.ids))
+		w.idIndex[uint32(id)] = index
+		w.ids = append(w.ids, uint32(id))
+	}
+	return index
+}
+
+// Writes the inodes of a directory's children, then its listing and
+// finally the directory's own inode, since each needs to know where the
+// previous ones ended up.
+func (w *squashfsWriter) writeInode(node *imageNode, parentNumber uint32) {
+	var listingBlock uint32
+	var listingOffset uint16
+	var listingSize int
+	subdirs := uint32(0)
+	if node.isDir() {
+		names := sortedChildren(node)
+		for _, name := range names {
+			child := node.children[name]
+			if child.isDir() {
+				subdirs++
+			}
+			if !child.squashfs.written {
+				w.writeInode(child, node.squashfs.number)
+			}
+		}
+		listingBlock, listingOffset = w.directories.position()
+		listingSize = w.writeListing(node, names)
+	}
+
+	header := node.header
+	node.squashfs.block, node.squashfs.offset = w.inodes.position()
+	node.squashfs.written = true
+	kind := squashfsKind(node)
+	if kind == squashfsDirType || kind == squashfsFileType {
+		kind += squashfsExtendedOffset
+	}
+	fields := []interface{}{
+		kind,
+		uint16(header.Mode & 07777),
+		w.id(header.Uid),
+		w.id(header.Gid),
+		uint32(header.ModTime.Unix()),
+		node.squashfs.number,
+	}
+	switch squashfsKind(node) {
+	case squashfsDirType:
+		fields = append(fields,
+			2+subdirs,
+			uint32(listingSize+3),
+			listingBlock,
+			parentNumber,
+			uint16(0), // Directory index count
+			listingOffset,
+			uint32(squashfsInvalidIndex))
+	case squashfsFileType:
+		fields = append(fields,
+			uint64(node.squashfs.blocksStart),
+			uint64(header.Size),
+			uint64(0), // Sparse bytes
+			node.nlink,
+			uint32(squashfsInvalidIndex), // Fragment
+			uint32(0),
+			uint32(squashfsInvalidIndex), // Xattrs
+			node.squashfs.blockSizes)
+	case squashfsSymlinkType:
+		fields = append(fields, node.nlink, uint32(len(header.Linkname)), []byte(header.Linkname))
+	case squashfsBlockDevType, squashfsCharDevType:
+		major, minor := uint32(header.Devmajor), uint32(header.Devminor)
+		fields = append(fields, node.nlink, major<<8|minor&0xff|(minor&^0xff)<<12)
+	default:
+		fields = append(fields, node.nlink)
+	}
+	for _, field := range fields {
+		binary.Write(&w.inodes, binary.LittleEndian, field)
+	}
+}
+
+// Directory entries are grouped under headers naming the inode metadata
+// block they're in. A header covers at most 256 entries and inode numbers
+// within 16 bits of its own.
+func (w *squashfsWriter) writeListing(node *imageNode, names []string) int {
+	var listing bytes.Buffer
+	for i := 0; i < len(names); {
+		first := node.children[names[i]].squashfs
+		count := 1
+		for i+count < len(names) && count < 256 {
+			next := node.children[names[i+count]].squashfs
+			delta := int64(next.number) - int64(first.number)
+			if next.block != first.block || delta < -32768 || delta > 32767 {
+				break
+			}
+			count++
+		}
+		binary.Write(&listing, binary.LittleEndian, []uint32{uint32(count - 1), first.block, first.number})
+		for _, name := range names[i : i+count] {
+			child := node.children[name]
+			binary.Write(&listing, binary.LittleEndian, child.squashfs.offset)
+			binary.Write(&listing, binary.LittleEndian, int16(int64(child.squashfs.number)-int64(first.number)))
+			binary.Write(&listing, binary.LittleEndian, squashfsKind(child))
+			binary.Write(&listing, binary.LittleEndian, uint16(len(name)-1))
+			listing.WriteString(name)
+		}
+		i += count
+	}
+	w.directories.Write(listing.Bytes())
+	return listing.Len()
+}
+
+// Packs a SquashFS metadata table into 8KiB blocks, each compressed if that
+// makes it smaller and prefixed with a 2 byte header.
+type metadataWriter struct {
+	out     bytes.Buffer
+	pending bytes.Buffer
+	// Offset of every block within out.
+	blockStarts []int
+}
+
+// Block offset (relative to the start of the table) and offset within the
+// uncompressed block the next write will land at.
+func (m *metadataWriter) position() (uint32, uint16) {
+	return uint32(m.out.Len()), uint16(m.pending.Len())
+}
+
+func (m *metadataWriter) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		n := min(int64(len(p)-written), int64(squashfsMetadataSize-m.pending.Len()))
+		m.pending.Write(p[written : written+int(n)])
+		written += int(n)
+		if m.pending.Len() == squashfsMetadataSize {
+			m.flush()
+		}
+	}
+	return len(p), nil
+}
+
+func (m *metadataWriter) flush() {
+	m.blockStarts = append(m.blockStarts, m.out.Len())
+	var compressed bytes.Buffer
+	compressor := zlib.NewWriter(&compressed)
+	compressor.Write(m.pending.Bytes())
+	compressor.Close()
+	if compressed.Len() < m.pending.Len() {
+		binary.Write(&m.out, binary.LittleEndian, uint16(compressed.Len()))
+		m.out.Write(compressed.Bytes())
+	} else {
+		binary.Write(&m.out, binary.LittleEndian, uint16(m.pending.Len()|squashfsUncompressedMeta))
+		m.out.Write(m.pending.Bytes())
+	}
+	m.pending.Reset()
+}
+
+func (m *metadataWriter) finish() []byte {
+	if m.pending.Len() > 0 {
+		m.flush()
+	}
+	return m.out.Bytes()
+}
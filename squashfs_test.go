@@ -0,0 +1,303 @@
+package fastar
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetadataWriter(t *testing.T) {
+	var m metadataWriter
+	data := []byte(RandomString(2*squashfsMetadataSize + 100))
+	m.Write(data[:10])
+	if block, offset := m.position(); block != 0 || offset != 10 {
+		t.Fatalf("Got position %d/%d", block, offset)
+	}
+	m.Write(data[10:])
+	table := m.finish()
+	if len(m.blockStarts) != 3 {
+		t.Fatalf("Got %d blocks, wanted 3", len(m.blockStarts))
+	}
+
+	var decoded []byte
+	for _, start := range m.blockStarts {
+		header := binary.LittleEndian.Uint16(table[start:])
+		block := table[start+2 : start+2+int(header&^squashfsUncompressedMeta)]
+		if header&squashfsUncompressedMeta == 0 {
+			reader, err := zlib.NewReader(bytes.NewReader(block))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block, err = io.ReadAll(reader); err != nil {
+				t.Fatal(err)
+			}
+		}
+		decoded = append(decoded, block...)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatalf("Metadata blocks don't decode to the written data")
+	}
+}
+
+func TestSquashfsRoundTrip(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts = DefaultOptions()
+
+	tarball, expected, inodeCount := imageTestTar(t)
+	imagePath := filepath.Join(t.TempDir(), "image.squashfs")
+	WriteSquashfs(bytes.NewReader(tarball), imagePath)
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image)%squashfsPadding != 0 {
+		t.Fatalf("Image is %d bytes, not padded to %d", len(image), squashfsPadding)
+	}
+
+	reader := newSquashfsTestReader(t, image)
+	if reader.super.InodeCount != uint32(inodeCount) {
+		t.Fatalf("Superblock has %d inodes, wanted %d", reader.super.InodeCount, inodeCount)
+	}
+	entries := map[string]imageTestEntry{}
+	numbers := map[uint32]bool{}
+	reader.walk(".", reader.super.RootInode, reader.super.InodeCount+1, entries, numbers)
+	if len(numbers) != inodeCount {
+		t.Fatalf("Found %d distinct inode numbers, wanted %d", len(numbers), inodeCount)
+	}
+	for number := uint32(1); number <= uint32(inodeCount); number++ {
+		if !numbers[number] {
+			t.Fatalf("Inode number %d isn't used", number)
+		}
+	}
+	checkImageEntries(t, entries, expected)
+
+	unsquashfs, err := exec.LookPath("unsquashfs")
+	if err != nil {
+		t.Log("unsquashfs not found, skipping the check with squashfs-tools")
+		return
+	}
+	listing, err := exec.Command(unsquashfs, "-l", imagePath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("unsquashfs failed: %v\n%s", err, listing)
+	}
+	for name := range expected {
+		if name != "." && !strings.Contains(string(listing), "squashfs-root/"+name+"\n") {
+			t.Fatalf("unsquashfs doesn't list %s:\n%s", name, listing)
+		}
+	}
+}
+
+type squashfsTestSuperblock struct {
+	Magic, InodeCount, ModTime, BlockSize, FragmentCount  uint32
+	Compression, BlockLog, Flags, IdCount, Major, Minor   uint16
+	RootInode, BytesUsed, IdTable, XattrTable, InodeTable uint64
+	DirectoryTable, FragmentTable, ExportTable            uint64
+}
+
+// Just enough of a SquashFS reader to check what WriteSquashfs produces.
+type squashfsTestReader struct {
+	t           *testing.T
+	image       []byte
+	super       squashfsTestSuperblock
+	inodes      []byte
+	inodeBlocks map[uint32]int
+	dirs        []byte
+	dirBlocks   map[uint32]int
+	ids         []uint32
+}
+
+func newSquashfsTestReader(t *testing.T, image []byte) *squashfsTestReader {
+	r := &squashfsTestReader{t: t, image: image}
+	if err := binary.Read(bytes.NewReader(image), binary.LittleEndian, &r.super); err != nil {
+		t.Fatal(err)
+	}
+	super := r.super
+	if super.Magic != squashfsMagic || super.Major != 4 || super.Minor != 0 {
+		t.Fatalf("Bad superblock magic %x or version %d.%d", super.Magic, super.Major, super.Minor)
+	}
+	if super.BlockSize != squashfsBlockSize || super.BlockSize != 1<<super.BlockLog || super.Compression != squashfsZlib {
+		t.Fatalf("Bad block size %d (log %d) or compression %d", super.BlockSize, super.BlockLog, super.Compression)
+	}
+	if super.BytesUsed > uint64(len(image)) || super.InodeTable >= super.DirectoryTable || super.DirectoryTable > super.FragmentTable {
+		t.Fatalf("Tables out of order or past the end of the image: %+v", super)
+	}
+	r.inodes, r.inodeBlocks = r.metadata(super.InodeTable, super.DirectoryTable)
+	r.dirs, r.dirBlocks = r.metadata(super.DirectoryTable, super.FragmentTable)
+	idBlock := binary.LittleEndian.Uint64(image[super.IdTable:])
+	ids, _ := r.metadata(idBlock, super.IdTable)
+	for i := 0; i < int(super.IdCount); i++ {
+		r.ids = append(r.ids, binary.LittleEndian.Uint32(ids[i*4:]))
+	}
+	return r
+}
+
+// Decodes the metadata blocks from start to end, returning their contents
+// and where each block, by offset relative to start, begins in them.
+func (r *squashfsTestReader) metadata(start, end uint64) ([]byte, map[uint32]int) {
+	var decoded []byte
+	blocks := map[uint32]int{}
+	for offset := start; offset < end; {
+		header := binary.LittleEndian.Uint16(r.image[offset:])
+		size := uint64(header &^ squashfsUncompressedMeta)
+		blocks[uint32(offset-start)] = len(decoded)
+		block := r.image[offset+2 : offset+2+size]
+		if header&squashfsUncompressedMeta == 0 {
+			block = r.inflate(block)
+		}
+		if len(block) > squashfsMetadataSize {
+			r.t.Fatalf("Metadata block at %d is %d bytes", offset, len(block))
+		}
+		decoded = append(decoded, block...)
+		offset += 2 + size
+	}
+	return decoded, blocks
+}
+
+func (r *squashfsTestReader) inflate(data []byte) []byte {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	inflated, err := io.ReadAll(reader)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return inflated
+}
+
+func (r *squashfsTestReader) id(index uint16) uint32 {
+	if int(index) >= len(r.ids) {
+		r.t.Fatalf("Id index %d out of range", index)
+	}
+	return r.ids[index]
+}
+
+// Reads the inode ref points to, and everything under it if it's a
+// directory, into entries.
+func (r *squashfsTestReader) walk(name string, ref uint64, parent uint32, entries map[string]imageTestEntry, numbers map[uint32]bool) (uint16, uint32) {
+	inode := bytes.NewReader(r.inodes[r.inodeBlocks[uint32(ref>>16)]+int(ref&0xffff):])
+	var header struct {
+		Kind, Mode, Uid, Gid uint16
+		ModTime, Number      uint32
+	}
+	read := func(data interface{}) {
+		if err := binary.Read(inode, binary.LittleEndian, data); err != nil {
+			r.t.Fatalf("Failed to read the inode of %s: %v", name, err)
+		}
+	}
+	read(&header)
+	numbers[header.Number] = true
+	entry := imageTestEntry{uid: r.id(header.Uid), gid: r.id(header.Gid), mode: uint32(header.Mode)}
+	kind := header.Kind
+	if kind > squashfsExtendedOffset {
+		kind -= squashfsExtendedOffset
+	}
+	switch header.Kind {
+	case squashfsDirType + squashfsExtendedOffset:
+		var dir struct {
+			Nlink, Size, Block, Parent uint32
+			IndexCount, Offset         uint16
+			Xattr                      uint32
+		}
+		read(&dir)
+		entry.mode |= modeDir
+		entry.nlink = dir.Nlink
+		if dir.Parent != parent {
+			r.t.Fatalf("%s has parent inode %d, wanted %d", name, dir.Parent, parent)
+		}
+		r.walkListing(name, r.dirs[r.dirBlocks[dir.Block]+int(dir.Offset):][:dir.Size-3], header.Number, entries, numbers)
+	case squashfsFileType + squashfsExtendedOffset:
+		var file struct {
+			BlocksStart, Size, Sparse      uint64
+			Nlink, Fragment, Offset, Xattr uint32
+		}
+		read(&file)
+		entry.mode |= modeRegular
+		entry.nlink = file.Nlink
+		if file.Fragment != squashfsInvalidIndex {
+			r.t.Fatalf("%s uses a fragment", name)
+		}
+		sizes := make([]uint32, (file.Size+squashfsBlockSize-1)/squashfsBlockSize)
+		read(sizes)
+		var data []byte
+		offset := file.BlocksStart
+		for _, size := range sizes {
+			block := r.image[offset : offset+uint64(size&^squashfsUncompressedBlock)]
+			offset += uint64(size &^ squashfsUncompressedBlock)
+			if size&squashfsUncompressedBlock == 0 {
+				block = r.inflate(block)
+			}
+			data = append(data, block...)
+		}
+		if uint64(len(data)) != file.Size {
+			r.t.Fatalf("%s has %d bytes of data, its inode says %d", name, len(data), file.Size)
+		}
+		entry.data = string(data)
+	case squashfsSymlinkType:
+		var symlink struct{ Nlink, Size uint32 }
+		read(&symlink)
+		target := make([]byte, symlink.Size)
+		read(target)
+		entry.mode |= modeSymlink
+		entry.nlink = symlink.Nlink
+		entry.data = string(target)
+	case squashfsBlockDevType, squashfsCharDevType:
+		var device struct{ Nlink, Rdev uint32 }
+		read(&device)
+		entry.mode |= map[uint16]uint32{squashfsBlockDevType: modeBlkdev, squashfsCharDevType: modeChrdev}[header.Kind]
+		entry.nlink = device.Nlink
+		entry.rdev = device.Rdev
+	case squashfsFifoType:
+		read(&entry.nlink)
+		entry.mode |= modeFifo
+	default:
+		r.t.Fatalf("%s has unexpected inode type %d", name, header.Kind)
+	}
+	entries[name] = entry
+	return kind, header.Number
+}
+
+func (r *squashfsTestReader) walkListing(dir string, listing []byte, number uint32, entries map[string]imageTestEntry, numbers map[uint32]bool) {
+	reader := bytes.NewReader(listing)
+	previous := ""
+	for reader.Len() > 0 {
+		var header struct{ Count, Block, Number uint32 }
+		binary.Read(reader, binary.LittleEndian, &header)
+		if header.Count >= 256 {
+			r.t.Fatalf("Listing of %s has a header with %d entries", dir, header.Count+1)
+		}
+		for i := uint32(0); i <= header.Count; i++ {
+			var entry struct {
+				Offset      uint16
+				NumberDelta int16
+				Kind, Size  uint16
+			}
+			binary.Read(reader, binary.LittleEndian, &entry)
+			nameBytes := make([]byte, int(entry.Size)+1)
+			if _, err := io.ReadFull(reader, nameBytes); err != nil {
+				r.t.Fatalf("Listing of %s is truncated", dir)
+			}
+			name := string(nameBytes)
+			if name <= previous {
+				r.t.Fatalf("Listing of %s isn't sorted: %q after %q", dir, name, previous)
+			}
+			previous = name
+			path := name
+			if dir != "." {
+				path = dir + "/" + name
+			}
+			kind, childNumber := r.walk(path, uint64(header.Block)<<16|uint64(entry.Offset), number, entries, numbers)
+			if kind != entry.Kind || childNumber != uint32(int64(header.Number)+int64(entry.NumberDelta)) {
+				r.t.Fatalf("Listing of %s says %s is inode %d of type %d, it's %d of type %d",
+					dir, name, int64(header.Number)+int64(entry.NumberDelta), entry.Kind, childNumber, kind)
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package fastar
+
+import (
+	"io"
+	"mime/multipart"
+	"os"
+)
+
+// Downloader for archives piped in on stdin, selected by passing - as the
+// URL. Lets fastar slot in behind curl or aria2 and still decompress and
+// write files in parallel. The stream can only be read once, front to back.
+type StdinDownloader struct{}
+
+func (stdinDownloader StdinDownloader) GetFileInfo() (int64, bool, bool) {
+	// Only known when stdin is redirected from a file.
+	var size int64
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode().IsRegular() {
+		size = info.Size()
+	}
+	return size, false, false
+}
+
+func (stdinDownloader StdinDownloader) Get() io.ReadCloser {
+	return io.NopCloser(os.Stdin)
+}
+
+func (stdinDownloader StdinDownloader) GetRange(start, end int64) io.ReadCloser {
+	fatal("Can't read ranges from stdin")
+	return nil
+}
+
+func (stdinDownloader StdinDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	fatal("Can't read ranges from stdin")
+	return nil, nil
+}
@@ -0,0 +1,31 @@
+package fastar
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStdinDownloader(t *testing.T) {
+	data := RandomString(1000)
+	path := filepath.Join(t.TempDir(), "archive.tar")
+	os.WriteFile(path, []byte(data), 0644)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	oldStdin := os.Stdin
+	defer func() { os.Stdin = oldStdin }()
+	os.Stdin = file
+
+	downloader := getDownloader("-", false, false)
+	if size, supportsRange, _ := downloader.GetFileInfo(); size != 1000 || supportsRange {
+		t.Fatalf("Got size %d, range support %t", size, supportsRange)
+	}
+	if actual, err := io.ReadAll(GetDownloadStream(context.Background(), downloader, 100, 4)); err != nil || string(actual) != data {
+		t.Fatalf("Got %d bytes, %v", len(actual), err)
+	}
+}
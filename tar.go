@@ -1,15 +1,19 @@
-package main
+package fastar
 
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -21,13 +25,81 @@ import (
 // the background writer thread is finished.
 var openFileTokens chan bool
 
+// Files are written in slices of this size, checking for cancellation
+// between them. Bigger on slow filesystems, see tuneForTargetFilesystem.
+const writeSliceSize = 8 << 20
+
+var writeSlice int64 = writeSliceSize
+
+// Aligned blocks of this many zero bytes are left as holes when writing
+// files, see writeSparse.
+const sparseBlockSize = 64 << 10
+
+// Smaller regular files are written out in full, the seeks cost more than
+// the few blocks a hole would save.
+const sparseMinSize = 1 << 20
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
 var bytesWritten atomic.Uint64
 var writeTimeMilli atomic.Uint64
 
-func ExtractTar(stream io.Reader) {
-	openFileTokens = make(chan bool, opts.WriteWorkers)
-	tarReader := tar.NewReader(stream)
-	for i := 0; i < opts.WriteWorkers; i++ {
+// Header types that proprietary backup tools and multi-volume archives
+// leave in tarballs but that fastar can't recreate. With --lenient they're
+// skipped with a warning rather than failing the extraction.
+var exoticTypeflags = map[byte]string{
+	tar.TypeXGlobalHeader: "pax global extended header",
+	'V':                   "GNU volume header",
+	'M':                   "GNU multi-volume continuation",
+	'N':                   "GNU long name",
+	'D':                   "GNU dumpdir",
+	'A':                   "Solaris ACL",
+	'X':                   "Solaris extended header",
+	'I':                   "inode metadata",
+}
+
+// Entries that can't be extracted where a directory already is.
+var fileTypeflags = map[byte]string{
+	tar.TypeReg:       "file",
+	tar.TypeGNUSparse: "sparse file",
+	tar.TypeLink:      "hard link",
+	tar.TypeSymlink:   "symlink",
+}
+
+// Set once creating a symlink failed for lack of privilege, after which
+// symlinks are skipped without warning again.
+var symlinksSkipped atomic.Bool
+
+// Extracts the tarball in stream into --directory. Canceling ctx stops it
+// between entries: writes in flight are abandoned and their files removed,
+// everything already written stays, and with --resume the journal is kept
+// so the next run carries on from there.
+func ExtractTar(ctx context.Context, stream io.Reader) {
+	setupIdMappings()
+	setupEntryFilters()
+	writeWorkers := opts.WriteWorkers
+	if opts.AutoscaleWrites {
+		writeWorkers = opts.MaxWriteWorkers
+	}
+	writeWorkers = writeWorkerBudget(tuneForTargetFilesystem(writeWorkers))
+	if opts.AutoscaleWrites {
+		startWriteAutoscaler(writeWorkers)
+	}
+	openFileTokens = make(chan bool, writeWorkers)
+	if opts.FakerootDb != "" {
+		loadFakerootDb()
+	}
+	if opts.Manifest != "" {
+		loadManifest()
+	}
+	if opts.ExpectManifest != "" {
+		loadExpectedManifest()
+	}
+	// With --resume, entries are journaled by the offset of their first
+	// header block, and already extracted ones are skipped.
+	var consumed atomic.Int64
+	tarReader := tar.NewReader(countingReader{contextReader{ctx, stream}, &consumed})
+	for i := 0; i < writeWorkers; i++ {
 		openFileTokens <- true
 	}
 	// Hard linking is special, we need to make sure the file we're
@@ -37,94 +109,224 @@ func ExtractTar(stream io.Reader) {
 	// all existing writes to finish (one of them might be the file
 	// we need to link to).
 	var wg sync.WaitGroup
+	dirs := dirCache{}
+	syncDirs := syncDirSet{}
+	seen := seenPaths{}
+	writes := newPathWrites()
 
 	var lastLog = time.Now()
 
-	for {
+	for ctx.Err() == nil {
+		var entryStart int64
+		if journal != nil {
+			// Skipped entries leave their data unread, which would put the
+			// next header at the wrong offset.
+			if _, err := io.Copy(io.Discard, tarReader); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				fatalf("ExtractTarGz: skipping entry failed: %s", err.Error())
+			}
+			entryStart = journal.base + (consumed.Load()+tarHeaderSize-1)/tarHeaderSize*tarHeaderSize
+		}
 		header, err := tarReader.Next()
 
-		if err == io.EOF {
+		if err == io.EOF || ctx.Err() != nil {
 			break
 		}
 		if err != nil {
-			log.Fatalf("ExtractTarGz: Next() failed: %s", err.Error())
+			// Files already read in full are still written out rather
+			// than left half written.
+			wg.Wait()
+			fatalStream("ExtractTarGz: Next() failed: ", err)
 		}
+		dumpHeader(header)
+
+		header.Uid = mapId(header.Uid, uidMappings)
+		header.Gid = mapId(header.Gid, gidMappings)
 
 		name := header.Name
 		linkName := header.Linkname
 		if opts.StripComponents != 0 {
-			name = filepath.Join(strings.Split(name, "/")[opts.StripComponents:]...)
+			name = filepath.ToSlash(filepath.Join(strings.Split(name, "/")[opts.StripComponents:]...))
 			if linkName != "" {
-				linkName = filepath.Join(strings.Split(linkName, "/")[opts.StripComponents:]...)
+				linkName = filepath.ToSlash(filepath.Join(strings.Split(linkName, "/")[opts.StripComponents:]...))
 			}
 		}
-		if name == "" {
+		if name == "" || filteredOut(name) || !expectedEntry(name, header) {
 			continue
 		}
-		path := filepath.Join(opts.OutputDir, name)
+		checkPathLimits(name)
+		localName, err := platformPath(name)
+		if err != nil {
+			fatalf("ExtractTarGz: can't extract %s: %s", header.Name, err.Error())
+		}
+		path := filepath.Join(opts.OutputDir, localName)
+		if !opts.UnsafePaths {
+			if escapesDirectory(name) {
+				fatalf("ExtractTarGz: %s is outside of --directory, pass --unsafe-paths to extract it anyway", header.Name)
+			}
+			if path, err = safeEntryPath(localName, header.Typeflag == tar.TypeDir, dirs); err != nil {
+				fatalf("ExtractTarGz: can't extract %s: %s", header.Name, err.Error())
+			}
+		}
 		info := header.FileInfo()
 		pathDir, _ := filepath.Split(path)
-		if _, err = os.Stat(pathDir); os.IsNotExist(err) {
-			if err := os.MkdirAll(pathDir, 0755); err != nil {
-				log.Fatalf("ExtractTarGz: Unspecified Mkdir() failed: %s", err.Error())
+		dirs.ensure(pathDir)
+		syncDirs.add(pathDir)
+
+		if opts.OverlayWhiteout && handleWhiteout(path, localName, header) {
+			// The whiteout may have removed a cached directory.
+			dirs = dirCache{}
+			continue
+		}
+		kind, isFile := fileTypeflags[header.Typeflag]
+		if journal != nil {
+			if journal.done[filepath.Clean(localName)] {
+				if isFile {
+					seen[filepath.Clean(path)] = true
+				}
+				if opts.Manifest != "" && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeGNUSparse || header.Typeflag == tar.TypeLink) {
+					verifyExtractedFile(path)
+				}
+				if opts.RecordManifest != "" {
+					recordExtractedEntry(path, header)
+				}
+				continue
 			}
 		}
 
+		if isFile && dirs[filepath.Clean(path)] {
+			fatalf("ExtractTarGz: %s is a directory, can't extract a %s over it", header.Name, kind)
+		}
+		if isFile {
+			extract, replace := seen.admit(filepath.Clean(path), header.Name, func() { writes.wait(path) })
+			if !extract {
+				continue
+			}
+			if replace {
+				removeReplaced(path)
+			}
+		}
+		if journal != nil {
+			journal.entryStarted(entryStart)
+		}
+
 		switch header.Typeflag {
 		case tar.TypeDir:
 			// Directories are synchronously created since a later file
 			// might require it exist already.
-			if err := os.MkdirAll(path, info.Mode()); err != nil {
-				log.Fatalf("ExtractTarGz: Mkdir() failed: %s", err.Error())
+			if !dirs[filepath.Clean(path)] {
+				if err := os.MkdirAll(path, info.Mode()); err != nil {
+					fatalErr("ExtractTarGz: Mkdir() failed: ", err)
+				}
+				dirs.add(path)
 			}
-			os.Chmod(path, info.Mode())
-			os.Chown(path, header.Uid, header.Gid)
-		case tar.TypeReg:
+			syncDirs.add(path)
+			chmodEntry(path, info.Mode())
+			chownEntry(path, header.Uid, header.Gid, false)
+			applyXattrs(path, header)
+			recordFakeroot(path, header)
+			recordManifestEntry(relativeToOutputDir(path), "")
+			emitEvent("file_extracted", map[string]interface{}{"path": path, "type": "dir", "size": 0})
+		case tar.TypeReg, tar.TypeGNUSparse:
 			// Read file contents into a buffer to pass along to background
 			// writer thread.
 			buf := make([]byte, info.Size())
 			totalRead := 0
-			for totalRead < int(info.Size()) {
+			for totalRead < int(info.Size()) && ctx.Err() == nil {
 				read, err := tarReader.Read(buf[totalRead:])
-				if err != nil && err != io.EOF {
-					log.Fatal("Failed to read from resp:", err.Error())
+				if err != nil && err != io.EOF && ctx.Err() == nil {
+					wg.Wait()
+					fatalStream("Failed to read from resp: ", err)
 				}
 				totalRead += read
 			}
+			if ctx.Err() != nil {
+				break
+			}
+			var gate *writeGate
+			if opts.AutoscaleWrites {
+				gate = writeGateFor(pathDir)
+				gate.acquire()
+			}
+			finished := writes.begin(path)
 			<-openFileTokens
 			wg.Add(1)
-			go writeFileAsync(path, buf, header, &wg)
+			go writeFileAsync(ctx, path, buf, header, gate, &wg, finished, entryStart)
 		case tar.TypeLink:
-			newPath := filepath.Join(opts.OutputDir, linkName)
+			if filteredOut(linkName) {
+				log.Printf("ExtractTarGz: skipping hard link %s, its target %s is filtered out\n", name, linkName)
+				emitEvent("entry_skipped", map[string]interface{}{"path": path, "type": string(header.Typeflag), "reason": "link target filtered out"})
+				break
+			}
+			localLinkName, err := platformPath(linkName)
+			if err != nil {
+				fatalf("ExtractTarGz: can't link %s to %s: %s", header.Name, linkName, err.Error())
+			}
+			newPath := filepath.Join(opts.OutputDir, localLinkName)
+			if !opts.UnsafePaths {
+				if escapesDirectory(linkName) {
+					fatalf("ExtractTarGz: %s links to %s outside of --directory, pass --unsafe-paths to extract it anyway", header.Name, linkName)
+				}
+				if newPath, err = safeEntryPath(localLinkName, false, dirs); err != nil {
+					fatalf("ExtractTarGz: can't link %s to %s: %s", header.Name, linkName, err.Error())
+				}
+			}
 			hardLink(newPath, path, header, &wg)
 		case tar.TypeSymlink:
 			// Symlinks don't require the stop-the-world synchronization
 			// of hard links since they don't require the source file
-			// to exist.
-			if opts.Overwrite {
+			// to exist. An interrupted run may have created it already.
+			if !opts.UnsafePaths && symlinkEscapes(name, linkName) {
+				fatalf("ExtractTarGz: %s links to %s outside of --directory, pass --unsafe-paths to extract it anyway", header.Name, linkName)
+			}
+			writes.wait(path)
+			if opts.Overwrite || journal != nil {
 				if _, err := os.Lstat(path); err == nil {
 					os.Remove(path)
 				}
 			}
-			if err = os.Symlink(linkName, path); err != nil {
-				log.Fatal("Failed to symlink: ", err.Error())
+			if err = os.Symlink(linkName, path); symlinkUnprivileged(err) {
+				if !symlinksSkipped.Swap(true) {
+					log.Println("ExtractTarGz: not allowed to create symlinks, skipping them. Enable Developer Mode or run as administrator to extract them")
+				}
+				emitEvent("entry_skipped", map[string]interface{}{"path": path, "type": string(header.Typeflag), "reason": "no symlink privilege"})
+				break
+			} else if err != nil {
+				fatalErr("Failed to symlink: ", err)
 			}
-			os.Lchown(path, header.Uid, header.Gid)
+			chownEntry(path, header.Uid, header.Gid, true)
+			applyXattrs(path, header)
+			recordFakeroot(path, header)
+			recordManifestEntry(relativeToOutputDir(path), "")
+			emitEvent("file_extracted", map[string]interface{}{"path": path, "type": "symlink", "size": 0})
 		default:
-			if opts.IgnoreNodeFiles {
+			if extractFakerootNode(path, header) {
+				recordManifestEntry(relativeToOutputDir(path), "")
+				emitEvent("file_extracted", map[string]interface{}{"path": path, "type": "node", "size": 0})
+				break
+			}
+			kind, exotic := exoticTypeflags[header.Typeflag]
+			if !exotic {
+				kind = "unknown type " + string(header.Typeflag)
+			}
+			if opts.Lenient {
+				log.Printf("ExtractTarGz: skipping %s in %s\n", kind, header.Name)
+				emitEvent("entry_skipped", map[string]interface{}{"path": path, "type": string(header.Typeflag), "reason": kind})
+			} else if opts.IgnoreNodeFiles {
 				log.Println(
 					"ExtractTarGz: uknown type:",
 					string(header.Typeflag),
 					" in ",
 					header.Name)
 			} else {
-				log.Fatal(
-					"ExtractTarGz: uknown type:",
-					string(header.Typeflag),
-					" in ",
-					header.Name)
+				fatalf("ExtractTarGz: %s in %s, pass --lenient to skip it", kind, header.Name)
 			}
 		}
+		if journal != nil && header.Typeflag != tar.TypeReg {
+			journal.entryFinished(entryStart, filepath.Clean(name))
+		}
 		if (uint64)(time.Since(lastLog).Seconds()) >= 30 {
 			log.Printf("Average write speed %.3fMBps\n", (float64)(bytesWritten.Load())/1e3/(float64(writeTimeMilli.Load())))
 			lastLog = time.Now()
@@ -133,42 +335,271 @@ func ExtractTar(stream io.Reader) {
 	// Wait for all threads to finish, otherwise fastar
 	// might exit before last few files done writing.
 	wg.Wait()
+	if opts.AutoscaleWrites {
+		stopWriteAutoscaler()
+	}
+	if ctx.Err() != nil {
+		log.Println("ExtractTarGz: canceled, stopped extracting")
+		if journal != nil {
+			journal.file.Close()
+		}
+		return
+	}
+	if opts.CasDir != "" {
+		writeCasManifest()
+	}
+	if opts.HashFiles != "" {
+		writeHashManifest()
+	}
+	if opts.Manifest != "" {
+		finishManifestCheck()
+	}
+	logSkippedUnexpected()
+	writeRecordedManifest()
+	saveFakerootDb()
+	syncExtracted(syncDirs)
+	if journal != nil {
+		journal.remove()
+	}
+}
+
+// Guard against pathological archives (extremely deep directory trees or
+// absurdly long file names) by failing up front with a clear message,
+// rather than hitting kernel path limits partway through extraction.
+func checkPathLimits(name string) {
+	components := strings.Split(path.Clean(name), "/")
+	if opts.MaxPathDepth > 0 && len(components) > opts.MaxPathDepth {
+		log.Printf("Entry has path depth %d, exceeding --max-path-depth of %d: %.200s\n", len(components), opts.MaxPathDepth, name)
+		exit(syscall.ENAMETOOLONG)
+	}
+	if opts.MaxNameLength > 0 {
+		for _, component := range components {
+			if len(component) > opts.MaxNameLength {
+				log.Printf("Entry has a %d byte path component, exceeding --max-name-length of %d: %.200s\n", len(component), opts.MaxNameLength, name)
+				exit(syscall.ENAMETOOLONG)
+			}
+		}
+	}
+}
+
+// Directories known to exist, so extracting millions of files into deep
+// trees doesn't cost a Stat per entry, and a file in the archive at the
+// path of an earlier directory is caught before anything is written.
+// Only touched by the goroutine reading the archive.
+type dirCache map[string]bool
+
+// Creates dir and any missing parents unless it's known to exist.
+func (dirs dirCache) ensure(dir string) {
+	if dirs[filepath.Clean(dir)] {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatalErr("ExtractTarGz: Unspecified Mkdir() failed: ", err)
+	}
+	dirs.add(dir)
 }
 
-func writeFileAsync(filename string, buf []byte, header *tar.Header, wg *sync.WaitGroup) {
+// Records dir and, since it exists, all of its parents.
+func (dirs dirCache) add(dir string) {
+	for dir = filepath.Clean(dir); !dirs[dir]; dir = filepath.Dir(dir) {
+		dirs[dir] = true
+	}
+}
+
+func writeFileAsync(ctx context.Context, filename string, buf []byte, header *tar.Header, gate *writeGate, wg *sync.WaitGroup, finished func(), entryStart int64) {
 	defer wg.Done()
+	defer finished()
 	defer func() { openFileTokens <- true }()
 	var writeStartTime = time.Now()
+	var written bool
+	if !expectedContent(relativeToOutputDir(filename), buf, header) {
+		written = false
+	} else if opts.CasDir != "" {
+		written = writeFileToCas(ctx, filename, buf, header)
+	} else {
+		written = writeFile(ctx, filename, buf, header)
+	}
+	if !written {
+		if gate != nil {
+			gate.release(0, time.Since(writeStartTime))
+		}
+		return
+	}
+	if opts.HashFiles != "" {
+		recordFileHash(relativeToOutputDir(filename), buf)
+	}
+	if opts.Manifest != "" {
+		verifyFileDigest(relativeToOutputDir(filename), buf)
+	}
+	recordManifestFile(relativeToOutputDir(filename), buf)
+	emitEvent("file_extracted", map[string]interface{}{"path": filename, "type": "file", "size": len(buf)})
+	bytesWritten.Add((uint64)(len(buf)))
+	writeTimeMilli.Add(uint64(time.Since(writeStartTime).Milliseconds()))
+	recordFileSize(len(buf), time.Since(writeStartTime))
+	if gate != nil {
+		gate.release(len(buf), time.Since(writeStartTime))
+	}
+	if journal != nil {
+		journal.entryFinished(entryStart, relativeToOutputDir(filename))
+	}
+}
+
+// Returns false if ctx was canceled part way, the file is removed then.
+func writeFile(ctx context.Context, filename string, buf []byte, header *tar.Header) bool {
 	if opts.Overwrite {
 		if _, err := os.Stat(filename); err == nil {
 			os.Remove(filename)
 		}
 	}
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode())
-	if err != nil {
-		log.Fatal("Create file failed: ", err.Error())
+	size := int64(len(buf))
+	sparse := isSparseEntry(header)
+	file, direct, err := openFileForWrite(filename, !sparse && opts.DirectIo && size >= directIoMinSize, header.FileInfo().Mode())
+	if errors.Is(err, syscall.ELOOP) {
+		fatalf("Create file failed: %s is a symlink, pass --unsafe-paths to write through it", filename)
+	} else if errors.Is(err, syscall.ENOSPC) {
+		failDiskFull(filename, err)
+	} else if err != nil {
+		fatalErr("Create file failed: ", err)
+	}
+	// Preallocated and direct files are written out in full, leaving
+	// holes would defeat both.
+	preallocated := !sparse && opts.Preallocate > 0 && size >= opts.Preallocate*1e6
+	if preallocated {
+		preallocate(file, size)
 	}
-	defer os.Chmod(filename, header.FileInfo().Mode())
-	defer os.Chown(filename, header.Uid, header.Gid)
-	defer file.Close()
-	_, err = io.Copy(file, bytes.NewReader(buf))
+	if direct {
+		err = writeDirect(ctx, file, buf)
+	} else if sparse || (!opts.NoSparse && !preallocated && size >= sparseMinSize) {
+		err = writeSparse(ctx, file, buf)
+	} else {
+		err = writeBuffer(ctx, file, buf)
+	}
+	if err == nil && syncFiles() {
+		if err := file.Sync(); errors.Is(err, syscall.ENOSPC) {
+			closeTrackedFile(file)
+			failDiskFull(filename, err)
+		} else if err != nil {
+			fatalErr("Failed to fsync file: ", err)
+		}
+	}
+	closeTrackedFile(file)
 	if err != nil {
-		log.Fatal("Copy file failed: ", err.Error())
+		if ctx.Err() != nil {
+			os.Remove(filename)
+			return false
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			failDiskFull(filename, err)
+		}
+		fatalErr("Copy file failed: ", err)
 	}
-	bytesWritten.Add((uint64)(len(buf)))
-	writeTimeMilli.Add(uint64(time.Since(writeStartTime).Milliseconds()))
+	chownEntry(filename, header.Uid, header.Gid, false)
+	chmodEntry(filename, header.FileInfo().Mode())
+	applyXattrs(filename, header)
+	recordFakeroot(filename, header)
+	return true
+}
+
+// Writes buf a slice at a time, so a canceled ctx doesn't have to wait for
+// a multi gigabyte file to finish.
+func writeBuffer(ctx context.Context, file *os.File, buf []byte) error {
+	for len(buf) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := file.Write(buf[:min(int64(len(buf)), writeSlice)])
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// Writes buf to a new, empty file, seeking over sparseBlockSize aligned
+// blocks of zeros instead of writing them. The skipped blocks are holes
+// the filesystem reads back as zeros without allocating them, so VM disk
+// images and the like take up only their data on disk. Holes in sparse
+// entries read as zeros from the archive, so they end up holes too.
+func writeSparse(ctx context.Context, file *os.File, buf []byte) error {
+	dataStart := 0
+	flush := func(end int) error {
+		if end <= dataStart {
+			return nil
+		}
+		if _, err := file.Seek(int64(dataStart), io.SeekStart); err != nil {
+			return err
+		}
+		return writeBuffer(ctx, file, buf[dataStart:end])
+	}
+	for offset := 0; offset < len(buf); offset += sparseBlockSize {
+		if offset%writeSliceSize == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		end := int(min(int64(offset+sparseBlockSize), int64(len(buf))))
+		if !bytes.Equal(buf[offset:end], zeroBlock[:end-offset]) {
+			continue
+		}
+		if err := flush(offset); err != nil {
+			return err
+		}
+		dataStart = end
+	}
+	if err := flush(len(buf)); err != nil {
+		return err
+	}
+	// Extends the file over a trailing hole.
+	return file.Truncate(int64(len(buf)))
+}
+
+// Whether header is a GNU sparse entry, either old GNU format or PAX.
+func isSparseEntry(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
 }
 
 func hardLink(newPath string, path string, header *tar.Header, wg *sync.WaitGroup) {
 	wg.Wait()
+	if !expectedLinkContent(relativeToOutputDir(path), newPath, header) {
+		return
+	}
 
-	if opts.Overwrite {
+	if opts.Overwrite || journal != nil {
 		if _, err := os.Stat(path); err == nil {
 			os.Remove(path)
 		}
 	}
 	if err := os.Link(newPath, path); err != nil {
-		log.Fatal("Failed to hardlink: ", err.Error())
+		fatalErr("Failed to hardlink: ", err)
+	}
+	if opts.CasDir != "" {
+		// Changing the owner would change it for the shared CAS object.
+		recordCasLink(newPath, path)
+	} else {
+		chownEntry(path, header.Uid, header.Gid, false)
+	}
+	recordFakeroot(path, header)
+	if opts.HashFiles != "" {
+		recordHashLink(relativeToOutputDir(newPath), relativeToOutputDir(path))
+	}
+	if opts.Manifest != "" {
+		verifyExtractedFile(path)
+	}
+	recordManifestLink(relativeToOutputDir(newPath), relativeToOutputDir(path))
+	emitEvent("file_extracted", map[string]interface{}{"path": path, "type": "hardlink", "size": 0})
+}
+
+func relativeToOutputDir(path string) string {
+	relative, err := filepath.Rel(opts.OutputDir, path)
+	if err != nil {
+		return path
 	}
-	os.Chown(path, header.Uid, header.Gid)
+	return relative
 }
@@ -0,0 +1,210 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExtractTarLenient(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "backup volume 1", Typeflag: 'V', Format: tar.FormatGNU})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "nightly"}})
+	tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	opts.Lenient = true
+	ExtractTar(context.Background(), &buf)
+
+	entries, _ := os.ReadDir(opts.OutputDir)
+	if len(entries) != 1 || entries[0].Name() != "file" {
+		t.Fatalf("Expected only file to be extracted, got %v", entries)
+	}
+	if contents, err := os.ReadFile(filepath.Join(opts.OutputDir, "file")); err != nil || string(contents) != "hello" {
+		t.Fatalf("Got %q, %v", contents, err)
+	}
+}
+
+func TestExtractTarCanceled(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ExtractTar(ctx, &buf)
+
+	if entries, _ := os.ReadDir(opts.OutputDir); len(entries) != 0 {
+		t.Fatalf("Expected nothing to be extracted, got %v", entries)
+	}
+
+	// A write cut short leaves nothing behind.
+	path := filepath.Join(opts.OutputDir, "partial")
+	if writeFile(ctx, path, make([]byte, 3*writeSliceSize), &tar.Header{Mode: 0644}) {
+		t.Fatal("Expected canceled write to fail")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected partial file to be removed, got %v", err)
+	}
+}
+
+func TestExtractTarDeepTree(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "a/b/c/one", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	tw.Write([]byte("one"))
+	tw.WriteHeader(&tar.Header{Name: "a/b/", Typeflag: tar.TypeDir, Mode: 0700})
+	tw.WriteHeader(&tar.Header{Name: "a/b/d/two", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	tw.Write([]byte("two"))
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	ExtractTar(context.Background(), &buf)
+
+	for path, expected := range map[string]string{"a/b/c/one": "one", "a/b/d/two": "two"} {
+		if contents, err := os.ReadFile(filepath.Join(opts.OutputDir, path)); err != nil || string(contents) != expected {
+			t.Fatalf("Got %q, %v for %s", contents, err, path)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(opts.OutputDir, "a/b")); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("Expected a/b to get the mode of its entry, got %v, %v", info, err)
+	}
+}
+
+func TestExtractTarDuplicates(t *testing.T) {
+	large := RandomString(4 << 20)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(large))})
+	tw.Write([]byte(large))
+	tw.WriteHeader(&tar.Header{Name: "./file", Typeflag: tar.TypeReg, Mode: 0600, Size: 3})
+	tw.Write([]byte("new"))
+	tw.Close()
+	archive := buf.Bytes()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.WriteWorkers = 8
+	for policy, expected := range map[string]string{"last": "new", "first": large} {
+		opts.OutputDir = t.TempDir()
+		opts.Duplicates = policy
+		ExtractTar(context.Background(), bytes.NewReader(archive))
+		if contents, err := os.ReadFile(filepath.Join(opts.OutputDir, "file")); err != nil || string(contents) != expected {
+			t.Fatalf("Expected --duplicates=%s to keep the %d byte entry, got %d bytes, %v", policy, len(expected), len(contents), err)
+		}
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	root := t.TempDir()
+	dirs := dirCache{}
+	dirs.ensure(filepath.Join(root, "x/y/z") + "/")
+	if info, err := os.Stat(filepath.Join(root, "x/y/z")); err != nil || !info.IsDir() {
+		t.Fatalf("Expected x/y/z to be created, got %v", err)
+	}
+	for _, dir := range []string{"x/y/z", "x/y", "x", ""} {
+		if !dirs[filepath.Join(root, dir)] {
+			t.Fatalf("Expected %q to be cached", dir)
+		}
+	}
+	// Cached directories aren't checked again.
+	os.RemoveAll(filepath.Join(root, "x"))
+	dirs.ensure(filepath.Join(root, "x/y"))
+	if _, err := os.Stat(filepath.Join(root, "x")); !os.IsNotExist(err) {
+		t.Fatalf("Expected a cache hit not to touch the filesystem, got %v", err)
+	}
+}
+
+func TestCheckPathLimits(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	deep := strings.Repeat("d/", 999) + "file"
+	for _, test := range []struct {
+		name    string
+		depth   int
+		length  int
+		tooLong bool
+	}{
+		{"a/b/c", 3, 0, false},
+		{"a/b/c/d", 3, 0, true},
+		{"./a/../b/c/", 2, 0, false},
+		{"abcde/x", 0, 5, false},
+		{"x/abcdef", 0, 5, true},
+		{deep, 1000, 0, false},
+		{deep, 999, 0, true},
+		{deep + "/" + strings.Repeat("n", 255), 1024, 255, false},
+		{deep + "/" + strings.Repeat("n", 256), 1024, 255, true},
+		{deep + "/" + strings.Repeat("n", 256), 0, 0, false},
+	} {
+		options := DefaultOptions()
+		options.MaxPathDepth = test.depth
+		options.MaxNameLength = test.length
+		// Failures are reported to the library call instead of exiting.
+		if err := beginCall(options); err != nil {
+			t.Fatal(err)
+		}
+		runOwned(func() { checkPathLimits(test.name) })
+		err := callError()
+		endCall()
+		if tooLong := errors.Is(err, syscall.ENAMETOOLONG); tooLong != test.tooLong || (err != nil && !tooLong) {
+			t.Fatalf("%.40s with depth %d and length %d: got %v", test.name, test.depth, test.length, err)
+		}
+	}
+}
+
+func TestExtractTarZeroRuns(t *testing.T) {
+	contents := map[string][]byte{}
+	for _, size := range []int{0, 1, sparseBlockSize, sparseMinSize - 1, sparseMinSize, sparseMinSize + sparseBlockSize + 7} {
+		buf := make([]byte, size)
+		// Data at both ends and zero runs, aligned or not, in between.
+		for _, offset := range []int{0, sparseBlockSize + 3, 3 * sparseBlockSize, size - 1} {
+			if offset >= 0 && offset < size {
+				buf[offset] = 'x'
+			}
+		}
+		contents[fmt.Sprintf("file-%d", size)] = buf
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for name, data := range contents {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	for _, noSparse := range []bool{false, true} {
+		opts.OutputDir = t.TempDir()
+		opts.WriteWorkers = 2
+		opts.NoSparse = noSparse
+		ExtractTar(context.Background(), bytes.NewReader(archive.Bytes()))
+		for name, expected := range contents {
+			if actual, err := os.ReadFile(filepath.Join(opts.OutputDir, name)); err != nil || !bytes.Equal(actual, expected) {
+				t.Fatalf("%s with --no-sparse=%t reads back differently, err %v", name, noSparse, err)
+			}
+		}
+	}
+}
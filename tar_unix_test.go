@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteSparse(t *testing.T) {
+	buf := make([]byte, 16*sparseBlockSize+100)
+	copy(buf, "head")
+	copy(buf[10*sparseBlockSize+10:], "middle")
+	path := filepath.Join(t.TempDir(), "sparse")
+	if !writeFile(context.Background(), path, buf, &tar.Header{Mode: 0644}) {
+		t.Fatal("Expected write to succeed")
+	}
+	if contents, err := os.ReadFile(path); err != nil || !bytes.Equal(contents, buf) {
+		t.Fatalf("Sparse file reads back differently, err %v", err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		t.Fatal(err)
+	}
+	// Only the two blocks with data are allocated.
+	if stat.Blocks*512 > 3*sparseBlockSize {
+		t.Fatalf("%d bytes allocated for %d bytes of data", stat.Blocks*512, 2*sparseBlockSize)
+	}
+
+	// Files under sparseMinSize are written out in full.
+	small := make([]byte, 4*sparseBlockSize)
+	copy(small[3*sparseBlockSize:], "tail")
+	if !writeFile(context.Background(), path+"-small", small, &tar.Header{Mode: 0644}) {
+		t.Fatal("Expected write to succeed")
+	}
+	if err := unix.Stat(path+"-small", &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Blocks*512 < int64(len(small)) {
+		t.Fatalf("Only %d bytes allocated for a %d byte file under sparseMinSize", stat.Blocks*512, len(small))
+	}
+
+	if !isSparseEntry(&tar.Header{Typeflag: tar.TypeGNUSparse}) ||
+		!isSparseEntry(&tar.Header{Typeflag: tar.TypeReg, PAXRecords: map[string]string{"GNU.sparse.major": "1"}}) ||
+		isSparseEntry(&tar.Header{Typeflag: tar.TypeReg}) {
+		t.Fatal("Sparse entries misdetected")
+	}
+}
@@ -0,0 +1,34 @@
+package fastar
+
+import (
+	"io"
+	"os"
+)
+
+// Copies everything read through it to stdout, so one download can feed a
+// local extraction and a pipe to another host at the same time. The
+// extraction only goes as fast as stdout is drained.
+//
+// Failing to write to stdout, e.g. because the downstream consumer exited,
+// is fatal instead of surfacing as a confusing read error in the tar reader.
+type stdoutTee struct {
+	reader io.Reader
+}
+
+func (tee stdoutTee) Read(p []byte) (int, error) {
+	n, err := tee.reader.Read(p)
+	if n > 0 {
+		if _, writeErr := os.Stdout.Write(p[:n]); writeErr != nil {
+			fatal("Failed to write tar stream to stdout: ", writeErr.Error())
+		}
+	}
+	return n, err
+}
+
+// Tar extraction stops at the end of archive marker, but whatever comes
+// after it still belongs on stdout.
+func finishTee(tee io.Reader) {
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		fatal("Failed to read remainder of archive: ", err.Error())
+	}
+}
@@ -0,0 +1,49 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStdoutTee(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	contents := RandomString(100000)
+	tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+	tw.Write([]byte(contents))
+	tw.Close()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout := os.Stdout
+	defer func() { os.Stdout = oldStdout }()
+	os.Stdout = writer
+	piped := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		piped <- data
+	}()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	tee := stdoutTee{bytes.NewReader(archive.Bytes())}
+	ExtractTar(context.Background(), tee)
+	finishTee(tee)
+	writer.Close()
+
+	if data := <-piped; !bytes.Equal(data, archive.Bytes()) {
+		t.Fatalf("Got %d bytes on stdout, wanted the whole %d byte archive", len(data), archive.Len())
+	}
+	if extracted, _ := os.ReadFile(filepath.Join(opts.OutputDir, "file")); string(extracted) != contents {
+		t.Fatal("File wasn't extracted")
+	}
+}
@@ -3,7 +3,7 @@
 ret=0
 
 echo building binaries
-go build
+go build ./cmd/fastar
 cd fileserver
 go build ./fileserver.go
 cd ..
@@ -24,6 +24,11 @@ lz4 /tmp/rand.tar /tmp/rand.tar.lz4
 cp /tmp/rand.tar /tmp/randTAR
 cp /tmp/rand.tar.gz /tmp/randTARGZ
 cp /tmp/rand.tar.lz4 /tmp/randTARLZ4
+# chained layers
+gzip -c /tmp/rand.tar.gz > /tmp/rand.tar.gz.gz
+echo fastar > /tmp/rand.pass
+gpg --batch --pinentry-mode loopback --passphrase-file /tmp/rand.pass -c -o /tmp/rand.tar.gz.gpg /tmp/rand.tar.gz
+cp /tmp/rand.tar.gz.gpg /tmp/randTARGZGPG
 
 rm -rf /tmp/output
 mkdir /tmp/output
@@ -66,6 +71,22 @@ do
     fi
 done
 
+echo testing chained layers
+for filename in rand.tar.gz.gz rand.tar.gz.gpg randTARGZGPG
+do
+    rm -rf /tmp/output/*
+    if ./fastar http://localhost:8000/$filename -C /tmp/output --gpg-passphrase-file /tmp/rand.pass; then
+        if diff /tmp/output/tmp/rand /tmp/rand; then
+            echo $filename matches
+        else
+            echo xxx $filename does not match
+            ret=1
+        fi
+    else
+        ret=1
+    fi
+done
+
 echo killing fileserver...
 kill -9 $pid
 
@@ -3,7 +3,7 @@
 ret=0
 
 echo building binaries
-go build
+go build ./cmd/fastar
 cp fastar /tmp
 cd fileserver
 go build ./fileserver.go
@@ -0,0 +1,45 @@
+#!/bin/bash
+
+ret=0
+
+echo building binaries
+go build ./cmd/fastar
+cd grpcserver
+go build ./grpcserver.go
+cd ..
+
+echo starting grpcserver
+./grpcserver/grpcserver &
+pid=$!
+echo grpcserver pid is $pid, saving for later
+sleep 1
+
+chunkSize=$((1<<20))
+
+for fileSize in 0 1 $(($chunkSize-1)) $chunkSize $(($chunkSize+1)) $((4*$chunkSize+1))
+do
+    echo testing with fileSize $fileSize
+    rm -rf /tmp/source
+    rm -rf /tmp/download
+    dd if=/dev/urandom of=/tmp/source bs=1 count=$fileSize
+    ./fastar grpc://localhost:9000/source --chunk-size 1 --download-workers 4 -O > /tmp/download
+    if diff /tmp/source /tmp/download; then
+        echo files match
+    else
+        echo xxx files do not match
+        ret=1
+    fi
+    echo 
+done
+
+echo checking missing key exits with code 2
+./fastar grpc://localhost:9000/not_found -O > /dev/null
+if [ $? -ne 2 ]; then
+    echo "xxx Didn't return exit code 2"
+    ret=1
+fi
+
+echo killing grpcserver...
+kill -9 $pid
+
+exit $ret
@@ -0,0 +1,320 @@
+package fastar
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Downloads the payload of a single file torrent from its HTTP web seeds
+// (BEP 19 "url-list"), striping chunks across all seeds and verifying every
+// piece against the SHA1 hashes in the torrent. Peer to peer transfer isn't
+// supported, so torrents without web seeds can't be downloaded.
+//
+// Handles URLs to .torrent files and magnet links carrying the .torrent's
+// location in an xs= parameter, any ws= web seeds in the magnet link are
+// used in addition to the ones in the torrent.
+type TorrentDownloader struct {
+	Url         string
+	seeds       []HttpDownloader
+	nextSeed    *atomic.Uint64
+	length      int64
+	pieceLength int64
+	pieces      []byte
+}
+
+func NewTorrentDownloader(rawUrl string, client *http.Client) TorrentDownloader {
+	torrentUrl := rawUrl
+	var infoHash string
+	var extraSeeds []string
+	if strings.HasPrefix(rawUrl, "magnet:") {
+		magnet, err := url.Parse(rawUrl)
+		if err != nil {
+			fatal("Failed to parse magnet link: ", err.Error())
+		}
+		params := magnet.Query()
+		torrentUrl = params.Get("xs")
+		if torrentUrl == "" {
+			fatal("Magnet links need an xs= parameter pointing at the .torrent file, fetching metadata from peers isn't supported")
+		}
+		infoHash = strings.ToLower(strings.TrimPrefix(params.Get("xt"), "urn:btih:"))
+		extraSeeds = params["ws"]
+	}
+
+	torrentFile := HttpDownloader{Url: torrentUrl, client: client}
+	resp := torrentFile.retryHttpRequest(torrentFile.generateRequest("GET"))
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		fatal("Failed to download torrent file: ", err.Error())
+	}
+	decoder := &bencodeDecoder{data: data}
+	decoded, err := decoder.decode()
+	if err != nil {
+		fatal("Failed to parse torrent file: ", err.Error())
+	}
+	if infoHash != "" {
+		actual := sha1.Sum(data[decoder.infoStart:decoder.infoEnd])
+		if hex.EncodeToString(actual[:]) != infoHash {
+			log.Println("Torrent file doesn't match the magnet link's info hash")
+			exit(ErrCorrupt)
+		}
+	}
+
+	torrent, _ := decoded.(map[string]interface{})
+	info, _ := torrent["info"].(map[string]interface{})
+	name, _ := info["name"].(string)
+	length, hasLength := info["length"].(int64)
+	pieceLength, _ := info["piece length"].(int64)
+	pieces, _ := info["pieces"].(string)
+	if !hasLength {
+		fatal("Only single file torrents are supported")
+	}
+	if pieceLength <= 0 || int64(len(pieces)) != (length+pieceLength-1)/pieceLength*sha1.Size {
+		fatal("Torrent file has invalid piece information")
+	}
+
+	var seedUrls []string
+	switch urlList := torrent["url-list"].(type) {
+	case string:
+		seedUrls = append(seedUrls, urlList)
+	case []interface{}:
+		for _, seed := range urlList {
+			if s, ok := seed.(string); ok {
+				seedUrls = append(seedUrls, s)
+			}
+		}
+	}
+	seedUrls = append(seedUrls, extraSeeds...)
+	if len(seedUrls) == 0 {
+		fatal("Torrent has no web seeds, downloading from peers isn't supported")
+	}
+	var seeds []HttpDownloader
+	for _, seed := range seedUrls {
+		// Per BEP 19 seeds ending in a slash are a directory holding the file.
+		if strings.HasSuffix(seed, "/") {
+			seed += url.PathEscape(name)
+		}
+		seeds = append(seeds, HttpDownloader{Url: seed, client: client})
+	}
+	log.Printf("Torrent %s has %d pieces and %d web seeds\n", name, len(pieces)/sha1.Size, len(seeds))
+	return TorrentDownloader{rawUrl, seeds, &atomic.Uint64{}, length, pieceLength, []byte(pieces)}
+}
+
+// Round robin chunk requests across all web seeds.
+func (torrentDownloader TorrentDownloader) seed() HttpDownloader {
+	next := torrentDownloader.nextSeed.Add(1)
+	return torrentDownloader.seeds[next%uint64(len(torrentDownloader.seeds))]
+}
+
+func (torrentDownloader TorrentDownloader) GetFileInfo() (int64, bool, bool) {
+	return torrentDownloader.length, true, false
+}
+
+func (torrentDownloader TorrentDownloader) Get() io.ReadCloser {
+	return torrentDownloader.seed().Get()
+}
+
+func (torrentDownloader TorrentDownloader) GetRange(start, end int64) io.ReadCloser {
+	return torrentDownloader.seed().GetRange(start, end)
+}
+
+func (torrentDownloader TorrentDownloader) GetRanges(ranges [][]int64) (*multipart.Reader, error) {
+	return nil, errors.New("multipart range requests not supported for torrents")
+}
+
+func (torrentDownloader TorrentDownloader) VerifyStream(stream io.Reader) io.Reader {
+	// Downloading a piece again doesn't fix an --output-file already on
+	// disk.
+	_, onDisk := stream.(*os.File)
+	return &pieceVerifier{
+		reader:     stream,
+		downloader: torrentDownloader,
+		buf:        make([]byte, torrentDownloader.pieceLength),
+		refetch:    !onDisk,
+	}
+}
+
+// Passes on the in order download stream one piece at a time, each only
+// once it matches its hash. A corrupt piece is downloaded again from the
+// web seeds unless the stream is a file. Exits with EBADMSG if none of
+// them has it right, or the stream doesn't hold exactly the torrent's
+// pieces.
+type pieceVerifier struct {
+	reader     io.Reader
+	downloader TorrentDownloader
+	piece      int
+	buf        []byte
+	refetch    bool
+	// What's left to pass on of the last verified piece.
+	verified []byte
+}
+
+func (v *pieceVerifier) Read(p []byte) (int, error) {
+	if len(v.verified) == 0 {
+		if err := v.nextPiece(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, v.verified)
+	v.verified = v.verified[n:]
+	return n, nil
+}
+
+func (v *pieceVerifier) pieceCount() int {
+	return len(v.downloader.pieces) / sha1.Size
+}
+
+// The byte range [start, end) of piece.
+func (v *pieceVerifier) pieceRange(piece int) (int64, int64) {
+	start := int64(piece) * v.downloader.pieceLength
+	return start, min(start+v.downloader.pieceLength, v.downloader.length)
+}
+
+func (v *pieceVerifier) nextPiece() error {
+	if v.piece == v.pieceCount() {
+		if n, _ := io.ReadFull(v.reader, v.buf[:1]); n > 0 {
+			log.Printf("Torrent stream is longer than its %d pieces\n", v.pieceCount())
+			exit(ErrCorrupt)
+		}
+		return io.EOF
+	}
+	start, end := v.pieceRange(v.piece)
+	piece := v.buf[:end-start]
+	if n, err := io.ReadFull(v.reader, piece); err == io.EOF || err == io.ErrUnexpectedEOF {
+		log.Printf("Torrent stream ended %d bytes into piece %d of %d\n", n, v.piece, v.pieceCount())
+		exit(ErrCorrupt)
+	} else if err != nil {
+		return err
+	}
+	if !v.matches(v.piece, piece) {
+		if !v.refetch {
+			log.Printf("Torrent piece %d failed hash verification\n", v.piece)
+			exit(ErrCorrupt)
+		}
+		v.downloadAgain(v.piece, piece)
+	}
+	v.verified = piece
+	v.piece++
+	return nil
+}
+
+func (v *pieceVerifier) matches(piece int, data []byte) bool {
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], v.downloader.pieces[piece*sha1.Size:(piece+1)*sha1.Size])
+}
+
+// Downloads piece into data again, trying each web seed once.
+func (v *pieceVerifier) downloadAgain(piece int, data []byte) {
+	start, end := v.pieceRange(piece)
+	for attempt := 1; attempt <= len(v.downloader.seeds); attempt++ {
+		seed := v.downloader.seed()
+		log.Printf("Torrent piece %d failed hash verification, downloading it again from %s\n", piece, seed.Url)
+		body := seed.GetRange(start, end)
+		_, err := io.ReadFull(body, data)
+		body.Close()
+		if err == nil && v.matches(piece, data) {
+			return
+		}
+	}
+	log.Printf("Torrent piece %d failed hash verification from every web seed\n", piece)
+	exit(ErrCorrupt)
+}
+
+// Minimal bencode decoder. Integers decode to int64, strings to string,
+// lists to []interface{} and dictionaries to map[string]interface{}.
+// Records where the top level "info" dictionary is so its hash can be
+// checked against a magnet link.
+type bencodeDecoder struct {
+	data               []byte
+	pos                int
+	depth              int
+	infoStart, infoEnd int
+}
+
+func (d *bencodeDecoder) decode() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, errors.New("unexpected end of bencoded data")
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, errors.New("unterminated integer")
+		}
+		value, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		d.pos += end + 1
+		return value, err
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(d.data[d.pos:], ':')
+		if colon < 0 {
+			return nil, errors.New("invalid string length")
+		}
+		length, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+		start := d.pos + colon + 1
+		if err != nil || length < 0 || start+length > len(d.data) {
+			return nil, errors.New("invalid string length")
+		}
+		d.pos = start + length
+		return string(d.data[start:d.pos]), nil
+	case c == 'l':
+		d.pos++
+		d.depth++
+		list := []interface{}{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			item, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		if d.pos >= len(d.data) {
+			return nil, errors.New("unterminated list")
+		}
+		d.pos++
+		d.depth--
+		return list, nil
+	case c == 'd':
+		d.pos++
+		d.depth++
+		dict := map[string]interface{}{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			key, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, errors.New("dictionary key is not a string")
+			}
+			valueStart := d.pos
+			value, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			if d.depth == 1 && keyString == "info" {
+				d.infoStart, d.infoEnd = valueStart, d.pos
+			}
+			dict[keyString] = value
+		}
+		if d.pos >= len(d.data) {
+			return nil, errors.New("unterminated dictionary")
+		}
+		d.pos++
+		d.depth--
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("unexpected byte %q in bencoded data", c)
+	}
+}
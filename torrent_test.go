@@ -0,0 +1,171 @@
+package fastar
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBencodeDecode(t *testing.T) {
+	data := "d8:announce8:http://x4:infod6:lengthi42e4:name3:foo6:piecesl1:a2:bceee"
+	decoder := &bencodeDecoder{data: []byte(data)}
+	decoded, err := decoder.decode()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := map[string]interface{}{
+		"announce": "http://x",
+		"info": map[string]interface{}{
+			"length": int64(42),
+			"name":   "foo",
+			"pieces": []interface{}{"a", "bc"},
+		},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("Got %v, wanted %v", decoded, expected)
+	}
+	if info := data[decoder.infoStart:decoder.infoEnd]; info != "d6:lengthi42e4:name3:foo6:piecesl1:a2:bcee" {
+		t.Fatalf("Got info span %s", info)
+	}
+	for _, invalid := range []string{"", "i42", "5:abc", "d1:ai1e", "di1ei2ee", "x"} {
+		if _, err := (&bencodeDecoder{data: []byte(invalid)}).decode(); err == nil {
+			t.Fatalf("Decoding %q should have failed", invalid)
+		}
+	}
+}
+
+// Serves a torrent of data with pieceLength byte pieces at /data.torrent,
+// and data from every seed, with corrupt[seed] in place of the seed's
+// bytes from corruptAt on.
+func serveTorrent(t *testing.T, data string, pieceLength int, corruptAt int, corrupt map[string]string) (string, func() []string) {
+	var pieces strings.Builder
+	for start := 0; start < len(data); start += pieceLength {
+		hash := sha1.Sum([]byte(data[start:min(int64(start+pieceLength), int64(len(data)))]))
+		pieces.Write(hash[:])
+	}
+	var mutex sync.Mutex
+	var requested []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/data.torrent" {
+			seeds := ""
+			for _, seed := range []string{"good", "bad", "worse"} {
+				seeds += fmt.Sprintf("%d:%s", len(server.URL)+len(seed)+1, server.URL+"/"+seed)
+			}
+			fmt.Fprintf(w, "d8:url-listl%se4:infod6:lengthi%de4:name4:data12:piece lengthi%de6:pieces%d:%see",
+				seeds, len(data), pieceLength, pieces.Len(), pieces.String())
+			return
+		}
+		seed := strings.TrimPrefix(r.URL.Path, "/")
+		mutex.Lock()
+		requested = append(requested, seed)
+		mutex.Unlock()
+		served := data
+		if replacement, ok := corrupt[seed]; ok {
+			served = data[:corruptAt] + replacement + data[corruptAt+len(replacement):]
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(served))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/data.torrent", func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), requested...)
+	}
+}
+
+func TestTorrentPieceVerification(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	options := DefaultOptions()
+	options.MinSpeed = "0"
+	options.RetryCount = 1
+
+	data := RandomString(1000)
+	corruptAt := 250
+	corrupted := data[:corruptAt] + "XXXX" + data[corruptAt+4:]
+	onDisk := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(onDisk, []byte(corrupted), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		corrupt map[string]string
+		stream  string
+		onDisk  bool
+		// How much of data is passed on, all of it unless it fails.
+		valid int
+		fails bool
+	}{
+		{"intact", nil, data, false, len(data), false},
+		// The stream came from the bad seed, only the good one has piece 2.
+		{"downloaded again", map[string]string{"bad": "XXXX", "worse": "YYYY"}, corrupted, false, len(data), false},
+		{"corrupt everywhere", map[string]string{"good": "XXXX", "bad": "XXXX", "worse": "YYYY"}, corrupted, false, 200, true},
+		{"output file", map[string]string{"bad": "XXXX"}, "", true, 200, true},
+		{"truncated", nil, data[:950], false, 900, true},
+		{"too long", nil, data + "trailing", false, len(data), true},
+	} {
+		if err := beginCall(options); err != nil {
+			t.Fatal(err)
+		}
+		torrentUrl, requested := serveTorrent(t, data, 100, corruptAt, test.corrupt)
+		var verified []byte
+		runOwned(func() {
+			downloader := NewTorrentDownloader(torrentUrl, &http.Client{})
+			var stream io.Reader = strings.NewReader(test.stream)
+			if test.onDisk {
+				file, err := os.Open(onDisk)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer file.Close()
+				stream = file
+			}
+			stream = downloader.VerifyStream(stream)
+			buf := make([]byte, 7)
+			for {
+				n, err := stream.Read(buf)
+				verified = append(verified, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+		})
+		err := callError()
+		endCall()
+		if string(verified) != data[:test.valid] {
+			t.Fatalf("%s: passed on %d bytes, %d of them valid, wanted %d valid ones", test.name, len(verified), commonPrefix(string(verified), data), test.valid)
+		}
+		if test.fails != errors.Is(err, syscall.EBADMSG) {
+			t.Fatalf("%s: failed with %v", test.name, err)
+		}
+		seeds := requested()
+		if test.name == "downloaded again" {
+			if len(seeds) == 0 || seeds[len(seeds)-1] != "good" {
+				t.Fatalf("%s: piece downloaded again from %v", test.name, seeds)
+			}
+		} else if test.name != "corrupt everywhere" && len(seeds) > 0 {
+			t.Fatalf("%s: downloaded from %v", test.name, seeds)
+		}
+	}
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,80 @@
+package fastar
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Overridden at build time, e.g.
+//
+//	go build -ldflags "-X github.com/databricks/fastar.version=1.2.3 -X github.com/databricks/fastar.gitSha=$(git rev-parse HEAD)" ./cmd/fastar
+var (
+	version = "0.0.0-dev"
+	gitSha  = ""
+)
+
+// URL schemes and compression codecs compiled into this binary. Keep the
+// backends in sync with getDownloader() so tooling can rely on --version to
+// check for support before passing newer flags.
+var (
+	supportedBackends = []string{"http", "https", "s3", "gs", "grpc", "grpcs", "hdfs", "webhdfs", "swebhdfs", "smb", "sftp", "scp", "rsync", "github", "github-lfs", "torrent", "magnet", "ipfs", "az", "stdin"}
+	supportedCodecs   = compressionNames(decodableCompressionTypes)
+)
+
+func compressionNames(compressionTypes []CompressionType) []string {
+	names := make([]string, len(compressionTypes))
+	for i, compressionType := range compressionTypes {
+		names[i] = compressionType.String()
+	}
+	return names
+}
+
+type versionInfo struct {
+	Version   string   `json:"version"`
+	GitSha    string   `json:"git_sha"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Backends  []string `json:"backends"`
+	Codecs    []string `json:"codecs"`
+	// Whether the binary was built against a FIPS validated crypto module
+	// (GOEXPERIMENT=boringcrypto).
+	FipsCrypto bool `json:"fips_crypto"`
+	// Whether --use-fips-endpoint is available for S3 downloads.
+	FipsEndpoint bool `json:"fips_endpoint"`
+}
+
+func getVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:      version,
+		GitSha:       gitSha,
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Backends:     supportedBackends,
+		Codecs:       supportedCodecs,
+		FipsEndpoint: true,
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.GitSha == "" {
+				info.GitSha = setting.Value
+			} else if setting.Key == "GOEXPERIMENT" && strings.Contains(setting.Value, "boringcrypto") {
+				info.FipsCrypto = true
+			}
+		}
+	}
+	if info.GitSha == "" {
+		info.GitSha = "unknown"
+	}
+	return info
+}
+
+func printVersion() {
+	out, err := json.MarshalIndent(getVersionInfo(), "", "  ")
+	if err != nil {
+		fatal("Failed to encode version info: ", err.Error())
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,143 @@
+package fastar
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const writeAutoscaleInterval = time.Second
+
+// Limits concurrent file writes to one filesystem. With
+// --autoscale-write-workers the limit follows the observed write latency:
+// it grows while writes queue up behind it and latency holds steady, and
+// backs off once latency climbs, which is how an overwhelmed network
+// filesystem shows itself.
+type writeGate struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	dev   uint64
+	limit int
+	inUse int
+	// Lowest per-operation latency seen, in seconds, drifting up slowly so
+	// one lucky interval doesn't pin it.
+	baseline float64
+	// Collected since the last adjustment.
+	waited  bool
+	ops     float64
+	latency time.Duration
+}
+
+var (
+	writeGatesMutex sync.Mutex
+	writeGates      map[uint64]*writeGate
+	dirDevices      map[string]uint64
+	stopAutoscaler  chan bool
+)
+
+// Starts adjusting the write gates every writeAutoscaleInterval, until
+// stopWriteAutoscaler is called.
+func startWriteAutoscaler(maxWorkers int) {
+	writeGates = map[uint64]*writeGate{}
+	dirDevices = map[string]uint64{}
+	stopAutoscaler = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(writeAutoscaleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopAutoscaler:
+				return
+			case <-ticker.C:
+				writeGatesMutex.Lock()
+				for _, gate := range writeGates {
+					gate.adjust(maxWorkers)
+				}
+				writeGatesMutex.Unlock()
+			}
+		}
+	}()
+}
+
+func stopWriteAutoscaler() {
+	close(stopAutoscaler)
+}
+
+// Returns the gate of the filesystem dir is on, starting it off at
+// --write-workers.
+func writeGateFor(dir string) *writeGate {
+	writeGatesMutex.Lock()
+	defer writeGatesMutex.Unlock()
+	dev, ok := dirDevices[dir]
+	if !ok {
+		if info, err := os.Stat(dir); err == nil {
+			dev = fileDevice(info)
+		}
+		dirDevices[dir] = dev
+	}
+	gate := writeGates[dev]
+	if gate == nil {
+		gate = &writeGate{dev: dev, limit: opts.WriteWorkers}
+		gate.cond = sync.NewCond(&gate.mutex)
+		writeGates[dev] = gate
+	}
+	return gate
+}
+
+func (gate *writeGate) acquire() {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if gate.inUse >= gate.limit {
+		gate.waited = true
+	}
+	for gate.inUse >= gate.limit {
+		gate.cond.Wait()
+	}
+	gate.inUse++
+}
+
+// Every MiB written counts as another operation, so large files don't
+// look like congestion.
+func (gate *writeGate) release(size int, latency time.Duration) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.inUse--
+	gate.ops += 1 + float64(size)/(1<<20)
+	gate.latency += latency
+	gate.cond.Signal()
+}
+
+func (gate *writeGate) adjust(maxWorkers int) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if gate.ops == 0 {
+		return
+	}
+	latency := gate.latency.Seconds() / gate.ops
+	if gate.baseline == 0 || latency < gate.baseline {
+		gate.baseline = latency
+	} else {
+		gate.baseline *= 1.05
+	}
+	previous := gate.limit
+	if latency > 2*gate.baseline && gate.limit > 1 {
+		gate.limit = gate.limit * 3 / 4
+		if gate.limit < 1 {
+			gate.limit = 1
+		}
+	} else if gate.waited && latency <= 1.5*gate.baseline && gate.limit < maxWorkers {
+		gate.limit += (gate.limit + 3) / 4
+		if gate.limit > maxWorkers {
+			gate.limit = maxWorkers
+		}
+	}
+	gate.waited = false
+	gate.ops = 0
+	gate.latency = 0
+	if gate.limit != previous {
+		log.Printf("Write workers for device %d: %d -> %d (%.2fms per op)\n", gate.dev, previous, gate.limit, latency*1e3)
+		emitEvent("write_workers_changed", map[string]interface{}{"device": gate.dev, "workers": gate.limit, "latency_ms": latency * 1e3})
+		gate.cond.Broadcast()
+	}
+}
@@ -0,0 +1,72 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteGateAdjust(t *testing.T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.WriteWorkers = 4
+	// Adjusted by hand rather than by startWriteAutoscaler's ticker.
+	writeGates = map[uint64]*writeGate{}
+	dirDevices = map[string]uint64{}
+	gate := writeGateFor(t.TempDir())
+	if gate != writeGateFor(t.TempDir()) {
+		t.Fatal("Directories on the same filesystem got different gates")
+	}
+
+	interval := func(waited bool, latency time.Duration) int {
+		for i := 0; i < 10; i++ {
+			gate.acquire()
+			gate.release(0, latency)
+		}
+		gate.waited = waited
+		gate.adjust(8)
+		return gate.limit
+	}
+	if limit := interval(false, time.Millisecond); limit != 4 {
+		t.Fatalf("Grew to %d without any queueing", limit)
+	}
+	if limit := interval(true, time.Millisecond); limit != 5 {
+		t.Fatalf("Got limit %d, wanted 5", limit)
+	}
+	if limit := interval(true, time.Millisecond); limit != 7 {
+		t.Fatalf("Got limit %d, wanted 7", limit)
+	}
+	if limit := interval(true, time.Millisecond); limit != 8 {
+		t.Fatalf("Got limit %d, wanted to stop at 8", limit)
+	}
+	if limit := interval(true, 10*time.Millisecond); limit != 6 {
+		t.Fatalf("Got limit %d after latency spike, wanted 6", limit)
+	}
+}
+
+func TestExtractTarAutoscale(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < 200; i++ {
+		contents := RandomString(int64(i * 100))
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("dir%d/file%d", i%3, i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+		tw.Write([]byte(contents))
+	}
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 1
+	opts.MaxWriteWorkers = 4
+	opts.AutoscaleWrites = true
+	ExtractTar(context.Background(), &buf)
+	if entries, _ := os.ReadDir(filepath.Join(opts.OutputDir, "dir2")); len(entries) != 66 {
+		t.Fatalf("Got %d files in dir2, wanted 66", len(entries))
+	}
+}
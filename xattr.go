@@ -0,0 +1,159 @@
+package fastar
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Text POSIX ACLs as GNU tar --acls and star archive them.
+const (
+	paxAclAccess  = "SCHILY.acl.access"
+	paxAclDefault = "SCHILY.acl.default"
+)
+
+// ACL entry tags and version of the kernel's binary xattr format, see
+// linux/posix_acl_xattr.h.
+const (
+	aclXattrVersion = 2
+	aclUndefinedId  = 0xffffffff
+)
+
+var aclTags = map[string]uint16{
+	"user::":  0x01,
+	"user:":   0x02,
+	"group::": 0x04,
+	"group:":  0x08,
+	"mask::":  0x10,
+	"other::": 0x20,
+}
+
+// Xattr names that failed to apply and have been warned about, so a layer
+// full of file capabilities extracted unprivileged logs it only once.
+var xattrWarned sync.Map
+
+// Applies the xattrs and ACLs in header's pax records to the entry already
+// extracted at path. Has to run after the entry is chowned, which clears
+// security.capability. Failures, e.g. trusted.* or capabilities without
+// CAP_SYS_ADMIN or a filesystem without xattrs, are logged but not fatal.
+func applyXattrs(path string, header *tar.Header) {
+	xattrs := archivedXattrs(header)
+	for record, name := range map[string]string{paxAclAccess: "system.posix_acl_access", paxAclDefault: "system.posix_acl_default"} {
+		text, ok := header.PAXRecords[record]
+		if !ok || text == "" {
+			continue
+		}
+		if _, ok := xattrs[name]; ok {
+			continue
+		}
+		acl, err := parseTextAcl(text)
+		if err != nil {
+			log.Printf("ExtractTarGz: ignoring ACL of %s: %s\n", header.Name, err.Error())
+			continue
+		}
+		xattrs[name] = string(acl)
+	}
+	for name, value := range xattrs {
+		if err := lsetxattr(path, name, []byte(value)); err != nil {
+			if _, warned := xattrWarned.LoadOrStore(name, true); !warned {
+				log.Printf("ExtractTarGz: failed to set xattr %s on %s, not warning about it again: %s\n", name, path, err.Error())
+			}
+		}
+	}
+}
+
+// Converts a text ACL like "user::rw-,user:alice:r--:1001,group::r--,
+// mask::r--,other::---" to the binary format of the system.posix_acl_*
+// xattrs. Named entries use their trailing numeric id if there is one, as
+// star writes it, otherwise the name is looked up on this host.
+func parseTextAcl(text string) ([]byte, error) {
+	type aclEntry struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}
+	var entries []aclEntry
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid ACL entry %q", field)
+		}
+		kind, qualifier, perms := parts[0], parts[1], parts[2]
+		key := kind + ":"
+		if qualifier == "" {
+			key += ":"
+		}
+		tag, ok := aclTags[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid ACL entry %q", field)
+		}
+		entry := aclEntry{tag: tag, id: aclUndefinedId}
+		if len(perms) != 3 {
+			return nil, fmt.Errorf("invalid permissions in ACL entry %q", field)
+		}
+		for i, bit := range []byte("rwx") {
+			if perms[i] == bit {
+				entry.perm |= 4 >> i
+			} else if perms[i] != '-' {
+				return nil, fmt.Errorf("invalid permissions in ACL entry %q", field)
+			}
+		}
+		if qualifier != "" {
+			id, err := aclQualifierId(kind, qualifier, parts[3:])
+			if err != nil {
+				return nil, err
+			}
+			entry.id = id
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("empty ACL")
+	}
+	// The kernel requires entries sorted by tag, then id.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	acl := binary.LittleEndian.AppendUint32(nil, aclXattrVersion)
+	for _, entry := range entries {
+		acl = binary.LittleEndian.AppendUint16(acl, entry.tag)
+		acl = binary.LittleEndian.AppendUint16(acl, entry.perm)
+		acl = binary.LittleEndian.AppendUint32(acl, entry.id)
+	}
+	return acl, nil
+}
+
+func aclQualifierId(kind, qualifier string, trailingId []string) (uint32, error) {
+	if len(trailingId) == 1 {
+		qualifier = trailingId[0]
+	}
+	if id, err := strconv.ParseUint(qualifier, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	var id string
+	if kind == "user" {
+		u, err := user.Lookup(qualifier)
+		if err != nil {
+			return 0, fmt.Errorf("unknown user %q in ACL", qualifier)
+		}
+		id = u.Uid
+	} else {
+		g, err := user.LookupGroup(qualifier)
+		if err != nil {
+			return 0, fmt.Errorf("unknown group %q in ACL", qualifier)
+		}
+		id = g.Gid
+	}
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	return uint32(parsed), err
+}
@@ -0,0 +1,65 @@
+package fastar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTextAcl(t *testing.T) {
+	acl, err := parseTextAcl("user::rw-,user:alice:r--:1001,group::r--,mask::r-x,other::---")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][3]uint32{{0x01, 6, aclUndefinedId}, {0x02, 4, 1001}, {0x04, 4, aclUndefinedId}, {0x10, 5, aclUndefinedId}, {0x20, 0, aclUndefinedId}}
+	if len(acl) != 4+8*len(expected) || binary.LittleEndian.Uint32(acl) != aclXattrVersion {
+		t.Fatalf("Got %v", acl)
+	}
+	for i, entry := range expected {
+		raw := acl[4+8*i:]
+		got := [3]uint32{uint32(binary.LittleEndian.Uint16(raw)), uint32(binary.LittleEndian.Uint16(raw[2:])), binary.LittleEndian.Uint32(raw[4:])}
+		if got != entry {
+			t.Fatalf("Entry %d is %v, wanted %v", i, got, entry)
+		}
+	}
+	for _, invalid := range []string{"", "user::rw", "nobody::rwx", "mask:1:rwx", "user::rwz"} {
+		if _, err := parseTextAcl(invalid); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExtractTarXattrs(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5,
+		PAXRecords: map[string]string{paxXattrPrefix + "user.origin": "layer"}})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "shared", Typeflag: tar.TypeReg, Mode: 0640, Size: 0,
+		PAXRecords: map[string]string{paxAclAccess: "user::rw-,user:4242:rw-,group::r--,mask::rw-,other::---"}})
+	tw.WriteHeader(&tar.Header{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755,
+		PAXRecords: map[string]string{paxXattrPrefix + "user.origin": "dir layer"}})
+	tw.Close()
+
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+	opts.OutputDir = t.TempDir()
+	opts.WriteWorkers = 2
+	if err := lsetxattr(opts.OutputDir, "user.probe", []byte("y")); err != nil {
+		t.Skip("Filesystem doesn't support user xattrs: ", err)
+	}
+	ExtractTar(context.Background(), &buf)
+
+	for name, expected := range map[string]string{"file": "layer", "dir": "dir layer"} {
+		if xattrs := diskXattrs(filepath.Join(opts.OutputDir, name)); xattrs["user.origin"] != expected {
+			t.Fatalf("Got xattrs %v on %s", xattrs, name)
+		}
+	}
+	expected, _ := parseTextAcl("user::rw-,user:4242:rw-,group::r--,mask::rw-,other::---")
+	if acl := diskXattrs(filepath.Join(opts.OutputDir, "shared"))["system.posix_acl_access"]; acl != string(expected) {
+		t.Fatalf("Got ACL %v, wanted %v", []byte(acl), expected)
+	}
+}
@@ -0,0 +1,229 @@
+package fastar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd streams are a sequence of frames that each decode on their own.
+// Seekable zstd, pzstd and t2sz cut the content into many small frames,
+// which with --decompress-workers above 1 are decoded on that many cores at
+// once and written out in order, like lz4 blocks. The zstd CLI writes a
+// single frame by default, which can't be split: from the first frame
+// that might decode to more than zstdMaxFrameSize on, the rest of the
+// stream is decoded as it streams in.
+const (
+	zstdFrameMagic     = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+	// Frames that decode to at most this much are read whole and decoded
+	// on a worker, bounding the memory of the frames in flight.
+	zstdMaxFrameSize = 8 << 20
+	// Blocks decode to at most this much, a frame without a content size
+	// is assumed to decode to this much per compressed block.
+	zstdMaxBlockSize = 128 << 10
+	zstdStreamChunk  = 1 << 20
+)
+
+var (
+	zstdBuffers     sync.Pool
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+)
+
+func newZstdReader(stream io.Reader) io.Reader {
+	return newParallelZstdReader(stream, decompressWorkers())
+}
+
+func newParallelZstdReader(stream io.Reader, workers int) io.Reader {
+	src := bufio.NewReader(stream)
+	return decodeInOrder(workers, func(submit func(*decodeTask)) error {
+		err := readZstdFrames(src, submit)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// Splits the stream into tasks decoding a frame each, until a frame is too
+// large to decode whole. Returns nil at the end of the stream.
+func readZstdFrames(src io.Reader, submit func(*decodeTask)) error {
+	for first := true; ; first = false {
+		frame := make([]byte, 4)
+		if _, err := io.ReadFull(src, frame); err == io.EOF && !first {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(frame)
+		if magic&^0xf == zstdSkippableMagic {
+			var size [4]byte
+			_, err := io.ReadFull(src, size[:])
+			if err == nil {
+				_, err = io.CopyN(io.Discard, src, int64(binary.LittleEndian.Uint32(size[:])))
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		} else if magic != zstdFrameMagic {
+			return fmt.Errorf("zstd: invalid frame magic %#x", magic)
+		}
+		frame, contentSize, checksum, err := readZstdFrameHeader(src, frame)
+		if err != nil {
+			return err
+		}
+		complete := false
+		if contentSize <= zstdMaxFrameSize {
+			frame, complete, err = readZstdBlocks(src, frame, checksum)
+			if err != nil {
+				return err
+			}
+		}
+		if !complete {
+			return streamZstdFrames(io.MultiReader(bytes.NewReader(frame), src), submit)
+		}
+		submit(&decodeTask{
+			decode: func() ([]byte, error) { return decodeZstdFrame(frame) },
+			done:   func(decoded []byte) { zstdBuffers.Put(decoded[:0]) },
+		})
+	}
+}
+
+// Appends the frame header following the magic number to frame. The
+// content size is -1 if the frame doesn't have one.
+func readZstdFrameHeader(src io.Reader, frame []byte) ([]byte, int64, bool, error) {
+	var descriptor [1]byte
+	if _, err := io.ReadFull(src, descriptor[:]); err != nil {
+		return nil, 0, false, err
+	}
+	frame = append(frame, descriptor[0])
+	if descriptor[0]&0x08 != 0 {
+		return nil, 0, false, errors.New("zstd: reserved frame header bit is set")
+	}
+	singleSegment := descriptor[0]&0x20 != 0
+	checksum := descriptor[0]&0x04 != 0
+	contentSizeBytes := []int{0, 2, 4, 8}[descriptor[0]>>6]
+	if contentSizeBytes == 0 && singleSegment {
+		contentSizeBytes = 1
+	}
+	size := []int{0, 1, 2, 4}[descriptor[0]&3] + contentSizeBytes
+	if !singleSegment {
+		// The window descriptor.
+		size++
+	}
+	frame = append(frame, make([]byte, size)...)
+	if _, err := io.ReadFull(src, frame[len(frame)-size:]); err != nil {
+		return nil, 0, false, err
+	}
+	field := frame[len(frame)-contentSizeBytes:]
+	contentSize := int64(-1)
+	switch contentSizeBytes {
+	case 1:
+		contentSize = int64(field[0])
+	case 2:
+		contentSize = int64(binary.LittleEndian.Uint16(field)) + 256
+	case 4:
+		contentSize = int64(binary.LittleEndian.Uint32(field))
+	case 8:
+		contentSize = int64(binary.LittleEndian.Uint64(field))
+	}
+	return frame, contentSize, checksum, nil
+}
+
+// Appends the frame's blocks and checksum to frame. Returns false, with
+// what was read so far, once the frame might decode to more than
+// zstdMaxFrameSize.
+func readZstdBlocks(src io.Reader, frame []byte, checksum bool) ([]byte, bool, error) {
+	decodedBound := int64(0)
+	for {
+		var header [3]byte
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			return nil, false, err
+		}
+		frame = append(frame, header[:]...)
+		word := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+		last := word&1 != 0
+		size := int(word >> 3)
+		switch word >> 1 & 3 {
+		case 0:
+			decodedBound += int64(size)
+		case 1:
+			// RLE blocks store the byte that's repeated size times.
+			decodedBound += int64(size)
+			size = 1
+		case 2:
+			decodedBound += zstdMaxBlockSize
+		default:
+			return nil, false, errors.New("zstd: reserved block type")
+		}
+		if size > zstdMaxBlockSize {
+			return nil, false, fmt.Errorf("zstd: block of %d bytes is over the %d byte maximum", size, zstdMaxBlockSize)
+		}
+		frame = append(frame, make([]byte, size)...)
+		if _, err := io.ReadFull(src, frame[len(frame)-size:]); err != nil {
+			return nil, false, err
+		}
+		if decodedBound > zstdMaxFrameSize && !last {
+			return frame, false, nil
+		}
+		if last {
+			break
+		}
+	}
+	if checksum {
+		frame = append(frame, make([]byte, 4)...)
+		if _, err := io.ReadFull(src, frame[len(frame)-4:]); err != nil {
+			return nil, false, err
+		}
+	}
+	return frame, true, nil
+}
+
+func decodeZstdFrame(frame []byte) ([]byte, error) {
+	zstdDecoderOnce.Do(func() {
+		// Only used for DecodeAll, which is safe to call from every worker.
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	buf, _ := zstdBuffers.Get().([]byte)
+	decoded, err := zstdDecoder.DecodeAll(frame, buf[:0])
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return decoded, nil
+}
+
+// Decodes the rest of the stream as it comes in. The decoding happens here,
+// the tasks only hand the output on in order after the frames before it.
+func streamZstdFrames(stream io.Reader, submit func(*decodeTask)) error {
+	decoder, err := zstd.NewReader(stream)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	for {
+		chunk := make([]byte, zstdStreamChunk)
+		n := 0
+		for n < len(chunk) && err == nil {
+			var read int
+			read, err = decoder.Read(chunk[n:])
+			n += read
+		}
+		if n > 0 {
+			chunk = chunk[:n]
+			submit(&decodeTask{decode: func() ([]byte, error) { return chunk, nil }})
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package fastar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compresses data as a frame of its own, with the content size in the
+// header if known is set.
+func compressZstdFrame(t *testing.T, data string, known bool) []byte {
+	var buf bytes.Buffer
+	writer, err := zstd.NewWriter(&buf, zstd.WithEncoderCRC(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known {
+		writer.ResetContentSize(&buf, int64(len(data)))
+	}
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestParallelZstdReader(t *testing.T) {
+	var frames []string
+	var stream bytes.Buffer
+	for i := 0; i < 20; i++ {
+		frame := strings.Repeat(RandomString(1000), 100+i)
+		frames = append(frames, frame)
+		stream.Write(compressZstdFrame(t, frame, i%2 == 0))
+	}
+	// Seekable zstd ends with its seek table in a skippable frame.
+	binary.Write(&stream, binary.LittleEndian, []uint32{zstdSkippableMagic + 0xe, 4, 0})
+
+	actual, err := io.ReadAll(newParallelZstdReader(bytes.NewReader(stream.Bytes()), 4))
+	if err != nil || string(actual) != strings.Join(frames, "") {
+		t.Fatalf("Got %d bytes, %v", len(actual), err)
+	}
+
+	corrupted := compressZstdFrame(t, frames[0], false)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err := io.ReadAll(newParallelZstdReader(bytes.NewReader(corrupted), 4)); err == nil {
+		t.Fatal("Expected a checksum error")
+	}
+	if _, err := io.ReadAll(newParallelZstdReader(bytes.NewReader(corrupted[:len(corrupted)/2]), 4)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a truncated stream to fail, got %v", err)
+	}
+}
+
+func TestZstdLargeFrameStreamed(t *testing.T) {
+	small := RandomString(100000)
+	// Over zstdMaxFrameSize, with and without the content size saying so.
+	large := strings.Repeat(RandomString(100000), 100)
+	for _, known := range []bool{true, false} {
+		var stream bytes.Buffer
+		stream.Write(compressZstdFrame(t, small, true))
+		stream.Write(compressZstdFrame(t, large, known))
+		stream.Write(compressZstdFrame(t, small, false))
+		actual, err := io.ReadAll(newParallelZstdReader(bytes.NewReader(stream.Bytes()), 4))
+		if err != nil || string(actual) != small+large+small {
+			t.Fatalf("Got %d bytes, %v", len(actual), err)
+		}
+	}
+}